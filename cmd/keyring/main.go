@@ -0,0 +1,108 @@
+// Command keyring manages keys that sign user tokens of the shortener.
+//
+//	keyring -f keyring.json generate
+//	keyring -f keyring.json rotate
+//	keyring -f keyring.json retire -id 1
+//	keyring -f keyring.json list
+//
+// Secrets are never printed.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+)
+
+func main() {
+	filePath := flag.String("f", os.Getenv("USER_KEYRING_FILE"), "keyring file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -f <file> generate|rotate|retire -id <id>|list\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(*filePath) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*filePath, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(filePath, command string, args []string) error {
+	switch command {
+	case "generate":
+		if _, err := os.Stat(filePath); err == nil {
+			return fmt.Errorf("%s already exists", filePath)
+		}
+		k, err := app.NewKeyring()
+		if err != nil {
+			return err
+		}
+		if err := k.Save(filePath); err != nil {
+			return err
+		}
+		fmt.Printf("generated key %d\n", k.Primary)
+		return nil
+
+	case "rotate":
+		k, err := app.LoadKeyring(filePath)
+		if err != nil {
+			return err
+		}
+		key, err := k.Rotate()
+		if err != nil {
+			return err
+		}
+		if err := k.Save(filePath); err != nil {
+			return err
+		}
+		fmt.Printf("key %d is primary now\n", key.ID)
+		return nil
+
+	case "retire":
+		fs := flag.NewFlagSet("retire", flag.ContinueOnError)
+		id := fs.Uint("id", 0, "key id")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *id == 0 {
+			return errors.New("key id is required")
+		}
+		k, err := app.LoadKeyring(filePath)
+		if err != nil {
+			return err
+		}
+		if err := k.Retire(uint32(*id)); err != nil {
+			return err
+		}
+		if err := k.Save(filePath); err != nil {
+			return err
+		}
+		fmt.Printf("key %d retired\n", *id)
+		return nil
+
+	case "list":
+		k, err := app.LoadKeyring(filePath)
+		if err != nil {
+			return err
+		}
+		for _, key := range k.Keys {
+			primary := ""
+			if key.ID == k.Primary {
+				primary = " primary"
+			}
+			fmt.Printf("%d\t%s%s\n", key.ID, key.Created.Format("2006-01-02T15:04:05Z07:00"), primary)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q", command)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+// runCommand runs a maintenance command against a storage a config points to instead of serving:
+//
+//	shortener -f links.json export -o backup.ndjson
+//	shortener -d postgres://... import -i backup.ndjson
+//
+// "-" or no file stands for the standard output or input.
+func runCommand(cfg *config, command string, args []string) error {
+	if len(cfg.configFile) != 0 {
+		c, err := loadConfigFromFile(cfg.configFile)
+		if err != nil {
+			return err
+		}
+		cfg = c
+	}
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	var path *string
+	switch command {
+	case "export":
+		path = fs.String("o", "-", "backup file to write")
+	case "import":
+		path = fs.String("i", "-", "backup file to read")
+	default:
+		return fmt.Errorf("unknown command %q, expected export or import", command)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// A memory storage is gone with the process, so links imported into it would be lost.
+	if command == "import" && len(cfg.FileStoragePath) == 0 && len(cfg.DatabaseConnectionString) == 0 {
+		return errors.New("import needs a storage to restore links to, set a file storage with -f or a database with -d")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	st, _, _, err := createStorage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	backup, ok := st.(storage.URLBackup)
+	if !ok {
+		return errors.New("storage doesn't support backups")
+	}
+
+	if command == "export" {
+		return exportBackup(ctx, backup, *path)
+	}
+	return importBackup(ctx, backup, *path)
+}
+
+// exportBackup writes a backup to a new file, a file of a failed export is removed.
+func exportBackup(ctx context.Context, st storage.URLBackup, path string) error {
+	output := os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	written, err := app.WriteBackup(ctx, st, output)
+	if err == nil && path != "-" {
+		err = output.Sync()
+	}
+	if err != nil {
+		if path != "-" {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d links\n", written)
+	return nil
+}
+
+func importBackup(ctx context.Context, st storage.URLBackup, path string) error {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	read, restored, err := app.RestoreBackup(ctx, st, input)
+	if err != nil {
+		return fmt.Errorf("%w, %d links have been restored", err, restored)
+	}
+
+	fmt.Fprintf(os.Stderr, "restored %d of %d links, %d already existed\n", restored, read, read-restored)
+	return nil
+}
@@ -8,11 +8,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	pb "github.com/r4start/go-url-shortener/internal/grpc/proto"
 	http_srv "github.com/r4start/go-url-shortener/internal/http"
@@ -25,7 +28,10 @@ import (
 
 	"github.com/r4start/go-url-shortener/internal/app"
 	grpc_srv "github.com/r4start/go-url-shortener/internal/grpc"
+	"github.com/r4start/go-url-shortener/pkg/metrics"
+	"github.com/r4start/go-url-shortener/pkg/oidc"
 	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 )
 
 //go:generate sh -c "git branch --show-current > branch.txt"
@@ -54,12 +60,33 @@ type config struct {
 	DatabaseConnectionString string `json:"database_dsn"`
 	ServeTLS                 bool   `json:"enable_https"`
 	TrustedSubnet            string `json:"trusted_subnet"`
-	configFile               string
+	VisitorSalt              string `json:"visitor_salt"`
+	BotSignaturesFile        string `json:"bot_signatures_file"`
+	MetricsAddress           string `json:"metrics_address"`
+	TraceFile                string `json:"trace_file"`
+	UserKeyringFile          string `json:"user_keyring_file"`
+	UserTokenTTL             string `json:"user_token_ttl"`
+	IdempotencyWindow        string `json:"idempotency_window"`
+	SortQueryParams          bool   `json:"sort_query_params"`
+	StripQueryParams         string `json:"strip_query_params"`
+	OIDCIssuer               string `json:"oidc_issuer"`
+	OIDCClientID             string `json:"oidc_client_id"`
+	OIDCRedirectURL          string `json:"oidc_redirect_url"`
+	BlocklistHostsFile       string `json:"blocklist_hosts_file"`
+	BlocklistPrefixesFile    string `json:"blocklist_prefixes_file"`
+	BlocklistHashesFile      string `json:"blocklist_hashes_file"`
+	BlocklistReload          string `json:"blocklist_reload_interval"`
+	BlocklistRescan          string `json:"blocklist_rescan_interval"`
+
+	// URLPolicy - rules of URLs that can be shortened, it is read from a config file only.
+	URLPolicy *app.URLPolicyConfig `json:"url_policy"`
+	// URLChains - rules of URLs that point to short URLs, it is read from a config file only.
+	// Short URLs of BaseURL are always resolved.
+	URLChains  *app.ChainPolicyConfig `json:"url_chains"`
+	configFile string
 }
 
 func main() {
-	printStartupMessage()
-
 	cfg := config{}
 
 	flag.StringVar(&cfg.ServerAddress, "a", os.Getenv("SERVER_ADDRESS"), "")
@@ -69,6 +96,22 @@ func main() {
 	flag.StringVar(&cfg.DatabaseConnectionString, "d", os.Getenv("DATABASE_DSN"), "")
 	flag.StringVar(&cfg.configFile, "c", os.Getenv("CONFIG"), "")
 	flag.StringVar(&cfg.TrustedSubnet, "t", os.Getenv("TRUSTED_SUBNET"), "")
+	flag.StringVar(&cfg.VisitorSalt, "vs", os.Getenv("VISITOR_SALT"), "")
+	flag.StringVar(&cfg.BotSignaturesFile, "bs", os.Getenv("BOT_SIGNATURES_FILE"), "")
+	flag.StringVar(&cfg.MetricsAddress, "ma", os.Getenv("METRICS_ADDRESS"), "")
+	flag.StringVar(&cfg.TraceFile, "tf", os.Getenv("TRACE_FILE"), "")
+	flag.StringVar(&cfg.UserKeyringFile, "k", os.Getenv("USER_KEYRING_FILE"), "")
+	flag.StringVar(&cfg.UserTokenTTL, "ut", os.Getenv("USER_TOKEN_TTL"), "")
+	flag.StringVar(&cfg.IdempotencyWindow, "iw", os.Getenv("IDEMPOTENCY_WINDOW"), "")
+	flag.StringVar(&cfg.StripQueryParams, "sp", os.Getenv("STRIP_QUERY_PARAMS"), "")
+	flag.StringVar(&cfg.OIDCIssuer, "oi", os.Getenv("OIDC_ISSUER"), "")
+	flag.StringVar(&cfg.OIDCClientID, "oc", os.Getenv("OIDC_CLIENT_ID"), "")
+	flag.StringVar(&cfg.OIDCRedirectURL, "or", os.Getenv("OIDC_REDIRECT_URL"), "")
+	flag.StringVar(&cfg.BlocklistHostsFile, "bh", os.Getenv("BLOCKLIST_HOSTS_FILE"), "")
+	flag.StringVar(&cfg.BlocklistPrefixesFile, "bp", os.Getenv("BLOCKLIST_PREFIXES_FILE"), "")
+	flag.StringVar(&cfg.BlocklistHashesFile, "bx", os.Getenv("BLOCKLIST_HASHES_FILE"), "")
+	flag.StringVar(&cfg.BlocklistReload, "br", os.Getenv("BLOCKLIST_RELOAD_INTERVAL"), "")
+	flag.StringVar(&cfg.BlocklistRescan, "bi", os.Getenv("BLOCKLIST_RESCAN_INTERVAL"), "")
 
 	if _, exists := os.LookupEnv("ENABLE_HTTPS"); exists {
 		flag.BoolVar(&cfg.ServeTLS, "s", true, "")
@@ -76,8 +119,21 @@ func main() {
 		flag.BoolVar(&cfg.ServeTLS, "s", false, "")
 	}
 
+	_, sortQueryParams := os.LookupEnv("SORT_QUERY_PARAMS")
+	flag.BoolVar(&cfg.SortQueryParams, "sq", sortQueryParams, "")
+
 	flag.Parse()
 
+	if flag.NArg() != 0 {
+		if err := runCommand(&cfg, flag.Arg(0), flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	printStartupMessage()
+
 	logger, err := zap.NewProduction()
 	if err != nil {
 		fmt.Printf("failed to initialize logger: %+v", err)
@@ -130,8 +186,113 @@ func main() {
 	serverContext, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	shortener, err := app.NewURLShortener(serverContext, logger,
-		app.WithDatabase(dbConn), app.WithStorage(st), app.WithStat(stat))
+	if stat == nil {
+		stat, _ = st.(storage.ServiceStat)
+	}
+
+	var tracer *tracing.Tracer = nil
+	if len(cfg.TraceFile) != 0 {
+		traceOutput, err := openTraceOutput(cfg.TraceFile)
+		if err != nil {
+			logger.Fatal("failed to open trace file", zap.Error(err), zap.String("path", cfg.TraceFile))
+		}
+		defer traceOutput.Close()
+		tracer = tracing.NewTracer(tracing.NewWriterExporter(traceOutput))
+	}
+
+	registry := metrics.NewRegistry()
+	registry.RegisterRuntimeMetrics()
+	if queue, ok := st.(storage.DeleteQueue); ok {
+		registry.NewGaugeFunc("storage_delete_queue_depth", "Number of URLs waiting to be deleted.", func() float64 {
+			return float64(queue.DeleteQueueDepth())
+		})
+	}
+
+	urlStorage := instrumentStorage(registry, tracer, storageBackend(&cfg), st)
+	shortenerOpts := []app.ShortenerConfigurator{
+		app.WithDatabase(dbConn), app.WithStorage(urlStorage), app.WithStat(stat), app.WithTracer(tracer),
+		app.WithURLNormalizer(urlNormalizer(&cfg)),
+	}
+	if cfg.URLPolicy != nil {
+		policy, err := app.NewURLPolicy(*cfg.URLPolicy)
+		if err != nil {
+			logger.Fatal("bad url policy", zap.Error(err))
+		}
+		shortenerOpts = append(shortenerOpts, app.WithURLPolicy(policy))
+	}
+	chains, err := chainPolicy(&cfg)
+	if err != nil {
+		logger.Fatal("bad url chains policy", zap.Error(err))
+	}
+	shortenerOpts = append(shortenerOpts, app.WithChainPolicy(chains))
+	// The instrumented storage keeps canonical URL adds, so they are measured too.
+	if canonical, ok := urlStorage.(storage.CanonicalURLStorage); ok {
+		shortenerOpts = append(shortenerOpts, app.WithCanonicalURLStorage(canonical))
+	}
+	if clickStat, ok := st.(storage.ClickStat); ok {
+		shortenerOpts = append(shortenerOpts, app.WithClickStat(clickStat))
+	}
+	if apiKeys, ok := st.(storage.APIKeyStorage); ok {
+		shortenerOpts = append(shortenerOpts, app.WithAPIKeyStorage(apiKeys))
+	}
+	if identities, ok := st.(storage.IdentityStorage); ok {
+		shortenerOpts = append(shortenerOpts, app.WithIdentityStorage(identities))
+	}
+	if merge, ok := st.(storage.UserMerge); ok {
+		shortenerOpts = append(shortenerOpts, app.WithUserMerge(merge))
+	}
+	if export, ok := st.(storage.URLExport); ok {
+		shortenerOpts = append(shortenerOpts, app.WithURLExport(export))
+	}
+	if idempotency, ok := st.(storage.IdempotencyStore); ok {
+		shortenerOpts = append(shortenerOpts, app.WithIdempotencyStore(idempotency))
+	}
+	if blocklist := loadBlocklist(logger, &cfg); blocklist != nil {
+		reload, rescan, err := blocklistIntervals(&cfg)
+		if err != nil {
+			logger.Fatal("bad blocklist interval", zap.Error(err))
+		}
+		shortenerOpts = append(shortenerOpts, app.WithBlocklist(blocklist), app.WithBlocklistIntervals(reload, rescan))
+		if blocker, ok := st.(storage.URLBlocker); ok {
+			shortenerOpts = append(shortenerOpts, app.WithURLBlocker(blocker))
+		}
+	}
+	if len(cfg.VisitorSalt) != 0 {
+		shortenerOpts = append(shortenerOpts, app.WithVisitorSalt([]byte(cfg.VisitorSalt)))
+	}
+	if len(cfg.BotSignaturesFile) != 0 {
+		signatures, err := app.LoadBotSignatures(cfg.BotSignaturesFile)
+		if err != nil {
+			logger.Fatal("failed to load bot signatures", zap.Error(err), zap.String("path", cfg.BotSignaturesFile))
+		}
+		shortenerOpts = append(shortenerOpts, app.WithBotClassifier(app.NewBotClassifier(signatures...)))
+	}
+
+	keyring, err := loadKeyring(&cfg)
+	if err != nil {
+		logger.Fatal("failed to load user keyring", zap.Error(err))
+	}
+	if keyring != nil {
+		shortenerOpts = append(shortenerOpts, app.WithKeyring(keyring))
+	} else {
+		logger.Warn("user keyring isn't configured, user tokens won't survive a restart")
+	}
+	if len(cfg.UserTokenTTL) != 0 {
+		ttl, err := time.ParseDuration(cfg.UserTokenTTL)
+		if err != nil || ttl <= 0 {
+			logger.Fatal("bad user token ttl", zap.Error(err), zap.String("ttl", cfg.UserTokenTTL))
+		}
+		shortenerOpts = append(shortenerOpts, app.WithUserTokenTTL(ttl))
+	}
+	if len(cfg.IdempotencyWindow) != 0 {
+		window, err := time.ParseDuration(cfg.IdempotencyWindow)
+		if err != nil || window <= 0 {
+			logger.Fatal("bad idempotency window", zap.Error(err), zap.String("window", cfg.IdempotencyWindow))
+		}
+		shortenerOpts = append(shortenerOpts, app.WithIdempotencyWindow(window))
+	}
+
+	shortener, err := app.NewURLShortener(serverContext, logger, shortenerOpts...)
 	if err != nil {
 		logger.Fatal("failed to create shortener", zap.Error(err))
 	}
@@ -158,7 +319,14 @@ func main() {
 		creds = insecure.NewCredentials()
 	}
 
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	callMetrics := grpc_srv.NewCallMetrics(registry)
+	grpcServer := grpc.NewServer(grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(grpc_srv.LoggingInterceptor(logger),
+			grpc_srv.TracingInterceptor(tracer), callMetrics.UnaryInterceptor(),
+			grpcShortener.AuthInterceptor(), grpcShortener.IdempotencyInterceptor()),
+		grpc.ChainStreamInterceptor(grpc_srv.StreamLoggingInterceptor(logger),
+			grpc_srv.StreamTracingInterceptor(tracer), callMetrics.StreamInterceptor(),
+			grpcShortener.StreamAuthInterceptor()))
 	pb.RegisterUrlShortenerServer(grpcServer, grpcShortener)
 
 	go func() {
@@ -172,15 +340,36 @@ func main() {
 		}
 	}()
 
-	httpHandler, err := http_srv.NewHTTPServer(shortener, logger,
-		http_srv.WithDomain(cfg.BaseURL), http_srv.WithTrustedNetwork(trustedNetwork))
+	httpOpts := []http_srv.ServerConfigurator{
+		http_srv.WithDomain(cfg.BaseURL), http_srv.WithTrustedNetwork(trustedNetwork),
+		http_srv.WithMetrics(registry), http_srv.WithTracer(tracer),
+	}
+	if len(cfg.OIDCIssuer) != 0 {
+		httpOpts = append(httpOpts, http_srv.WithIdentityProvider(newIdentityProvider(&cfg)))
+	}
+
+	httpHandler, err := http_srv.NewHTTPServer(shortener, logger, httpOpts...)
 	if err != nil {
 		logger.Fatal("failed to create http server", zap.Error(err))
 	}
 
 	server := &http.Server{Addr: cfg.ServerAddress, Handler: httpHandler}
+	servers := []*http.Server{server}
+
+	if len(cfg.MetricsAddress) != 0 {
+		adminHandler := http.NewServeMux()
+		adminHandler.Handle("/metrics", registry)
+		adminServer := &http.Server{Addr: cfg.MetricsAddress, Handler: adminHandler}
+		servers = append(servers, adminServer)
 
-	sCh, err := prepareShutdown(server, grpcServer, logger)
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal("failed to serve metrics", zap.Error(err))
+			}
+		}()
+	}
+
+	sCh, err := prepareShutdown(servers, grpcServer, logger)
 	if err != nil {
 		logger.Fatal("failed to prepare shutdown", zap.Error(err))
 	}
@@ -225,6 +414,143 @@ func createStorage(ctx context.Context, cfg *config) (storage.URLStorage, storag
 	return st, stat, dbConn, err
 }
 
+func storageBackend(cfg *config) string {
+	if len(cfg.DatabaseConnectionString) != 0 {
+		return "database"
+	} else if len(cfg.FileStoragePath) != 0 {
+		return "file"
+	}
+	return "memory"
+}
+
+func instrumentStorage(registry *metrics.Registry, tracer *tracing.Tracer, backend string, st storage.URLStorage) storage.URLStorage {
+	latency := registry.NewHistogramVec("storage_operation_duration_seconds",
+		"Storage operation latencies by backend.", metrics.DefaultBuckets, "backend", "operation")
+	failures := registry.NewCounterVec("storage_operation_errors_total",
+		"Number of failed storage operations by backend.", "backend", "operation")
+
+	return storage.NewInstrumentedStorage(st, func(ctx context.Context, operation string, start time.Time, err error) {
+		latency.Observe(time.Since(start).Seconds(), backend, operation)
+		// Missing, deleted and blocked URLs are regular outcomes rather than failures.
+		if err != nil && !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrDeleted) &&
+			!errors.Is(err, storage.ErrBlocked) {
+			failures.Inc(backend, operation)
+		}
+
+		// Background operations, e.g. batched deletes, don't belong to any request and aren't traced.
+		if tracing.SpanFromContext(ctx) != nil {
+			tracer.Record(ctx, "storage."+operation, start, err, map[string]string{"storage.backend": backend})
+		}
+	})
+}
+
+// chainPolicy makes rules of URLs that point to short URLs, short URLs of BaseURL are own ones.
+func chainPolicy(cfg *config) (*app.ChainPolicy, error) {
+	var chains app.ChainPolicyConfig
+	if cfg.URLChains != nil {
+		chains = *cfg.URLChains
+	}
+	if len(cfg.BaseURL) != 0 {
+		chains.OwnURLs = append(chains.OwnURLs, cfg.BaseURL)
+	}
+	return app.NewChainPolicy(chains)
+}
+
+// urlNormalizer makes rules of canonical URLs, STRIP_QUERY_PARAMS is a comma separated list of parameter names.
+func urlNormalizer(cfg *config) *app.URLNormalizer {
+	normalizer := &app.URLNormalizer{SortQuery: cfg.SortQueryParams}
+	for _, param := range strings.Split(cfg.StripQueryParams, ",") {
+		if param = strings.TrimSpace(param); len(param) != 0 {
+			normalizer.StripParams = append(normalizer.StripParams, param)
+		}
+	}
+	return normalizer
+}
+
+// loadKeyring reads a keyring from a file or from USER_KEYRING, it returns nil if neither is set.
+func loadKeyring(cfg *config) (*app.Keyring, error) {
+	if len(cfg.UserKeyringFile) != 0 {
+		return app.LoadKeyring(cfg.UserKeyringFile)
+	}
+	if data, ok := os.LookupEnv("USER_KEYRING"); ok && len(data) != 0 {
+		return app.ParseKeyring([]byte(data))
+	}
+	return nil, nil
+}
+
+// loadBlocklist loads blocklist files, it returns nil if none of them is configured.
+func loadBlocklist(logger *zap.Logger, cfg *config) *app.Blocklist {
+	blocklistCfg := app.BlocklistConfig{
+		HostsFile:    cfg.BlocklistHostsFile,
+		PrefixesFile: cfg.BlocklistPrefixesFile,
+		HashesFile:   cfg.BlocklistHashesFile,
+	}
+	if blocklistCfg == (app.BlocklistConfig{}) {
+		return nil
+	}
+
+	blocklist, err := app.NewBlocklist(blocklistCfg)
+	if err != nil {
+		logger.Fatal("failed to load blocklist", zap.Error(err))
+	}
+	return blocklist
+}
+
+// blocklistIntervals parses how often blocklist files are checked and links are rescanned.
+func blocklistIntervals(cfg *config) (reload, rescan time.Duration, err error) {
+	reload, rescan = app.DefaultBlocklistReload, app.DefaultBlocklistRescan
+	for _, interval := range []struct {
+		value string
+		dst   *time.Duration
+	}{{cfg.BlocklistReload, &reload}, {cfg.BlocklistRescan, &rescan}} {
+		if len(interval.value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(interval.value)
+		if err != nil {
+			return 0, 0, err
+		}
+		if d <= 0 {
+			return 0, 0, fmt.Errorf("interval %s isn't positive", interval.value)
+		}
+		*interval.dst = d
+	}
+	return reload, rescan, nil
+}
+
+// newIdentityProvider configures an OpenID provider, a client secret is read from OIDC_CLIENT_SECRET only.
+func newIdentityProvider(cfg *config) *oidc.Provider {
+	redirectURL := cfg.OIDCRedirectURL
+	if len(redirectURL) == 0 {
+		redirectURL = strings.TrimSuffix(cfg.BaseURL, "/") + "/api/auth/callback"
+	}
+
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       cfg.OIDCIssuer,
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email"},
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	})
+}
+
+// openTraceOutput opens a file to write spans to, "stdout" stands for the standard output.
+func openTraceOutput(path string) (io.WriteCloser, error) {
+	if path == "stdout" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
 func printStartupMessage() {
 	buildVersion := "N/A\n"
 	buildDate := buildVersion
@@ -269,7 +595,7 @@ func loadConfigFromFile(filePath string) (*config, error) {
 	return &result, err
 }
 
-func prepareShutdown(server *http.Server, grpcServer *grpc.Server, logger *zap.Logger) (<-chan interface{}, error) {
+func prepareShutdown(servers []*http.Server, grpcServer *grpc.Server, logger *zap.Logger) (<-chan interface{}, error) {
 	shutdownSig := make(chan interface{})
 	signals := make(chan os.Signal, 1)
 
@@ -280,8 +606,10 @@ func prepareShutdown(server *http.Server, grpcServer *grpc.Server, logger *zap.L
 	go func() {
 		<-signals
 
-		if err := server.Shutdown(context.Background()); err != nil {
-			logger.Error("failed to shutdown a server", zap.Error(err))
+		for _, server := range servers {
+			if err := server.Shutdown(context.Background()); err != nil {
+				logger.Error("failed to shutdown a server", zap.Error(err))
+			}
 		}
 
 		grpcServer.GracefulStop()
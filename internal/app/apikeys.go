@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// APIKeyPrefix - prefix of API keys, it makes keys easy to recognize, e.g. by secret scanners.
+	APIKeyPrefix = "gus_"
+	// MaxAPIKeyNameLength - maximum number of characters in an API key name.
+	MaxAPIKeyNameLength = 128
+	// MaxUserAPIKeys - maximum number of active API keys a user can have.
+	MaxUserAPIKeys = 20
+
+	apiKeySecretSize = 32
+)
+
+var (
+	// ErrAPIKeysUnsupported - a storage doesn't keep API keys.
+	ErrAPIKeysUnsupported = errors.New("api keys are not supported")
+	// ErrInvalidAPIKey - an API key is malformed, unknown or revoked.
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrBadAPIKeyName - an API key name is too long or isn't valid UTF-8.
+	ErrBadAPIKeyName = errors.New("bad api key name")
+	// ErrTooManyAPIKeys - a user has reached MaxUserAPIKeys.
+	ErrTooManyAPIKeys = errors.New("too many api keys")
+)
+
+// CreateAPIKey issues a new API key for a user. The returned key is shown once, only its hash is stored.
+func (u *URLShortener) CreateAPIKey(ctx context.Context, userID uint64, name string) (string, *storage.APIKey, error) {
+	if u.apiKeys == nil {
+		return "", nil, ErrAPIKeysUnsupported
+	}
+
+	if utf8.RuneCountInString(name) > MaxAPIKeyNameLength || !utf8.ValidString(name) {
+		return "", nil, ErrBadAPIKeyName
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	keys, err := u.apiKeys.UserAPIKeys(ctx, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(keys) >= MaxUserAPIKeys {
+		return "", nil, ErrTooManyAPIKeys
+	}
+
+	id, err := cryptoRandUint64()
+	if err != nil {
+		return "", nil, err
+	}
+
+	data := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(data); err != nil {
+		return "", nil, err
+	}
+
+	secret := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(data)
+	key := storage.APIKey{
+		ID:      id,
+		UserID:  userID,
+		Name:    name,
+		Hash:    hashAPIKey(secret),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+
+	if err := u.apiKeys.AddAPIKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	return secret, &key, nil
+}
+
+// UserAPIKeys returns active API keys of a user.
+func (u *URLShortener) UserAPIKeys(ctx context.Context, userID uint64) ([]storage.APIKey, error) {
+	if u.apiKeys == nil {
+		return nil, ErrAPIKeysUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	return u.apiKeys.UserAPIKeys(ctx, userID)
+}
+
+// RevokeAPIKey revokes a user API key by its id as returned by FormatAPIKeyID.
+// storage.ErrNotFound is returned if the user doesn't have such a key.
+func (u *URLShortener) RevokeAPIKey(ctx context.Context, userID uint64, keyID string) error {
+	if u.apiKeys == nil {
+		return ErrAPIKeysUnsupported
+	}
+
+	id, err := strconv.ParseUint(keyID, 16, 64)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	return u.apiKeys.RevokeAPIKey(ctx, userID, id)
+}
+
+// AuthenticateAPIKey returns an owner of an API key.
+func (u *URLShortener) AuthenticateAPIKey(ctx context.Context, key string) (uint64, error) {
+	if u.apiKeys == nil || !strings.HasPrefix(key, APIKeyPrefix) {
+		return 0, ErrInvalidAPIKey
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	apiKey, err := u.apiKeys.FindAPIKey(ctx, hashAPIKey(key))
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, ErrInvalidAPIKey
+	} else if err != nil {
+		return 0, err
+	}
+
+	return apiKey.UserID, nil
+}
+
+// FormatAPIKeyID returns a public representation of an API key id.
+func FormatAPIKeyID(id uint64) string {
+	return strconv.FormatUint(id, 16)
+}
+
+// hashAPIKey - keys have enough entropy, so a plain hash is enough to protect them at rest.
+func hashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
@@ -0,0 +1,204 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// BackupFormat - a name of the backup format, the first line of a backup has it.
+	BackupFormat = "go-url-shortener-backup"
+	// BackupVersion - a version of the backup format that is written and the newest one that can be read.
+	// Version 2 adds the blocked state.
+	BackupVersion = 2
+
+	// restoreBatchSize - the most links restored with one storage call.
+	restoreBatchSize = 1000
+	// maxBackupLine - the longest line of a backup.
+	maxBackupLine = 1 << 20
+)
+
+// ErrBadBackup - a backup can't be read.
+var ErrBadBackup = errors.New("bad backup")
+
+// backupHeader - the first line of a backup.
+type backupHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// backupRecord - a link of a backup. A user id is a string, so it survives JSON parsers with float numbers.
+// CanonicalURL is set for links identified by a canonical form that differs from the original URL.
+type backupRecord struct {
+	UserID       uint64     `json:"user_id,string"`
+	ShortURL     string     `json:"short_url"`
+	OriginalURL  string     `json:"original_url"`
+	CanonicalURL string     `json:"canonical_url,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	State        string     `json:"state"`
+	Deleted      *time.Time `json:"deleted,omitempty"`
+}
+
+const (
+	backupActive  = "active"
+	backupDeleted = "deleted"
+	backupBlocked = "blocked"
+)
+
+// WriteBackup writes all links of a storage as a header line followed by a JSON object per link.
+// Short URLs are written as they are served, so they keep working after a restore.
+// It returns the number of written links.
+func WriteBackup(ctx context.Context, st storage.URLBackup, w io.Writer) (uint64, error) {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(backupHeader{Format: BackupFormat, Version: BackupVersion, Created: time.Now().UTC()}); err != nil {
+		return 0, err
+	}
+
+	written := uint64(0)
+	err := st.BackupURLs(ctx, func(link storage.UserURL) error {
+		record := backupRecord{
+			UserID:       link.UserID,
+			ShortURL:     string(EncodeID(link.ShortURLID)),
+			OriginalURL:  link.OriginalURL,
+			CanonicalURL: link.Canonical,
+			Created:      optionalTime(link.Created),
+			State:        backupActive,
+		}
+		// A deleted link isn't served whether it is blocked or not.
+		if link.Deleted {
+			record.State = backupDeleted
+			record.Deleted = optionalTime(link.DeletedAt)
+		} else if link.Blocked {
+			record.State = backupBlocked
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+
+	return written, writer.Flush()
+}
+
+// RestoreBackup loads links of a backup into a storage. Links the storage already has are kept as they are.
+// It returns the number of read links and the number of restored ones.
+func RestoreBackup(ctx context.Context, st storage.URLBackup, r io.Reader) (uint64, uint64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBackupLine)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, fmt.Errorf("%w: empty file", ErrBadBackup)
+	}
+	var header backupHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != BackupFormat {
+		return 0, 0, fmt.Errorf("%w: not a backup", ErrBadBackup)
+	}
+	if header.Version < 1 || header.Version > BackupVersion {
+		return 0, 0, fmt.Errorf("%w: unsupported version %d", ErrBadBackup, header.Version)
+	}
+
+	var read, restored uint64
+	batch := make([]storage.UserURL, 0, restoreBatchSize)
+	flush := func() error {
+		count, err := st.RestoreURLs(ctx, batch)
+		restored += count
+		batch = batch[:0]
+		return err
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		link, err := parseBackupRecord(scanner.Bytes())
+		if err != nil {
+			return read, restored, fmt.Errorf("%w: line %d: %v", ErrBadBackup, line, err)
+		}
+		read++
+
+		if batch = append(batch, link); len(batch) == restoreBatchSize {
+			if err := flush(); err != nil {
+				return read, restored, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return read, restored, err
+	}
+
+	if len(batch) != 0 {
+		if err := flush(); err != nil {
+			return read, restored, err
+		}
+	}
+	return read, restored, nil
+}
+
+func parseBackupRecord(data []byte) (storage.UserURL, error) {
+	var record backupRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return storage.UserURL{}, err
+	}
+
+	id, err := decodeID(record.ShortURL)
+	if err != nil {
+		return storage.UserURL{}, err
+	}
+	if len(record.OriginalURL) == 0 {
+		return storage.UserURL{}, errors.New("original_url is required")
+	}
+
+	link := storage.UserURL{
+		UserID:    record.UserID,
+		Canonical: record.CanonicalURL,
+		ExportedURL: storage.ExportedURL{
+			ShortURLID:  id,
+			OriginalURL: record.OriginalURL,
+		},
+	}
+	if record.Created != nil {
+		link.Created = *record.Created
+	}
+
+	switch record.State {
+	case backupActive:
+	case backupDeleted:
+		link.Deleted = true
+		if record.Deleted != nil {
+			link.DeletedAt = *record.Deleted
+		}
+	case backupBlocked:
+		link.Blocked = true
+	default:
+		return storage.UserURL{}, fmt.Errorf("unknown state %q", record.State)
+	}
+
+	return link, nil
+}
+
+// optionalTime returns nil for unknown, i.e. zero, times.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
@@ -0,0 +1,319 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultBlocklistReload - how often blocklist files are checked for changes.
+	DefaultBlocklistReload = time.Minute
+	// DefaultBlocklistRescan - how often links of a storage are checked against a blocklist.
+	DefaultBlocklistRescan = time.Hour
+
+	// blockBatchSize - the most links blocked or unblocked by a single storage call.
+	blockBatchSize = 1000
+)
+
+// Lists of a blocklist, a PolicyError tells which one a URL matches.
+const (
+	BlocklistHosts    = "hosts"
+	BlocklistPrefixes = "prefixes"
+	BlocklistHashes   = "hashes"
+)
+
+// BlocklistConfig - files of a blocklist, an empty path means an empty list. A file has one entry per line,
+// empty lines and lines starting with '#' are skipped.
+type BlocklistConfig struct {
+	// HostsFile - domain names, which match subdomains too, IP addresses or CIDR networks.
+	HostsFile string
+	// PrefixesFile - URL prefixes, e.g. https://example.com/phish/. Prefixes and URLs are compared in canonical forms.
+	PrefixesFile string
+	// HashesFile - hex encoded SHA-256 hashes of canonical forms of URLs.
+	HashesFile string
+}
+
+// Blocklist tells phishing and malware destinations. Lists are read from files and can be reloaded
+// when the files change. Canonical forms are the ones of the default URLNormalizer without fragments.
+type Blocklist struct {
+	cfg BlocklistConfig
+
+	lock     sync.RWMutex
+	rules    *blockRules
+	versions [3]fileVersion
+}
+
+type blockRules struct {
+	hosts    hostList
+	prefixes []string
+	hashes   map[[sha256.Size]byte]bool
+}
+
+// fileVersion - a modification time and a size of a loaded file, a change of either means a new version.
+type fileVersion struct {
+	modTime int64
+	size    int64
+}
+
+// NewBlocklist loads lists of a config.
+func NewBlocklist(cfg BlocklistConfig) (*Blocklist, error) {
+	b := &Blocklist{cfg: cfg}
+	if _, err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload reads the files again if any of them has changed since they have been loaded and returns true
+// if the lists have been replaced. The lists are kept if a file can't be loaded.
+func (b *Blocklist) Reload() (bool, error) {
+	versions, err := b.fileVersions()
+	if err != nil {
+		return false, err
+	}
+
+	b.lock.RLock()
+	unchanged := b.rules != nil && versions == b.versions
+	b.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	rules, err := loadBlockRules(b.cfg)
+	if err != nil {
+		return false, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rules, b.versions = rules, versions
+	return true, nil
+}
+
+func (b *Blocklist) fileVersions() ([3]fileVersion, error) {
+	var versions [3]fileVersion
+	for i, path := range []string{b.cfg.HostsFile, b.cfg.PrefixesFile, b.cfg.HashesFile} {
+		if len(path) == 0 {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return versions, err
+		}
+		versions[i] = fileVersion{modTime: info.ModTime().UnixNano(), size: info.Size()}
+	}
+	return versions, nil
+}
+
+// Match returns the list a URL matches, an empty string if there is none.
+func (b *Blocklist) Match(u *url.URL) string {
+	b.lock.RLock()
+	rules := b.rules
+	b.lock.RUnlock()
+
+	host := asciiHostname(strings.TrimSuffix(u.Hostname(), "."))
+	if rules.hosts.match(host, net.ParseIP(host)) {
+		return BlocklistHosts
+	}
+
+	canonical := blockForm(u)
+	if rules.hashes[sha256.Sum256([]byte(canonical))] {
+		return BlocklistHashes
+	}
+	for _, prefix := range rules.prefixes {
+		if strings.HasPrefix(canonical, prefix) {
+			return BlocklistPrefixes
+		}
+	}
+	return ""
+}
+
+// Check returns a PolicyError if a URL is in the blocklist.
+func (b *Blocklist) Check(u *url.URL) error {
+	if list := b.Match(u); len(list) != 0 {
+		return &PolicyError{Rule: PolicyRuleBlocklist, Reason: fmt.Sprintf("url is in the %s blocklist", list)}
+	}
+	return nil
+}
+
+// blockForm returns a canonical form of a URL that blocklists are compared with.
+func blockForm(u *url.URL) string {
+	c := *u
+	c.Fragment, c.RawFragment = "", ""
+	return (&URLNormalizer{}).Normalize(&c)
+}
+
+func loadBlockRules(cfg BlocklistConfig) (*blockRules, error) {
+	rules := &blockRules{hashes: make(map[[sha256.Size]byte]bool)}
+
+	hosts, err := readBlocklistFile(cfg.HostsFile)
+	if err != nil {
+		return nil, err
+	}
+	if rules.hosts, err = newHostList(hosts); err != nil {
+		return nil, err
+	}
+
+	prefixes, err := readBlocklistFile(cfg.PrefixesFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		u, err := url.Parse(prefix)
+		if err != nil || len(u.Hostname()) == 0 {
+			return nil, fmt.Errorf("bad blocklist prefix %q", prefix)
+		}
+		rules.prefixes = append(rules.prefixes, blockForm(u))
+	}
+
+	hashes, err := readBlocklistFile(cfg.HashesFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		sum, err := hex.DecodeString(hash)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("bad blocklist hash %q", hash)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], sum)
+		rules.hashes[key] = true
+	}
+
+	return rules, nil
+}
+
+func readBlocklistFile(filePath string) ([]string, error) {
+	if len(filePath) == 0 {
+		return nil, nil
+	}
+	entries, err := readListFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist %s: %w", filePath, err)
+	}
+	return entries, nil
+}
+
+// RescanBlocklist blocks links whose destinations are in the blocklist and unblocks blocked links
+// that aren't there anymore, e.g. after a false positive has been removed from a list.
+func (u *URLShortener) RescanBlocklist(ctx context.Context) (blocked, unblocked int, err error) {
+	if u.blocklist == nil || u.blocker == nil {
+		return 0, 0, nil
+	}
+
+	matches := make(map[uint64]bool)
+	err = u.blocker.ScanURLs(ctx, func(id uint64, link string) error {
+		if parsed, err := url.Parse(link); err == nil && len(u.blocklist.Match(parsed)) != 0 {
+			matches[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	current, err := u.blocker.BlockedURLs(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	toUnblock := make([]uint64, 0)
+	for _, id := range current {
+		if matches[id] {
+			delete(matches, id)
+		} else {
+			toUnblock = append(toUnblock, id)
+		}
+	}
+	toBlock := make([]uint64, 0, len(matches))
+	for id := range matches {
+		toBlock = append(toBlock, id)
+	}
+
+	if err := inBatches(toBlock, func(ids []uint64) error {
+		if err := u.blocker.BlockURLs(ctx, ids); err != nil {
+			return err
+		}
+		blocked += len(ids)
+		return nil
+	}); err != nil {
+		return blocked, unblocked, err
+	}
+	if err := inBatches(toUnblock, func(ids []uint64) error {
+		if err := u.blocker.UnblockURLs(ctx, ids); err != nil {
+			return err
+		}
+		unblocked += len(ids)
+		return nil
+	}); err != nil {
+		return blocked, unblocked, err
+	}
+
+	return blocked, unblocked, nil
+}
+
+// inBatches calls fn for parts of ids of at most blockBatchSize ids.
+func inBatches(ids []uint64, fn func([]uint64) error) error {
+	for len(ids) != 0 {
+		n := blockBatchSize
+		if len(ids) < n {
+			n = len(ids)
+		}
+		if err := fn(ids[:n]); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// watchBlocklist reloads the blocklist when its files change and rescans links periodically and after reloads.
+func (u *URLShortener) watchBlocklist() {
+	reload := time.NewTicker(u.blocklistReload)
+	defer reload.Stop()
+	rescan := time.NewTicker(u.blocklistRescan)
+	defer rescan.Stop()
+
+	// Lists might have changed while the service has been down.
+	u.rescanBlocklist()
+	for {
+		select {
+		case <-u.deleteCtx.Done():
+			return
+		case <-reload.C:
+			changed, err := u.blocklist.Reload()
+			if err != nil {
+				u.logger.Error("failed to reload blocklist", zap.Error(err))
+				continue
+			}
+			if changed {
+				u.logger.Info("blocklist has been reloaded")
+				u.rescanBlocklist()
+			}
+		case <-rescan.C:
+			u.rescanBlocklist()
+		}
+	}
+}
+
+func (u *URLShortener) rescanBlocklist() {
+	blocked, unblocked, err := u.RescanBlocklist(u.deleteCtx)
+	if err != nil {
+		u.logger.Error("failed to rescan links against blocklist", zap.Error(err))
+		return
+	}
+	if blocked != 0 || unblocked != 0 {
+		u.logger.Info("links have been rescanned against blocklist",
+			zap.Int("blocked", blocked), zap.Int("unblocked", unblocked))
+	}
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// DefaultBotSignatures - user agent substrings of well known crawlers and link unfurlers.
+// A bare "bot" would match devices and browsers too, e.g. CUBOT phones, so only product tokens
+// that end with it, like Googlebot/2.1, and known bot names are listed.
+var DefaultBotSignatures = []string{
+	"bot/",
+	"bot;",
+	"slackbot",
+	"twitterbot",
+	"telegrambot",
+	"crawler",
+	"spider",
+	"slurp",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"slack-imgproxy",
+	"whatsapp",
+	"skypeuripreview",
+	"bingpreview",
+	"embedly",
+	"vkshare",
+	"viber",
+	"pinterest",
+	"headlesschrome",
+	"lighthouse",
+}
+
+// prefetchPurposes - values of Purpose-like headers that browsers and proxies send for speculative requests.
+var prefetchPurposes = []string{
+	"prefetch",
+	"preview",
+	"prerender",
+}
+
+// BotClassifier tags requests that are made by automated clients rather than people.
+type BotClassifier struct {
+	signatures []string
+}
+
+// NewBotClassifier creates a classifier with default signatures extended by extra ones.
+func NewBotClassifier(extra ...string) *BotClassifier {
+	signatures := make([]string, 0, len(DefaultBotSignatures)+len(extra))
+	for _, list := range [][]string{DefaultBotSignatures, extra} {
+		for _, s := range list {
+			if s = strings.ToLower(strings.TrimSpace(s)); len(s) != 0 {
+				signatures = append(signatures, s)
+			}
+		}
+	}
+
+	return &BotClassifier{signatures: signatures}
+}
+
+// IsBot returns true iff a visitor is a known bot or the request is a prefetch.
+func (c *BotClassifier) IsBot(v *Visitor) bool {
+	purpose := strings.ToLower(v.Purpose)
+	for _, p := range prefetchPurposes {
+		if strings.Contains(purpose, p) {
+			return true
+		}
+	}
+
+	userAgent := strings.ToLower(v.UserAgent)
+	for _, s := range c.signatures {
+		if strings.Contains(userAgent, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadBotSignatures reads user agent signatures from a file.
+// The file contains one signature per line, empty lines and lines starting with '#' are skipped.
+func LoadBotSignatures(filePath string) ([]string, error) {
+	return readListFile(filePath)
+}
+
+// readListFile reads entries of a list file, one per line. Empty lines and lines starting with '#' are skipped.
+func readListFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
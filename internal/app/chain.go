@@ -0,0 +1,223 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// DefaultMaxChainDepth - the most short URLs of other shorteners a URL may pass through by default.
+	DefaultMaxChainDepth = 1
+
+	// maxOwnHops - short URLs of this service resolved for a URL at most, more of them make a loop.
+	maxOwnHops = 8
+	// chainProbeTimeout - how long a short URL of another shortener is waited for.
+	chainProbeTimeout = 2 * time.Second
+)
+
+// ChainPolicyConfig - rules of URLs that point to short URLs as they are written in a config file.
+type ChainPolicyConfig struct {
+	// OwnURLs - base URLs short URLs of this service are made of, e.g. https://sho.rt.
+	OwnURLs []string `json:"own_urls"`
+	// RejectOwn - reject short URLs of this service instead of shortening their targets.
+	RejectOwn bool `json:"reject_own"`
+	// Shorteners - hosts of other URL shorteners, e.g. bit.ly. Domains match subdomains too.
+	Shorteners []string `json:"shorteners"`
+	// MaxDepth - the most short URLs of Shorteners a URL may pass through, zero means DefaultMaxChainDepth.
+	MaxDepth int `json:"max_depth"`
+}
+
+// ChainPolicy keeps short URLs from pointing to short URLs. A short URL of this service is replaced with
+// its target, so links never lead back to the service. Short URLs of other shorteners are followed
+// until they leave them, a shortener that doesn't answer ends a chain.
+type ChainPolicy struct {
+	own        []ownBase
+	rejectOwn  bool
+	shorteners hostList
+	maxDepth   int
+	client     *http.Client
+}
+
+// ownBase - a host and a path prefix of short URLs of this service.
+type ownBase struct {
+	host string
+	path string
+}
+
+// NewChainPolicy checks and compiles rules of a config.
+func NewChainPolicy(cfg ChainPolicyConfig) (*ChainPolicy, error) {
+	if cfg.MaxDepth < 0 {
+		return nil, fmt.Errorf("bad max chain depth %d", cfg.MaxDepth)
+	}
+	policy := &ChainPolicy{
+		rejectOwn: cfg.RejectOwn,
+		maxDepth:  cfg.MaxDepth,
+		client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	if policy.maxDepth == 0 {
+		policy.maxDepth = DefaultMaxChainDepth
+	}
+
+	for _, base := range cfg.OwnURLs {
+		if !strings.Contains(base, "://") {
+			base = "http://" + base
+		}
+		u, err := url.Parse(base)
+		if err != nil || len(u.Hostname()) == 0 {
+			return nil, fmt.Errorf("bad own url %q", base)
+		}
+		policy.own = append(policy.own, ownBase{
+			host: normalizeHost(strings.ToLower(u.Scheme), u.Host),
+			path: strings.TrimSuffix(u.Path, "/"),
+		})
+	}
+
+	var err error
+	if policy.shorteners, err = newHostList(cfg.Shorteners); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// ownID returns an id of a short URL of this service.
+func (p *ChainPolicy) ownID(u *url.URL) (uint64, bool) {
+	host := normalizeHost(strings.ToLower(u.Scheme), u.Host)
+	for _, base := range p.own {
+		if host != base.host || !strings.HasPrefix(u.Path, base.path+"/") {
+			continue
+		}
+		id := strings.TrimPrefix(u.Path, base.path+"/")
+		if len(id) == 0 || strings.Contains(id, "/") {
+			continue
+		}
+		// Other pages of the service, e.g. /ping, aren't short URLs.
+		if key, err := decodeID(id); err == nil {
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+// checkDepth follows short URLs of other shorteners and fails if there are more than maxDepth of them.
+func (p *ChainPolicy) checkDepth(ctx context.Context, u *url.URL) error {
+	for depth := 1; p.isShortener(u); depth++ {
+		if depth > p.maxDepth {
+			return &PolicyError{
+				Rule:   PolicyRuleChainDepth,
+				Reason: fmt.Sprintf("url passes through more than %d url shorteners", p.maxDepth),
+			}
+		}
+
+		next, ok := p.follow(ctx, u)
+		if !ok {
+			return nil
+		}
+		u = next
+	}
+	return nil
+}
+
+func (p *ChainPolicy) isShortener(u *url.URL) bool {
+	if p.shorteners.empty() {
+		return false
+	}
+	host := asciiHostname(strings.TrimSuffix(u.Hostname(), "."))
+	return p.shorteners.match(host, net.ParseIP(host))
+}
+
+// follow returns where a short URL of another shortener redirects to. Bodies of responses aren't read.
+func (p *ChainPolicy) follow(ctx context.Context, u *url.URL) (*url.URL, bool) {
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, chainProbeTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, false
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, false
+	}
+	response.Body.Close()
+
+	if response.StatusCode < http.StatusMultipleChoices || response.StatusCode >= http.StatusBadRequest {
+		return nil, false
+	}
+	location, err := response.Location()
+	if err != nil {
+		return nil, false
+	}
+	return location, true
+}
+
+// resolveChain replaces a short URL of this service with its target and makes sure the URL doesn't pass
+// through too many short URLs of other shorteners. It returns the URL to shorten.
+func (u *URLShortener) resolveChain(ctx context.Context, data string, parsedURL *url.URL) (string, *url.URL, error) {
+	if u.chains == nil {
+		return data, parsedURL, nil
+	}
+
+	resolved := false
+	for hops := 0; ; hops++ {
+		id, ok := u.chains.ownID(parsedURL)
+		if !ok {
+			break
+		}
+		if u.chains.rejectOwn {
+			return "", nil, &PolicyError{Rule: PolicyRuleOwnURL, Reason: "url is a short url of this service"}
+		}
+		if hops == maxOwnHops {
+			return "", nil, &PolicyError{Rule: PolicyRuleOwnURL, Reason: "short urls of this service make a loop"}
+		}
+
+		target, err := u.urlStorage.Get(ctx, id)
+		switch {
+		case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrDeleted):
+			return "", nil, &PolicyError{
+				Rule:   PolicyRuleOwnURL,
+				Reason: "url is a short url of this service that doesn't exist or has been deleted",
+			}
+		case errors.Is(err, storage.ErrBlocked):
+			return "", nil, &PolicyError{
+				Rule:   PolicyRuleBlocklist,
+				Reason: "url is a short url of this service that has been blocked",
+			}
+		case err != nil:
+			return "", nil, err
+		}
+
+		parsedTarget, err := url.Parse(target)
+		if err != nil || len(parsedTarget.Hostname()) == 0 {
+			return "", nil, ErrBadURL
+		}
+		data, parsedURL, resolved = target, parsedTarget, true
+	}
+
+	// A target might have been shortened under other rules.
+	if resolved {
+		if err := u.checkPolicy(data, parsedURL); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := u.chains.checkDepth(ctx, parsedURL); err != nil {
+		return "", nil, err
+	}
+	return data, parsedURL, nil
+}
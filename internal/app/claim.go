@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+var (
+	// ErrMergeUnsupported - a storage can't move links between users.
+	ErrMergeUnsupported = errors.New("user merge is not supported")
+	// ErrClaimAccount - links of an account can't be claimed, only anonymous users are merged.
+	ErrClaimAccount = errors.New("account links can't be claimed")
+	// ErrMergedUser - a user token belongs to an anonymous user whose links have been claimed.
+	ErrMergedUser = fmt.Errorf("%w: user has been merged", ErrInvalidToken)
+)
+
+// AuthenticateUser verifies a user token and checks that its user hasn't been merged into an account.
+// Tokens of merged users are refused, so a copy of a claimed token gives no access to the account.
+func (u *URLShortener) AuthenticateUser(ctx context.Context, rawToken string) (*UserToken, error) {
+	token, err := u.ParseUserToken(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.merge == nil || token.HasScope(ScopeAccount) {
+		return token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	if _, err := u.merge.MergedInto(ctx, token.UserID); err == nil {
+		return nil, ErrMergedUser
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	return token, nil
+}
+
+// ClaimLinks moves links of an anonymous user identified by a user token to userID.
+// The anonymous user is merged, its token isn't accepted afterwards. It returns the number of moved links.
+func (u *URLShortener) ClaimLinks(ctx context.Context, rawToken string, userID uint64) (uint64, error) {
+	if u.merge == nil {
+		return 0, ErrMergeUnsupported
+	}
+
+	token, err := u.AuthenticateUser(ctx, rawToken)
+	if err != nil {
+		return 0, err
+	}
+
+	if token.HasScope(ScopeAccount) {
+		return 0, ErrClaimAccount
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	return u.merge.MergeUsers(ctx, token.UserID, userID)
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/pkg/hyperloglog"
+	"github.com/r4start/go-url-shortener/pkg/logging"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	clickQueueSize    = 1024
+	maxClicksPerBatch = 512
+)
+
+// Visitor describes a client that follows a short URL.
+type Visitor struct {
+	IP        string
+	UserAgent string
+	// Purpose - value of Purpose-like request headers, e.g. "prefetch".
+	Purpose string
+}
+
+// DailyLinkStats - redirect statistics of a short URL for a single day.
+type DailyLinkStats struct {
+	Day            time.Time
+	Clicks         uint64
+	BotClicks      uint64
+	UniqueVisitors uint64
+}
+
+// LinkStats - redirect statistics of a short URL.
+// Clicks and UniqueVisitors don't include requests made by bots, those are counted in BotClicks.
+type LinkStats struct {
+	Clicks         uint64
+	BotClicks      uint64
+	UniqueVisitors uint64
+	Days           []DailyLinkStats
+}
+
+// Redirect resolves a short URL and registers a click made by the visitor.
+func (u *URLShortener) Redirect(ctx context.Context, urlID string, visitor *Visitor) (string, error) {
+	key, err := decodeID(urlID)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, span := u.tracer.Start(ctx, "URLShortener.Redirect")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	originalURL, err := u.urlStorage.Get(ctx, key)
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
+
+	if u.clickStat != nil && visitor != nil {
+		click := storage.Click{
+			ID:      key,
+			Visitor: u.visitorFingerprint(visitor),
+			Time:    time.Now(),
+			Bot:     u.bots.IsBot(visitor),
+		}
+
+		// Statistics must never slow down a redirect, so a click is dropped when the queue is full.
+		select {
+		case u.clickChan <- click:
+		default:
+			logging.FromContext(ctx, u.logger).Debug("click queue is full, dropping a click")
+		}
+	}
+
+	return originalURL, nil
+}
+
+// LinkStats returns redirect statistics of a short URL owned by userID.
+func (u *URLShortener) LinkStats(ctx context.Context, userID uint64, urlID string) (*LinkStats, error) {
+	key, err := decodeID(urlID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	userData, err := u.urlStorage.GetUserData(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := false
+	for _, d := range userData {
+		if d.ShortURLID == key {
+			owned = true
+			break
+		}
+	}
+
+	if !owned {
+		return nil, storage.ErrNotFound
+	}
+
+	result := &LinkStats{
+		Days: make([]DailyLinkStats, 0),
+	}
+
+	if u.clickStat == nil {
+		return result, nil
+	}
+
+	days, err := u.clickStat.LinkClicks(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	visitors := hyperloglog.New()
+	for _, d := range days {
+		visitors.Merge(d.Visitors)
+		result.Clicks += d.Clicks
+		result.BotClicks += d.BotClicks
+		result.Days = append(result.Days, DailyLinkStats{
+			Day:            d.Day,
+			Clicks:         d.Clicks,
+			BotClicks:      d.BotClicks,
+			UniqueVisitors: d.Visitors.Estimate(),
+		})
+	}
+	result.UniqueVisitors = visitors.Estimate()
+
+	return result, nil
+}
+
+func (u *URLShortener) registerClicks() {
+	for {
+		select {
+		case <-u.deleteCtx.Done():
+			return
+		case click := <-u.clickChan:
+			clicks := []storage.Click{click}
+
+			// Take everything that has been queued meanwhile to save storage round trips.
+		drain:
+			for len(clicks) < maxClicksPerBatch {
+				select {
+				case c := <-u.clickChan:
+					clicks = append(clicks, c)
+				default:
+					break drain
+				}
+			}
+
+			if err := u.clickStat.AddClicks(u.deleteCtx, clicks); err != nil {
+				u.logger.Error("failed to register clicks", zap.Error(err))
+			}
+		}
+	}
+}
+
+// visitorFingerprint hashes visitor's address and user agent with a secret salt,
+// so raw client data never reaches a storage.
+func (u *URLShortener) visitorFingerprint(v *Visitor) uint64 {
+	hasher := hmac.New(sha256.New, u.visitorSalt)
+	hasher.Write([]byte(v.IP))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(v.UserAgent))
+	return binary.BigEndian.Uint64(hasher.Sum(nil))
+}
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+// ErrExportUnsupported - a storage can't list links of a user with their states.
+var ErrExportUnsupported = errors.New("export is not supported")
+
+// ExportUserURLs calls fn for every link of a user, deleted ones included, in order of creation.
+// Links are read from a storage as fn consumes them, so there is no StorageOperationTimeout,
+// an export lasts as long as ctx allows.
+func (u *URLShortener) ExportUserURLs(ctx context.Context, userID uint64, fn func(storage.ExportedURL) error) error {
+	if u.export == nil {
+		return ErrExportUnsupported
+	}
+
+	ctx, span := u.tracer.Start(ctx, "URLShortener.ExportUserURLs")
+	defer span.End()
+
+	err := u.export.ExportUserURLs(ctx, userID, fn)
+	span.SetError(err)
+	return err
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// DefaultIdempotencyWindow - how long a response is replayed for an idempotency key by default.
+	DefaultIdempotencyWindow = 24 * time.Hour
+	// MaxIdempotencyKeyLength - the longest idempotency key.
+	MaxIdempotencyKeyLength = 255
+
+	// idempotencyLease - how long a key is held by a request in progress, a key of a request
+	// that has never finished, e.g. because of a crash, is free after it.
+	idempotencyLease = time.Minute
+)
+
+var (
+	// ErrBadIdempotencyKey - an idempotency key is too long or has non-printable characters.
+	ErrBadIdempotencyKey = errors.New("bad idempotency key")
+	// ErrIdempotencyInProgress - a request with the same idempotency key hasn't finished yet.
+	ErrIdempotencyInProgress = errors.New("request with the idempotency key is in progress")
+	// ErrIdempotencyKeyReused - an idempotency key has been used for another request.
+	ErrIdempotencyKeyReused = errors.New("idempotency key has been used for another request")
+)
+
+// IdempotentResponse - a response saved for an idempotency key. Status is an HTTP status or a gRPC code.
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// BeginIdempotent starts a request of a user with an idempotency key. fingerprint identifies the request,
+// e.g. it is a hash of its body. A saved response of the same request is returned to be replayed.
+// Otherwise the result is nil and the request must be finished with CompleteIdempotent or AbortIdempotent.
+// Without a configured store keys are ignored.
+func (u *URLShortener) BeginIdempotent(ctx context.Context, userID uint64, key string, fingerprint []byte) (*IdempotentResponse, error) {
+	if !validIdempotencyKey(key) {
+		return nil, ErrBadIdempotencyKey
+	}
+	if u.idempotency == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	record, err := u.idempotency.ReserveIdempotencyKey(ctx, userID, key, fingerprint, time.Now().Add(idempotencyLease))
+	switch {
+	case err != nil:
+		return nil, err
+	case record == nil:
+		return nil, nil
+	case !bytes.Equal(record.Fingerprint, fingerprint):
+		return nil, ErrIdempotencyKeyReused
+	case !record.Done:
+		return nil, ErrIdempotencyInProgress
+	}
+
+	return &IdempotentResponse{Status: record.Status, ContentType: record.ContentType, Body: record.Body}, nil
+}
+
+// CompleteIdempotent saves a response of a request started with BeginIdempotent for the idempotency window.
+func (u *URLShortener) CompleteIdempotent(ctx context.Context, userID uint64, key string, response *IdempotentResponse) error {
+	if u.idempotency == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	return u.idempotency.SaveIdempotentResponse(ctx, userID, key, storage.IdempotencyRecord{
+		Status:      response.Status,
+		ContentType: response.ContentType,
+		Body:        response.Body,
+		Expires:     time.Now().Add(u.idempotencyWindow),
+	})
+}
+
+// AbortIdempotent frees a key of a request that has failed, so the request may be retried.
+func (u *URLShortener) AbortIdempotent(ctx context.Context, userID uint64, key string) error {
+	if u.idempotency == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	return u.idempotency.ReleaseIdempotencyKey(ctx, userID, key)
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxIdempotencyKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
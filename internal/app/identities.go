@@ -0,0 +1,33 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+// ScopeAccount - a scope of user tokens issued after a login with an identity provider.
+const ScopeAccount = "account"
+
+// ErrIdentitiesUnsupported - a storage doesn't keep external identities.
+var ErrIdentitiesUnsupported = errors.New("identities are not supported")
+
+// Login returns a persistent user id of an external identity. An identity that logs in for the first time
+// is bound to a new id. Ids of anonymous users are never adopted, since their tokens might be known to others,
+// links created before the login are moved to the account with ClaimLinks.
+func (u *URLShortener) Login(ctx context.Context, identity storage.Identity) (uint64, error) {
+	if u.identities == nil {
+		return 0, ErrIdentitiesUnsupported
+	}
+
+	userID, _, err := newUserID()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	return u.identities.BindIdentity(ctx, identity, userID)
+}
@@ -0,0 +1,323 @@
+package app
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxImportRows - the most rows an import file may have.
+const MaxImportRows = 100000
+
+// maxImportLine - the longest NDJSON line.
+const maxImportLine = 1 << 20
+
+// ImportFormat - a format of an import file.
+type ImportFormat int
+
+const (
+	// ImportCSV - comma separated values, a header row names columns.
+	ImportCSV ImportFormat = iota + 1
+	// ImportNDJSON - a JSON object per line.
+	ImportNDJSON
+)
+
+var (
+	// ErrBadImport - an import file can't be parsed as a whole, e.g. it has no url column.
+	ErrBadImport = errors.New("bad import file")
+	// ErrImportTooLarge - an import file has more than MaxImportRows rows.
+	ErrImportTooLarge = fmt.Errorf("%w: more than %d rows", ErrBadImport, MaxImportRows)
+	// ErrBadImportValue - a value of an import row can't be parsed.
+	ErrBadImportValue = errors.New("bad import value")
+)
+
+// ImportRow - a link of an import file, Line is its line in the file. Err is set if the row can't be parsed.
+type ImportRow struct {
+	Line        int
+	OriginalURL string
+	Alias       string
+	Tags        []string
+	ExpiresAt   time.Time
+	Err         error
+}
+
+type importField int
+
+const (
+	fieldUnknown importField = iota
+	fieldURL
+	fieldAlias
+	fieldTags
+	fieldExpiry
+)
+
+// importColumns - column names of this service and of exports of common shorteners (Bitly, Rebrandly,
+// Short.io, YOURLS, Kutt and others). Names are compared with normalizeColumn applied.
+// A "link" column isn't accepted as a url, exports use it for short links.
+var importColumns = map[string]importField{
+	"url":            fieldURL,
+	"originalurl":    fieldURL,
+	"longurl":        fieldURL,
+	"destination":    fieldURL,
+	"destinationurl": fieldURL,
+	"target":         fieldURL,
+	"targeturl":      fieldURL,
+
+	"alias":       fieldAlias,
+	"customalias": fieldAlias,
+	"keyword":     fieldAlias,
+	"slug":        fieldAlias,
+	"slashtag":    fieldAlias,
+	"path":        fieldAlias,
+	"address":     fieldAlias,
+	"shortcode":   fieldAlias,
+	"backhalf":    fieldAlias,
+
+	"tags":   fieldTags,
+	"tag":    fieldTags,
+	"labels": fieldTags,
+
+	"expiresat":      fieldExpiry,
+	"expires":        fieldExpiry,
+	"expireat":       fieldExpiry,
+	"expiry":         fieldExpiry,
+	"expiration":     fieldExpiry,
+	"expirationdate": fieldExpiry,
+}
+
+// headerlessColumns - columns of a CSV file without a header.
+var headerlessColumns = []importField{fieldURL, fieldAlias, fieldTags, fieldExpiry}
+
+// ParseImport reads links of an import file. Rows with bad values are returned with Err set,
+// a file that can't be read as a whole fails with ErrBadImport.
+func ParseImport(r io.Reader, format ImportFormat) ([]ImportRow, error) {
+	switch format {
+	case ImportCSV:
+		return parseCSVImport(r)
+	case ImportNDJSON:
+		return parseNDJSONImport(r)
+	}
+	return nil, fmt.Errorf("%w: unknown format", ErrBadImport)
+}
+
+func parseCSVImport(r io.Reader) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	var columns []importField
+	rows := make([]ImportRow, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadImport, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if columns == nil {
+			if columns = csvHeader(record); columns != nil {
+				continue
+			}
+			if !isAbsoluteURL(strings.TrimSpace(record[0])) {
+				return nil, fmt.Errorf("%w: no url column", ErrBadImport)
+			}
+			columns = headerlessColumns
+		}
+
+		if len(record) == 1 && len(strings.TrimSpace(record[0])) == 0 {
+			continue
+		}
+		if len(rows) == MaxImportRows {
+			return nil, ErrImportTooLarge
+		}
+
+		row := ImportRow{Line: line}
+		for i, value := range record {
+			if i >= len(columns) {
+				break
+			}
+			if err := row.set(columns[i], strings.TrimSpace(value)); err != nil && row.Err == nil {
+				row.Err = err
+			}
+		}
+		rows = append(rows, row.validate())
+	}
+
+	if columns == nil {
+		return nil, fmt.Errorf("%w: empty file", ErrBadImport)
+	}
+	return rows, nil
+}
+
+// csvHeader returns fields of header columns or nil if a record has no url column, i.e. isn't a header.
+func csvHeader(record []string) []importField {
+	columns := make([]importField, len(record))
+	hasURL := false
+	for i, name := range record {
+		columns[i] = importColumns[normalizeColumn(name)]
+		hasURL = hasURL || columns[i] == fieldURL
+	}
+	if !hasURL {
+		return nil
+	}
+	return columns
+}
+
+func parseNDJSONImport(r io.Reader) ([]ImportRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+
+	rows := make([]ImportRow, 0)
+	for line := 1; scanner.Scan(); line++ {
+		data := strings.TrimSpace(scanner.Text())
+		if len(data) == 0 {
+			continue
+		}
+		if len(rows) == MaxImportRows {
+			return nil, ErrImportTooLarge
+		}
+
+		row := ImportRow{Line: line}
+		var object map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &object); err != nil {
+			row.Err = fmt.Errorf("%w: line isn't a json object", ErrBadImportValue)
+			rows = append(rows, row)
+			continue
+		}
+
+		for key, value := range object {
+			if err := row.setJSON(importColumns[normalizeColumn(key)], value); err != nil && row.Err == nil {
+				row.Err = err
+			}
+		}
+		rows = append(rows, row.validate())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImport, err)
+	}
+	return rows, nil
+}
+
+func (r *ImportRow) set(field importField, value string) error {
+	switch field {
+	case fieldURL:
+		r.OriginalURL = value
+	case fieldAlias:
+		r.Alias = value
+	case fieldTags:
+		r.Tags = splitTags(value)
+	case fieldExpiry:
+		if len(value) == 0 {
+			return nil
+		}
+		expiresAt, err := parseExpiry(value)
+		if err != nil {
+			return err
+		}
+		r.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (r *ImportRow) setJSON(field importField, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return r.set(field, strings.TrimSpace(v))
+	case float64:
+		if field != fieldExpiry {
+			return fmt.Errorf("%w: unexpected number", ErrBadImportValue)
+		}
+		r.ExpiresAt = time.Unix(int64(v), 0).UTC()
+		return nil
+	case []interface{}:
+		if field != fieldTags {
+			return fmt.Errorf("%w: unexpected array", ErrBadImportValue)
+		}
+		for _, tag := range v {
+			s, ok := tag.(string)
+			if !ok {
+				return fmt.Errorf("%w: tags must be strings", ErrBadImportValue)
+			}
+			if s = strings.TrimSpace(s); len(s) != 0 {
+				r.Tags = append(r.Tags, s)
+			}
+		}
+		return nil
+	}
+	if field == fieldUnknown {
+		return nil
+	}
+	return fmt.Errorf("%w: unexpected value type", ErrBadImportValue)
+}
+
+func (r ImportRow) validate() ImportRow {
+	if r.Err == nil && !isAbsoluteURL(r.OriginalURL) {
+		r.Err = ErrBadURL
+	}
+	return r
+}
+
+// normalizeColumn lowercases a column name and drops everything but letters and digits,
+// so "Long URL", "long_url" and "longUrl" are the same column.
+func normalizeColumn(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// splitTags splits tags separated with commas, semicolons or pipes.
+func splitTags(value string) []string {
+	parts := strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || c == ';' || c == '|'
+	})
+
+	tags := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); len(p) != 0 {
+			tags = append(tags, p)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// parseExpiry accepts RFC 3339 times, dates and unix timestamps.
+func parseExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: expiry %q", ErrBadImportValue, value)
+}
+
+func isAbsoluteURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && len(u.Hostname()) != 0
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// ImportJobTTL - how long results of a finished import are kept.
+	ImportJobTTL = 24 * time.Hour
+
+	// maxRunningImports - the most imports a user may run at once.
+	maxRunningImports = 2
+	// importBatchSize - the most rows an import commits with one storage call.
+	importBatchSize = 1000
+)
+
+var (
+	// ErrTooManyImports - a user already runs maxRunningImports imports.
+	ErrTooManyImports = errors.New("too many running imports")
+	// ErrUnsupportedField - an import row sets a field short links of this service don't have.
+	ErrUnsupportedField = errors.New("unsupported field")
+)
+
+// ImportStatus - a state of an import job.
+type ImportStatus string
+
+const (
+	ImportRunning ImportStatus = "running"
+	ImportDone    ImportStatus = "done"
+	ImportFailed  ImportStatus = "failed"
+)
+
+// ImportRowResult - an outcome of an import row.
+type ImportRowResult struct {
+	Line        int
+	OriginalURL string
+	Key         []byte
+	Status      BatchStatus
+	Err         error
+	// Ignored - fields of a row that have been dropped.
+	Ignored []string
+}
+
+// ImportJob - a snapshot of a background import. Rows has results of processed rows only.
+type ImportJob struct {
+	ID        string
+	UserID    uint64
+	Status    ImportStatus
+	Created   time.Time
+	Finished  time.Time
+	Total     int
+	Processed int
+	Failed    int
+	Rows      []ImportRowResult
+	// Err - why a job has failed.
+	Err error
+}
+
+// importJobs - imports of all users, they live in memory until ImportJobTTL after they finish.
+type importJobs struct {
+	lock sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+func newImportJobs() *importJobs {
+	return &importJobs{jobs: make(map[string]*ImportJob)}
+}
+
+// evict removes jobs that have finished ImportJobTTL before now. The lock must be held.
+func (j *importJobs) evict(now time.Time) {
+	for key, job := range j.jobs {
+		if job.Status != ImportRunning && now.Sub(job.Finished) > ImportJobTTL {
+			delete(j.jobs, key)
+		}
+	}
+}
+
+// StartImport runs a background import of rows for a user and returns its initial state.
+// Aliases and expiry times can't be kept, rows with them fail with ErrUnsupportedField. Tags are dropped.
+func (u *URLShortener) StartImport(ctx context.Context, userID uint64, rows []ImportRow) (*ImportJob, error) {
+	_, span := u.tracer.Start(ctx, "URLShortener.StartImport")
+	defer span.End()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	job := &ImportJob{
+		ID:      hex.EncodeToString(id),
+		UserID:  userID,
+		Status:  ImportRunning,
+		Created: time.Now(),
+		Total:   len(rows),
+		Rows:    make([]ImportRowResult, 0, len(rows)),
+	}
+
+	u.imports.lock.Lock()
+	u.imports.evict(time.Now())
+	running := 0
+	for _, j := range u.imports.jobs {
+		if j.UserID == userID && j.Status == ImportRunning {
+			running++
+		}
+	}
+	if running >= maxRunningImports {
+		u.imports.lock.Unlock()
+		span.SetError(ErrTooManyImports)
+		return nil, ErrTooManyImports
+	}
+	u.imports.jobs[job.ID] = job
+	snapshot := job.snapshot()
+	u.imports.lock.Unlock()
+
+	// A job outlives a request that has started it, it stops with the shortener only.
+	go u.runImport(job, rows)
+
+	return snapshot, nil
+}
+
+// Import returns a state of an import of a user. Imports of other users aren't found.
+func (u *URLShortener) Import(_ context.Context, userID uint64, id string) (*ImportJob, error) {
+	u.imports.lock.Lock()
+	defer u.imports.lock.Unlock()
+
+	u.imports.evict(time.Now())
+	job, ok := u.imports.jobs[id]
+	if !ok || job.UserID != userID {
+		return nil, storage.ErrNotFound
+	}
+	return job.snapshot(), nil
+}
+
+func (u *URLShortener) runImport(job *ImportJob, rows []ImportRow) {
+	ctx := u.deleteCtx
+	logger := u.logger.With(zap.String("import_id", job.ID))
+
+	var err error
+	for start := 0; start < len(rows) && err == nil; start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var results []ImportRowResult
+		if results, err = u.importBatch(ctx, job.UserID, rows[start:end]); err != nil {
+			break
+		}
+
+		u.imports.lock.Lock()
+		for _, r := range results {
+			if r.Status == BatchInvalid {
+				job.Failed++
+			}
+		}
+		job.Rows = append(job.Rows, results...)
+		job.Processed = len(job.Rows)
+		u.imports.lock.Unlock()
+	}
+
+	u.imports.lock.Lock()
+	defer u.imports.lock.Unlock()
+
+	job.Finished = time.Now()
+	job.Status = ImportDone
+	if err != nil {
+		logger.Error("import has failed", zap.Error(err))
+		job.Status = ImportFailed
+		job.Err = err
+	}
+	u.imports.evict(job.Finished)
+}
+
+func (u *URLShortener) importBatch(ctx context.Context, userID uint64, rows []ImportRow) ([]ImportRowResult, error) {
+	results := make([]ImportRowResult, len(rows))
+	urls := make([]string, 0, len(rows))
+	positions := make([]int, 0, len(rows))
+
+	for i, row := range rows {
+		results[i] = ImportRowResult{Line: row.Line, OriginalURL: row.OriginalURL, Status: BatchInvalid}
+		switch {
+		case row.Err != nil:
+			results[i].Err = row.Err
+		case len(row.Alias) != 0:
+			results[i].Err = fmt.Errorf("%w: alias", ErrUnsupportedField)
+		case !row.ExpiresAt.IsZero():
+			results[i].Err = fmt.Errorf("%w: expiry", ErrUnsupportedField)
+		default:
+			if len(row.Tags) != 0 {
+				results[i].Ignored = []string{"tags"}
+			}
+			urls = append(urls, row.OriginalURL)
+			positions = append(positions, i)
+		}
+	}
+
+	if len(urls) == 0 {
+		return results, nil
+	}
+
+	batch, err := u.BatchShorten(ctx, userID, urls, BatchPartial)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range batch {
+		results[positions[i]].Key = r.Key
+		results[positions[i]].Status = r.Status
+		results[positions[i]].Err = r.Err
+	}
+
+	return results, nil
+}
+
+func (j *ImportJob) snapshot() *ImportJob {
+	s := *j
+	s.Rows = make([]ImportRowResult, len(j.Rows))
+	copy(s.Rows, j.Rows)
+	return &s
+}
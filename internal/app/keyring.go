@@ -0,0 +1,200 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SigningKeySize - size of a user token key, it is used both for AES-256-GCM and HMAC-SHA256.
+const SigningKeySize = 32
+
+var (
+	// ErrBadKeyring - a keyring is malformed.
+	ErrBadKeyring = errors.New("bad keyring")
+	// ErrPrimaryKey - the primary key can't be retired.
+	ErrPrimaryKey = errors.New("primary key can't be retired")
+)
+
+// SigningKey - a secret that protects user tokens.
+type SigningKey struct {
+	ID      uint32    `json:"id"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+// Keyring - a set of user token keys. New tokens are issued with the primary key,
+// all keys are accepted for verification, so a key can be rotated without logging users out.
+type Keyring struct {
+	Primary uint32       `json:"primary"`
+	Keys    []SigningKey `json:"keys"`
+}
+
+// NewKeyring creates a keyring with a single random key.
+func NewKeyring() (*Keyring, error) {
+	k := &Keyring{Keys: make([]SigningKey, 0, 1)}
+	if _, err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ParseKeyring decodes a keyring from JSON and validates it.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	k := &Keyring{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadKeyring, err)
+	}
+
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// LoadKeyring reads a keyring from a file.
+func LoadKeyring(filePath string) (*Keyring, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(data)
+}
+
+// Save atomically writes a keyring to a file that is readable by the owner only.
+func (k *Keyring) Save(filePath string) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// Validate checks that key ids are unique, secrets have a proper size and the primary key exists.
+func (k *Keyring) Validate() error {
+	if len(k.Keys) == 0 {
+		return fmt.Errorf("%w: no keys", ErrBadKeyring)
+	}
+
+	ids := make(map[uint32]bool)
+	for _, key := range k.Keys {
+		if ids[key.ID] {
+			return fmt.Errorf("%w: duplicate key id %d", ErrBadKeyring, key.ID)
+		}
+		ids[key.ID] = true
+
+		if len(key.Secret) != SigningKeySize {
+			return fmt.Errorf("%w: key %d has %d bytes secret, %d expected", ErrBadKeyring, key.ID, len(key.Secret), SigningKeySize)
+		}
+	}
+
+	if !ids[k.Primary] {
+		return fmt.Errorf("%w: primary key %d doesn't exist", ErrBadKeyring, k.Primary)
+	}
+
+	return nil
+}
+
+// Rotate adds a new random key and makes it primary.
+func (k *Keyring) Rotate() (*SigningKey, error) {
+	secret := make([]byte, SigningKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	id := uint32(1)
+	for _, key := range k.Keys {
+		if key.ID >= id {
+			id = key.ID + 1
+		}
+	}
+
+	k.Keys = append(k.Keys, SigningKey{
+		ID:      id,
+		Secret:  secret,
+		Created: time.Now().UTC().Truncate(time.Second),
+	})
+	k.Primary = id
+
+	return &k.Keys[len(k.Keys)-1], nil
+}
+
+// Retire removes a key, tokens issued with it become invalid.
+func (k *Keyring) Retire(id uint32) error {
+	if id == k.Primary {
+		return ErrPrimaryKey
+	}
+
+	for i, key := range k.Keys {
+		if key.ID == id {
+			k.Keys = append(k.Keys[:i], k.Keys[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: key %d doesn't exist", ErrBadKeyring, id)
+}
+
+// userKey - a signing key ready for use.
+type userKey struct {
+	id     uint32
+	secret []byte
+	gcm    cipher.AEAD
+}
+
+func newUserKeys(k *Keyring) (map[uint32]*userKey, error) {
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[uint32]*userKey, len(k.Keys))
+	for _, key := range k.Keys {
+		aes256Cipher, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(aes256Cipher)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[key.ID] = &userKey{
+			id:     key.ID,
+			secret: key.Secret,
+			gcm:    aead,
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// TrackingParams - query parameters of common analytics and ad systems, a value for URLNormalizer.StripParams.
+var TrackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "yclid", "mc_cid", "mc_eid", "_openstat"}
+
+// defaultPorts - ports that are dropped from URLs of schemes.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// URLNormalizer makes canonical forms of URLs, URLs with equal forms share a short URL.
+// A scheme and a host are lowercased, a default port is dropped, an international host name is
+// converted to punycode and dot segments of a path are resolved. Query parameters are changed
+// only if SortQuery or StripParams are set.
+type URLNormalizer struct {
+	// SortQuery - order query parameters by name, values of a parameter keep their order.
+	SortQuery bool
+	// StripParams - names of query parameters to drop, a name that ends with * is a prefix, e.g. utm_*.
+	// Names are case-insensitive.
+	StripParams []string
+}
+
+// Normalize returns a canonical form of a URL, the URL isn't changed.
+func (n *URLNormalizer) Normalize(u *url.URL) string {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Host = normalizeHost(c.Scheme, c.Host)
+
+	if len(c.RawPath) != 0 {
+		raw := removeDotSegments(c.EscapedPath())
+		if path, err := url.PathUnescape(raw); err == nil {
+			c.Path, c.RawPath = path, raw
+		}
+	} else {
+		c.Path = removeDotSegments(c.Path)
+	}
+
+	c.RawQuery = n.normalizeQuery(c.RawQuery)
+	if len(c.RawQuery) == 0 {
+		c.ForceQuery = false
+	}
+
+	return c.String()
+}
+
+func normalizeHost(scheme, host string) string {
+	hostname, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	} else if strings.HasSuffix(host, ":") {
+		hostname = strings.TrimSuffix(host, ":")
+	}
+
+	hostname = asciiHostname(hostname)
+	if port == defaultPorts[scheme] {
+		port = ""
+	}
+	if strings.Contains(hostname, ":") {
+		hostname = "[" + hostname + "]"
+	}
+	if len(port) == 0 {
+		return hostname
+	}
+	return hostname + ":" + port
+}
+
+// asciiHostname lowercases a host name and converts an international one to punycode.
+func asciiHostname(hostname string) string {
+	hostname = strings.ToLower(hostname)
+	if net.ParseIP(hostname) != nil {
+		return hostname
+	}
+	// Host names that aren't valid IDNs, e.g. with underscores, are kept as they are.
+	if ascii, err := idna.Lookup.ToASCII(hostname); err == nil {
+		return ascii
+	}
+	return hostname
+}
+
+// removeDotSegments resolves . and .. segments of an absolute path as RFC 3986 does.
+func removeDotSegments(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	result := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		switch segment {
+		case ".":
+		case "..":
+			// The first segment is the empty one before the leading slash.
+			if len(result) > 1 {
+				result = result[:len(result)-1]
+			}
+		default:
+			result = append(result, segment)
+			continue
+		}
+		// A path that ends with a dot segment denotes a directory.
+		if i == len(segments)-1 {
+			result = append(result, "")
+		}
+	}
+	return strings.Join(result, "/")
+}
+
+type queryParam struct {
+	name string
+	raw  string
+}
+
+func (n *URLNormalizer) normalizeQuery(query string) string {
+	if len(query) == 0 || (!n.SortQuery && len(n.StripParams) == 0) {
+		return query
+	}
+
+	params := make([]queryParam, 0)
+	for _, raw := range strings.Split(query, "&") {
+		if len(raw) == 0 {
+			continue
+		}
+		name := raw
+		if i := strings.IndexByte(raw, '='); i >= 0 {
+			name = raw[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if n.stripped(name) {
+			continue
+		}
+		params = append(params, queryParam{name: name, raw: raw})
+	}
+
+	if n.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].name < params[j].name
+		})
+	}
+
+	result := make([]string, 0, len(params))
+	for _, p := range params {
+		result = append(result, p.raw)
+	}
+	return strings.Join(result, "&")
+}
+
+func (n *URLNormalizer) stripped(name string) bool {
+	name = strings.ToLower(name)
+	for _, param := range n.StripParams {
+		param = strings.ToLower(param)
+		if prefix := strings.TrimSuffix(param, "*"); prefix != param {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == param {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,10 @@ package app
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 )
 
 type ShortenerConfigurator func(s *URLShortener)
@@ -14,14 +16,149 @@ func WithStorage(st storage.URLStorage) ShortenerConfigurator {
 	}
 }
 
+// WithCanonicalURLStorage makes different spellings of a URL share a short URL,
+// URLs are identified by their canonical forms.
+func WithCanonicalURLStorage(st storage.CanonicalURLStorage) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.canonical = st
+	}
+}
+
+// WithURLNormalizer sets rules of canonical forms of URLs, nil turns canonical forms off.
+func WithURLNormalizer(n *URLNormalizer) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.normalizer = n
+	}
+}
+
+// WithURLPolicy sets rules of URLs that can be shortened, nil allows any URL with a host.
+func WithURLPolicy(p *URLPolicy) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.policy = p
+	}
+}
+
+// WithChainPolicy sets rules of URLs that point to short URLs, nil turns the checks off.
+func WithChainPolicy(p *ChainPolicy) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.chains = p
+	}
+}
+
+// WithBlocklist makes phishing and malware destinations forbidden. With a URLBlocker existing links are
+// checked against the blocklist too.
+func WithBlocklist(b *Blocklist) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.blocklist = b
+	}
+}
+
+// WithURLBlocker sets a storage that disables links with blocked destinations.
+func WithURLBlocker(st storage.URLBlocker) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.blocker = st
+	}
+}
+
+// WithBlocklistIntervals sets how often blocklist files are checked for changes and how often links are rescanned.
+func WithBlocklistIntervals(reload, rescan time.Duration) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.blocklistReload = reload
+		s.blocklistRescan = rescan
+	}
+}
+
 func WithStat(stat storage.ServiceStat) ShortenerConfigurator {
 	return func(s *URLShortener) {
 		s.stat = stat
 	}
 }
 
+func WithClickStat(stat storage.ClickStat) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.clickStat = stat
+	}
+}
+
+// WithVisitorSalt sets a secret used to anonymize visitors.
+// Unique visitor estimates are comparable only between runs with the same salt.
+func WithVisitorSalt(salt []byte) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.visitorSalt = salt
+	}
+}
+
+// WithAPIKeyStorage enables API keys.
+func WithAPIKeyStorage(st storage.APIKeyStorage) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.apiKeys = st
+	}
+}
+
+// WithIdentityStorage enables logins with external identity providers.
+func WithIdentityStorage(st storage.IdentityStorage) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.identities = st
+	}
+}
+
+// WithUserMerge lets users claim links they have created anonymously.
+func WithUserMerge(st storage.UserMerge) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.merge = st
+	}
+}
+
+// WithURLExport lets users export their links with creation times and states.
+func WithURLExport(st storage.URLExport) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.export = st
+	}
+}
+
+func WithBotClassifier(c *BotClassifier) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.bots = c
+	}
+}
+
+func WithTracer(t *tracing.Tracer) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.tracer = t
+	}
+}
+
+// WithKeyring sets keys for user tokens. Without a keyring a random key is used,
+// so tokens become invalid after a restart and aren't accepted by other replicas.
+func WithKeyring(k *Keyring) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.keyring = k
+	}
+}
+
 func WithDatabase(c *sql.DB) ShortenerConfigurator {
 	return func(s *URLShortener) {
 		s.db = c
 	}
 }
+
+// WithUserTokenTTL sets a lifetime of issued user tokens.
+func WithUserTokenTTL(ttl time.Duration) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.tokenTTL = ttl
+	}
+}
+
+// WithIdempotencyStore lets clients retry shorten requests with idempotency keys.
+func WithIdempotencyStore(st storage.IdempotencyStore) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.idempotency = st
+	}
+}
+
+// WithIdempotencyWindow sets how long responses are replayed for idempotency keys.
+func WithIdempotencyWindow(window time.Duration) ShortenerConfigurator {
+	return func(s *URLShortener) {
+		s.idempotencyWindow = window
+	}
+}
@@ -0,0 +1,197 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultMaxURLLength - the longest URL a storage keeps.
+const DefaultMaxURLLength = 8192
+
+// Rules of a URL policy, a PolicyError tells which one a URL breaks.
+const (
+	PolicyRuleLength    = "length"
+	PolicyRuleScheme    = "scheme"
+	PolicyRuleHost      = "host"
+	PolicyRulePrivateIP = "private_ip"
+	// PolicyRuleOwnURL - a URL is a short URL of this service that can't be shortened, see ChainPolicy.
+	PolicyRuleOwnURL = "own_url"
+	// PolicyRuleChainDepth - a URL passes through too many short URLs of other shorteners, see ChainPolicy.
+	PolicyRuleChainDepth = "chain_depth"
+	// PolicyRuleBlocklist - a URL is a phishing or malware destination, see Blocklist.
+	PolicyRuleBlocklist = "blocklist"
+)
+
+// DefaultSchemes - schemes of URLs that can be shortened if a policy doesn't list them.
+var DefaultSchemes = []string{"http", "https"}
+
+// ErrForbiddenURL - a URL breaks a rule of the URL policy.
+var ErrForbiddenURL = errors.New("url is forbidden")
+
+// PolicyError - a URL breaks a rule of the URL policy. It wraps ErrForbiddenURL.
+type PolicyError struct {
+	// Rule - one of PolicyRule constants.
+	Rule   string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrForbiddenURL, e.Reason)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrForbiddenURL
+}
+
+// URLPolicyConfig - rules of URLs that can be shortened as they are written in a config file.
+// Hosts are domain names, which match subdomains too, IP addresses or CIDR networks.
+type URLPolicyConfig struct {
+	// MaxLength - the longest URL, zero means DefaultMaxURLLength.
+	MaxLength int `json:"max_length"`
+	// Schemes - allowed schemes, DefaultSchemes if it is empty.
+	Schemes []string `json:"schemes"`
+	// AllowHosts - if it isn't empty, only these hosts are allowed. Private addresses listed here are allowed too.
+	AllowHosts []string `json:"allow_hosts"`
+	// BlockHosts - forbidden hosts, they are forbidden even if AllowHosts lists them.
+	BlockHosts []string `json:"block_hosts"`
+	// AllowPrivateIPs - allow loopback, private, link-local and unspecified addresses and localhost.
+	AllowPrivateIPs bool `json:"allow_private_ips"`
+}
+
+// URLPolicy decides which URLs can be shortened. Host names aren't resolved,
+// so private addresses are caught only if they are written in URLs.
+type URLPolicy struct {
+	maxLength       int
+	schemes         map[string]bool
+	allowHosts      hostList
+	blockHosts      hostList
+	allowPrivateIPs bool
+}
+
+// DefaultURLPolicy accepts http and https URLs of public hosts of at most DefaultMaxURLLength.
+func DefaultURLPolicy() *URLPolicy {
+	policy, _ := NewURLPolicy(URLPolicyConfig{})
+	return policy
+}
+
+// NewURLPolicy checks and compiles rules of a config.
+func NewURLPolicy(cfg URLPolicyConfig) (*URLPolicy, error) {
+	if cfg.MaxLength < 0 {
+		return nil, fmt.Errorf("bad max url length %d", cfg.MaxLength)
+	}
+	policy := &URLPolicy{
+		maxLength:       cfg.MaxLength,
+		schemes:         make(map[string]bool),
+		allowPrivateIPs: cfg.AllowPrivateIPs,
+	}
+	if policy.maxLength == 0 {
+		policy.maxLength = DefaultMaxURLLength
+	}
+
+	schemes := cfg.Schemes
+	if len(schemes) == 0 {
+		schemes = DefaultSchemes
+	}
+	for _, scheme := range schemes {
+		policy.schemes[strings.ToLower(scheme)] = true
+	}
+
+	var err error
+	if policy.allowHosts, err = newHostList(cfg.AllowHosts); err != nil {
+		return nil, err
+	}
+	if policy.blockHosts, err = newHostList(cfg.BlockHosts); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Check returns a PolicyError if a URL can't be shortened, raw is the URL as a user has sent it.
+func (p *URLPolicy) Check(raw string, u *url.URL) error {
+	if len(raw) > p.maxLength {
+		return &PolicyError{Rule: PolicyRuleLength, Reason: fmt.Sprintf("url is longer than %d", p.maxLength)}
+	}
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return &PolicyError{Rule: PolicyRuleScheme, Reason: fmt.Sprintf("scheme %q isn't allowed", u.Scheme)}
+	}
+
+	host := asciiHostname(strings.TrimSuffix(u.Hostname(), "."))
+	ip := net.ParseIP(host)
+	if p.blockHosts.match(host, ip) {
+		return &PolicyError{Rule: PolicyRuleHost, Reason: fmt.Sprintf("host %q is blocked", host)}
+	}
+	allowed := p.allowHosts.match(host, ip)
+	if !p.allowHosts.empty() && !allowed {
+		return &PolicyError{Rule: PolicyRuleHost, Reason: fmt.Sprintf("host %q isn't allowed", host)}
+	}
+	if !p.allowPrivateIPs && !allowed && privateHost(host, ip) {
+		return &PolicyError{Rule: PolicyRulePrivateIP, Reason: fmt.Sprintf("host %q is a private address", host)}
+	}
+	return nil
+}
+
+func privateHost(host string, ip net.IP) bool {
+	if ip == nil {
+		return host == "localhost" || strings.HasSuffix(host, ".localhost")
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified()
+}
+
+// hostList - domains, addresses and networks of a policy.
+type hostList struct {
+	domains  []string
+	networks []*net.IPNet
+}
+
+func newHostList(hosts []string) (hostList, error) {
+	var list hostList
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 {
+			continue
+		}
+		if strings.Contains(host, "/") {
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return list, fmt.Errorf("bad network %q: %w", host, err)
+			}
+			list.networks = append(list.networks, network)
+			continue
+		}
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			list.networks = append(list.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		list.domains = append(list.domains, asciiHostname(strings.Trim(host, ".")))
+	}
+	return list, nil
+}
+
+func (l hostList) empty() bool {
+	return len(l.domains) == 0 && len(l.networks) == 0
+}
+
+func (l hostList) match(host string, ip net.IP) bool {
+	if ip != nil {
+		for _, network := range l.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, domain := range l.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
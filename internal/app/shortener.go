@@ -2,11 +2,7 @@ package app
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"encoding/binary"
@@ -17,7 +13,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/r4start/go-url-shortener/pkg/logging"
 	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 	"go.uber.org/zap"
 
 	"golang.org/x/sync/errgroup"
@@ -35,67 +33,234 @@ type ShortenResult struct {
 	Key    []byte
 }
 
+const (
+	DefaultStatsWindow = 24 * time.Hour
+	DefaultStatsBucket = time.Hour
+	DefaultTopLinks    = 10
+
+	maxStatsBuckets = 1000
+	maxTopLinks     = 1000
+)
+
+var (
+	ErrBadStatsQuery = errors.New("bad statistics query")
+	// ErrBadURL - a URL to shorten isn't an absolute URL with a host.
+	ErrBadURL = errors.New("bad url")
+	// ErrBadShortID - a short URL id can't be decoded.
+	ErrBadShortID = errors.New("bad short url id")
+)
+
+// BatchURLError - a URL of a batch can't be shortened, Index is its position in the batch.
+type BatchURLError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchURLError) Error() string {
+	return fmt.Sprintf("batch url %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchURLError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError - URLs of a batch that can't be shortened in BatchAtomic mode, nothing of the batch is stored.
+// It wraps ErrBadURL.
+type BatchError struct {
+	Items []BatchURLError
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d bad urls in batch, first: %v", len(e.Items), &e.Items[0])
+}
+
+func (e *BatchError) Unwrap() error {
+	return ErrBadURL
+}
+
+// BatchMode - how a batch with bad URLs is handled.
+type BatchMode int
+
+const (
+	// BatchPartial - good URLs are shortened, bad ones are reported in their results.
+	BatchPartial BatchMode = iota
+	// BatchAtomic - a batch with a bad URL fails with BatchError and nothing is stored.
+	BatchAtomic
+)
+
+// BatchStatus - an outcome of a batch item.
+type BatchStatus int
+
+const (
+	// BatchCreated - a short URL has been created.
+	BatchCreated BatchStatus = iota + 1
+	// BatchExisted - a URL has been shortened before.
+	BatchExisted
+	// BatchInvalid - a URL can't be shortened, BatchResult.Err tells why.
+	BatchInvalid
+)
+
+func (s BatchStatus) String() string {
+	switch s {
+	case BatchCreated:
+		return "created"
+	case BatchExisted:
+		return "existed"
+	case BatchInvalid:
+		return "invalid"
+	}
+	return "unknown"
+}
+
+// BatchResult - a result of a batch item, Key is empty for invalid items.
+type BatchResult struct {
+	Key    []byte
+	Status BatchStatus
+	Err    error
+}
+
+// StatsQuery - parameters of service statistics. Zero values are replaced with defaults.
+type StatsQuery struct {
+	// Window - length of time series that end with the current hour.
+	Window time.Duration
+	// Bucket - length of a single time series point. It has to be a multiple of an hour.
+	Bucket time.Duration
+	// Top - number of the most clicked links to return.
+	Top int
+}
+
+// TopLink - one of the most clicked links.
+type TopLink struct {
+	Key         []byte
+	OriginalURL string
+	Clicks      uint64
+}
+
 type ShortenerStats struct {
 	URLs  uint64
 	Users uint64
+
+	// From, To and Bucket describe time series below, every series has a point for each bucket.
+	From   time.Time
+	To     time.Time
+	Bucket time.Duration
+
+	Created   []storage.TimeBucket
+	Deleted   []storage.TimeBucket
+	Redirects []storage.TimeBucket
+	TopLinks  []TopLink
 }
 
 type deleteData struct {
 	UserID uint64
 	IDs    []string
+	// Logger - a logger of a request that asked for deletion.
+	Logger *zap.Logger
 }
 
 type URLShortener struct {
-	urlStorage storage.URLStorage
-	stat       storage.ServiceStat
-	gcm        cipher.AEAD
-	privateKey []byte
-	db         *sql.DB
-	logger     *zap.Logger
-	deleteCtx  context.Context
-	deleteChan chan deleteData
-	trustedNet *net.IPNet
+	urlStorage  storage.URLStorage
+	canonical   storage.CanonicalURLStorage
+	normalizer  *URLNormalizer
+	policy      *URLPolicy
+	chains      *ChainPolicy
+	blocklist   *Blocklist
+	blocker     storage.URLBlocker
+	stat        storage.ServiceStat
+	clickStat   storage.ClickStat
+	apiKeys     storage.APIKeyStorage
+	identities  storage.IdentityStorage
+	merge       storage.UserMerge
+	export      storage.URLExport
+	bots        *BotClassifier
+	tracer      *tracing.Tracer
+	keyring     *Keyring
+	userKeys    map[uint32]*userKey
+	primaryKey  *userKey
+	tokenTTL    time.Duration
+	visitorSalt []byte
+	db          *sql.DB
+	logger      *zap.Logger
+	deleteCtx   context.Context
+	deleteChan  chan deleteData
+	clickChan   chan storage.Click
+	trustedNet  *net.IPNet
+	imports     *importJobs
+
+	idempotency       storage.IdempotencyStore
+	idempotencyWindow time.Duration
+
+	// blocklistReload - how often blocklist files are checked, blocklistRescan - how often links are checked.
+	blocklistReload time.Duration
+	blocklistRescan time.Duration
 }
 
 func NewURLShortener(ctx context.Context, logger *zap.Logger, opts ...ShortenerConfigurator) (*URLShortener, error) {
-	privateKey := make([]byte, 32)
-	readBytes, err := rand.Read(privateKey)
-	if err != nil || readBytes != len(privateKey) {
-		return nil, err
-	}
-	aes256Cipher, err := aes.NewCipher(privateKey)
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err := cipher.NewGCM(aes256Cipher)
-	if err != nil {
+	visitorSalt := make([]byte, 32)
+	if _, err := rand.Read(visitorSalt); err != nil {
 		return nil, err
 	}
 
 	handler := &URLShortener{
-		gcm:        aead,
-		privateKey: privateKey,
-		logger:     logger,
-		deleteCtx:  ctx,
-		deleteChan: make(chan deleteData),
+		visitorSalt: visitorSalt,
+		logger:      logger,
+		deleteCtx:   ctx,
+		deleteChan:  make(chan deleteData),
+		clickChan:   make(chan storage.Click, clickQueueSize),
+		bots:        NewBotClassifier(),
+		tokenTTL:    DefaultUserTokenTTL,
+		imports:     newImportJobs(),
+		normalizer:  &URLNormalizer{},
+		policy:      DefaultURLPolicy(),
+
+		idempotencyWindow: DefaultIdempotencyWindow,
+		blocklistReload:   DefaultBlocklistReload,
+		blocklistRescan:   DefaultBlocklistRescan,
 	}
 
 	for _, o := range opts {
 		o(handler)
 	}
 
+	// Without a configured keyring user tokens are valid until a restart only.
+	if handler.keyring == nil {
+		keyring, err := NewKeyring()
+		if err != nil {
+			return nil, err
+		}
+		handler.keyring = keyring
+	}
+
+	userKeys, err := newUserKeys(handler.keyring)
+	if err != nil {
+		return nil, err
+	}
+	handler.userKeys = userKeys
+	handler.primaryKey = userKeys[handler.keyring.Primary]
+
 	go handler.deleteIDs()
 
+	if handler.clickStat != nil {
+		go handler.registerClicks()
+	}
+
+	if handler.blocklist != nil {
+		go handler.watchBlocklist()
+	}
+
 	return handler, nil
 }
 
 func (u *URLShortener) Shorten(ctx context.Context, userID uint64, url string) (*ShortenResult, error) {
+	ctx, span := u.tracer.Start(ctx, "URLShortener.Shorten")
+	defer span.End()
+
 	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
 	defer cancel()
 
 	dst, exists, err := u.generateShortID(ctx, userID, url)
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 
@@ -111,29 +276,48 @@ func (u *URLShortener) OriginalURL(ctx context.Context, urlID string) (string, e
 		return "", err
 	}
 
+	ctx, span := u.tracer.Start(ctx, "URLShortener.OriginalURL")
+	defer span.End()
+
 	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
 	defer cancel()
 
-	return u.urlStorage.Get(ctx, key)
+	originalURL, err := u.urlStorage.Get(ctx, key)
+	span.SetError(err)
+	return originalURL, err
 }
 
-func (u *URLShortener) BatchShorten(ctx context.Context, userID uint64, urls []string) ([][]byte, error) {
+// BatchShorten shortens urls and returns a result for each of them in the same order.
+// In BatchAtomic mode a batch with a bad URL fails with BatchError.
+func (u *URLShortener) BatchShorten(ctx context.Context, userID uint64, urls []string, mode BatchMode) ([]BatchResult, error) {
+	ctx, span := u.tracer.Start(ctx, "URLShortener.BatchShorten")
+	defer span.End()
+
 	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
 	defer cancel()
 
-	return u.generateShortIDs(ctx, userID, urls)
+	results, err := u.generateShortIDs(ctx, userID, urls, mode)
+	span.SetError(err)
+	return results, err
 }
 
 func (u *URLShortener) UserURLs(ctx context.Context, userID uint64) ([]storage.UserData, error) {
+	ctx, span := u.tracer.Start(ctx, "URLShortener.UserURLs")
+	defer span.End()
+
 	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
 	defer cancel()
-	return u.urlStorage.GetUserData(ctx, userID)
+
+	data, err := u.urlStorage.GetUserData(ctx, userID)
+	span.SetError(err)
+	return data, err
 }
 
-func (u *URLShortener) DeleteUserURLs(_ context.Context, userID uint64, ids []string) error {
+func (u *URLShortener) DeleteUserURLs(ctx context.Context, userID uint64, ids []string) error {
 	u.deleteChan <- deleteData{
 		UserID: userID,
 		IDs:    ids,
+		Logger: logging.FromContext(ctx, u.logger),
 	}
 	return nil
 }
@@ -149,137 +333,200 @@ func (u *URLShortener) Ping(ctx context.Context) error {
 	return u.db.PingContext(ctx)
 }
 
-func (u *URLShortener) Stat(ctx context.Context) (*ShortenerStats, error) {
-	if u.stat == nil {
-		return &ShortenerStats{}, nil
+func (u *URLShortener) Stat(ctx context.Context, query StatsQuery) (*ShortenerStats, error) {
+	if query.Window == 0 {
+		query.Window = DefaultStatsWindow
+	}
+	if query.Bucket == 0 {
+		query.Bucket = DefaultStatsBucket
+	}
+	if query.Top == 0 {
+		query.Top = DefaultTopLinks
+	}
+
+	if query.Window < 0 || query.Bucket < time.Hour || query.Bucket%time.Hour != 0 ||
+		query.Top < 0 || query.Top > maxTopLinks {
+		return nil, ErrBadStatsQuery
+	}
+
+	buckets := int(query.Window / query.Bucket)
+	if query.Window%query.Bucket != 0 {
+		buckets++
+	}
+	if buckets > maxStatsBuckets {
+		return nil, ErrBadStatsQuery
+	}
+
+	to := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	result := &ShortenerStats{
+		From:     to.Add(-time.Duration(buckets) * query.Bucket),
+		To:       to,
+		Bucket:   query.Bucket,
+		TopLinks: make([]TopLink, 0),
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
 	defer cancel()
 
-	urls, err := u.stat.TotalURLs(ctx)
-	if err != nil {
-		return nil, err
+	var created, deleted, redirects []storage.TimeBucket
+	var err error
+
+	if u.stat != nil {
+		if result.URLs, err = u.stat.TotalURLs(ctx); err != nil {
+			return nil, err
+		}
+
+		if result.Users, err = u.stat.TotalUsers(ctx); err != nil {
+			return nil, err
+		}
+
+		if created, err = u.stat.CreatedURLs(ctx, result.From, result.To, result.Bucket); err != nil {
+			return nil, err
+		}
+
+		if deleted, err = u.stat.DeletedURLs(ctx, result.From, result.To, result.Bucket); err != nil {
+			return nil, err
+		}
 	}
 
-	users, err := u.stat.TotalUsers(ctx)
-	if err != nil {
-		return nil, err
+	if u.clickStat != nil {
+		if redirects, err = u.clickStat.Redirects(ctx, result.From, result.To, result.Bucket); err != nil {
+			return nil, err
+		}
+
+		top, err := u.clickStat.TopLinks(ctx, result.From, result.To, query.Top)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range top {
+			result.TopLinks = append(result.TopLinks, TopLink{
+				Key:         EncodeID(t.ID),
+				OriginalURL: t.OriginalURL,
+				Clicks:      t.Clicks,
+			})
+		}
 	}
 
-	return &ShortenerStats{
-		URLs:  urls,
-		Users: users,
-	}, nil
+	result.Created = fillSeries(result.From, result.Bucket, buckets, created)
+	result.Deleted = fillSeries(result.From, result.Bucket, buckets, deleted)
+	result.Redirects = fillSeries(result.From, result.Bucket, buckets, redirects)
+
+	return result, nil
 }
 
 func (u *URLShortener) generateShortID(ctx context.Context, userID uint64, data string) ([]byte, bool, error) {
 	parsedURL, err := url.Parse(data)
 	if err != nil || len(parsedURL.Hostname()) == 0 {
-		return nil, false, errors.New("bad input data")
+		return nil, false, ErrBadURL
 	}
-
-	key, exists, err := u.urlStorage.Add(ctx, userID, parsedURL.String())
+	if err := u.checkPolicy(data, parsedURL); err != nil {
+		return nil, false, err
+	}
+	data, parsedURL, err = u.resolveChain(ctx, data, parsedURL)
 	if err != nil {
 		return nil, false, err
 	}
 
-	return EncodeID(key), exists, nil
-}
-
-func (u *URLShortener) generateShortIDs(ctx context.Context, userID uint64, urls []string) ([][]byte, error) {
-	for _, data := range urls {
-		u, err := url.Parse(data)
-		if err != nil || len(u.Hostname()) == 0 {
-			return nil, errors.New("bad input data")
+	if u.canonical != nil && u.normalizer != nil {
+		added, err := u.canonical.AddCanonicalURLs(ctx, userID, []storage.CanonicalURL{{
+			URL:       data,
+			Canonical: u.normalizer.Normalize(parsedURL),
+		}})
+		if err != nil {
+			return nil, false, err
 		}
+		return EncodeID(added[0].ID), !added[0].Inserted, nil
 	}
 
-	results, err := u.urlStorage.AddURLs(ctx, userID, urls)
+	key, exists, err := u.urlStorage.Add(ctx, userID, parsedURL.String())
 	if err != nil {
-		return nil, err
-	}
-
-	ids := make([][]byte, 0)
-	for _, key := range results {
-		ids = append(ids, EncodeID(key.ID))
+		return nil, false, err
 	}
 
-	return ids, nil
+	return EncodeID(key), exists, nil
 }
 
-func (u *URLShortener) GetUserID(rawValue *string) (uint64, bool, error) {
-	if rawValue == nil {
-		id, err := cryptoRandUint64()
-		if err != nil {
-			return 0, false, err
+// checkPolicy returns a PolicyError for URLs the policy forbids or the blocklist has,
+// without them any URL is allowed.
+func (u *URLShortener) checkPolicy(data string, parsedURL *url.URL) error {
+	if u.policy != nil {
+		if err := u.policy.Check(data, parsedURL); err != nil {
+			return err
 		}
-		return id, true, nil
 	}
-
-	encoder := base64.URLEncoding.WithPadding(base64.NoPadding)
-	data, err := encoder.DecodeString(*rawValue)
-	if err != nil {
-		return 0, false, err
+	if u.blocklist != nil {
+		return u.blocklist.Check(parsedURL)
 	}
+	return nil
+}
 
-	hasher := hmac.New(sha256.New, u.privateKey)
+func (u *URLShortener) generateShortIDs(ctx context.Context, userID uint64, urls []string, mode BatchMode) ([]BatchResult, error) {
+	results := make([]BatchResult, len(urls))
+	valid := make([]string, 0, len(urls))
+	canonical := make([]storage.CanonicalURL, 0, len(urls))
+	positions := make([]int, 0, len(urls))
 
-	if len(data) < u.gcm.NonceSize()+hasher.Size()+1 {
-		return 0, false, errors.New("data size is too small")
+	var batchErr *BatchError
+	invalid := func(i int, err error) {
+		if batchErr == nil {
+			batchErr = &BatchError{}
+		}
+		batchErr.Items = append(batchErr.Items, BatchURLError{Index: i, Err: err})
+		results[i] = BatchResult{Status: BatchInvalid, Err: err}
 	}
-
-	sign := data[:hasher.Size()]
-	nonce := data[hasher.Size() : hasher.Size()+u.gcm.NonceSize()]
-	text := data[hasher.Size()+u.gcm.NonceSize():]
-
-	hasher.Write(data[hasher.Size():])
-	msgSign := hasher.Sum(nil)
-
-	if !hmac.Equal(sign, msgSign) {
-		id, err := cryptoRandUint64()
-		if err != nil {
-			return 0, false, err
+	for i, data := range urls {
+		parsed, err := url.Parse(data)
+		if err != nil || len(parsed.Hostname()) == 0 {
+			invalid(i, ErrBadURL)
+			continue
+		}
+		if err := u.checkPolicy(data, parsed); err != nil {
+			invalid(i, err)
+			continue
+		}
+		data, parsed, err = u.resolveChain(ctx, data, parsed)
+		switch {
+		case errors.Is(err, ErrForbiddenURL), errors.Is(err, ErrBadURL):
+			invalid(i, err)
+			continue
+		case err != nil:
+			return nil, err
+		}
+		valid = append(valid, data)
+		if u.canonical != nil && u.normalizer != nil {
+			canonical = append(canonical, storage.CanonicalURL{URL: data, Canonical: u.normalizer.Normalize(parsed)})
 		}
-		return id, true, nil
+		positions = append(positions, i)
 	}
-
-	var rawID []byte
-	uid, err := u.gcm.Open(rawID, nonce, text, nil)
-	if err != nil {
-		return 0, false, err
+	if batchErr != nil && mode == BatchAtomic {
+		return nil, batchErr
 	}
 
-	return binary.BigEndian.Uint64(uid[:binary.MaxVarintLen64]), false, nil
-}
-
-func (u *URLShortener) GenerateUserID(userID uint64) (*string, error) {
-	nonce := make([]byte, u.gcm.NonceSize())
+	if len(valid) == 0 {
+		return results, nil
+	}
 
-	readBytes, err := rand.Read(nonce)
+	var added []storage.AddResult
+	var err error
+	if len(canonical) != 0 {
+		added, err = u.canonical.AddCanonicalURLs(ctx, userID, canonical)
+	} else {
+		added, err = u.urlStorage.AddURLs(ctx, userID, valid)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if readBytes != len(nonce) {
-		return nil, errors.New("not enough entropy")
+	for i, r := range added {
+		status := BatchCreated
+		if !r.Inserted {
+			status = BatchExisted
+		}
+		results[positions[i]] = BatchResult{Key: EncodeID(r.ID), Status: status}
 	}
 
-	text := make([]byte, binary.MaxVarintLen64)
-	binary.BigEndian.PutUint64(text, userID)
-
-	var dst []byte
-	cipherText := u.gcm.Seal(dst, nonce, text, nil)
-	cipherText = append(nonce, cipherText...)
-
-	hasher := hmac.New(sha256.New, u.privateKey)
-	hasher.Write(cipherText)
-	sum := hasher.Sum(nil)
-
-	cipherText = append(sum, cipherText...)
-	encoder := base64.URLEncoding.WithPadding(base64.NoPadding)
-	result := encoder.EncodeToString(cipherText)
-	return &result, nil
+	return results, nil
 }
 
 func (u *URLShortener) deleteIDs() {
@@ -290,12 +537,12 @@ func (u *URLShortener) deleteIDs() {
 		case data := <-u.deleteChan:
 			decodedIDs, err := batchDecodeIDs(u.deleteCtx, data.IDs, MaxWorkersPerRequest)
 			if err != nil {
-				u.logger.Error("failed to decode short ids", zap.Error(err))
+				data.Logger.Error("failed to decode short ids", zap.Error(err))
 				continue
 			}
 
 			if err := u.urlStorage.DeleteURLs(u.deleteCtx, data.UserID, decodedIDs); err != nil {
-				u.logger.Error("failed to delete urls", zap.Error(err))
+				data.Logger.Error("failed to delete urls", zap.Error(err))
 			}
 		}
 	}
@@ -311,11 +558,11 @@ func EncodeID(id uint64) []byte {
 func decodeID(data string) (uint64, error) {
 	decodedKey, err := base64.RawURLEncoding.DecodeString(data)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("%w: %v", ErrBadShortID, err)
 	}
 	key, err := strconv.ParseUint(string(decodedKey), 16, 64)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("%w: %v", ErrBadShortID, err)
 	}
 
 	return key, nil
@@ -361,6 +608,23 @@ func batchDecodeIDs(ctx context.Context, strIDs []string, maxParallel int) ([]ui
 	return ids, nil
 }
 
+// fillSeries makes a time series with a point for every bucket out of a sparse one.
+func fillSeries(from time.Time, bucket time.Duration, count int, sparse []storage.TimeBucket) []storage.TimeBucket {
+	result := make([]storage.TimeBucket, count)
+	for i := range result {
+		result[i].Start = from.Add(time.Duration(i) * bucket)
+	}
+
+	for _, b := range sparse {
+		idx := int(b.Start.Sub(from) / bucket)
+		if idx >= 0 && idx < count {
+			result[idx].Count += b.Count
+		}
+	}
+
+	return result
+}
+
 func cryptoRandUint64() (uint64, error) {
 	randU64 := make([]byte, binary.MaxVarintLen64)
 	if readBytes, err := rand.Read(randU64); err != nil || readBytes != binary.MaxVarintLen64 {
@@ -2,9 +2,25 @@ package app
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/storage/storagetest"
 )
 
 func Test_batchDecodeIDs(t *testing.T) {
@@ -53,3 +69,957 @@ func Test_batchDecodeIDs(t *testing.T) {
 		})
 	}
 }
+
+func TestBotClassifier_IsBot(t *testing.T) {
+	tests := []struct {
+		name    string
+		visitor Visitor
+		isBot   bool
+	}{
+		{
+			name:    "Browser",
+			visitor: Visitor{UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:105.0) Gecko/20100101 Firefox/105.0"},
+			isBot:   false,
+		},
+		{
+			name: "Phone with bot in its name",
+			visitor: Visitor{UserAgent: "Mozilla/5.0 (Linux; Android 10; CUBOT_X30) AppleWebKit/537.36 " +
+				"(KHTML, like Gecko) Chrome/96.0.4664.104 Mobile Safari/537.36"},
+			isBot: false,
+		},
+		{
+			name:    "Search crawler",
+			visitor: Visitor{UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"},
+			isBot:   true,
+		},
+		{
+			name:    "Chat unfurler",
+			visitor: Visitor{UserAgent: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"},
+			isBot:   true,
+		},
+		{
+			name:    "Social crawler",
+			visitor: Visitor{UserAgent: "facebookexternalhit/1.1"},
+			isBot:   true,
+		},
+		{
+			name:    "Browser prefetch",
+			visitor: Visitor{UserAgent: "Mozilla/5.0", Purpose: "prefetch"},
+			isBot:   true,
+		},
+		{
+			name:    "Custom signature",
+			visitor: Visitor{UserAgent: "InternalMonitor/2.0"},
+			isBot:   true,
+		},
+	}
+
+	signaturesFile := filepath.Join(t.TempDir(), "bots.txt")
+	assert.NoError(t, os.WriteFile(signaturesFile, []byte("# monitoring\n\ninternalmonitor\n"), 0600))
+
+	signatures, err := LoadBotSignatures(signaturesFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"internalmonitor"}, signatures)
+
+	classifier := NewBotClassifier(signatures...)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.isBot, classifier.IsBot(&tt.visitor))
+		})
+	}
+}
+
+func TestKeyring_Validate(t *testing.T) {
+	secret := make([]byte, SigningKeySize)
+	tests := []struct {
+		name    string
+		keyring Keyring
+		wantErr bool
+	}{
+		{
+			name:    "Valid keyring",
+			keyring: Keyring{Primary: 2, Keys: []SigningKey{{ID: 1, Secret: secret}, {ID: 2, Secret: secret}}},
+		},
+		{
+			name:    "No keys",
+			keyring: Keyring{Primary: 1},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate id",
+			keyring: Keyring{Primary: 1, Keys: []SigningKey{{ID: 1, Secret: secret}, {ID: 1, Secret: secret}}},
+			wantErr: true,
+		},
+		{
+			name:    "Short secret",
+			keyring: Keyring{Primary: 1, Keys: []SigningKey{{ID: 1, Secret: secret[:16]}}},
+			wantErr: true,
+		},
+		{
+			name:    "Missing primary key",
+			keyring: Keyring{Primary: 3, Keys: []SigningKey{{ID: 1, Secret: secret}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.keyring.Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadKeyring)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestKeyring_SaveLoad(t *testing.T) {
+	k, err := NewKeyring()
+	assert.NoError(t, err)
+	_, err = k.Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), k.Primary)
+
+	filePath := filepath.Join(t.TempDir(), "keyring.json")
+	assert.NoError(t, k.Save(filePath))
+
+	info, err := os.Stat(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := LoadKeyring(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, k, loaded)
+
+	assert.ErrorIs(t, loaded.Retire(2), ErrPrimaryKey)
+	assert.ErrorIs(t, loaded.Retire(5), ErrBadKeyring)
+	assert.NoError(t, loaded.Retire(1))
+	assert.Len(t, loaded.Keys, 1)
+
+	_, err = ParseKeyring([]byte("{"))
+	assert.ErrorIs(t, err, ErrBadKeyring)
+}
+
+func TestURLShortener_KeyRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k, err := NewKeyring()
+	assert.NoError(t, err)
+
+	issuer, err := NewURLShortener(ctx, zap.NewNop(), WithKeyring(k))
+	assert.NoError(t, err)
+
+	token, err := issuer.GenerateUserID(42)
+	assert.NoError(t, err)
+
+	// Another replica with the same keyring accepts a token.
+	replica, err := NewURLShortener(ctx, zap.NewNop(), WithKeyring(k))
+	assert.NoError(t, err)
+	userID, generated, err := replica.GetUserID(token)
+	assert.NoError(t, err)
+	assert.False(t, generated)
+	assert.Equal(t, uint64(42), userID)
+
+	// Tokens signed with an old key stay valid after a rotation.
+	_, err = k.Rotate()
+	assert.NoError(t, err)
+	rotated, err := NewURLShortener(ctx, zap.NewNop(), WithKeyring(k))
+	assert.NoError(t, err)
+	userID, generated, err = rotated.GetUserID(token)
+	assert.NoError(t, err)
+	assert.False(t, generated)
+	assert.Equal(t, uint64(42), userID)
+
+	newToken, err := rotated.GenerateUserID(42)
+	assert.NoError(t, err)
+	_, _, err = replica.GetUserID(newToken)
+	assert.ErrorIs(t, err, ErrBadSignature)
+
+	// A retired key makes its tokens invalid.
+	assert.NoError(t, k.Retire(1))
+	retired, err := NewURLShortener(ctx, zap.NewNop(), WithKeyring(k))
+	assert.NoError(t, err)
+	_, _, err = retired.GetUserID(token)
+	assert.ErrorIs(t, err, ErrBadSignature)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// A tampered token isn't accepted.
+	tampered := []byte(*newToken)
+	tampered[len(tampered)/2] = 'A'
+	if tampered[len(tampered)/2] == (*newToken)[len(tampered)/2] {
+		tampered[len(tampered)/2] = 'B'
+	}
+	tamperedToken := string(tampered)
+	_, _, err = retired.GetUserID(&tamperedToken)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestURLShortener_ParseUserToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k, err := NewKeyring()
+	assert.NoError(t, err)
+
+	shortener, err := NewURLShortener(ctx, zap.NewNop(), WithKeyring(k))
+	assert.NoError(t, err)
+	expired, err := NewURLShortener(ctx, zap.NewNop(), WithKeyring(k), WithUserTokenTTL(-time.Minute))
+	assert.NoError(t, err)
+
+	scoped, err := shortener.GenerateUserID(42, "urls:read", "urls:write")
+	assert.NoError(t, err)
+	plain, err := shortener.GenerateUserID(42)
+	assert.NoError(t, err)
+	old, err := expired.GenerateUserID(42)
+	assert.NoError(t, err)
+
+	_, err = shortener.GenerateUserID(42, "bad scope")
+	assert.Error(t, err)
+
+	encoder := base64.URLEncoding.WithPadding(base64.NoPadding)
+	data, err := encoder.DecodeString(*plain)
+	assert.NoError(t, err)
+	data[0] = UserTokenVersion + 1
+	future := encoder.EncodeToString(data)
+
+	tests := []struct {
+		name    string
+		token   string
+		scopes  []string
+		wantErr error
+	}{
+		{
+			name:   "Token with scopes",
+			token:  *scoped,
+			scopes: []string{"urls:read", "urls:write"},
+		},
+		{
+			name:  "Token without scopes",
+			token: *plain,
+		},
+		{
+			name:    "Expired token",
+			token:   *old,
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:    "Unknown version",
+			token:   future,
+			wantErr: ErrUnknownTokenVersion,
+		},
+		{
+			name:    "Not base64",
+			token:   "!!!",
+			wantErr: ErrMalformedToken,
+		},
+		{
+			name:    "Truncated token",
+			token:   (*plain)[:20],
+			wantErr: ErrMalformedToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := shortener.ParseUserToken(tt.token)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.ErrorIs(t, err, ErrInvalidToken)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(42), token.UserID)
+			assert.Equal(t, tt.scopes, token.Scopes)
+			assert.Equal(t, DefaultUserTokenTTL, token.ExpiresAt.Sub(token.IssuedAt))
+			assert.False(t, token.NeedsRefresh(time.Now()))
+			assert.True(t, token.NeedsRefresh(token.ExpiresAt.Add(-DefaultUserTokenTTL/8)))
+		})
+	}
+}
+
+func TestParseImport(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  ImportFormat
+		data    string
+		rows    []ImportRow
+		wantErr error
+	}{
+		{
+			name:   "CSV with a header",
+			format: ImportCSV,
+			data:   "url,tags,expires_at\nhttps://ya.ru,\"news;search\",2030-01-02\n\nhttps://vc.ru,,\n",
+			rows: []ImportRow{
+				{Line: 2, OriginalURL: "https://ya.ru", Tags: []string{"news", "search"},
+					ExpiresAt: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+				{Line: 4, OriginalURL: "https://vc.ru"},
+			},
+		},
+		{
+			name:   "Bitly export",
+			format: ImportCSV,
+			data:   "Date Created,Title,Link,Long URL,Tags\n2022-01-01,Ya,https://bit.ly/abc,https://ya.ru,news\n",
+			rows: []ImportRow{
+				{Line: 2, OriginalURL: "https://ya.ru", Tags: []string{"news"}},
+			},
+		},
+		{
+			name:   "YOURLS export",
+			format: ImportCSV,
+			data:   "keyword,url,title\nya,https://ya.ru,Ya\n",
+			rows: []ImportRow{
+				{Line: 2, OriginalURL: "https://ya.ru", Alias: "ya"},
+			},
+		},
+		{
+			name:   "CSV without a header",
+			format: ImportCSV,
+			data:   "https://ya.ru\nya.ru,alias\nhttps://vc.ru,,,never\n",
+			rows: []ImportRow{
+				{Line: 1, OriginalURL: "https://ya.ru"},
+				{Line: 2, OriginalURL: "ya.ru", Alias: "alias", Err: ErrBadURL},
+				{Line: 3, OriginalURL: "https://vc.ru", Err: ErrBadImportValue},
+			},
+		},
+		{
+			name:    "CSV without a url column",
+			format:  ImportCSV,
+			data:    "title,link\nYa,https://bit.ly/abc\n",
+			wantErr: ErrBadImport,
+		},
+		{
+			name:    "Empty CSV",
+			format:  ImportCSV,
+			wantErr: ErrBadImport,
+		},
+		{
+			name:   "NDJSON",
+			format: ImportNDJSON,
+			data: `{"originalURL":"https://ya.ru","path":"ya","tags":["a","b"],"expires":1893456000}` + "\n\n" +
+				`not json` + "\n" + `{"destination":"https://vc.ru","title":"Vc"}` + "\n" + `{"url":42}`,
+			rows: []ImportRow{
+				{Line: 1, OriginalURL: "https://ya.ru", Alias: "ya", Tags: []string{"a", "b"},
+					ExpiresAt: time.Unix(1893456000, 0).UTC()},
+				{Line: 3, Err: ErrBadImportValue},
+				{Line: 4, OriginalURL: "https://vc.ru"},
+				{Line: 5, Err: ErrBadImportValue},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := ParseImport(strings.NewReader(tt.data), tt.format)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, rows, len(tt.rows))
+			for i, row := range rows {
+				if i >= len(tt.rows) {
+					break
+				}
+				expected := tt.rows[i]
+				assert.ErrorIs(t, row.Err, expected.Err)
+				row.Err, expected.Err = nil, nil
+				assert.Equal(t, expected, row)
+			}
+		})
+	}
+}
+
+func TestURLShortener_StartImport(t *testing.T) {
+	st := storage.NewInMemoryStorage()
+	s, err := NewURLShortener(context.Background(), zap.NewNop(), WithStorage(st))
+	assert.NoError(t, err)
+
+	_, err = s.Shorten(context.Background(), 1, "https://vc.ru")
+	assert.NoError(t, err)
+
+	rows := make([]ImportRow, 0, importBatchSize+3)
+	for i := 0; i < importBatchSize; i++ {
+		rows = append(rows, ImportRow{Line: i + 1, OriginalURL: fmt.Sprintf("https://ya.ru/%d", i)})
+	}
+	rows = append(rows,
+		ImportRow{Line: importBatchSize + 1, OriginalURL: "https://vc.ru", Tags: []string{"news"}},
+		ImportRow{Line: importBatchSize + 2, OriginalURL: "https://ya.ru", Alias: "ya"},
+		ImportRow{Line: importBatchSize + 3, OriginalURL: "ya.ru", Err: ErrBadURL},
+	)
+
+	job, err := s.StartImport(context.Background(), 1, rows)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportRunning, job.Status)
+	assert.Equal(t, len(rows), job.Total)
+
+	assert.Eventually(t, func() bool {
+		job, err = s.Import(context.Background(), 1, job.ID)
+		return err == nil && job.Status != ImportRunning
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, ImportDone, job.Status)
+	assert.Equal(t, len(rows), job.Processed)
+	assert.Equal(t, 2, job.Failed)
+	assert.Equal(t, BatchCreated, job.Rows[0].Status)
+
+	tail := job.Rows[importBatchSize:]
+	assert.Equal(t, BatchExisted, tail[0].Status)
+	assert.Equal(t, []string{"tags"}, tail[0].Ignored)
+	assert.Equal(t, BatchInvalid, tail[1].Status)
+	assert.ErrorIs(t, tail[1].Err, ErrUnsupportedField)
+	assert.ErrorIs(t, tail[2].Err, ErrBadURL)
+
+	_, err = s.Import(context.Background(), 2, job.ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Results are gone after ImportJobTTL even if no other import starts.
+	s.imports.lock.Lock()
+	s.imports.jobs[job.ID].Finished = time.Now().Add(-ImportJobTTL - time.Minute)
+	s.imports.lock.Unlock()
+	_, err = s.Import(context.Background(), 1, job.ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.Empty(t, s.imports.jobs)
+}
+
+func TestURLNormalizer_Normalize(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalizer URLNormalizer
+		url        string
+		expected   string
+	}{
+		{
+			name:     "Scheme, host and default port",
+			url:      "HTTP://Example.COM:80/a?b=1&a=2",
+			expected: "http://example.com/a?b=1&a=2",
+		},
+		{
+			name:     "Other ports are kept",
+			url:      "https://example.com:8443/",
+			expected: "https://example.com:8443/",
+		},
+		{
+			name:     "IPv6 host",
+			url:      "http://[FE80::1]:80/",
+			expected: "http://[fe80::1]/",
+		},
+		{
+			name:     "International host name",
+			url:      "https://Пример.рф/путь",
+			expected: "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C",
+		},
+		{
+			name:     "Dot segments",
+			url:      "http://example.com/a/./b/../../c/d/..",
+			expected: "http://example.com/c/",
+		},
+		{
+			name:     "Dot segments above the root",
+			url:      "http://example.com/../a",
+			expected: "http://example.com/a",
+		},
+		{
+			name:       "Sorted query",
+			normalizer: URLNormalizer{SortQuery: true},
+			url:        "http://example.com/a?b=1&a=2&b=0",
+			expected:   "http://example.com/a?a=2&b=1&b=0",
+		},
+		{
+			name:       "Stripped tracking parameters",
+			normalizer: URLNormalizer{StripParams: TrackingParams},
+			url:        "http://example.com/?UTM_source=x&id=1&fbclid=y",
+			expected:   "http://example.com/?id=1",
+		},
+		{
+			name:       "Only tracking parameters",
+			normalizer: URLNormalizer{StripParams: TrackingParams},
+			url:        "http://example.com/?utm_source=x#top",
+			expected:   "http://example.com/#top",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			assert.NoError(t, err)
+			original := u.String()
+
+			assert.Equal(t, tt.expected, tt.normalizer.Normalize(u))
+			assert.Equal(t, original, u.String())
+		})
+	}
+}
+
+func TestURLPolicy_Check(t *testing.T) {
+	policy, err := NewURLPolicy(URLPolicyConfig{
+		MaxLength:  40,
+		Schemes:    []string{"http", "HTTPS", "ftp"},
+		AllowHosts: []string{"example.com", "пример.рф", "10.1.0.0/16"},
+		BlockHosts: []string{"bad.example.com", "10.1.2.3"},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		policy *URLPolicy
+		url    string
+		rule   string
+	}{
+		{name: "Allowed domain", policy: policy, url: "https://example.com/a"},
+		{name: "Allowed subdomain", policy: policy, url: "ftp://files.EXAMPLE.com./a"},
+		{name: "Allowed international domain", policy: policy, url: "http://www.xn--e1afmkfd.xn--p1ai/"},
+		{name: "Allowed private network", policy: policy, url: "http://10.1.0.1/"},
+		{name: "Too long", policy: policy, url: "https://example.com/" + strings.Repeat("a", 30), rule: PolicyRuleLength},
+		{name: "Scheme", policy: policy, url: "file://example.com/etc/passwd", rule: PolicyRuleScheme},
+		{name: "Blocked subdomain", policy: policy, url: "http://www.bad.example.com/", rule: PolicyRuleHost},
+		{name: "Blocked address", policy: policy, url: "http://10.1.2.3/", rule: PolicyRuleHost},
+		{name: "Not allowed domain", policy: policy, url: "http://notexample.com/", rule: PolicyRuleHost},
+		{name: "Default policy", policy: DefaultURLPolicy(), url: "http://ya.ru/"},
+		{name: "Default schemes", policy: DefaultURLPolicy(), url: "javascript://ya.ru/%0aalert(1)", rule: PolicyRuleScheme},
+		{name: "Loopback", policy: DefaultURLPolicy(), url: "http://127.0.0.1:8080/", rule: PolicyRulePrivateIP},
+		{name: "Localhost", policy: DefaultURLPolicy(), url: "http://app.localhost/", rule: PolicyRulePrivateIP},
+		{name: "Private", policy: DefaultURLPolicy(), url: "http://192.168.1.1/", rule: PolicyRulePrivateIP},
+		{name: "Link-local", policy: DefaultURLPolicy(), url: "http://169.254.169.254/latest", rule: PolicyRulePrivateIP},
+		{name: "IPv6 loopback", policy: DefaultURLPolicy(), url: "http://[::1]/", rule: PolicyRulePrivateIP},
+		{name: "Mapped IPv4", policy: DefaultURLPolicy(), url: "http://[::ffff:10.0.0.1]/", rule: PolicyRulePrivateIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			assert.NoError(t, err)
+
+			err = tt.policy.Check(tt.url, u)
+			if len(tt.rule) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			var policyErr *PolicyError
+			assert.ErrorAs(t, err, &policyErr)
+			assert.ErrorIs(t, err, ErrForbiddenURL)
+			assert.Equal(t, tt.rule, policyErr.Rule)
+		})
+	}
+
+	_, err = NewURLPolicy(URLPolicyConfig{BlockHosts: []string{"10.0.0.0/33"}})
+	assert.Error(t, err)
+
+	// Forbidden URLs of a batch are reported with their rules.
+	s, err := NewURLShortener(context.Background(), zap.NewNop(), WithStorage(storage.NewInMemoryStorage()))
+	assert.NoError(t, err)
+	results, err := s.BatchShorten(context.Background(), 1, []string{"http://ya.ru", "file://ya.ru/etc"}, BatchPartial)
+	assert.NoError(t, err)
+	assert.Equal(t, BatchCreated, results[0].Status)
+	assert.Equal(t, BatchInvalid, results[1].Status)
+	assert.ErrorIs(t, results[1].Err, ErrForbiddenURL)
+}
+
+func TestURLShortener_CanonicalURLs(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewInMemoryStorage()
+	s, err := NewURLShortener(ctx, zap.NewNop(), WithStorage(st), WithCanonicalURLStorage(st),
+		WithURLNormalizer(&URLNormalizer{SortQuery: true}))
+	assert.NoError(t, err)
+
+	first, err := s.Shorten(ctx, 1, "HTTP://Example.com:80/a?b=1&a=2")
+	assert.NoError(t, err)
+	assert.False(t, first.Exists)
+
+	second, err := s.Shorten(ctx, 1, "http://example.com/a?a=2&b=1")
+	assert.NoError(t, err)
+	assert.True(t, second.Exists)
+	assert.Equal(t, first.Key, second.Key)
+
+	results, err := s.BatchShorten(ctx, 2, []string{"http://EXAMPLE.com/./a?a=2&b=1", "http://ya.ru"}, BatchPartial)
+	assert.NoError(t, err)
+	assert.Equal(t, BatchExisted, results[0].Status)
+	assert.Equal(t, first.Key, results[0].Key)
+	assert.Equal(t, BatchCreated, results[1].Status)
+
+	// The first spelling is served.
+	original, err := s.OriginalURL(ctx, string(first.Key))
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP://Example.com:80/a?b=1&a=2", original)
+}
+
+func TestURLShortener_OriginalInput(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		options  func(st storage.URLStorage) []ShortenerConfigurator
+		original string
+	}{
+		{
+			// Short URLs of the plain storage are made of parsed URLs, so they are stored parsed.
+			name:     "Plain storage",
+			options:  func(st storage.URLStorage) []ShortenerConfigurator { return []ShortenerConfigurator{WithStorage(st)} },
+			original: "http://ya.ru/A%7e",
+		},
+		{
+			name: "Canonical storage",
+			options: func(st storage.URLStorage) []ShortenerConfigurator {
+				return []ShortenerConfigurator{WithStorage(st), WithCanonicalURLStorage(st.(storage.CanonicalURLStorage)),
+					WithURLNormalizer(&URLNormalizer{})}
+			},
+			original: "HTTP://ya.ru/A%7e",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewURLShortener(ctx, zap.NewNop(), tt.options(storage.NewInMemoryStorage())...)
+			assert.NoError(t, err)
+
+			single, err := s.Shorten(ctx, 1, "HTTP://ya.ru/A%7e")
+			assert.NoError(t, err)
+			original, err := s.OriginalURL(ctx, string(single.Key))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.original, original)
+			parsed, err := s.Shorten(ctx, 1, "http://ya.ru/A%7e")
+			assert.NoError(t, err)
+			assert.True(t, parsed.Exists)
+			assert.Equal(t, single.Key, parsed.Key)
+
+			batch, err := s.BatchShorten(ctx, 1, []string{"HTTPS://vc.ru/B%7e"}, BatchAtomic)
+			assert.NoError(t, err)
+			original, err = s.OriginalURL(ctx, string(batch[0].Key))
+			assert.NoError(t, err)
+			assert.Equal(t, "HTTPS://vc.ru/B%7e", original)
+		})
+	}
+}
+
+func TestURLShortener_OwnURLs(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewInMemoryStorage()
+	chains, err := NewChainPolicy(ChainPolicyConfig{OwnURLs: []string{"https://sho.rt", "go.example.com/s/"}})
+	assert.NoError(t, err)
+	s, err := NewURLShortener(ctx, zap.NewNop(), WithStorage(st), WithChainPolicy(chains))
+	assert.NoError(t, err)
+
+	target, err := s.Shorten(ctx, 1, "https://ya.ru/page")
+	assert.NoError(t, err)
+	ownURL := "https://sho.rt/" + string(target.Key)
+
+	// A short URL of the service shares its target's short URL.
+	own, err := s.Shorten(ctx, 1, ownURL)
+	assert.NoError(t, err)
+	assert.True(t, own.Exists)
+	assert.Equal(t, target.Key, own.Key)
+
+	results, err := s.BatchShorten(ctx, 1, []string{"http://go.example.com/s/" + string(target.Key), "https://sho.rt/ping"},
+		BatchPartial)
+	assert.NoError(t, err)
+	assert.Equal(t, BatchExisted, results[0].Status)
+	assert.Equal(t, target.Key, results[0].Key)
+	// Other pages of the service aren't short URLs.
+	assert.Equal(t, BatchCreated, results[1].Status)
+
+	id, err := decodeID(string(target.Key))
+	assert.NoError(t, err)
+	assert.NoError(t, st.DeleteURLs(ctx, 1, []uint64{id}))
+
+	var policyErr *PolicyError
+	_, err = s.Shorten(ctx, 1, ownURL)
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, PolicyRuleOwnURL, policyErr.Rule)
+
+	_, err = s.Shorten(ctx, 1, "https://sho.rt/"+string(EncodeID(id+1)))
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, PolicyRuleOwnURL, policyErr.Rule)
+
+	// Short URLs stored before the policy are followed to the end of a chain.
+	deep, _, err := st.Add(ctx, 1, "https://ya.ru/deep")
+	assert.NoError(t, err)
+	middle, _, err := st.Add(ctx, 1, "https://sho.rt/"+string(EncodeID(deep)))
+	assert.NoError(t, err)
+	resolved, err := s.Shorten(ctx, 1, "https://sho.rt/"+string(EncodeID(middle)))
+	assert.NoError(t, err)
+	assert.True(t, resolved.Exists)
+	assert.Equal(t, EncodeID(deep), resolved.Key)
+
+	rejecting, err := NewChainPolicy(ChainPolicyConfig{OwnURLs: []string{"https://sho.rt"}, RejectOwn: true})
+	assert.NoError(t, err)
+	strict, err := NewURLShortener(ctx, zap.NewNop(), WithStorage(st), WithChainPolicy(rejecting))
+	assert.NoError(t, err)
+	_, err = strict.Shorten(ctx, 1, "https://sho.rt/"+string(EncodeID(deep)))
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, PolicyRuleOwnURL, policyErr.Rule)
+}
+
+func TestURLShortener_OwnURLs_database(t *testing.T) {
+	ctx := context.Background()
+	st, err := storage.NewDatabaseStorage(ctx, storagetest.Database(t))
+	assert.NoError(t, err)
+	defer st.Close()
+	chains, err := NewChainPolicy(ChainPolicyConfig{OwnURLs: []string{"https://sho.rt"}})
+	assert.NoError(t, err)
+	s, err := NewURLShortener(ctx, zap.NewNop(), WithStorage(st), WithChainPolicy(chains))
+	assert.NoError(t, err)
+
+	target, err := s.Shorten(ctx, 1, "https://ya.ru/page")
+	assert.NoError(t, err)
+	own, err := s.Shorten(ctx, 1, "https://sho.rt/"+string(target.Key))
+	assert.NoError(t, err)
+	assert.Equal(t, target.Key, own.Key)
+
+	id, err := decodeID(string(target.Key))
+	assert.NoError(t, err)
+	var policyErr *PolicyError
+	_, err = s.Shorten(ctx, 1, "https://sho.rt/"+string(EncodeID(id+1)))
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, PolicyRuleOwnURL, policyErr.Rule)
+}
+
+func TestURLShortener_ChainDepth(t *testing.T) {
+	ctx := context.Background()
+	redirect := func(location string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, location, http.StatusMovedPermanently)
+		}))
+	}
+	// Test servers play shorteners, a redirect out of them ends a chain.
+	first := redirect("https://ya.ru/page")
+	defer first.Close()
+	second := redirect(first.URL + "/x")
+	defer second.Close()
+
+	chains, err := NewChainPolicy(ChainPolicyConfig{Shorteners: []string{"127.0.0.1"}})
+	assert.NoError(t, err)
+	s, err := NewURLShortener(ctx, zap.NewNop(), WithStorage(storage.NewInMemoryStorage()),
+		WithURLPolicy(nil), WithChainPolicy(chains))
+	assert.NoError(t, err)
+
+	_, err = s.Shorten(ctx, 1, first.URL+"/x")
+	assert.NoError(t, err)
+
+	var policyErr *PolicyError
+	_, err = s.Shorten(ctx, 1, second.URL+"/y")
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, PolicyRuleChainDepth, policyErr.Rule)
+}
+
+func TestBlocklist_Match(t *testing.T) {
+	dir := t.TempDir()
+	hash := sha256.Sum256([]byte("https://bad.example/login?u=1"))
+	files := map[string]string{
+		"hosts":    "# phishing\nphish.example\n10.1.0.0/16\n",
+		"prefixes": "HTTPS://Files.example:443/malware/\n",
+		"hashes":   hex.EncodeToString(hash[:]) + "\n",
+	}
+	for name, data := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+
+	b, err := NewBlocklist(BlocklistConfig{
+		HostsFile:    filepath.Join(dir, "hosts"),
+		PrefixesFile: filepath.Join(dir, "prefixes"),
+		HashesFile:   filepath.Join(dir, "hashes"),
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "http://login.PHISH.example/", want: BlocklistHosts},
+		{url: "http://10.1.2.3/", want: BlocklistHosts},
+		{url: "https://files.example/malware/x.exe", want: BlocklistPrefixes},
+		{url: "https://files.example/safe/x.exe", want: ""},
+		{url: "https://BAD.example/login?u=1#top", want: BlocklistHashes},
+		{url: "https://bad.example/login?u=2", want: ""},
+		{url: "https://ya.ru", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, b.Match(u))
+		})
+	}
+
+	changed, err := b.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "hosts"), []byte("ya.ru\n"), 0644))
+	changed, err = b.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	u, _ := url.Parse("https://ya.ru")
+	assert.Equal(t, BlocklistHosts, b.Match(u))
+
+	// Bad lists keep the loaded ones.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "hashes"), []byte("abcd\n"), 0644))
+	_, err = b.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, BlocklistHosts, b.Match(u))
+
+	_, err = NewBlocklist(BlocklistConfig{HostsFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+func TestURLShortener_Blocklist(t *testing.T) {
+	ctx := context.Background()
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	assert.NoError(t, os.WriteFile(hosts, []byte("phish.example\n"), 0644))
+	b, err := NewBlocklist(BlocklistConfig{HostsFile: hosts})
+	assert.NoError(t, err)
+
+	st := storage.NewInMemoryStorage()
+	added, err := st.AddURLs(ctx, 1, []string{"https://malware.example/x.exe", "https://ya.ru"})
+	assert.NoError(t, err)
+
+	// Background rescans are stopped, so the test runs them itself.
+	stopped, stop := context.WithCancel(ctx)
+	stop()
+	s, err := NewURLShortener(stopped, zap.NewNop(), WithStorage(st), WithBlocklist(b), WithURLBlocker(st))
+	assert.NoError(t, err)
+
+	var policyErr *PolicyError
+	_, err = s.Shorten(ctx, 1, "https://www.phish.example/login")
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, PolicyRuleBlocklist, policyErr.Rule)
+
+	results, err := s.BatchShorten(ctx, 1, []string{"https://phish.example", "https://vc.ru"}, BatchPartial)
+	assert.NoError(t, err)
+	assert.Equal(t, BatchInvalid, results[0].Status)
+	assert.Equal(t, BatchCreated, results[1].Status)
+
+	// Links added before a list has got their hosts are blocked by a rescan.
+	assert.NoError(t, os.WriteFile(hosts, []byte("phish.example\nmalware.example\n"), 0644))
+	changed, err := b.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	blocked, unblocked, err := s.RescanBlocklist(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, blocked)
+	assert.Equal(t, 0, unblocked)
+
+	_, err = s.OriginalURL(ctx, string(EncodeID(added[0].ID)))
+	assert.ErrorIs(t, err, storage.ErrBlocked)
+	_, err = s.OriginalURL(ctx, string(EncodeID(added[1].ID)))
+	assert.NoError(t, err)
+
+	// A false positive removed from a list is unblocked.
+	assert.NoError(t, os.WriteFile(hosts, []byte("phish.example\n"), 0644))
+	_, err = b.Reload()
+	assert.NoError(t, err)
+	blocked, unblocked, err = s.RescanBlocklist(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, blocked)
+	assert.Equal(t, 1, unblocked)
+	_, err = s.OriginalURL(ctx, string(EncodeID(added[0].ID)))
+	assert.NoError(t, err)
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewInMemoryStorage()
+
+	added, err := src.AddURLs(ctx, 1, []string{"https://ya.ru", "https://vc.ru"})
+	assert.NoError(t, err)
+	_, _, err = src.Add(ctx, 2, "https://habr.com/ru/all/?q=\"go\"&page=1")
+	assert.NoError(t, err)
+	blocked, _, err := src.Add(ctx, 2, "https://phish.example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, src.DeleteURLs(ctx, 1, []uint64{added[1].ID}))
+	assert.NoError(t, src.BlockURLs(ctx, []uint64{blocked}))
+
+	var backup strings.Builder
+	written, err := WriteBackup(ctx, src, &backup)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), written)
+	assert.True(t, strings.HasPrefix(backup.String(), `{"format":"go-url-shortener-backup","version":2,`))
+	assert.Contains(t, backup.String(), `"state":"blocked"`)
+
+	collect := func(st storage.URLBackup) map[uint64]storage.UserURL {
+		links := make(map[uint64]storage.UserURL)
+		assert.NoError(t, st.BackupURLs(ctx, func(link storage.UserURL) error {
+			links[link.ShortURLID] = link
+			return nil
+		}))
+		return links
+	}
+	expected := collect(src)
+
+	// Links move to another kind of storage with the same ids, owners, states and seconds of times.
+	filePath := filepath.Join(t.TempDir(), "storage")
+	dst, err := storage.NewFileStorage(filePath)
+	assert.NoError(t, err)
+	read, restored, err := RestoreBackup(ctx, dst.(storage.URLBackup), strings.NewReader(backup.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), read)
+	assert.Equal(t, uint64(4), restored)
+
+	// A second restore keeps existing links.
+	_, restored, err = RestoreBackup(ctx, dst.(storage.URLBackup), strings.NewReader(backup.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), restored)
+	assert.NoError(t, dst.Close())
+
+	dst, err = storage.NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer dst.Close()
+
+	actual := collect(dst.(storage.URLBackup))
+	assert.Len(t, actual, len(expected))
+	for id, link := range expected {
+		assert.Equal(t, link.UserID, actual[id].UserID)
+		assert.Equal(t, link.OriginalURL, actual[id].OriginalURL)
+		assert.Equal(t, link.Deleted, actual[id].Deleted)
+		assert.Equal(t, link.Blocked, actual[id].Blocked)
+		assert.Equal(t, link.Created.Unix(), actual[id].Created.Unix())
+		assert.Equal(t, link.DeletedAt.Unix(), actual[id].DeletedAt.Unix())
+	}
+
+	_, err = dst.Get(ctx, added[1].ID)
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	_, err = dst.Get(ctx, blocked)
+	assert.ErrorIs(t, err, storage.ErrBlocked)
+	original, err := dst.Get(ctx, added[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ya.ru", original)
+
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{
+			name: "Not a backup",
+			data: "{\"url\":\"https://ya.ru\"}\n",
+			err:  ErrBadBackup,
+		},
+		{
+			name: "Newer version",
+			data: "{\"format\":\"go-url-shortener-backup\",\"version\":3}\n",
+			err:  ErrBadBackup,
+		},
+		{
+			name: "Unknown state",
+			data: "{\"format\":\"go-url-shortener-backup\",\"version\":1}\n" +
+				"{\"user_id\":\"1\",\"short_url\":\"ZjRhMjc3OGQ1N2UyMWQzMw\",\"original_url\":\"https://ya.ru\",\"state\":\"gone\"}\n",
+			err: ErrBadBackup,
+		},
+		{
+			name: "Foreign short url",
+			data: "{\"format\":\"go-url-shortener-backup\",\"version\":1}\n" +
+				"{\"user_id\":\"1\",\"short_url\":\"ZjRhMjc3OGQ1N2UyMWQzMw\",\"original_url\":\"https://vc.ru\",\"state\":\"active\"}\n",
+			err: storage.ErrKeyMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restored, err := RestoreBackup(ctx, storage.NewInMemoryStorage(), strings.NewReader(tt.data))
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, uint64(0), restored)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultUserTokenTTL - lifetime of a user token, active users get their tokens refreshed before it ends.
+	DefaultUserTokenTTL = 90 * 24 * time.Hour
+
+	// UserTokenVersion - version of user tokens that are issued now.
+	UserTokenVersion = 1
+
+	// keyIDSize - size of a signing key id that follows a token version.
+	keyIDSize = 4
+	// claimsSize - size of a user id, issue and expiry times that precede scopes.
+	claimsSize = 3 * 8
+)
+
+var (
+	// ErrInvalidToken - a user token can't be accepted, it is wrapped by more specific errors.
+	ErrInvalidToken = errors.New("invalid user token")
+	// ErrTokenExpired - a user token is past its expiry time.
+	ErrTokenExpired = fmt.Errorf("%w: expired", ErrInvalidToken)
+	// ErrBadSignature - a user token has been tampered with or signed with an unknown key.
+	ErrBadSignature = fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	// ErrUnknownTokenVersion - a user token has a format this server doesn't know.
+	ErrUnknownTokenVersion = fmt.Errorf("%w: unknown version", ErrInvalidToken)
+	// ErrMalformedToken - a user token can't be decoded.
+	ErrMalformedToken = fmt.Errorf("%w: malformed", ErrInvalidToken)
+)
+
+// UserToken - claims of a user token.
+type UserToken struct {
+	UserID    uint64
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Scopes    []string
+}
+
+// NeedsRefresh returns true if less than a quarter of a token lifetime is left.
+func (t *UserToken) NeedsRefresh(now time.Time) bool {
+	return now.After(t.ExpiresAt.Add(-t.ExpiresAt.Sub(t.IssuedAt) / 4))
+}
+
+// HasScope returns true if a token has been issued with scope.
+func (t *UserToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// UserTokenTTL returns a lifetime of issued user tokens.
+func (u *URLShortener) UserTokenTTL() time.Duration {
+	return u.tokenTTL
+}
+
+// GetUserID decodes a user token. A new random id is generated if there is no token.
+func (u *URLShortener) GetUserID(rawValue *string) (uint64, bool, error) {
+	if rawValue == nil {
+		return newUserID()
+	}
+
+	token, err := u.ParseUserToken(*rawValue)
+	if err != nil {
+		return 0, false, err
+	}
+	return token.UserID, false, nil
+}
+
+// ParseUserToken verifies a user token and returns its claims.
+// Errors returned for tokens that can't be accepted wrap ErrInvalidToken.
+func (u *URLShortener) ParseUserToken(rawValue string) (*UserToken, error) {
+	encoder := base64.URLEncoding.WithPadding(base64.NoPadding)
+	data, err := encoder.DecodeString(rawValue)
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if len(data) < 1+keyIDSize {
+		return nil, ErrMalformedToken
+	}
+
+	if data[0] != UserTokenVersion {
+		return nil, ErrUnknownTokenVersion
+	}
+
+	key, ok := u.userKeys[binary.BigEndian.Uint32(data[1:1+keyIDSize])]
+	if !ok {
+		return nil, ErrBadSignature
+	}
+
+	hasher := hmac.New(sha256.New, key.secret)
+	header := 1 + keyIDSize
+
+	if len(data) < header+hasher.Size()+key.gcm.NonceSize()+key.gcm.Overhead()+claimsSize {
+		return nil, ErrMalformedToken
+	}
+
+	sign := data[header : header+hasher.Size()]
+	nonce := data[header+hasher.Size() : header+hasher.Size()+key.gcm.NonceSize()]
+	text := data[header+hasher.Size()+key.gcm.NonceSize():]
+
+	hasher.Write(data[:header])
+	hasher.Write(data[header+hasher.Size():])
+
+	if !hmac.Equal(sign, hasher.Sum(nil)) {
+		return nil, ErrBadSignature
+	}
+
+	claims, err := key.gcm.Open(nil, nonce, text, data[:header])
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+
+	token := &UserToken{
+		UserID:    binary.BigEndian.Uint64(claims[0:8]),
+		IssuedAt:  time.Unix(int64(binary.BigEndian.Uint64(claims[8:16])), 0).UTC(),
+		ExpiresAt: time.Unix(int64(binary.BigEndian.Uint64(claims[16:24])), 0).UTC(),
+	}
+	if len(claims) > claimsSize {
+		token.Scopes = strings.Split(string(claims[claimsSize:]), " ")
+	}
+
+	if !time.Now().Before(token.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// GenerateUserID creates a user token signed with the primary key.
+// The token is laid out as version | key id | HMAC(version | key id | nonce | cipher text) | nonce | cipher text,
+// the cipher text holds a user id, issue and expiry times and space separated scopes.
+func (u *URLShortener) GenerateUserID(userID uint64, scopes ...string) (*string, error) {
+	for _, s := range scopes {
+		if len(s) == 0 || strings.ContainsRune(s, ' ') {
+			return nil, fmt.Errorf("bad scope %q", s)
+		}
+	}
+
+	key := u.primaryKey
+	nonce := make([]byte, key.gcm.NonceSize())
+
+	readBytes, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if readBytes != len(nonce) {
+		return nil, errors.New("not enough entropy")
+	}
+
+	now := time.Now()
+	claims := make([]byte, claimsSize, claimsSize+len(strings.Join(scopes, " ")))
+	binary.BigEndian.PutUint64(claims[0:8], userID)
+	binary.BigEndian.PutUint64(claims[8:16], uint64(now.Unix()))
+	binary.BigEndian.PutUint64(claims[16:24], uint64(now.Add(u.tokenTTL).Unix()))
+	claims = append(claims, strings.Join(scopes, " ")...)
+
+	header := make([]byte, 1+keyIDSize)
+	header[0] = UserTokenVersion
+	binary.BigEndian.PutUint32(header[1:], key.id)
+
+	cipherText := key.gcm.Seal(nil, nonce, claims, header)
+	cipherText = append(nonce, cipherText...)
+
+	hasher := hmac.New(sha256.New, key.secret)
+	hasher.Write(header)
+	hasher.Write(cipherText)
+
+	token := append(header, hasher.Sum(nil)...)
+	token = append(token, cipherText...)
+	encoder := base64.URLEncoding.WithPadding(base64.NoPadding)
+	result := encoder.EncodeToString(token)
+	return &result, nil
+}
+
+func newUserID() (uint64, bool, error) {
+	id, err := cryptoRandUint64()
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	DefaultUserTopLinks = 5
+	// UserHistoryDays - number of days in user's creation history, the last one is the current day.
+	UserHistoryDays = 30
+)
+
+// UserStats - usage summary of a user account.
+type UserStats struct {
+	ActiveURLs  uint64
+	DeletedURLs uint64
+	// TotalClicks - clicks made by people on active user URLs.
+	TotalClicks uint64
+	// TopLinks - the most clicked active user URLs.
+	TopLinks []TopLink
+	// Created - number of URLs created by the user per day.
+	Created []storage.TimeBucket
+}
+
+// UserStats returns usage summary of a user. A user without URLs gets empty statistics.
+func (u *URLShortener) UserStats(ctx context.Context, userID uint64) (*UserStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, StorageOperationTimeout)
+	defer cancel()
+
+	userData, err := u.urlStorage.GetUserData(ctx, userID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	to := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	from := to.Add(-UserHistoryDays * 24 * time.Hour)
+	result := &UserStats{
+		ActiveURLs: uint64(len(userData)),
+		TopLinks:   make([]TopLink, 0),
+	}
+
+	var created []storage.TimeBucket
+	if u.stat != nil {
+		if result.DeletedURLs, err = u.stat.UserDeletedURLs(ctx, userID); err != nil {
+			return nil, err
+		}
+
+		if created, err = u.stat.UserCreatedURLs(ctx, userID, from, to, 24*time.Hour); err != nil {
+			return nil, err
+		}
+	}
+	result.Created = fillSeries(from, 24*time.Hour, UserHistoryDays, created)
+
+	if u.clickStat == nil || len(userData) == 0 {
+		return result, nil
+	}
+
+	ids := make([]uint64, len(userData))
+	for i, d := range userData {
+		ids[i] = d.ShortURLID
+	}
+
+	clicks, err := u.clickStat.LinksClicks(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	top := make([]storage.TopLink, 0, len(clicks))
+	for _, d := range userData {
+		count := clicks[d.ShortURLID]
+		result.TotalClicks += count
+		if count != 0 {
+			top = append(top, storage.TopLink{
+				ID:          d.ShortURLID,
+				OriginalURL: d.OriginalURL,
+				Clicks:      count,
+			})
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Clicks != top[j].Clicks {
+			return top[i].Clicks > top[j].Clicks
+		}
+		return top[i].ID < top[j].ID
+	})
+	if len(top) > DefaultUserTopLinks {
+		top = top[:DefaultUserTopLinks]
+	}
+
+	for _, t := range top {
+		result.TopLinks = append(result.TopLinks, TopLink{
+			Key:         EncodeID(t.ID),
+			OriginalURL: t.OriginalURL,
+			Clicks:      t.Clicks,
+		})
+	}
+
+	return result, nil
+}
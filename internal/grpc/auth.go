@@ -0,0 +1,169 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/logging"
+)
+
+const (
+	// AuthorizationMetadata - gRPC metadata key with an API key in the "Bearer <key>" form.
+	AuthorizationMetadata = "authorization"
+	// UserTokenMetadata - gRPC metadata key with a user token. Servers send new and refreshed tokens
+	// in a response header with the same key.
+	UserTokenMetadata = "user-token"
+	// StrictAuthMetadata - gRPC metadata key a client sets to "true" to get Unauthenticated for a user token
+	// that isn't accepted instead of a new user.
+	StrictAuthMetadata = "strict-auth"
+)
+
+// publicMethods - calls that don't act on behalf of a user, so no user is resolved or generated for them.
+var publicMethods = map[string]bool{
+	"/shortener.UrlShortener/GetURL": true,
+	"/shortener.UrlShortener/Stat":   true,
+	"/shortener.UrlShortener/Ping":   true,
+}
+
+// callUser - a user a call is made by.
+type callUser struct {
+	ID uint64
+	// Generated - a user has come without credentials and has got a new id.
+	Generated bool
+}
+
+type userContextKey struct{}
+
+// legacyUserRequest - a request with a user token in a deprecated user_id field.
+type legacyUserRequest interface {
+	GetUserId() string
+}
+
+// AuthInterceptor resolves a user of a call once and puts it into a call context.
+// A user is read from an API key, a user token in metadata or, for older clients, a user_id request field.
+// A user without credentials or with a token that isn't accepted gets a new id, like HTTP clients do.
+// New and soon to expire tokens are sent back in a user-token header.
+func (s *Server) AuthInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if publicMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		user, err := s.authenticate(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		logging.SetUserID(ctx, user.ID)
+		return handler(context.WithValue(ctx, userContextKey{}, user), req)
+	}
+}
+
+// StreamAuthInterceptor does for streaming calls what AuthInterceptor does for unary ones.
+// Streams have no user_id fields, so older clients without metadata credentials get a new user.
+func (s *Server) StreamAuthInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if publicMethods[info.FullMethod] {
+			return handler(srv, ss)
+		}
+
+		ctx := ss.Context()
+		user, err := s.authenticate(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		logging.SetUserID(ctx, user.ID)
+		return handler(srv, &contextStream{ServerStream: ss, ctx: context.WithValue(ctx, userContextKey{}, user)})
+	}
+}
+
+func (s *Server) authenticate(ctx context.Context, req interface{}) (*callUser, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if values := md.Get(AuthorizationMetadata); len(values) != 0 {
+		key := strings.TrimPrefix(values[0], "Bearer ")
+		userID, err := s.shortener.AuthenticateAPIKey(ctx, key)
+		if err != nil {
+			return nil, s.statusError(ctx, err, errorSubject{})
+		}
+
+		return &callUser{ID: userID}, nil
+	}
+
+	var rawToken string
+	if values := md.Get(UserTokenMetadata); len(values) != 0 {
+		rawToken = values[0]
+	} else if legacy, ok := req.(legacyUserRequest); ok {
+		rawToken = legacy.GetUserId()
+	}
+
+	if len(rawToken) == 0 {
+		return s.newUser(ctx)
+	}
+
+	token, err := s.shortener.AuthenticateUser(ctx, rawToken)
+	if errors.Is(err, app.ErrInvalidToken) && !isStrictAuth(md) {
+		s.requestLogger(ctx).Info("user token isn't accepted", zap.Error(err))
+		return s.newUser(ctx)
+	} else if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{})
+	}
+
+	user := &callUser{ID: token.UserID}
+	if token.NeedsRefresh(time.Now()) {
+		return user, s.sendUserToken(ctx, user.ID, token.Scopes...)
+	}
+	return user, nil
+}
+
+// newUser generates a user for a call and sends its token.
+func (s *Server) newUser(ctx context.Context) (*callUser, error) {
+	userID, _, err := s.shortener.GetUserID(nil)
+	if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{})
+	}
+
+	user := &callUser{ID: userID, Generated: true}
+	return user, s.sendUserToken(ctx, user.ID)
+}
+
+func isStrictAuth(md metadata.MD) bool {
+	values := md.Get(StrictAuthMetadata)
+	return len(values) != 0 && values[0] == "true"
+}
+
+// sendUserToken sets a user-token response header.
+func (s *Server) sendUserToken(ctx context.Context, userID uint64, scopes ...string) error {
+	token, err := s.shortener.GenerateUserID(userID, scopes...)
+	if err != nil {
+		return s.statusError(ctx, err, errorSubject{})
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(UserTokenMetadata, *token)); err != nil {
+		s.requestLogger(ctx).Error("failed to set user token header", zap.Error(err))
+	}
+	return nil
+}
+
+// currentUser returns a user resolved by AuthInterceptor. A server without the interceptor resolves a user per call.
+func (s *Server) currentUser(ctx context.Context, req interface{}) (*callUser, error) {
+	if user, ok := ctx.Value(userContextKey{}).(*callUser); ok {
+		return user, nil
+	}
+
+	user, err := s.authenticate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.SetUserID(ctx, user.ID)
+	return user, nil
+}
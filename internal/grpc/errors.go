@@ -0,0 +1,181 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// ShortURLResource - a resource type of short URLs in error details.
+	ShortURLResource = "short_url"
+	// APIKeyResource - a resource type of API keys in error details.
+	APIKeyResource = "api_key"
+
+	// DeletedViolation - a precondition violation type of calls about deleted short URLs.
+	DeletedViolation = "DELETED"
+	// BlockedViolation - a precondition violation type of calls about short URLs with malicious destinations.
+	BlockedViolation = "BLOCKED"
+	// IdempotencyKeyReusedViolation - a precondition violation type of calls with a key of another call.
+	IdempotencyKeyReusedViolation = "IDEMPOTENCY_KEY_REUSED"
+
+	// ErrorDomain - a domain of error infos.
+	ErrorDomain = "github.com/r4start/go-url-shortener"
+	// ForbiddenURLReason - an error info reason of URLs the URL policy forbids, a "rule" metadata names the rule.
+	ForbiddenURLReason = "FORBIDDEN_URL"
+)
+
+// errorSubject - what a failed call is about, it is used to fill error details.
+type errorSubject struct {
+	// Field - a request field validation errors refer to.
+	Field string
+	// ResourceType and ResourceName identify a resource that is missing, deleted or already exists.
+	ResourceType string
+	ResourceName string
+}
+
+// statusError maps an application error to a gRPC status with error details.
+// Unexpected errors are logged and reported as Internal without a reason.
+func (s *Server) statusError(ctx context.Context, err error, subject errorSubject) error {
+	var st *status.Status
+	details := make([]protoiface.MessageV1, 0, 2)
+
+	var batchErr *app.BatchError
+	var policyErr *app.PolicyError
+	switch {
+	case errors.As(err, &batchErr):
+		st = status.New(codes.InvalidArgument, err.Error())
+		violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(batchErr.Items))
+		for _, item := range batchErr.Items {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("urls[%d].url", item.Index),
+				Description: item.Err.Error(),
+			})
+		}
+		details = append(details, &errdetails.BadRequest{FieldViolations: violations})
+
+	case errors.As(err, &policyErr):
+		st = status.New(codes.InvalidArgument, err.Error())
+		if len(subject.Field) != 0 {
+			details = append(details, &errdetails.BadRequest{
+				FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+					Field:       subject.Field,
+					Description: err.Error(),
+				}},
+			})
+		}
+		details = append(details, &errdetails.ErrorInfo{
+			Reason:   ForbiddenURLReason,
+			Domain:   ErrorDomain,
+			Metadata: map[string]string{"rule": policyErr.Rule},
+		})
+
+	case errors.Is(err, app.ErrBadURL), errors.Is(err, app.ErrBadShortID), errors.Is(err, app.ErrBadStatsQuery),
+		errors.Is(err, app.ErrBadAPIKeyName):
+		st = status.New(codes.InvalidArgument, err.Error())
+		if len(subject.Field) != 0 {
+			details = append(details, &errdetails.BadRequest{
+				FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+					Field:       subject.Field,
+					Description: err.Error(),
+				}},
+			})
+		}
+
+	case errors.Is(err, storage.ErrNotFound):
+		st = status.New(codes.NotFound, "not found")
+		details = subject.appendResourceInfo(details, "not found")
+
+	case errors.Is(err, storage.ErrDeleted):
+		st = status.New(codes.FailedPrecondition, "deleted")
+		details = subject.appendResourceInfo(details, "deleted")
+		details = append(details, &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        DeletedViolation,
+				Subject:     subject.ResourceName,
+				Description: "the short url has been deleted by its owner",
+			}},
+		})
+
+	case errors.Is(err, storage.ErrBlocked):
+		st = status.New(codes.FailedPrecondition, "blocked")
+		details = subject.appendResourceInfo(details, "blocked")
+		details = append(details, &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        BlockedViolation,
+				Subject:     subject.ResourceName,
+				Description: "the short url has been blocked as malicious",
+			}},
+		})
+
+	case errors.Is(err, app.ErrBadIdempotencyKey):
+		st = status.New(codes.InvalidArgument, err.Error())
+
+	case errors.Is(err, app.ErrIdempotencyInProgress):
+		st = status.New(codes.Aborted, err.Error())
+
+	case errors.Is(err, app.ErrIdempotencyKeyReused):
+		st = status.New(codes.FailedPrecondition, err.Error())
+		details = append(details, &errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        IdempotencyKeyReusedViolation,
+				Subject:     IdempotencyKeyMetadata,
+				Description: "the key has been used for a call with another request",
+			}},
+		})
+
+	case errors.Is(err, app.ErrTooManyAPIKeys):
+		st = status.New(codes.ResourceExhausted, err.Error())
+		details = append(details, &errdetails.QuotaFailure{
+			Violations: []*errdetails.QuotaFailure_Violation{{
+				Subject:     APIKeyResource,
+				Description: fmt.Sprintf("at most %d active api keys are allowed", app.MaxUserAPIKeys),
+			}},
+		})
+
+	case errors.Is(err, app.ErrInvalidToken), errors.Is(err, app.ErrInvalidAPIKey):
+		st = status.New(codes.Unauthenticated, err.Error())
+
+	case errors.Is(err, app.ErrAPIKeysUnsupported), errors.Is(err, app.ErrExportUnsupported):
+		st = status.New(codes.Unimplemented, err.Error())
+
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		st = status.FromContextError(err)
+
+	default:
+		s.requestLogger(ctx).Error("call failed", zap.Error(err))
+		st = status.New(codes.Internal, "internal error")
+	}
+
+	if len(details) == 0 {
+		return st.Err()
+	}
+
+	detailed, detailsErr := st.WithDetails(details...)
+	if detailsErr != nil {
+		s.requestLogger(ctx).Error("failed to attach error details", zap.Error(detailsErr))
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// appendResourceInfo adds resource info if a call is about a particular resource.
+func (e errorSubject) appendResourceInfo(details []protoiface.MessageV1, description string) []protoiface.MessageV1 {
+	if len(e.ResourceName) == 0 {
+		return details
+	}
+	return append(details, &errdetails.ResourceInfo{
+		ResourceType: e.ResourceType,
+		ResourceName: e.ResourceName,
+		Description:  description,
+	})
+}
@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	pb "github.com/r4start/go-url-shortener/internal/grpc/proto"
+)
+
+const (
+	// IdempotencyKeyMetadata - gRPC metadata key with a client chosen key, retries of a call with the same key
+	// get the response of the first one.
+	IdempotencyKeyMetadata = "idempotency-key"
+	// IdempotentReplayedMetadata - a response header set on replayed responses.
+	IdempotentReplayedMetadata = "idempotent-replayed"
+)
+
+// idempotentMethods - calls that accept idempotency keys and constructors of their responses.
+var idempotentMethods = map[string]func() proto.Message{
+	"/shortener.UrlShortener/Shorten":      func() proto.Message { return &pb.ShortenerResponse{} },
+	"/shortener.UrlShortener/BatchShorten": func() proto.Message { return &pb.BatchResponse{} },
+}
+
+// IdempotencyInterceptor replays a saved response to a call with an idempotency-key metadata that has been
+// made before. Only successful responses are saved. It must run after AuthInterceptor,
+// keys of users without credentials are ignored.
+func (s *Server) IdempotencyInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		newResponse, ok := idempotentMethods[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		keys := md.Get(IdempotencyKeyMetadata)
+		user, _ := ctx.Value(userContextKey{}).(*callUser)
+		if len(keys) == 0 || user == nil || user.Generated {
+			return handler(ctx, req)
+		}
+		key := keys[0]
+
+		fingerprint, err := callFingerprint(info.FullMethod, req)
+		if err != nil {
+			return nil, s.statusError(ctx, err, errorSubject{})
+		}
+
+		saved, err := s.shortener.BeginIdempotent(ctx, user.ID, key, fingerprint)
+		if err != nil {
+			return nil, s.statusError(ctx, err, errorSubject{})
+		}
+		if saved != nil {
+			resp := newResponse()
+			if err := proto.Unmarshal(saved.Body, resp); err != nil {
+				return nil, s.statusError(ctx, err, errorSubject{})
+			}
+			if err := grpc.SetHeader(ctx, metadata.Pairs(IdempotentReplayedMetadata, "true")); err != nil {
+				s.requestLogger(ctx).Error("failed to set idempotency header", zap.Error(err))
+			}
+			return resp, nil
+		}
+
+		resp, err := handler(ctx, req)
+		var body []byte
+		if err == nil {
+			body, err = proto.Marshal(resp.(proto.Message))
+		}
+		if err != nil {
+			if abortErr := s.shortener.AbortIdempotent(ctx, user.ID, key); abortErr != nil {
+				s.requestLogger(ctx).Error("failed to release idempotency key", zap.Error(abortErr))
+			}
+			return resp, err
+		}
+
+		if err := s.shortener.CompleteIdempotent(ctx, user.ID, key, &app.IdempotentResponse{
+			Status: int(codes.OK),
+			Body:   body,
+		}); err != nil {
+			s.requestLogger(ctx).Error("failed to save idempotent response", zap.Error(err))
+		}
+		return resp, nil
+	}
+}
+
+// callFingerprint hashes a method and a request, so a key can't be reused for another call.
+// A deprecated user_id field is a credential rather than a part of a call, a refreshed token mustn't
+// turn a retry into another call, so it is left out.
+func callFingerprint(method string, req interface{}) ([]byte, error) {
+	msg := proto.Clone(req.(proto.Message)).ProtoReflect()
+	if field := msg.Descriptor().Fields().ByName("user_id"); field != nil {
+		msg.Clear(field)
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	hasher.Write([]byte(method))
+	hasher.Write([]byte{0})
+	hasher.Write(data)
+	return hasher.Sum(nil), nil
+}
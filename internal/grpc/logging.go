@@ -0,0 +1,77 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/r4start/go-url-shortener/pkg/logging"
+)
+
+// LoggingInterceptor assigns a request id, attaches a request-scoped logger to a call context
+// and writes an access log line when a call is done.
+func LoggingInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		ctx, request := startCallLogging(ctx, logger)
+
+		resp, err := handler(ctx, req)
+
+		fields := callLogFields(info.FullMethod, err, start, request)
+		if m, ok := resp.(proto.Message); ok && err == nil {
+			fields = append(fields, zap.Int("bytes", proto.Size(m)))
+		}
+		logging.FromContext(ctx, logger).Info("request", fields...)
+
+		return resp, err
+	}
+}
+
+// StreamLoggingInterceptor does for streaming calls what LoggingInterceptor does for unary ones.
+func StreamLoggingInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx, request := startCallLogging(ss.Context(), logger)
+
+		err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+
+		logging.FromContext(ctx, logger).Info("request", callLogFields(info.FullMethod, err, start, request)...)
+
+		return err
+	}
+}
+
+// startCallLogging accepts a request id from metadata or generates one and sends it back in a response header.
+func startCallLogging(ctx context.Context, logger *zap.Logger) (context.Context, *logging.Request) {
+	var requestID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(logging.RequestIDMetadata); len(values) != 0 {
+			requestID = values[0]
+		}
+	}
+	requestID = logging.AcceptRequestID(requestID)
+
+	ctx, request := logging.NewContext(ctx, logger, requestID)
+	if err := grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDMetadata, requestID)); err != nil {
+		logging.FromContext(ctx, logger).Error("failed to set request id header", zap.Error(err))
+	}
+
+	return ctx, request
+}
+
+func callLogFields(method string, err error, start time.Time, request *logging.Request) []zap.Field {
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("latency", time.Since(start)),
+	}
+	if userID, ok := request.UserID(); ok {
+		fields = append(fields, zap.Uint64("user_id", userID))
+	}
+	return fields
+}
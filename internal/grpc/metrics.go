@@ -0,0 +1,57 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/r4start/go-url-shortener/pkg/metrics"
+)
+
+// CallMetrics - metrics of completed gRPC calls by a full method name and a status code.
+type CallMetrics struct {
+	handled *metrics.CounterVec
+	latency *metrics.HistogramVec
+}
+
+// NewCallMetrics registers call metrics, interceptors of unary and streaming calls share them.
+func NewCallMetrics(registry *metrics.Registry) *CallMetrics {
+	return &CallMetrics{
+		handled: registry.NewCounterVec("grpc_server_handled_total",
+			"Number of completed gRPC calls by method and status code.", "method", "code"),
+		latency: registry.NewHistogramVec("grpc_server_handling_seconds",
+			"gRPC call latencies by method.", metrics.DefaultBuckets, "method"),
+	}
+}
+
+// MetricsInterceptor accounts unary calls by a full method name and a status code.
+func MetricsInterceptor(registry *metrics.Registry) grpc.UnaryServerInterceptor {
+	return NewCallMetrics(registry).UnaryInterceptor()
+}
+
+// UnaryInterceptor accounts unary calls.
+func (m *CallMetrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamInterceptor accounts streaming calls, a latency is a lifetime of a stream.
+func (m *CallMetrics) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		m.observe(info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (m *CallMetrics) observe(method string, start time.Time, err error) {
+	m.handled.Inc(method, status.Code(err).String())
+	m.latency.Observe(time.Since(start).Seconds(), method)
+}
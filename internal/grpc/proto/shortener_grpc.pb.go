@@ -24,9 +24,16 @@ const _ = grpc.SupportPackageIsVersion7
 type UrlShortenerClient interface {
 	Shorten(ctx context.Context, in *ShortenerRequest, opts ...grpc.CallOption) (*ShortenerResponse, error)
 	BatchShorten(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	StreamBatchShorten(ctx context.Context, opts ...grpc.CallOption) (UrlShortener_StreamBatchShortenClient, error)
 	GetURL(ctx context.Context, in *ShortenerRequest, opts ...grpc.CallOption) (*ShortenerResponse, error)
 	ListUserUrls(ctx context.Context, in *ListUserUrlsRequest, opts ...grpc.CallOption) (*ListUserUrlsResponse, error)
+	ExportUserUrls(ctx context.Context, in *ExportUserUrlsRequest, opts ...grpc.CallOption) (UrlShortener_ExportUserUrlsClient, error)
 	DeleteUserUrls(ctx context.Context, in *DeleteUserUrlsRequest, opts ...grpc.CallOption) (*DeleteUserUrlsResponse, error)
+	GetLinkStats(ctx context.Context, in *LinkStatsRequest, opts ...grpc.CallOption) (*LinkStatsResponse, error)
+	GetUserStats(ctx context.Context, in *UserStatsRequest, opts ...grpc.CallOption) (*UserStatsResponse, error)
+	CreateAPIKey(ctx context.Context, in *CreateAPIKeyRequest, opts ...grpc.CallOption) (*CreateAPIKeyResponse, error)
+	ListAPIKeys(ctx context.Context, in *ListAPIKeysRequest, opts ...grpc.CallOption) (*ListAPIKeysResponse, error)
+	RevokeAPIKey(ctx context.Context, in *RevokeAPIKeyRequest, opts ...grpc.CallOption) (*RevokeAPIKeyResponse, error)
 	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
 	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
 }
@@ -57,6 +64,37 @@ func (c *urlShortenerClient) BatchShorten(ctx context.Context, in *BatchRequest,
 	return out, nil
 }
 
+func (c *urlShortenerClient) StreamBatchShorten(ctx context.Context, opts ...grpc.CallOption) (UrlShortener_StreamBatchShortenClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UrlShortener_ServiceDesc.Streams[0], "/shortener.UrlShortener/StreamBatchShorten", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &urlShortenerStreamBatchShortenClient{stream}
+	return x, nil
+}
+
+type UrlShortener_StreamBatchShortenClient interface {
+	Send(*StreamBatchRequest) error
+	Recv() (*StreamBatchResponse, error)
+	grpc.ClientStream
+}
+
+type urlShortenerStreamBatchShortenClient struct {
+	grpc.ClientStream
+}
+
+func (x *urlShortenerStreamBatchShortenClient) Send(m *StreamBatchRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *urlShortenerStreamBatchShortenClient) Recv() (*StreamBatchResponse, error) {
+	m := new(StreamBatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *urlShortenerClient) GetURL(ctx context.Context, in *ShortenerRequest, opts ...grpc.CallOption) (*ShortenerResponse, error) {
 	out := new(ShortenerResponse)
 	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/GetURL", in, out, opts...)
@@ -75,6 +113,38 @@ func (c *urlShortenerClient) ListUserUrls(ctx context.Context, in *ListUserUrlsR
 	return out, nil
 }
 
+func (c *urlShortenerClient) ExportUserUrls(ctx context.Context, in *ExportUserUrlsRequest, opts ...grpc.CallOption) (UrlShortener_ExportUserUrlsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UrlShortener_ServiceDesc.Streams[1], "/shortener.UrlShortener/ExportUserUrls", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &urlShortenerExportUserUrlsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type UrlShortener_ExportUserUrlsClient interface {
+	Recv() (*ExportedUrl, error)
+	grpc.ClientStream
+}
+
+type urlShortenerExportUserUrlsClient struct {
+	grpc.ClientStream
+}
+
+func (x *urlShortenerExportUserUrlsClient) Recv() (*ExportedUrl, error) {
+	m := new(ExportedUrl)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *urlShortenerClient) DeleteUserUrls(ctx context.Context, in *DeleteUserUrlsRequest, opts ...grpc.CallOption) (*DeleteUserUrlsResponse, error) {
 	out := new(DeleteUserUrlsResponse)
 	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/DeleteUserUrls", in, out, opts...)
@@ -84,6 +154,51 @@ func (c *urlShortenerClient) DeleteUserUrls(ctx context.Context, in *DeleteUserU
 	return out, nil
 }
 
+func (c *urlShortenerClient) GetLinkStats(ctx context.Context, in *LinkStatsRequest, opts ...grpc.CallOption) (*LinkStatsResponse, error) {
+	out := new(LinkStatsResponse)
+	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/GetLinkStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) GetUserStats(ctx context.Context, in *UserStatsRequest, opts ...grpc.CallOption) (*UserStatsResponse, error) {
+	out := new(UserStatsResponse)
+	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/GetUserStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) CreateAPIKey(ctx context.Context, in *CreateAPIKeyRequest, opts ...grpc.CallOption) (*CreateAPIKeyResponse, error) {
+	out := new(CreateAPIKeyResponse)
+	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/CreateAPIKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) ListAPIKeys(ctx context.Context, in *ListAPIKeysRequest, opts ...grpc.CallOption) (*ListAPIKeysResponse, error) {
+	out := new(ListAPIKeysResponse)
+	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/ListAPIKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) RevokeAPIKey(ctx context.Context, in *RevokeAPIKeyRequest, opts ...grpc.CallOption) (*RevokeAPIKeyResponse, error) {
+	out := new(RevokeAPIKeyResponse)
+	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/RevokeAPIKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *urlShortenerClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
 	out := new(StatResponse)
 	err := c.cc.Invoke(ctx, "/shortener.UrlShortener/Stat", in, out, opts...)
@@ -108,9 +223,16 @@ func (c *urlShortenerClient) Ping(ctx context.Context, in *PingRequest, opts ...
 type UrlShortenerServer interface {
 	Shorten(context.Context, *ShortenerRequest) (*ShortenerResponse, error)
 	BatchShorten(context.Context, *BatchRequest) (*BatchResponse, error)
+	StreamBatchShorten(UrlShortener_StreamBatchShortenServer) error
 	GetURL(context.Context, *ShortenerRequest) (*ShortenerResponse, error)
 	ListUserUrls(context.Context, *ListUserUrlsRequest) (*ListUserUrlsResponse, error)
+	ExportUserUrls(*ExportUserUrlsRequest, UrlShortener_ExportUserUrlsServer) error
 	DeleteUserUrls(context.Context, *DeleteUserUrlsRequest) (*DeleteUserUrlsResponse, error)
+	GetLinkStats(context.Context, *LinkStatsRequest) (*LinkStatsResponse, error)
+	GetUserStats(context.Context, *UserStatsRequest) (*UserStatsResponse, error)
+	CreateAPIKey(context.Context, *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error)
+	ListAPIKeys(context.Context, *ListAPIKeysRequest) (*ListAPIKeysResponse, error)
+	RevokeAPIKey(context.Context, *RevokeAPIKeyRequest) (*RevokeAPIKeyResponse, error)
 	Stat(context.Context, *StatRequest) (*StatResponse, error)
 	Ping(context.Context, *PingRequest) (*PingResponse, error)
 	mustEmbedUnimplementedUrlShortenerServer()
@@ -126,15 +248,36 @@ func (UnimplementedUrlShortenerServer) Shorten(context.Context, *ShortenerReques
 func (UnimplementedUrlShortenerServer) BatchShorten(context.Context, *BatchRequest) (*BatchResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method BatchShorten not implemented")
 }
+func (UnimplementedUrlShortenerServer) StreamBatchShorten(UrlShortener_StreamBatchShortenServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamBatchShorten not implemented")
+}
 func (UnimplementedUrlShortenerServer) GetURL(context.Context, *ShortenerRequest) (*ShortenerResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetURL not implemented")
 }
 func (UnimplementedUrlShortenerServer) ListUserUrls(context.Context, *ListUserUrlsRequest) (*ListUserUrlsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListUserUrls not implemented")
 }
+func (UnimplementedUrlShortenerServer) ExportUserUrls(*ExportUserUrlsRequest, UrlShortener_ExportUserUrlsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportUserUrls not implemented")
+}
 func (UnimplementedUrlShortenerServer) DeleteUserUrls(context.Context, *DeleteUserUrlsRequest) (*DeleteUserUrlsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserUrls not implemented")
 }
+func (UnimplementedUrlShortenerServer) GetLinkStats(context.Context, *LinkStatsRequest) (*LinkStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLinkStats not implemented")
+}
+func (UnimplementedUrlShortenerServer) GetUserStats(context.Context, *UserStatsRequest) (*UserStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserStats not implemented")
+}
+func (UnimplementedUrlShortenerServer) CreateAPIKey(context.Context, *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAPIKey not implemented")
+}
+func (UnimplementedUrlShortenerServer) ListAPIKeys(context.Context, *ListAPIKeysRequest) (*ListAPIKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAPIKeys not implemented")
+}
+func (UnimplementedUrlShortenerServer) RevokeAPIKey(context.Context, *RevokeAPIKeyRequest) (*RevokeAPIKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeAPIKey not implemented")
+}
 func (UnimplementedUrlShortenerServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
 }
@@ -190,6 +333,32 @@ func _UrlShortener_BatchShorten_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UrlShortener_StreamBatchShorten_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UrlShortenerServer).StreamBatchShorten(&urlShortenerStreamBatchShortenServer{stream})
+}
+
+type UrlShortener_StreamBatchShortenServer interface {
+	Send(*StreamBatchResponse) error
+	Recv() (*StreamBatchRequest, error)
+	grpc.ServerStream
+}
+
+type urlShortenerStreamBatchShortenServer struct {
+	grpc.ServerStream
+}
+
+func (x *urlShortenerStreamBatchShortenServer) Send(m *StreamBatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *urlShortenerStreamBatchShortenServer) Recv() (*StreamBatchRequest, error) {
+	m := new(StreamBatchRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _UrlShortener_GetURL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ShortenerRequest)
 	if err := dec(in); err != nil {
@@ -226,6 +395,27 @@ func _UrlShortener_ListUserUrls_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UrlShortener_ExportUserUrls_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportUserUrlsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UrlShortenerServer).ExportUserUrls(m, &urlShortenerExportUserUrlsServer{stream})
+}
+
+type UrlShortener_ExportUserUrlsServer interface {
+	Send(*ExportedUrl) error
+	grpc.ServerStream
+}
+
+type urlShortenerExportUserUrlsServer struct {
+	grpc.ServerStream
+}
+
+func (x *urlShortenerExportUserUrlsServer) Send(m *ExportedUrl) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _UrlShortener_DeleteUserUrls_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(DeleteUserUrlsRequest)
 	if err := dec(in); err != nil {
@@ -244,6 +434,96 @@ func _UrlShortener_DeleteUserUrls_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UrlShortener_GetLinkStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LinkStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).GetLinkStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.UrlShortener/GetLinkStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).GetLinkStats(ctx, req.(*LinkStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_GetUserStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).GetUserStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.UrlShortener/GetUserStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).GetUserStats(ctx, req.(*UserStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_CreateAPIKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateAPIKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).CreateAPIKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.UrlShortener/CreateAPIKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).CreateAPIKey(ctx, req.(*CreateAPIKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_ListAPIKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAPIKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).ListAPIKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.UrlShortener/ListAPIKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).ListAPIKeys(ctx, req.(*ListAPIKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_RevokeAPIKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeAPIKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).RevokeAPIKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/shortener.UrlShortener/RevokeAPIKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).RevokeAPIKey(ctx, req.(*RevokeAPIKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _UrlShortener_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(StatRequest)
 	if err := dec(in); err != nil {
@@ -307,6 +587,26 @@ var UrlShortener_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DeleteUserUrls",
 			Handler:    _UrlShortener_DeleteUserUrls_Handler,
 		},
+		{
+			MethodName: "GetLinkStats",
+			Handler:    _UrlShortener_GetLinkStats_Handler,
+		},
+		{
+			MethodName: "GetUserStats",
+			Handler:    _UrlShortener_GetUserStats_Handler,
+		},
+		{
+			MethodName: "CreateAPIKey",
+			Handler:    _UrlShortener_CreateAPIKey_Handler,
+		},
+		{
+			MethodName: "ListAPIKeys",
+			Handler:    _UrlShortener_ListAPIKeys_Handler,
+		},
+		{
+			MethodName: "RevokeAPIKey",
+			Handler:    _UrlShortener_RevokeAPIKey_Handler,
+		},
 		{
 			MethodName: "Stat",
 			Handler:    _UrlShortener_Stat_Handler,
@@ -316,6 +616,18 @@ var UrlShortener_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _UrlShortener_Ping_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamBatchShorten",
+			Handler:       _UrlShortener_StreamBatchShorten_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ExportUserUrls",
+			Handler:       _UrlShortener_ExportUserUrls_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "proto/shortener.proto",
 }
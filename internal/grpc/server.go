@@ -4,17 +4,20 @@ import (
 	"context"
 	"errors"
 	"net"
-	"net/http"
+	"time"
 
 	"github.com/r4start/go-url-shortener/pkg/storage"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	"github.com/r4start/go-url-shortener/internal/app"
 	pb "github.com/r4start/go-url-shortener/internal/grpc/proto"
+	"github.com/r4start/go-url-shortener/pkg/logging"
 )
 
 type Server struct {
@@ -36,38 +39,43 @@ func NewServer(shortener *app.URLShortener, domain string, logger *zap.Logger, s
 }
 
 func (s *Server) Shorten(ctx context.Context, req *pb.ShortenerRequest) (*pb.ShortenerResponse, error) {
-	userID, _, err := s.shortener.GetUserID(req.UserId)
+	user, err := s.currentUser(ctx, req)
 	if err != nil {
-		s.logger.Error("failed to get user id", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		return nil, err
 	}
 
-	r, err := s.shortener.Shorten(ctx, userID, req.Url)
+	r, err := s.shortener.Shorten(ctx, user.ID, req.Url)
 	if err != nil {
-		s.logger.Error("failed to generate short id", zap.Error(err))
-		return nil, status.Error(codes.InvalidArgument, "")
+		return nil, s.statusError(ctx, err, errorSubject{Field: "url"})
 	}
 
 	if r.Exists {
-		return nil, status.Error(codes.AlreadyExists, "")
+		st, err := status.New(codes.AlreadyExists, "already exists").WithDetails(&errdetails.ResourceInfo{
+			ResourceType: ShortURLResource,
+			ResourceName: string(r.Key),
+			Description:  "the url has already been shortened",
+		})
+		if err != nil {
+			return nil, status.Error(codes.AlreadyExists, "already exists")
+		}
+		return nil, st.Err()
 	}
 
 	res := &pb.ShortenerResponse{Url: string(r.Key)}
 
-	res.UserId, err = s.shortener.GenerateUserID(userID)
+	// The deprecated field is still filled for clients that don't read user-token headers.
+	res.UserId, err = s.shortener.GenerateUserID(user.ID)
 	if err != nil {
-		s.logger.Error("failed to generate user id", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		return nil, s.statusError(ctx, err, errorSubject{})
 	}
 
 	return res, nil
 }
 
 func (s *Server) BatchShorten(ctx context.Context, req *pb.BatchRequest) (*pb.BatchResponse, error) {
-	userID, _, err := s.shortener.GetUserID(req.UserId)
+	user, err := s.currentUser(ctx, req)
 	if err != nil {
-		s.logger.Error("failed to get user id", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		return nil, err
 	}
 
 	urls := make([]string, len(req.Urls))
@@ -75,56 +83,78 @@ func (s *Server) BatchShorten(ctx context.Context, req *pb.BatchRequest) (*pb.Ba
 		urls[i] = e.Url
 	}
 
-	encodedIds, err := s.shortener.BatchShorten(ctx, userID, urls)
+	mode := app.BatchPartial
+	if req.Atomic {
+		mode = app.BatchAtomic
+	}
+
+	results, err := s.shortener.BatchShorten(ctx, user.ID, urls, mode)
 	if err != nil {
-		s.logger.Error("failed to generate short ids", zap.Error(err))
-		return nil, status.Error(codes.InvalidArgument, "")
+		return nil, s.statusError(ctx, err, errorSubject{})
 	}
 
 	res := &pb.BatchResponse{}
-	res.UserId, err = s.shortener.GenerateUserID(userID)
+	// The deprecated field is still filled for clients that don't read user-token headers.
+	res.UserId, err = s.shortener.GenerateUserID(user.ID)
 	if err != nil {
-		s.logger.Error("failed to generate user id", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		return nil, s.statusError(ctx, err, errorSubject{})
 	}
 
-	res.Keys = make([]*pb.BatchResponse_Result, len(encodedIds))
-	for i, e := range encodedIds {
-		res.Keys[i] = &pb.BatchResponse_Result{
-			CorrelationId: req.Urls[i].CorrelationId,
-			Key:           string(e),
+	res.Keys = batchResults(req.Urls, results)
+
+	return res, nil
+}
+
+// batchResults pairs results of BatchShorten with correlation ids of requested urls.
+func batchResults(urls []*pb.BatchRequest_UrlData, results []app.BatchResult) []*pb.BatchResponse_Result {
+	res := make([]*pb.BatchResponse_Result, len(results))
+	for i, r := range results {
+		res[i] = &pb.BatchResponse_Result{
+			CorrelationId: urls[i].CorrelationId,
+			Key:           string(r.Key),
+			Status:        batchStatus(r.Status),
+		}
+		if r.Err != nil {
+			res[i].Error = r.Err.Error()
 		}
 	}
+	return res
+}
 
-	return res, nil
+func batchStatus(status app.BatchStatus) pb.BatchResponse_Status {
+	switch status {
+	case app.BatchCreated:
+		return pb.BatchResponse_STATUS_CREATED
+	case app.BatchExisted:
+		return pb.BatchResponse_STATUS_EXISTED
+	case app.BatchInvalid:
+		return pb.BatchResponse_STATUS_INVALID
+	}
+	return pb.BatchResponse_STATUS_UNSPECIFIED
 }
 
 func (s *Server) GetURL(ctx context.Context, req *pb.ShortenerRequest) (*pb.ShortenerResponse, error) {
-	u, err := s.shortener.OriginalURL(ctx, req.Url)
-	if errors.Is(err, storage.ErrDeleted) {
-		return nil, status.Error(http.StatusGone, "")
-	} else if err != nil {
-		s.logger.Error("failed to get original url", zap.Error(err))
-		return nil, status.Error(codes.NotFound, "")
+	u, err := s.shortener.Redirect(ctx, req.Url, visitorFromContext(ctx))
+	if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{Field: "url", ResourceType: ShortURLResource, ResourceName: req.Url})
 	}
 	return &pb.ShortenerResponse{Url: u}, nil
 }
 
 func (s *Server) ListUserUrls(ctx context.Context, req *pb.ListUserUrlsRequest) (*pb.ListUserUrlsResponse, error) {
-	userID, generated, err := s.shortener.GetUserID(&req.UserId)
+	user, err := s.currentUser(ctx, req)
 	if err != nil {
-		s.logger.Error("failed to get user id", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		return nil, err
 	}
 
-	if generated {
-		return nil, status.Error(codes.Unauthenticated, "")
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
 	}
 
-	userUrls, err := s.shortener.UserURLs(ctx, userID)
-	if err != nil {
-		s.logger.Error("failed to get user data", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+	// A user that hasn't shortened anything has an empty list rather than a missing one.
+	userUrls, err := s.shortener.UserURLs(ctx, user.ID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, s.statusError(ctx, err, errorSubject{})
 	}
 
 	result := &pb.ListUserUrlsResponse{
@@ -142,48 +172,248 @@ func (s *Server) ListUserUrls(ctx context.Context, req *pb.ListUserUrlsRequest)
 }
 
 func (s *Server) DeleteUserUrls(ctx context.Context, req *pb.DeleteUserUrlsRequest) (*pb.DeleteUserUrlsResponse, error) {
-	userID, generated, err := s.shortener.GetUserID(&req.UserId)
+	user, err := s.currentUser(ctx, req)
 	if err != nil {
-		s.logger.Error("failed to get user id", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		return nil, err
 	}
 
-	if generated {
-		return nil, status.Error(codes.Unauthenticated, "")
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
 	}
 
-	if err := s.shortener.DeleteUserURLs(ctx, userID, req.Urls); err != nil {
-		s.logger.Error("failed to delete user urls", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+	if err := s.shortener.DeleteUserURLs(ctx, user.ID, req.Urls); err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{Field: "urls"})
 	}
 
 	return &pb.DeleteUserUrlsResponse{}, nil
 }
 
+func (s *Server) GetLinkStats(ctx context.Context, req *pb.LinkStatsRequest) (*pb.LinkStatsResponse, error) {
+	user, err := s.currentUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
+	}
+
+	stats, err := s.shortener.LinkStats(ctx, user.ID, req.Url)
+	if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{Field: "url", ResourceType: ShortURLResource, ResourceName: req.Url})
+	}
+
+	result := &pb.LinkStatsResponse{
+		Clicks:         stats.Clicks,
+		BotClicks:      stats.BotClicks,
+		UniqueVisitors: stats.UniqueVisitors,
+		Days:           make([]*pb.LinkStatsResponse_Day, 0, len(stats.Days)),
+	}
+
+	for _, d := range stats.Days {
+		result.Days = append(result.Days, &pb.LinkStatsResponse_Day{
+			Date:           d.Day.Format("2006-01-02"),
+			Clicks:         d.Clicks,
+			BotClicks:      d.BotClicks,
+			UniqueVisitors: d.UniqueVisitors,
+		})
+	}
+
+	return result, nil
+}
+
+func (s *Server) GetUserStats(ctx context.Context, req *pb.UserStatsRequest) (*pb.UserStatsResponse, error) {
+	user, err := s.currentUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
+	}
+
+	stats, err := s.shortener.UserStats(ctx, user.ID)
+	if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{})
+	}
+
+	result := &pb.UserStatsResponse{
+		ActiveUrls:  stats.ActiveURLs,
+		DeletedUrls: stats.DeletedURLs,
+		TotalClicks: stats.TotalClicks,
+		TopLinks:    make([]*pb.UserStatsResponse_Link, 0, len(stats.TopLinks)),
+		Created:     make([]*pb.UserStatsResponse_Day, 0, len(stats.Created)),
+	}
+
+	for _, t := range stats.TopLinks {
+		result.TopLinks = append(result.TopLinks, &pb.UserStatsResponse_Link{
+			ShortUrl:    string(t.Key),
+			OriginalUrl: t.OriginalURL,
+			Clicks:      t.Clicks,
+		})
+	}
+
+	for _, d := range stats.Created {
+		result.Created = append(result.Created, &pb.UserStatsResponse_Day{
+			Date:    d.Start.Format("2006-01-02"),
+			Created: d.Count,
+		})
+	}
+
+	return result, nil
+}
+
 func (s *Server) Stat(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
 	if !s.statisticAuth(ctx, req) {
 		return nil, status.Error(codes.PermissionDenied, "unauthorized client")
 	}
 
-	stat, err := s.shortener.Stat(ctx)
+	query := app.StatsQuery{
+		Window: time.Duration(req.WindowSeconds) * time.Second,
+		Bucket: time.Duration(req.BucketSeconds) * time.Second,
+		Top:    int(req.Top),
+	}
+
+	stat, err := s.shortener.Stat(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, s.statusError(ctx, err, errorSubject{})
 	}
 
-	return &pb.StatResponse{
-		Urls:  stat.URLs,
-		Users: stat.Users,
-	}, nil
+	makeSeries := func(buckets []storage.TimeBucket) []*pb.StatResponse_Bucket {
+		result := make([]*pb.StatResponse_Bucket, 0, len(buckets))
+		for _, b := range buckets {
+			result = append(result, &pb.StatResponse_Bucket{Start: b.Start.Unix(), Count: b.Count})
+		}
+		return result
+	}
+
+	result := &pb.StatResponse{
+		Urls:          stat.URLs,
+		Users:         stat.Users,
+		From:          stat.From.Unix(),
+		To:            stat.To.Unix(),
+		BucketSeconds: uint64(stat.Bucket.Seconds()),
+		Created:       makeSeries(stat.Created),
+		Deleted:       makeSeries(stat.Deleted),
+		Redirects:     makeSeries(stat.Redirects),
+		TopLinks:      make([]*pb.StatResponse_TopLink, 0, len(stat.TopLinks)),
+	}
+
+	for _, t := range stat.TopLinks {
+		result.TopLinks = append(result.TopLinks, &pb.StatResponse_TopLink{
+			ShortUrl:    string(t.Key),
+			OriginalUrl: t.OriginalURL,
+			Clicks:      t.Clicks,
+		})
+	}
+
+	return result, nil
 }
 
 func (s *Server) Ping(ctx context.Context, _ *pb.PingRequest) (*pb.PingResponse, error) {
 	if err := s.shortener.Ping(ctx); err != nil {
-		s.logger.Error("failed to ping shortener", zap.Error(err))
-		return nil, status.Error(codes.Unknown, "")
+		s.requestLogger(ctx).Error("failed to ping shortener", zap.Error(err))
+		return nil, status.Error(codes.Unavailable, "storage is unavailable")
 	}
 	return &pb.PingResponse{}, nil
 }
 
+func visitorFromContext(ctx context.Context) *app.Visitor {
+	visitor := &app.Visitor{}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		visitor.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(visitor.IP); err == nil {
+			visitor.IP = host
+		}
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md.Get("user-agent"); len(ua) != 0 {
+			visitor.UserAgent = ua[0]
+		}
+		if purpose := md.Get("purpose"); len(purpose) != 0 {
+			visitor.Purpose = purpose[0]
+		}
+	}
+
+	return visitor
+}
+
+func (s *Server) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	user, err := s.currentUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
+	}
+
+	secret, key, err := s.shortener.CreateAPIKey(ctx, user.ID, req.Name)
+	if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{Field: "name"})
+	}
+
+	return &pb.CreateAPIKeyResponse{
+		Key: &pb.APIKey{
+			Id:      app.FormatAPIKeyID(key.ID),
+			Name:    key.Name,
+			Created: key.Created.Unix(),
+		},
+		Secret: secret,
+	}, nil
+}
+
+func (s *Server) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	user, err := s.currentUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
+	}
+
+	keys, err := s.shortener.UserAPIKeys(ctx, user.ID)
+	if err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{})
+	}
+
+	result := &pb.ListAPIKeysResponse{Keys: make([]*pb.APIKey, 0, len(keys))}
+	for _, k := range keys {
+		result.Keys = append(result.Keys, &pb.APIKey{
+			Id:      app.FormatAPIKeyID(k.ID),
+			Name:    k.Name,
+			Created: k.Created.Unix(),
+		})
+	}
+
+	return result, nil
+}
+
+func (s *Server) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+	user, err := s.currentUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Generated {
+		return nil, status.Error(codes.Unauthenticated, "credentials are required")
+	}
+
+	if err := s.shortener.RevokeAPIKey(ctx, user.ID, req.Id); err != nil {
+		return nil, s.statusError(ctx, err, errorSubject{ResourceType: APIKeyResource, ResourceName: req.Id})
+	}
+
+	return &pb.RevokeAPIKeyResponse{}, nil
+}
+
+// requestLogger returns a logger annotated with a request id.
+func (s *Server) requestLogger(ctx context.Context) *zap.Logger {
+	return logging.FromContext(ctx, s.logger)
+}
+
 type StatAuthorizer func(context.Context, *pb.StatRequest) bool
 
 func DefaultStatAuth(trustedNetwork *net.IPNet) StatAuthorizer {
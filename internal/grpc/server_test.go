@@ -1,41 +1,62 @@
 package grpc
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/stretchr/testify/assert"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/r4start/go-url-shortener/internal/app"
 	pb "github.com/r4start/go-url-shortener/internal/grpc/proto"
+	"github.com/r4start/go-url-shortener/pkg/metrics"
 	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/storage/storagetest"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 )
 
 func prepareServer(t *testing.T) (*grpc.Server, *bufconn.Listener) {
-	const bufSize = 1024 * 1024
-
 	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
 	st := storage.NewInMemoryStorage()
-	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithStat(st))
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithStat(st), app.WithClickStat(st),
+		app.WithAPIKeyStorage(st), app.WithURLExport(st), app.WithIdempotencyStore(st))
 	assert.NoError(t, err)
 
+	return serveShortener(t, s, logger)
+}
+
+// serveShortener starts a server of a shortener.
+func serveShortener(t *testing.T, s *app.URLShortener, logger *zap.Logger) (*grpc.Server, *bufconn.Listener) {
+	const bufSize = 1024 * 1024
+
 	shortener := NewServer(s, "", logger, func(context.Context, *pb.StatRequest) bool {
 		return true
 	})
 
 	lis := bufconn.Listen(bufSize)
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(shortener.AuthInterceptor(), shortener.IdempotencyInterceptor()),
+		grpc.StreamInterceptor(shortener.StreamAuthInterceptor()))
 	pb.RegisterUrlShortenerServer(grpcServer, shortener)
 	go func(t *testing.T) {
 		err := grpcServer.Serve(lis)
@@ -53,12 +74,15 @@ func makeDialer(l *bufconn.Listener) func(context.Context, string) (net.Conn, er
 
 func prepareTestEnv(t *testing.T) (*grpc.Server, *grpc.ClientConn) {
 	grpcServer, listener := prepareServer(t)
+	return grpcServer, dialServer(t, listener)
+}
 
+func dialServer(t *testing.T, listener *bufconn.Listener) *grpc.ClientConn {
 	ctx := context.Background()
 	conn, err := grpc.DialContext(ctx, "", grpc.WithContextDialer(makeDialer(listener)),
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
 	assert.NoError(t, err)
-	return grpcServer, conn
+	return conn
 }
 
 func TestServer_Shorten(t *testing.T) {
@@ -164,6 +188,31 @@ func TestServer_GetURL(t *testing.T) {
 	}
 }
 
+func TestServer_GetURL_database(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	st, err := storage.NewDatabaseStorage(ctx, storagetest.Database(t))
+	assert.NoError(t, err)
+	defer st.Close()
+	s, err := app.NewURLShortener(ctx, logger, app.WithStorage(st))
+	assert.NoError(t, err)
+
+	grpcServer, listener := serveShortener(t, s, logger)
+	defer grpcServer.Stop()
+	conn := dialServer(t, listener)
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	resp, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"})
+	assert.NoError(t, err)
+	ur, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: resp.Url})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ya.ru", ur.Url)
+
+	_, err = client.GetURL(ctx, &pb.ShortenerRequest{Url: "ZjRhMjc3OGQ1N2UyMWQzMw"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func TestServer_BatchShorten(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -219,6 +268,21 @@ func TestServer_BatchShorten(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Partial batch",
+			request: &pb.BatchRequest{
+				Urls: []*pb.BatchRequest_UrlData{
+					{CorrelationId: 0, Url: "http://ya.ru"},
+					{CorrelationId: 1, Url: "not a url"},
+					{CorrelationId: 2, Url: "http://vz.ru"},
+				},
+			},
+			expected: []pb.BatchResponse_Result{
+				{CorrelationId: 0, Key: "ZDIyNDk4MzQzMGZmMDQ1ZQ", Status: pb.BatchResponse_STATUS_EXISTED},
+				{CorrelationId: 1, Status: pb.BatchResponse_STATUS_INVALID, Error: "bad url"},
+				{CorrelationId: 2, Key: "MWZlNTFiNmZhNDQyOWNiOA", Status: pb.BatchResponse_STATUS_CREATED},
+			},
+		},
 	}
 
 	grpcServer, conn := prepareTestEnv(t)
@@ -236,6 +300,13 @@ func TestServer_BatchShorten(t *testing.T) {
 			for i, e := range resp.Keys {
 				assert.Equal(t, tt.expected[i].CorrelationId, e.CorrelationId)
 				assert.Equal(t, tt.expected[i].Key, e.Key)
+				if tt.expected[i].Status != pb.BatchResponse_STATUS_UNSPECIFIED {
+					assert.Equal(t, tt.expected[i].Status, e.Status)
+					assert.Equal(t, tt.expected[i].Error, e.Error)
+				}
+				if e.Status == pb.BatchResponse_STATUS_INVALID {
+					continue
+				}
 
 				ur, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: e.Key})
 				assert.NoError(t, err)
@@ -245,6 +316,62 @@ func TestServer_BatchShorten(t *testing.T) {
 	}
 }
 
+func TestServer_StreamBatchShorten(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+	stream, err := client.StreamBatchShorten(ctx)
+	assert.NoError(t, err)
+
+	bulk := make([]*pb.BatchRequest_UrlData, 0, streamBatchSize+10)
+	for i := 0; i < streamBatchSize+10; i++ {
+		bulk = append(bulk, &pb.BatchRequest_UrlData{CorrelationId: uint64(i), Url: fmt.Sprintf("https://ya.ru/%d", i)})
+	}
+
+	// The first chunk is split into two storage batches.
+	assert.NoError(t, stream.Send(&pb.StreamBatchRequest{Urls: bulk, Offset: 5}))
+	resp, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Len(t, resp.Results, streamBatchSize)
+	assert.Equal(t, uint64(5+streamBatchSize), resp.Committed)
+	assert.Equal(t, pb.BatchResponse_STATUS_CREATED, resp.Results[0].Status)
+
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Len(t, resp.Results, 10)
+	assert.Equal(t, uint64(5+streamBatchSize+10), resp.Committed)
+	assert.Equal(t, uint64(streamBatchSize), resp.Results[0].CorrelationId)
+
+	// An offset of a later message is ignored, resent urls are reported as existed.
+	assert.NoError(t, stream.Send(&pb.StreamBatchRequest{Offset: 100, Urls: []*pb.BatchRequest_UrlData{
+		{CorrelationId: 1, Url: "https://ya.ru/1"},
+		{CorrelationId: 2, Url: "not a url"},
+	}}))
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5+streamBatchSize+12), resp.Committed)
+	assert.Equal(t, pb.BatchResponse_STATUS_EXISTED, resp.Results[0].Status)
+	assert.Equal(t, pb.BatchResponse_STATUS_INVALID, resp.Results[1].Status)
+	assert.Equal(t, "bad url", resp.Results[1].Error)
+
+	assert.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+
+	header, err := stream.Header()
+	assert.NoError(t, err)
+	assert.Len(t, header.Get(UserTokenMetadata), 1)
+
+	// Links of the stream belong to the user of the token.
+	ctx = metadata.AppendToOutgoingContext(ctx, UserTokenMetadata, header.Get(UserTokenMetadata)[0])
+	urls, err := client.ListUserUrls(ctx, &pb.ListUserUrlsRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, urls.Urls, streamBatchSize+10)
+}
+
 func TestServer_ListUserUrls(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -309,6 +436,146 @@ func TestServer_ListUserUrls(t *testing.T) {
 			}
 		})
 	}
+
+	strict := metadata.AppendToOutgoingContext(ctx, StrictAuthMetadata, "true")
+	_, err := client.ListUserUrls(strict, &pb.ListUserUrlsRequest{UserId: "not a token"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "malformed")
+}
+
+func TestServer_ExportUserUrls(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	var header metadata.MD
+	_, err := client.BatchShorten(context.Background(), &pb.BatchRequest{Urls: []*pb.BatchRequest_UrlData{
+		{CorrelationId: 0, Url: "http://ya.ru"},
+		{CorrelationId: 1, Url: "http://vc.ru"},
+	}}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Len(t, header.Get(UserTokenMetadata), 1)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), UserTokenMetadata, header.Get(UserTokenMetadata)[0])
+
+	_, err = client.DeleteUserUrls(ctx, &pb.DeleteUserUrlsRequest{Urls: []string{"ZDIyNDk4MzQzMGZmMDQ1ZQ"}})
+	assert.NoError(t, err)
+
+	export := func() []*pb.ExportedUrl {
+		stream, err := client.ExportUserUrls(ctx, &pb.ExportUserUrlsRequest{})
+		assert.NoError(t, err)
+
+		links := make([]*pb.ExportedUrl, 0)
+		for {
+			link, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return links
+			}
+			assert.NoError(t, err)
+			links = append(links, link)
+		}
+	}
+
+	// Deletion is asynchronous.
+	var links []*pb.ExportedUrl
+	assert.Eventually(t, func() bool {
+		links = export()
+		for _, link := range links {
+			if link.State == pb.ExportedUrl_STATE_DELETED {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Len(t, links, 2)
+	for _, link := range links {
+		assert.NotZero(t, link.Created)
+		switch link.OriginalUrl {
+		case "http://ya.ru":
+			assert.Equal(t, "ZDIyNDk4MzQzMGZmMDQ1ZQ", link.ShortUrl)
+			assert.Equal(t, pb.ExportedUrl_STATE_DELETED, link.State)
+			assert.NotZero(t, link.Deleted)
+		case "http://vc.ru":
+			assert.Equal(t, "NWI4NTMwNmZjNWJmMjMzYg", link.ShortUrl)
+			assert.Equal(t, pb.ExportedUrl_STATE_ACTIVE, link.State)
+			assert.Zero(t, link.Deleted)
+		default:
+			t.Errorf("unexpected link %s", link.OriginalUrl)
+		}
+	}
+
+	// A new user has nothing to export.
+	stream, err := client.ExportUserUrls(context.Background(), &pb.ExportUserUrlsRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServer_GetLinkStats(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+
+	resp, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: resp.Url})
+		assert.NoError(t, err)
+	}
+
+	request := &pb.LinkStatsRequest{UserId: *resp.UserId, Url: resp.Url}
+	assert.Eventually(t, func() bool {
+		stats, err := client.GetLinkStats(ctx, request)
+		return err == nil && stats.Clicks == 3
+	}, time.Second, 10*time.Millisecond)
+
+	stats, err := client.GetLinkStats(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.UniqueVisitors)
+	assert.Len(t, stats.Days, 1)
+
+	_, err = client.GetLinkStats(ctx, &pb.LinkStatsRequest{UserId: *resp.UserId, Url: "M2U4OWJmNzU4ZWNkZTZlYQ"})
+	assert.Equal(t, codes.NotFound, status.Convert(err).Code())
+}
+
+func TestServer_GetUserStats(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+
+	resp, err := client.BatchShorten(ctx, &pb.BatchRequest{
+		Urls: []*pb.BatchRequest_UrlData{
+			{CorrelationId: 0, Url: "https://ya.ru"},
+			{CorrelationId: 1, Url: "https://vc.ru"},
+		},
+	})
+	assert.NoError(t, err)
+
+	_, err = client.GetURL(ctx, &pb.ShortenerRequest{Url: resp.Keys[0].Key})
+	assert.NoError(t, err)
+
+	request := &pb.UserStatsRequest{UserId: *resp.UserId}
+	assert.Eventually(t, func() bool {
+		stats, err := client.GetUserStats(ctx, request)
+		return err == nil && stats.TotalClicks == 1
+	}, time.Second, 10*time.Millisecond)
+
+	stats, err := client.GetUserStats(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.ActiveUrls)
+	assert.Equal(t, uint64(0), stats.DeletedUrls)
+	assert.Len(t, stats.TopLinks, 1)
+	assert.Equal(t, resp.Keys[0].Key, stats.TopLinks[0].ShortUrl)
+	assert.Len(t, stats.Created, app.UserHistoryDays)
+	assert.Equal(t, uint64(2), stats.Created[app.UserHistoryDays-1].Created)
 }
 
 func TestServer_DeleteUserUrls(t *testing.T) {
@@ -366,6 +633,44 @@ func TestServer_DeleteUserUrls(t *testing.T) {
 	assert.Equal(t, uint64(len(request.Urls)-len(deleteRequest.Urls)), stat.Urls)
 }
 
+func TestServer_APIKeys(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+	resp, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "http://ya.ru"})
+	assert.NoError(t, err)
+
+	created, err := client.CreateAPIKey(ctx, &pb.CreateAPIKeyRequest{UserId: *resp.UserId, Name: "ci"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(created.Secret, app.APIKeyPrefix))
+	assert.Equal(t, "ci", created.Key.Name)
+
+	_, err = client.CreateAPIKey(ctx, &pb.CreateAPIKeyRequest{UserId: *resp.UserId, Name: strings.Repeat("a", app.MaxAPIKeyNameLength+1)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	keyCtx := metadata.AppendToOutgoingContext(ctx, AuthorizationMetadata, "Bearer "+created.Secret)
+	urls, err := client.ListUserUrls(keyCtx, &pb.ListUserUrlsRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, urls.Urls, 1)
+
+	keys, err := client.ListAPIKeys(keyCtx, &pb.ListAPIKeysRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, keys.Keys, 1)
+	assert.Equal(t, created.Key.Id, keys.Keys[0].Id)
+
+	_, err = client.RevokeAPIKey(keyCtx, &pb.RevokeAPIKeyRequest{Id: created.Key.Id})
+	assert.NoError(t, err)
+
+	_, err = client.ListUserUrls(keyCtx, &pb.ListUserUrlsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.RevokeAPIKey(ctx, &pb.RevokeAPIKeyRequest{UserId: *resp.UserId, Id: created.Key.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
 func TestServer_Stat(t *testing.T) {
 	grpcServer, conn := prepareTestEnv(t)
 	defer grpcServer.Stop()
@@ -433,6 +738,56 @@ func TestServer_Stat(t *testing.T) {
 	assert.Equal(t, uint64(len(request.Urls))+firstLen, stat.Urls)
 }
 
+func TestServer_Stat_Series(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+
+	first, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"})
+	assert.NoError(t, err)
+	second, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://vc.ru"})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: first.Url})
+		assert.NoError(t, err)
+	}
+	_, err = client.GetURL(ctx, &pb.ShortenerRequest{Url: second.Url})
+	assert.NoError(t, err)
+
+	sum := func(buckets []*pb.StatResponse_Bucket) uint64 {
+		total := uint64(0)
+		for _, b := range buckets {
+			total += b.Count
+		}
+		return total
+	}
+
+	request := &pb.StatRequest{WindowSeconds: 48 * 3600, BucketSeconds: 6 * 3600, Top: 1}
+	assert.Eventually(t, func() bool {
+		stat, err := client.Stat(ctx, request)
+		return err == nil && sum(stat.Redirects) == 4
+	}, time.Second, 10*time.Millisecond)
+
+	stat, err := client.Stat(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6*3600), stat.BucketSeconds)
+	assert.Len(t, stat.Created, 8)
+	assert.Len(t, stat.Deleted, 8)
+	assert.Len(t, stat.Redirects, 8)
+	assert.Equal(t, uint64(2), sum(stat.Created))
+	assert.Zero(t, sum(stat.Deleted))
+	assert.Len(t, stat.TopLinks, 1)
+	assert.Equal(t, first.Url, stat.TopLinks[0].ShortUrl)
+	assert.Equal(t, uint64(3), stat.TopLinks[0].Clicks)
+
+	_, err = client.Stat(ctx, &pb.StatRequest{BucketSeconds: 60})
+	assert.Equal(t, codes.InvalidArgument, status.Convert(err).Code())
+}
+
 func TestServer_Stat_Denied(t *testing.T) {
 	const bufSize = 1024 * 1024
 
@@ -496,3 +851,506 @@ func TestServer_Stat_Denied(t *testing.T) {
 	_, err = client.Stat(ctx, &pb.StatRequest{})
 	assert.Equal(t, codes.PermissionDenied, status.Convert(err).Code())
 }
+
+func TestMetricsInterceptor(t *testing.T) {
+	const bufSize = 1024 * 1024
+
+	ctx := context.Background()
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st))
+	assert.NoError(t, err)
+
+	registry := metrics.NewRegistry()
+	lis := bufconn.Listen(bufSize)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(MetricsInterceptor(registry)))
+	pb.RegisterUrlShortenerServer(grpcServer, NewServer(s, "", logger, DefaultStatAuth(nil)))
+	go func(t *testing.T) {
+		err := grpcServer.Serve(lis)
+		assert.NoError(t, err)
+	}(t)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.DialContext(ctx, "", grpc.WithContextDialer(makeDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	_, err = client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"})
+	assert.NoError(t, err)
+	_, err = client.GetURL(ctx, &pb.ShortenerRequest{Url: "M2U4OWJmNzU4ZWNkZTZlYQ"})
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, registry.Write(&buf))
+	assert.Contains(t, buf.String(), `grpc_server_handled_total{method="/shortener.UrlShortener/Shorten",code="OK"} 1`)
+	assert.Contains(t, buf.String(), `grpc_server_handled_total{method="/shortener.UrlShortener/GetURL",code="NotFound"} 1`)
+	assert.Contains(t, buf.String(), `grpc_server_handling_seconds_count{method="/shortener.UrlShortener/Shorten"} 1`)
+}
+
+type recordingExporter struct {
+	lock  sync.Mutex
+	spans []*tracing.SpanData
+}
+
+func (e *recordingExporter) Export(span *tracing.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func TestTracingInterceptor(t *testing.T) {
+	const bufSize = 1024 * 1024
+
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer(exporter)
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithTracer(tracer))
+	assert.NoError(t, err)
+
+	lis := bufconn.Listen(bufSize)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(TracingInterceptor(tracer)))
+	pb.RegisterUrlShortenerServer(grpcServer, NewServer(s, "", logger, DefaultStatAuth(nil)))
+	go func(t *testing.T) {
+		err := grpcServer.Serve(lis)
+		assert.NoError(t, err)
+	}(t)
+	defer grpcServer.Stop()
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "", grpc.WithContextDialer(makeDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, err = client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"})
+	assert.NoError(t, err)
+
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+
+	assert.Len(t, exporter.spans, 2)
+	shorten, call := exporter.spans[0], exporter.spans[1]
+	assert.Equal(t, "URLShortener.Shorten", shorten.Name)
+	assert.Equal(t, "/shortener.UrlShortener/Shorten", call.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", call.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", call.ParentID)
+	assert.Equal(t, call.TraceID, shorten.TraceID)
+	assert.Equal(t, call.SpanID, shorten.ParentID)
+	assert.Equal(t, "OK", call.Attributes["rpc.grpc.status_code"])
+}
+
+func TestLoggingInterceptor(t *testing.T) {
+	const bufSize = 1024 * 1024
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st))
+	assert.NoError(t, err)
+
+	lis := bufconn.Listen(bufSize)
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(LoggingInterceptor(logger)))
+	pb.RegisterUrlShortenerServer(grpcServer, NewServer(s, "", logger, DefaultStatAuth(nil)))
+	go func(t *testing.T) {
+		err := grpcServer.Serve(lis)
+		assert.NoError(t, err)
+	}(t)
+	defer grpcServer.Stop()
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "", grpc.WithContextDialer(makeDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	var header metadata.MD
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", "request-1")
+	_, err = client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"request-1"}, header.Get("x-request-id"))
+
+	_, err = client.GetURL(context.Background(), &pb.ShortenerRequest{Url: "M2U4OWJmNzU4ZWNkZTZlYQ"}, grpc.Header(&header))
+	assert.Error(t, err)
+	assert.Len(t, header.Get("x-request-id"), 1)
+
+	entries := logs.FilterMessage("request").All()
+	assert.Len(t, entries, 2)
+
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "request-1", fields["request_id"])
+	assert.Equal(t, "/shortener.UrlShortener/Shorten", fields["method"])
+	assert.Equal(t, "OK", fields["code"])
+	assert.Contains(t, fields, "user_id")
+	assert.Contains(t, fields, "bytes")
+
+	fields = entries[1].ContextMap()
+	assert.Equal(t, header.Get("x-request-id")[0], fields["request_id"])
+	assert.Equal(t, "NotFound", fields["code"])
+	assert.NotContains(t, fields, "user_id")
+}
+
+func TestStreamInterceptors(t *testing.T) {
+	const bufSize = 1024 * 1024
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer(exporter)
+	registry := metrics.NewRegistry()
+
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithTracer(tracer))
+	assert.NoError(t, err)
+
+	shortener := NewServer(s, "", logger, DefaultStatAuth(nil))
+	lis := bufconn.Listen(bufSize)
+	grpcServer := grpc.NewServer(grpc.ChainStreamInterceptor(StreamLoggingInterceptor(logger),
+		StreamTracingInterceptor(tracer), NewCallMetrics(registry).StreamInterceptor(), shortener.StreamAuthInterceptor()))
+	pb.RegisterUrlShortenerServer(grpcServer, shortener)
+	go func(t *testing.T) {
+		err := grpcServer.Serve(lis)
+		assert.NoError(t, err)
+	}(t)
+	defer grpcServer.Stop()
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "", grpc.WithContextDialer(makeDialer(lis)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", "stream-1")
+	stream, err := client.StreamBatchShorten(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&pb.StreamBatchRequest{Urls: []*pb.BatchRequest_UrlData{{Url: "https://ya.ru"}}}))
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+
+	header, err := stream.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stream-1"}, header.Get("x-request-id"))
+	assert.Len(t, header.Get(UserTokenMetadata), 1)
+
+	// The server finishes a call after a client sees the end of a stream.
+	assert.Eventually(t, func() bool {
+		return len(logs.FilterMessage("request").All()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	fields := logs.FilterMessage("request").All()[0].ContextMap()
+	assert.Equal(t, "stream-1", fields["request_id"])
+	assert.Equal(t, "/shortener.UrlShortener/StreamBatchShorten", fields["method"])
+	assert.Equal(t, "OK", fields["code"])
+	assert.Contains(t, fields, "user_id")
+
+	var buf bytes.Buffer
+	assert.NoError(t, registry.Write(&buf))
+	assert.Contains(t, buf.String(), `grpc_server_handled_total{method="/shortener.UrlShortener/StreamBatchShorten",code="OK"} 1`)
+
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	call := exporter.spans[len(exporter.spans)-1]
+	assert.Equal(t, "/shortener.UrlShortener/StreamBatchShorten", call.Name)
+	assert.Equal(t, "URLShortener.BatchShorten", exporter.spans[0].Name)
+	assert.Equal(t, call.SpanID, exporter.spans[0].ParentID)
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+
+	var header metadata.MD
+	_, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://ya.ru"}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Len(t, header.Get(UserTokenMetadata), 1)
+	token := header.Get(UserTokenMetadata)[0]
+
+	tests := []struct {
+		name     string
+		metadata []string
+		userID   string
+		code     codes.Code
+		urls     int
+	}{
+		{
+			name:     "Token in metadata",
+			metadata: []string{UserTokenMetadata, token},
+			urls:     1,
+		},
+		{
+			name:   "Token in deprecated field",
+			userID: token,
+			urls:   1,
+		},
+		{
+			name:     "Metadata takes precedence",
+			metadata: []string{UserTokenMetadata, token},
+			userID:   "not a token",
+			urls:     1,
+		},
+		{
+			name:     "Bad token in metadata",
+			metadata: []string{UserTokenMetadata, "not a token"},
+			userID:   token,
+			code:     codes.Unauthenticated,
+		},
+		{
+			name: "No credentials",
+			code: codes.Unauthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callCtx := ctx
+			if len(tt.metadata) != 0 {
+				callCtx = metadata.AppendToOutgoingContext(ctx, tt.metadata...)
+			}
+
+			var header metadata.MD
+			urls, err := client.ListUserUrls(callCtx, &pb.ListUserUrlsRequest{UserId: tt.userID}, grpc.Header(&header))
+			assert.Equal(t, tt.code, status.Code(err))
+			if err != nil {
+				return
+			}
+
+			assert.Len(t, urls.Urls, tt.urls)
+			// A fresh token isn't reissued.
+			assert.Empty(t, header.Get(UserTokenMetadata))
+		})
+	}
+
+	// A token that isn't accepted is replaced by a new user, unless a client asks for strict checks.
+	badCtx := metadata.AppendToOutgoingContext(ctx, UserTokenMetadata, "not a token")
+	_, err = client.Shorten(badCtx, &pb.ShortenerRequest{Url: "https://vc.ru"}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Len(t, header.Get(UserTokenMetadata), 1)
+	assert.NotEqual(t, token, header.Get(UserTokenMetadata)[0])
+
+	strictCtx := metadata.AppendToOutgoingContext(badCtx, StrictAuthMetadata, "true")
+	_, err = client.Shorten(strictCtx, &pb.ShortenerRequest{Url: "https://vc.ru"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.GetURL(ctx, &pb.ShortenerRequest{Url: "ZjRhMjc3OGQ1N2UyMWQzMw"}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Empty(t, header.Get(UserTokenMetadata))
+}
+
+func TestServer_ErrorDetails(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	ctx := context.Background()
+
+	var header metadata.MD
+	deleted, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://vc.ru"}, grpc.Header(&header))
+	assert.NoError(t, err)
+	userCtx := metadata.AppendToOutgoingContext(ctx, UserTokenMetadata, header.Get(UserTokenMetadata)[0])
+
+	_, err = client.DeleteUserUrls(userCtx, &pb.DeleteUserUrlsRequest{Urls: []string{deleted.Url}})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: deleted.Url})
+		return status.Code(err) == codes.FailedPrecondition
+	}, time.Second, 10*time.Millisecond)
+
+	tests := []struct {
+		name    string
+		call    func() error
+		code    codes.Code
+		details func(t *testing.T, details []interface{})
+	}{
+		{
+			name: "Malformed short url",
+			call: func() error {
+				_, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: "!!!"})
+				return err
+			},
+			code: codes.InvalidArgument,
+			details: func(t *testing.T, details []interface{}) {
+				violations := details[0].(*errdetails.BadRequest).FieldViolations
+				assert.Len(t, violations, 1)
+				assert.Equal(t, "url", violations[0].Field)
+			},
+		},
+		{
+			name: "Unknown short url",
+			call: func() error {
+				_, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: "ZjRhMjc3OGQ1N2UyMWQzMw"})
+				return err
+			},
+			code: codes.NotFound,
+			details: func(t *testing.T, details []interface{}) {
+				info := details[0].(*errdetails.ResourceInfo)
+				assert.Equal(t, ShortURLResource, info.ResourceType)
+				assert.Equal(t, "ZjRhMjc3OGQ1N2UyMWQzMw", info.ResourceName)
+			},
+		},
+		{
+			name: "Deleted short url",
+			call: func() error {
+				_, err := client.GetURL(ctx, &pb.ShortenerRequest{Url: deleted.Url})
+				return err
+			},
+			code: codes.FailedPrecondition,
+			details: func(t *testing.T, details []interface{}) {
+				assert.Len(t, details, 2)
+				assert.Equal(t, deleted.Url, details[0].(*errdetails.ResourceInfo).ResourceName)
+				violations := details[1].(*errdetails.PreconditionFailure).Violations
+				assert.Equal(t, DeletedViolation, violations[0].Type)
+				assert.Equal(t, deleted.Url, violations[0].Subject)
+			},
+		},
+		{
+			name: "Bad url",
+			call: func() error {
+				_, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "not a url"})
+				return err
+			},
+			code: codes.InvalidArgument,
+			details: func(t *testing.T, details []interface{}) {
+				assert.Equal(t, "url", details[0].(*errdetails.BadRequest).FieldViolations[0].Field)
+			},
+		},
+		{
+			name: "Forbidden url",
+			call: func() error {
+				_, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "http://127.0.0.1/admin"})
+				return err
+			},
+			code: codes.InvalidArgument,
+			details: func(t *testing.T, details []interface{}) {
+				assert.Len(t, details, 2)
+				assert.Equal(t, "url", details[0].(*errdetails.BadRequest).FieldViolations[0].Field)
+				info := details[1].(*errdetails.ErrorInfo)
+				assert.Equal(t, ForbiddenURLReason, info.Reason)
+				assert.Equal(t, app.PolicyRulePrivateIP, info.Metadata["rule"])
+			},
+		},
+		{
+			name: "Bad url in a batch",
+			call: func() error {
+				_, err := client.BatchShorten(ctx, &pb.BatchRequest{Urls: []*pb.BatchRequest_UrlData{
+					{CorrelationId: 1, Url: "https://ya.ru"},
+					{CorrelationId: 2, Url: "not a url"},
+					{CorrelationId: 3, Url: "https://"},
+				}, Atomic: true})
+				return err
+			},
+			code: codes.InvalidArgument,
+			details: func(t *testing.T, details []interface{}) {
+				violations := details[0].(*errdetails.BadRequest).FieldViolations
+				assert.Len(t, violations, 2)
+				assert.Equal(t, "urls[1].url", violations[0].Field)
+				assert.Equal(t, "urls[2].url", violations[1].Field)
+			},
+		},
+		{
+			name: "Existing url",
+			call: func() error {
+				_, err := client.Shorten(ctx, &pb.ShortenerRequest{Url: "https://vc.ru"})
+				return err
+			},
+			code: codes.AlreadyExists,
+			details: func(t *testing.T, details []interface{}) {
+				assert.Equal(t, deleted.Url, details[0].(*errdetails.ResourceInfo).ResourceName)
+			},
+		},
+		{
+			name: "Bad stats query",
+			call: func() error {
+				_, err := client.Stat(ctx, &pb.StatRequest{BucketSeconds: 1})
+				return err
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(tt.call())
+			assert.Equal(t, tt.code, st.Code())
+			assert.NotEmpty(t, st.Message())
+
+			if tt.details == nil {
+				assert.Empty(t, st.Details())
+				return
+			}
+			assert.NotEmpty(t, st.Details())
+			tt.details(t, st.Details())
+		})
+	}
+}
+
+func TestServer_IdempotencyKeys(t *testing.T) {
+	grpcServer, conn := prepareTestEnv(t)
+	defer grpcServer.Stop()
+	defer conn.Close()
+	client := pb.NewUrlShortenerClient(conn)
+
+	var header metadata.MD
+	_, err := client.Shorten(context.Background(), &pb.ShortenerRequest{Url: "https://ya.ru"}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Len(t, header.Get(UserTokenMetadata), 1)
+	token := header.Get(UserTokenMetadata)[0]
+	ctx := metadata.AppendToOutgoingContext(context.Background(), UserTokenMetadata, token, IdempotencyKeyMetadata, "key-1")
+
+	request := &pb.BatchRequest{Urls: []*pb.BatchRequest_UrlData{
+		{CorrelationId: 0, Url: "http://ya.ru"},
+		{CorrelationId: 1, Url: "http://vc.ru"},
+	}}
+
+	header = metadata.MD{}
+	first, err := client.BatchShorten(ctx, request, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Empty(t, header.Get(IdempotentReplayedMetadata))
+
+	header = metadata.MD{}
+	retry, err := client.BatchShorten(ctx, request, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"true"}, header.Get(IdempotentReplayedMetadata))
+	assert.True(t, proto.Equal(first, retry))
+
+	// Credentials aren't a part of a call, a retry of an older client with a token in user_id is replayed too.
+	legacy := metadata.AppendToOutgoingContext(context.Background(), IdempotencyKeyMetadata, "key-1")
+	legacyRequest := proto.Clone(request).(*pb.BatchRequest)
+	legacyRequest.UserId = &token
+	header = metadata.MD{}
+	retry, err = client.BatchShorten(legacy, legacyRequest, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"true"}, header.Get(IdempotentReplayedMetadata))
+	assert.True(t, proto.Equal(first, retry))
+
+	_, err = client.BatchShorten(ctx, &pb.BatchRequest{Urls: []*pb.BatchRequest_UrlData{
+		{CorrelationId: 0, Url: "http://habr.com"},
+	}})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	bad := metadata.AppendToOutgoingContext(context.Background(), UserTokenMetadata, token,
+		IdempotencyKeyMetadata, "key with spaces")
+	_, err = client.Shorten(bad, &pb.ShortenerRequest{Url: "https://habr.com"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
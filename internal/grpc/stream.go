@@ -0,0 +1,121 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	pb "github.com/r4start/go-url-shortener/internal/grpc/proto"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+// streamBatchSize - the most urls StreamBatchShorten commits with one storage call.
+const streamBatchSize = 1000
+
+// contextStream - a server stream with a context of stream interceptors.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// StreamBatchShorten shortens urls sent in chunks of any size. A chunk is committed in batches of
+// at most streamBatchSize urls and results of a batch are sent as soon as it is committed.
+// The next chunk isn't read until the previous one is committed, so gRPC flow control keeps
+// a client from getting ahead of the storage.
+// A response tells how many urls have been committed, an interrupted stream is resumed by a new one
+// with that number as an offset and the rest of urls. Urls that are sent twice are reported as existed.
+func (s *Server) StreamBatchShorten(stream pb.UrlShortener_StreamBatchShortenServer) error {
+	ctx := stream.Context()
+	user, err := s.currentUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var committed uint64
+	for first := true; ; first = false {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if first {
+			committed = req.Offset
+		}
+
+		for start := 0; start < len(req.Urls); start += streamBatchSize {
+			end := start + streamBatchSize
+			if end > len(req.Urls) {
+				end = len(req.Urls)
+			}
+			chunk := req.Urls[start:end]
+
+			urls := make([]string, len(chunk))
+			for i, e := range chunk {
+				urls[i] = e.Url
+			}
+
+			results, err := s.shortener.BatchShorten(ctx, user.ID, urls, app.BatchPartial)
+			if err != nil {
+				return s.statusError(ctx, err, errorSubject{})
+			}
+			committed += uint64(len(chunk))
+
+			if err := stream.Send(&pb.StreamBatchResponse{
+				Results:   batchResults(chunk, results),
+				Committed: committed,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ExportUserUrls streams all links of a user, deleted ones included, in order of creation.
+// Links are sent as they are read from a storage.
+func (s *Server) ExportUserUrls(_ *pb.ExportUserUrlsRequest, stream pb.UrlShortener_ExportUserUrlsServer) error {
+	ctx := stream.Context()
+	user, err := s.currentUser(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if user.Generated {
+		return status.Error(codes.Unauthenticated, "credentials are required")
+	}
+
+	// Failures to send mean a client is gone, they aren't errors of the export.
+	var sendErr error
+	err = s.shortener.ExportUserURLs(ctx, user.ID, func(link storage.ExportedURL) error {
+		item := &pb.ExportedUrl{
+			ShortUrl:    string(app.EncodeID(link.ShortURLID)),
+			OriginalUrl: link.OriginalURL,
+			Created:     link.Created.Unix(),
+			State:       pb.ExportedUrl_STATE_ACTIVE,
+		}
+		if link.Deleted {
+			item.State = pb.ExportedUrl_STATE_DELETED
+			if !link.DeletedAt.IsZero() {
+				item.Deleted = link.DeletedAt.Unix()
+			}
+		}
+		sendErr = stream.Send(item)
+		return sendErr
+	})
+	if sendErr != nil {
+		return sendErr
+	} else if err != nil {
+		return s.statusError(ctx, err, errorSubject{})
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package grpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/r4start/go-url-shortener/pkg/tracing"
+)
+
+// TracingInterceptor starts a span per unary call, its parent is taken from traceparent metadata if there is one.
+func TracingInterceptor(tracer *tracing.Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startCallSpan(ctx, tracer, info.FullMethod)
+		defer span.End()
+
+		resp, err := handler(ctx, req)
+		endCallSpan(span, info.FullMethod, err)
+
+		return resp, err
+	}
+}
+
+// StreamTracingInterceptor starts a span per streaming call, the span lasts as long as the stream.
+func StreamTracingInterceptor(tracer *tracing.Tracer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startCallSpan(ss.Context(), tracer, info.FullMethod)
+		defer span.End()
+
+		err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		endCallSpan(span, info.FullMethod, err)
+
+		return err
+	}
+}
+
+func startCallSpan(ctx context.Context, tracer *tracing.Tracer, method string) (context.Context, *tracing.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(tracing.TraceparentHeader); len(values) != 0 {
+			if parent, err := tracing.ParseTraceparent(values[0]); err == nil {
+				ctx = tracing.ContextWithRemoteParent(ctx, parent)
+			}
+		}
+	}
+
+	return tracer.Start(ctx, method)
+}
+
+func endCallSpan(span *tracing.Span, method string, err error) {
+	span.SetAttribute("rpc.method", method)
+	span.SetAttribute("rpc.grpc.status_code", status.Code(err).String())
+	span.SetError(err)
+}
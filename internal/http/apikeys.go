@@ -0,0 +1,111 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+type apiKeyResponse struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Key     string    `json:"key,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (s *Server) apiCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name string `json:"name"`
+	}
+
+	reqData, err := s.apiParseRequest(r, &request)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	secret, key, err := s.shortener.CreateAPIKey(r.Context(), reqData.UserID, request.Name)
+	if err != nil {
+		s.writeAPIKeyError(w, r, err)
+		return
+	}
+
+	s.apiWriteResponse(w, r, reqData, http.StatusCreated, apiKeyResponse{
+		ID:      app.FormatAPIKeyID(key.ID),
+		Name:    key.Name,
+		Key:     secret,
+		Created: key.Created,
+	})
+}
+
+func (s *Server) apiUserAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if user.IsIDGenerated {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	keys, err := s.shortener.UserAPIKeys(r.Context(), user.UserID)
+	if err != nil {
+		s.writeAPIKeyError(w, r, err)
+		return
+	}
+
+	resp := make([]apiKeyResponse, 0, len(keys))
+	for _, k := range keys {
+		resp = append(resp, apiKeyResponse{
+			ID:      app.FormatAPIKeyID(k.ID),
+			Name:    k.Name,
+			Created: k.Created,
+		})
+	}
+
+	s.apiWriteResponse(w, r, user, http.StatusOK, resp)
+}
+
+func (s *Server) apiRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if user.IsIDGenerated {
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	}
+
+	if err := s.shortener.RevokeAPIKey(r.Context(), user.UserID, chi.URLParam(r, "id")); err != nil {
+		s.writeAPIKeyError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) writeAPIKeyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, app.ErrBadAPIKeyName):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidAPIKeyName, err.Error())
+	case errors.Is(err, app.ErrTooManyAPIKeys):
+		s.writeProblem(w, r, http.StatusConflict, CodeTooManyAPIKeys, "revoke unused keys first")
+	case errors.Is(err, storage.ErrNotFound):
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+	case errors.Is(err, app.ErrAPIKeysUnsupported):
+		s.writeProblem(w, r, http.StatusNotImplemented, CodeNotImplemented, "storage doesn't support api keys")
+	default:
+		s.requestLogger(r).Error("failed to manage api keys", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+	}
+}
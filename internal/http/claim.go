@@ -0,0 +1,58 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+)
+
+type claimResponse struct {
+	Claimed uint64 `json:"claimed"`
+}
+
+// apiClaimLinks moves links of an anonymous user to an account that uses an API key. The anonymous user
+// is the one of the user id cookie, which is expired, since the anonymous user can't be used afterwards.
+// Browsers that log in claim their links with the login callback.
+func (s *Server) apiClaimLinks(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if !user.isAccount() {
+		s.writeProblem(w, r, http.StatusForbidden, CodeAccountRequired, "log in or use an api key to claim links")
+		return
+	}
+
+	cookie, err := r.Cookie(UserIDCookieName)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, CodeMissingField, "user id cookie is required")
+		return
+	}
+
+	claimed, err := s.shortener.ClaimLinks(r.Context(), cookie.Value, user.UserID)
+	switch {
+	case err == nil:
+	case errors.Is(err, app.ErrInvalidToken):
+		expireUserID(w)
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidToken, "token isn't accepted")
+		return
+	case errors.Is(err, app.ErrClaimAccount):
+		s.writeProblem(w, r, http.StatusConflict, CodeAccountToken, "links of an account can't be claimed")
+		return
+	case errors.Is(err, app.ErrMergeUnsupported):
+		s.writeProblem(w, r, http.StatusNotImplemented, CodeNotImplemented, "storage doesn't support claiming links")
+		return
+	default:
+		s.requestLogger(r).Error("failed to claim links", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+		return
+	}
+
+	expireUserID(w)
+	s.apiWriteResponse(w, r, user, http.StatusOK, claimResponse{Claimed: claimed})
+}
@@ -0,0 +1,196 @@
+package http
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	mediaJSON   = "application/json"
+	mediaCSV    = "text/csv"
+	mediaNDJSON = "application/x-ndjson"
+
+	// exportFlushRows - an export is flushed to a client every exportFlushRows links.
+	exportFlushRows = 100
+)
+
+// exportMediaTypes - media types a client may ask links in, aliases are mapped to a response media type.
+var exportMediaTypes = map[string]string{
+	mediaJSON:            mediaJSON,
+	"application/*":      mediaJSON,
+	"*/*":                mediaJSON,
+	mediaCSV:             mediaCSV,
+	"text/*":             mediaCSV,
+	mediaNDJSON:          mediaNDJSON,
+	"application/ndjson": mediaNDJSON,
+	"application/jsonl":  mediaNDJSON,
+}
+
+// exportColumns - columns of a CSV export. original_url lets an export be imported back.
+var exportColumns = []string{"short_url", "original_url", "created", "state", "deleted"}
+
+type exportedLink struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	Created     time.Time  `json:"created"`
+	State       string     `json:"state"`
+	Deleted     *time.Time `json:"deleted,omitempty"`
+}
+
+type linkEncoder interface {
+	Encode(link *exportedLink) error
+	Flush() error
+}
+
+type csvLinkEncoder struct {
+	writer *csv.Writer
+}
+
+func (e *csvLinkEncoder) Encode(link *exportedLink) error {
+	deleted := ""
+	if link.Deleted != nil {
+		deleted = link.Deleted.Format(time.RFC3339)
+	}
+	return e.writer.Write([]string{
+		link.ShortURL, link.OriginalURL, link.Created.Format(time.RFC3339), link.State, deleted,
+	})
+}
+
+func (e *csvLinkEncoder) Flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type ndjsonLinkEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonLinkEncoder) Encode(link *exportedLink) error {
+	return e.encoder.Encode(link)
+}
+
+func (e *ndjsonLinkEncoder) Flush() error {
+	return nil
+}
+
+// negotiateExport picks a media type of user links by an Accept header. The most preferred type wins,
+// the first one of equally preferred types. Without an acceptable type links are sent as JSON.
+func negotiateExport(accept string) string {
+	best, bestQ := mediaJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := exportMediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// exportUserURLs streams all links of a user, deleted ones included, as CSV or NDJSON.
+// A failure after links have been sent aborts the response, so a client doesn't take it as complete.
+func (s *Server) exportUserURLs(w http.ResponseWriter, r *http.Request, user *apiRequestData, mediaType string) {
+	if user.needsCookie() {
+		if err := s.setUserID(w, user); err != nil {
+			s.requestLogger(r).Error("failed to set user id", zap.Error(err))
+			s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+			return
+		}
+	}
+
+	var encoder linkEncoder
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(http.StatusOK)
+
+		if mediaType == mediaCSV {
+			writer := csv.NewWriter(w)
+			encoder = &csvLinkEncoder{writer: writer}
+			return writer.Write(exportColumns)
+		}
+		encoder = &ndjsonLinkEncoder{encoder: json.NewEncoder(w)}
+		return nil
+	}
+
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	err := s.shortener.ExportUserURLs(r.Context(), user.UserID, func(link storage.ExportedURL) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		item := &exportedLink{
+			ShortURL:    s.makeResultURL(r, app.EncodeID(link.ShortURLID)),
+			OriginalURL: link.OriginalURL,
+			Created:     link.Created.UTC(),
+			State:       "active",
+		}
+		if link.Deleted {
+			item.State = "deleted"
+			if !link.DeletedAt.IsZero() {
+				deleted := link.DeletedAt.UTC()
+				item.Deleted = &deleted
+			}
+		}
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+
+		if count++; count%exportFlushRows == 0 && flusher != nil {
+			if err := encoder.Flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, app.ErrExportUnsupported) && !started:
+		s.writeProblem(w, r, http.StatusNotImplemented, CodeNotImplemented, "storage doesn't support exports")
+		return
+	case err != nil && !started:
+		s.writeError(w, r, err)
+		return
+	case err != nil:
+		s.requestLogger(r).Error("failed to export user urls", zap.Error(err), zap.Int("exported", count))
+		panic(http.ErrAbortHandler)
+	case !started:
+		if err := start(); err != nil {
+			s.requestLogger(r).Error("failed to start an export", zap.Error(err))
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if err := encoder.Flush(); err != nil {
+		s.requestLogger(r).Error("failed to write an export", zap.Error(err))
+	}
+}
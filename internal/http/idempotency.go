@@ -0,0 +1,109 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+)
+
+const (
+	// IdempotencyKeyHeader - a request header with a client chosen key, retries of a request with the same key
+	// get the response of the first one.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader - a response header set on replayed responses.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// responseCapture passes a response through and keeps a copy of it.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(statusCode int) {
+	c.status = statusCode
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotent replays a saved response to a request with an Idempotency-Key header that has been made before.
+// Server errors aren't saved, so such requests may be retried. Keys of users without credentials are ignored,
+// a new user id is generated for every such request.
+func (s *Server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if len(key) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := s.getUser(r)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if user.IsIDGenerated {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		saved, err := s.shortener.BeginIdempotent(r.Context(), user.UserID, key, requestFingerprint(r, body))
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		if saved != nil {
+			w.Header().Set("Content-Type", saved.ContentType)
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(saved.Status)
+			if _, err := w.Write(saved.Body); err != nil {
+				s.requestLogger(r).Error("failed to write response body", zap.Error(err))
+			}
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(capture, r)
+
+		if capture.status >= http.StatusInternalServerError {
+			err = s.shortener.AbortIdempotent(r.Context(), user.UserID, key)
+		} else {
+			err = s.shortener.CompleteIdempotent(r.Context(), user.UserID, key, &app.IdempotentResponse{
+				Status:      capture.status,
+				ContentType: capture.Header().Get("Content-Type"),
+				Body:        capture.body.Bytes(),
+			})
+		}
+		if err != nil {
+			s.requestLogger(r).Error("failed to finish idempotent request", zap.Error(err))
+		}
+	})
+}
+
+// requestFingerprint hashes what makes a request, so a key can't be reused for another one.
+func requestFingerprint(r *http.Request, body []byte) []byte {
+	hasher := sha256.New()
+	for _, part := range []string{r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type")} {
+		hasher.Write([]byte(part))
+		hasher.Write([]byte{0})
+	}
+	hasher.Write(body)
+	return hasher.Sum(nil)
+}
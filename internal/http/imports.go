@@ -0,0 +1,170 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+)
+
+// MaxImportSize - the largest import file in bytes.
+const MaxImportSize = 32 << 20
+
+// importFormats - media types of import files.
+var importFormats = map[string]app.ImportFormat{
+	"text/csv":             app.ImportCSV,
+	"application/x-ndjson": app.ImportNDJSON,
+	"application/ndjson":   app.ImportNDJSON,
+	"application/jsonl":    app.ImportNDJSON,
+}
+
+type importRowResponse struct {
+	Line        int      `json:"line"`
+	OriginalURL string   `json:"original_url"`
+	ShortURL    string   `json:"short_url,omitempty"`
+	Status      string   `json:"status"`
+	Code        string   `json:"code,omitempty"`
+	Rule        string   `json:"rule,omitempty"`
+	Detail      string   `json:"detail,omitempty"`
+	Ignored     []string `json:"ignored,omitempty"`
+}
+
+type importJobResponse struct {
+	ID        string              `json:"id"`
+	Status    string              `json:"status"`
+	Created   time.Time           `json:"created"`
+	Finished  *time.Time          `json:"finished,omitempty"`
+	Total     int                 `json:"total"`
+	Processed int                 `json:"processed"`
+	Failed    int                 `json:"failed"`
+	Error     string              `json:"error,omitempty"`
+	Rows      []importRowResponse `json:"rows"`
+}
+
+// apiStartImport accepts a CSV or NDJSON file of links and starts a background import.
+// Progress and per-row results are available at a URL from the Location header.
+func (s *Server) apiStartImport(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format, ok := importFormats[mediaType]
+	if err != nil || !ok {
+		s.writeProblem(w, r, http.StatusBadRequest, CodeBadContentType,
+			"content type must be text/csv or application/x-ndjson")
+		return
+	}
+
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, MaxImportSize+1))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if len(data) > MaxImportSize {
+		s.writeProblem(w, r, http.StatusRequestEntityTooLarge, CodeImportTooLarge,
+			fmt.Sprintf("import file must be at most %d bytes", MaxImportSize))
+		return
+	}
+
+	rows, err := app.ParseImport(bytes.NewReader(data), format)
+	if errors.Is(err, app.ErrImportTooLarge) {
+		s.writeProblem(w, r, http.StatusRequestEntityTooLarge, CodeImportTooLarge, err.Error())
+		return
+	} else if errors.Is(err, app.ErrBadImport) {
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidImport, err.Error())
+		return
+	} else if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	job, err := s.shortener.StartImport(r.Context(), user.UserID, rows)
+	if errors.Is(err, app.ErrTooManyImports) {
+		s.writeProblem(w, r, http.StatusTooManyRequests, CodeTooManyImports, "wait for running imports to finish")
+		return
+	} else if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/user/imports/"+job.ID)
+	s.apiWriteResponse(w, r, user, http.StatusAccepted, s.importJobResponse(r, job))
+}
+
+// apiImportStatus returns progress and per-row results of an import.
+func (s *Server) apiImportStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if user.IsIDGenerated {
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	}
+
+	job, err := s.shortener.Import(r.Context(), user.UserID, chi.URLParam(r, "id"))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.apiWriteResponse(w, r, user, http.StatusOK, s.importJobResponse(r, job))
+}
+
+func (s *Server) importJobResponse(r *http.Request, job *app.ImportJob) importJobResponse {
+	resp := importJobResponse{
+		ID:        job.ID,
+		Status:    string(job.Status),
+		Created:   job.Created,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Failed:    job.Failed,
+		Rows:      make([]importRowResponse, 0, len(job.Rows)),
+	}
+	if !job.Finished.IsZero() {
+		resp.Finished = &job.Finished
+	}
+	if job.Err != nil {
+		resp.Error = "import has been interrupted, rows after processed ones haven't been imported"
+	}
+
+	for _, row := range job.Rows {
+		item := importRowResponse{
+			Line:        row.Line,
+			OriginalURL: row.OriginalURL,
+			Status:      row.Status.String(),
+			Ignored:     row.Ignored,
+		}
+		if row.Status == app.BatchInvalid {
+			item.Code, item.Rule = importRowCode(row.Err)
+			item.Detail = row.Err.Error()
+		} else {
+			item.ShortURL = s.makeResultURL(r, row.Key)
+		}
+		resp.Rows = append(resp.Rows, item)
+	}
+
+	return resp
+}
+
+func importRowCode(err error) (string, string) {
+	switch {
+	case errors.Is(err, app.ErrUnsupportedField):
+		return CodeUnsupportedField, ""
+	case errors.Is(err, app.ErrBadImportValue):
+		return CodeInvalidValue, ""
+	}
+	return urlErrorCode(err)
+}
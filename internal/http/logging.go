@@ -0,0 +1,42 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/pkg/logging"
+)
+
+// logRequest assigns a request id, attaches a request-scoped logger to a request context
+// and writes an access log line when a request is done.
+func (s *Server) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := logging.AcceptRequestID(r.Header.Get(logging.RequestIDHeader))
+		w.Header().Set(logging.RequestIDHeader, requestID)
+
+		ctx, request := logging.NewContext(r.Context(), s.logger, requestID)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		fields := []zap.Field{
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", recorder.status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("bytes", recorder.bytes),
+		}
+		if rctx := chi.RouteContext(ctx); rctx != nil && len(rctx.RoutePattern()) != 0 {
+			fields = append(fields, zap.String("route", rctx.RoutePattern()))
+		}
+		if userID, ok := request.UserID(); ok {
+			fields = append(fields, zap.Uint64("user_id", userID))
+		}
+
+		logging.FromContext(ctx, s.logger).Info("request", fields...)
+	})
+}
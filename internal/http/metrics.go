@@ -0,0 +1,59 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/r4start/go-url-shortener/pkg/metrics"
+)
+
+// unmatchedRoute - route label of requests that don't match any route, it keeps label cardinality bounded.
+const unmatchedRoute = "unmatched"
+
+type serverMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+}
+
+func newServerMetrics(registry *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("http_requests_total",
+			"Number of HTTP requests by route and status code.", "method", "route", "code"),
+		latency: registry.NewHistogramVec("http_request_duration_seconds",
+			"HTTP request latencies by route.", metrics.DefaultBuckets, "method", "route"),
+	}
+}
+
+// collectMetrics accounts requests by a route pattern rather than a path, so short ids don't become labels.
+func (s *Server) collectMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePattern()) != 0 {
+			route = rctx.RoutePattern()
+		}
+
+		s.metrics.requests.Inc(r.Method, route, strconv.Itoa(recorder.status))
+		s.metrics.latency.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+func (s *Server) exportMetrics(w http.ResponseWriter, r *http.Request) {
+	realIP := r.Header.Get("x-real-ip")
+	userIP := net.ParseIP(realIP)
+	if userIP == nil || s.trustedNet == nil || !s.trustedNet.Contains(userIP) {
+		s.writeProblem(w, r, http.StatusForbidden, CodeForbidden, "")
+		return
+	}
+
+	s.metrics.registry.ServeHTTP(w, r)
+}
@@ -2,9 +2,12 @@ package http
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+
+	"go.uber.org/zap"
 )
 
 type gzipBodyReader struct {
@@ -12,19 +15,26 @@ type gzipBodyReader struct {
 }
 
 func (gz *gzipBodyReader) Read(p []byte) (n int, err error) {
-	return gz.gzipReader.Read(p)
+	n, err = gz.gzipReader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", ErrMalformedGzip, err)
+	}
+	return n, err
 }
 
 func (gz *gzipBodyReader) Close() error {
 	return gz.gzipReader.Close()
 }
 
-func DecompressGzip(next http.Handler) http.Handler {
+// decompressGzip replaces a gzip request body with a decompressed one. Errors of reading a malformed body
+// wrap ErrMalformedGzip.
+func (s *Server) decompressGzip(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Encoding") == "gzip" {
 			gz, err := gzip.NewReader(r.Body)
 			if err != nil {
-				http.Error(w, "", http.StatusInternalServerError)
+				s.requestLogger(r).Info("failed to read gzip body", zap.Error(err))
+				s.writeError(w, r, ErrMalformedGzip)
 				return
 			}
 			r.Body = &gzipBodyReader{gzipReader: gz}
@@ -35,14 +45,25 @@ func DecompressGzip(next http.Handler) http.Handler {
 
 type gzipBodyWriter struct {
 	http.ResponseWriter
-	writer io.Writer
+	writer *gzip.Writer
 }
 
 func (gz gzipBodyWriter) Write(b []byte) (int, error) {
 	return gz.writer.Write(b)
 }
 
-func CompressGzip(next http.Handler) http.Handler {
+// Flush sends compressed data written so far to a client.
+func (gz gzipBodyWriter) Flush() {
+	if err := gz.writer.Flush(); err != nil {
+		return
+	}
+	if f, ok := gz.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// compressGzip compresses responses for clients that accept gzip.
+func (s *Server) compressGzip(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 			next.ServeHTTP(w, r)
@@ -51,7 +72,8 @@ func CompressGzip(next http.Handler) http.Handler {
 
 		gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
 		if err != nil {
-			http.Error(w, "", http.StatusInternalServerError)
+			s.requestLogger(r).Error("failed to create gzip writer", zap.Error(err))
+			s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
 			return
 		}
 		defer gz.Close()
@@ -65,3 +87,27 @@ func CompressGzip(next http.Handler) http.Handler {
 		}, r)
 	})
 }
+
+// statusRecorder remembers a status code and a size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.status = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/oidc"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+const (
+	// LoginCookieName - a cookie that keeps a pending login between a redirect to a provider and a callback.
+	LoginCookieName = "gusoidc"
+
+	loginCookiePath   = "/api/auth"
+	loginCookieMaxAge = 600
+	defaultReturnPath = "/"
+)
+
+// pendingLogin - a login state kept by a browser.
+type pendingLogin struct {
+	oidc.AuthRequest
+	ReturnTo string `json:"return_to"`
+}
+
+// authLogin redirects a user to an identity provider. An optional return_to parameter
+// is a local path a user gets back to after the login.
+func (s *Server) authLogin(w http.ResponseWriter, r *http.Request) {
+	request, err := oidc.NewAuthRequest()
+	if err != nil {
+		s.requestLogger(r).Error("failed to create auth request", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+		return
+	}
+
+	login := pendingLogin{
+		AuthRequest: *request,
+		ReturnTo:    localPath(r.URL.Query().Get("return_to")),
+	}
+
+	authURL, err := s.identityProvider.AuthURL(r.Context(), request)
+	if err != nil {
+		s.requestLogger(r).Error("failed to prepare auth url", zap.Error(err))
+		s.writeProblem(w, r, http.StatusBadGateway, CodeProviderUnavailable, "")
+		return
+	}
+
+	data, err := json.Marshal(login)
+	if err != nil {
+		s.requestLogger(r).Error("failed to marshal login state", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+		return
+	}
+
+	setLoginCookie(w, base64.RawURLEncoding.EncodeToString(data), loginCookieMaxAge)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// authCallback completes a login: it checks the state, exchanges the code and binds the identity to a user.
+func (s *Server) authCallback(w http.ResponseWriter, r *http.Request) {
+	login, err := readLoginCookie(r)
+	if err != nil {
+		s.writeProblem(w, r, http.StatusBadRequest, CodeBadLoginState, "login hasn't been started")
+		return
+	}
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		s.writeProblem(w, r, http.StatusBadRequest, CodeBadLoginState, "state doesn't match")
+		return
+	}
+
+	// The login is over whatever its result is, a state is never accepted twice.
+	setLoginCookie(w, "", -1)
+
+	if e := query.Get("error"); len(e) != 0 {
+		s.requestLogger(r).Info("login has been rejected by provider", zap.String("error", e))
+		s.writeProblem(w, r, http.StatusUnauthorized, CodeLoginFailed, "login has been rejected by provider")
+		return
+	}
+
+	claims, err := s.identityProvider.Exchange(r.Context(), query.Get("code"), &login.AuthRequest)
+	if errors.Is(err, oidc.ErrBadIDToken) || errors.Is(err, oidc.ErrExchange) {
+		s.requestLogger(r).Info("login failed", zap.Error(err))
+		s.writeProblem(w, r, http.StatusUnauthorized, CodeLoginFailed, "")
+		return
+	} else if err != nil {
+		s.requestLogger(r).Error("failed to exchange code", zap.Error(err))
+		s.writeProblem(w, r, http.StatusBadGateway, CodeProviderUnavailable, "")
+		return
+	}
+
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	identity := storage.Identity{Issuer: claims.Issuer, Subject: claims.Subject}
+	userID, err := s.shortener.Login(r.Context(), identity)
+	if errors.Is(err, app.ErrIdentitiesUnsupported) {
+		s.writeProblem(w, r, http.StatusNotImplemented, CodeNotImplemented, "storage doesn't support identities")
+		return
+	} else if err != nil {
+		s.requestLogger(r).Error("failed to bind identity", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+		return
+	}
+
+	// Links created anonymously in this browser join the account.
+	if !user.IsIDGenerated && !user.isAccount() {
+		if cookie, err := r.Cookie(UserIDCookieName); err == nil {
+			_, err := s.shortener.ClaimLinks(r.Context(), cookie.Value, userID)
+			if err != nil && !errors.Is(err, app.ErrMergeUnsupported) {
+				s.requestLogger(r).Error("failed to claim anonymous links", zap.Error(err))
+			}
+		}
+	}
+
+	if err := s.setUserID(w, &apiRequestData{UserID: userID, Scopes: []string{app.ScopeAccount}}); err != nil {
+		s.requestLogger(r).Error("failed to set user id", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+		return
+	}
+
+	http.Redirect(w, r, login.ReturnTo, http.StatusSeeOther)
+}
+
+func setLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	w.Header().Add("set-cookie", fmt.Sprintf(`%s=%s; Path=%s; Max-Age=%d; HttpOnly; SameSite=Lax`,
+		LoginCookieName, value, loginCookiePath, maxAge))
+}
+
+func readLoginCookie(r *http.Request) (*pendingLogin, error) {
+	cookie, err := r.Cookie(LoginCookieName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	login := &pendingLogin{}
+	if err := json.Unmarshal(data, login); err != nil {
+		return nil, err
+	}
+	if len(login.State) == 0 {
+		return nil, ErrBadRequest
+	}
+	login.ReturnTo = localPath(login.ReturnTo)
+
+	return login, nil
+}
+
+// localPath returns path if it points to this service, so a login can't redirect users to other sites.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\r\n") {
+		return defaultReturnPath
+	}
+	return path
+}
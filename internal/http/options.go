@@ -2,6 +2,10 @@ package http
 
 import (
 	"net"
+
+	"github.com/r4start/go-url-shortener/pkg/metrics"
+	"github.com/r4start/go-url-shortener/pkg/oidc"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 )
 
 type ServerConfigurator func(s *Server)
@@ -17,3 +21,24 @@ func WithTrustedNetwork(network *net.IPNet) ServerConfigurator {
 		s.trustedNet = network
 	}
 }
+
+// WithMetrics enables request metrics and exports registry metrics at /metrics for the trusted network.
+func WithMetrics(registry *metrics.Registry) ServerConfigurator {
+	return func(s *Server) {
+		s.metrics = newServerMetrics(registry)
+	}
+}
+
+// WithTracer enables request tracing with W3C trace context propagation.
+func WithTracer(t *tracing.Tracer) ServerConfigurator {
+	return func(s *Server) {
+		s.tracer = t
+	}
+}
+
+// WithIdentityProvider enables logins with an OpenID Connect provider at /api/auth/login.
+func WithIdentityProvider(p *oidc.Provider) ServerConfigurator {
+	return func(s *Server) {
+		s.identityProvider = p
+	}
+}
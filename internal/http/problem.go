@@ -0,0 +1,197 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/logging"
+	"github.com/r4start/go-url-shortener/pkg/storage"
+)
+
+// ProblemContentType - a media type of error responses, see RFC 7807.
+const ProblemContentType = "application/problem+json"
+
+// Error codes of problem responses. They are a part of the API and never change their meaning.
+const (
+	CodeBadContentType        = "bad_content_type"
+	CodeMalformedJSON         = "malformed_json"
+	CodeMalformedGzip         = "malformed_gzip"
+	CodeMissingField          = "missing_field"
+	CodeInvalidParameter      = "invalid_parameter"
+	CodeInvalidImport         = "invalid_import"
+	CodeImportTooLarge        = "import_too_large"
+	CodeInvalidValue          = "invalid_value"
+	CodeUnsupportedField      = "unsupported_field"
+	CodeTooManyImports        = "too_many_imports"
+	CodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	CodeIdempotencyInProgress = "idempotency_in_progress"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeInvalidURL            = "invalid_url"
+	CodeForbiddenURL          = "forbidden_url"
+	CodeInvalidShortURL       = "invalid_short_url"
+	CodeInvalidStatsQuery     = "invalid_stats_query"
+	CodeInvalidAPIKeyName     = "invalid_api_key_name"
+	CodeInvalidToken          = "invalid_token"
+	CodeNotFound              = "not_found"
+	CodeDeleted               = "deleted"
+	CodeBlocked               = "blocked"
+	CodeUnauthorized          = "unauthorized"
+	CodeForbidden             = "forbidden"
+	CodeAccountRequired       = "account_required"
+	CodeUnknownUser           = "unknown_user"
+	CodeTooManyAPIKeys        = "too_many_api_keys"
+	CodeAccountToken          = "account_token"
+	CodeMethodNotAllowed      = "method_not_allowed"
+	CodeBadLoginState         = "bad_login_state"
+	CodeLoginFailed           = "login_failed"
+	CodeProviderUnavailable   = "provider_unavailable"
+	CodeNotImplemented        = "not_implemented"
+	CodeUnavailable           = "unavailable"
+	CodeInternal              = "internal_error"
+)
+
+var (
+	// ErrBadContentType - a request body isn't JSON. It wraps ErrBadRequest.
+	ErrBadContentType = fmt.Errorf("%w: content type must be application/json", ErrBadRequest)
+	// ErrMalformedJSON - a request body can't be decoded. It wraps ErrBadRequest.
+	ErrMalformedJSON = fmt.Errorf("%w: malformed json", ErrBadRequest)
+	// ErrMalformedGzip - a gzip request body can't be decompressed. It wraps ErrBadRequest.
+	ErrMalformedGzip = fmt.Errorf("%w: malformed gzip body", ErrBadRequest)
+)
+
+// problem - an RFC 7807 problem details object. Code is a stable machine-readable error code,
+// Rule is a rule of the URL policy a forbidden URL breaks, RequestID lets a client refer to server logs.
+type problem struct {
+	Type      string        `json:"type"`
+	Title     string        `json:"title"`
+	Status    int           `json:"status"`
+	Detail    string        `json:"detail,omitempty"`
+	Instance  string        `json:"instance,omitempty"`
+	Code      string        `json:"code"`
+	Rule      string        `json:"rule,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+	Errors    []itemProblem `json:"errors,omitempty"`
+}
+
+// itemProblem - an error of a single item of a batch request.
+type itemProblem struct {
+	Index         int    `json:"index"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Code          string `json:"code"`
+	Rule          string `json:"rule,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+func newProblem(r *http.Request, status int, code, detail string) *problem {
+	p := &problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Code:     code,
+	}
+	if request := logging.RequestFromContext(r.Context()); request != nil {
+		p.RequestID = request.ID
+	}
+	return p
+}
+
+// batchProblem lists bad items of a batch, correlationID returns a client id of an item if there is one.
+func batchProblem(r *http.Request, err *app.BatchError, correlationID func(int) string) *problem {
+	p := newProblem(r, http.StatusBadRequest, CodeInvalidURL, "urls of the batch can't be shortened")
+	for _, item := range err.Items {
+		code, rule := urlErrorCode(item.Err)
+		problem := itemProblem{Index: item.Index, Code: code, Rule: rule, Detail: item.Err.Error()}
+		if correlationID != nil {
+			problem.CorrelationID = correlationID(item.Index)
+		}
+		p.Errors = append(p.Errors, problem)
+	}
+	return p
+}
+
+// urlErrorCode returns a code of a URL that can't be shortened and a policy rule of a forbidden one.
+func urlErrorCode(err error) (string, string) {
+	var policyErr *app.PolicyError
+	if errors.As(err, &policyErr) {
+		return CodeForbiddenURL, policyErr.Rule
+	}
+	return CodeInvalidURL, ""
+}
+
+// writeProblem responds with a problem details object.
+func (s *Server) writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	s.sendProblem(w, r, newProblem(r, status, code, detail))
+}
+
+func (s *Server) sendProblem(w http.ResponseWriter, r *http.Request, p *problem) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		s.requestLogger(r).Error("failed to marshal problem", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+
+	if _, err := w.Write(data); err != nil {
+		s.requestLogger(r).Error("failed to write problem", zap.Error(err))
+	}
+}
+
+// writeError responds with a problem for errors of request parsing, user identification and the shortener.
+// Unknown errors are logged and hidden behind an internal error.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var batchErr *app.BatchError
+	var policyErr *app.PolicyError
+
+	switch {
+	case errors.Is(err, ErrBadContentType):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeBadContentType, "content type must be application/json")
+	case errors.Is(err, ErrMalformedJSON):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeMalformedJSON, "request body isn't valid json")
+	case errors.Is(err, ErrMalformedGzip):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeMalformedGzip, "request body isn't valid gzip")
+	case errors.Is(err, ErrUnauthorized):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "credentials aren't accepted")
+	case errors.Is(err, app.ErrBadIdempotencyKey):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidIdempotencyKey,
+			fmt.Sprintf("idempotency key must be 1 to %d printable characters", app.MaxIdempotencyKeyLength))
+	case errors.Is(err, app.ErrIdempotencyInProgress):
+		w.Header().Set("Retry-After", "1")
+		s.writeProblem(w, r, http.StatusConflict, CodeIdempotencyInProgress, "request with the idempotency key is in progress")
+	case errors.Is(err, app.ErrIdempotencyKeyReused):
+		s.writeProblem(w, r, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+			"idempotency key has been used for another request")
+	case errors.As(err, &batchErr):
+		s.sendProblem(w, r, batchProblem(r, batchErr, nil))
+	case errors.As(err, &policyErr):
+		p := newProblem(r, http.StatusBadRequest, CodeForbiddenURL, policyErr.Error())
+		p.Rule = policyErr.Rule
+		s.sendProblem(w, r, p)
+	case errors.Is(err, app.ErrBadURL):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidURL, "url must be absolute and have a host")
+	case errors.Is(err, app.ErrBadShortID):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidShortURL, "short url id can't be decoded")
+	case errors.Is(err, app.ErrBadStatsQuery):
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidStatsQuery, err.Error())
+	case errors.Is(err, storage.ErrDeleted):
+		s.writeProblem(w, r, http.StatusGone, CodeDeleted, "short url has been deleted")
+	case errors.Is(err, storage.ErrBlocked):
+		s.writeProblem(w, r, http.StatusForbidden, CodeBlocked, "short url has been blocked as malicious")
+	case errors.Is(err, storage.ErrNotFound):
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+	default:
+		s.requestLogger(r).Error("failed to process request", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+	}
+}
@@ -7,24 +7,74 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"go.uber.org/zap"
 
 	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/logging"
+	"github.com/r4start/go-url-shortener/pkg/oidc"
 	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 )
 
 const (
 	UserIDCookieName = "gusid"
+
+	bearerPrefix = "Bearer "
+)
+
+var (
+	// ErrBadRequest - a request can't be parsed.
+	ErrBadRequest = errors.New("bad request")
+	// ErrUnauthorized - a request has credentials that can't be accepted.
+	ErrUnauthorized = errors.New("unauthorized")
 )
 
-var ErrBadRequest = errors.New("bad request")
+// blockedPage - a page served instead of a redirect to a blocked destination.
+const blockedPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Link blocked</title></head>
+<body>
+<h1>This link has been blocked</h1>
+<p>The destination of this short link has been reported as phishing or malware, so you haven't been redirected there.</p>
+</body>
+</html>
+`
+
+// purposeHeaders - headers that browsers and link previewers use to mark speculative requests.
+var purposeHeaders = []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"}
 
 type apiRequestData struct {
 	UserID        uint64
 	IsIDGenerated bool
+	RefreshToken  bool
+	// Scopes - scopes of a user token, they are kept when the token is refreshed.
+	Scopes []string
+	// APIKey - a user is authenticated with an API key rather than a cookie.
+	APIKey bool
+}
+
+// needsCookie returns true if a user token must be sent to a client.
+func (d *apiRequestData) needsCookie() bool {
+	return d != nil && (d.IsIDGenerated || d.RefreshToken)
+}
+
+// isAccount returns true if a user has logged in or uses an API key, i.e. isn't just an anonymous cookie.
+func (d *apiRequestData) isAccount() bool {
+	if d.APIKey {
+		return true
+	}
+	for _, scope := range d.Scopes {
+		if scope == app.ScopeAccount {
+			return true
+		}
+	}
+	return false
 }
 
 type Server struct {
@@ -33,6 +83,10 @@ type Server struct {
 	domain     string
 	logger     *zap.Logger
 	trustedNet *net.IPNet
+	metrics    *serverMetrics
+	tracer     *tracing.Tracer
+
+	identityProvider *oidc.Provider
 }
 
 func NewHTTPServer(shortener *app.URLShortener, logger *zap.Logger, opts ...ServerConfigurator) (*Server, error) {
@@ -46,54 +100,85 @@ func NewHTTPServer(shortener *app.URLShortener, logger *zap.Logger, opts ...Serv
 		o(handler)
 	}
 
-	handler.Use(DecompressGzip)
-	handler.Use(CompressGzip)
+	handler.Use(handler.logRequest)
+
+	if handler.tracer != nil {
+		handler.Use(handler.traceRequest)
+	}
+
+	if handler.metrics != nil {
+		handler.Use(handler.collectMetrics)
+	}
+
+	handler.Use(handler.decompressGzip)
+	handler.Use(handler.compressGzip)
+
+	if handler.tracer != nil {
+		handler.Use(handler.traceRouting)
+	}
 
 	handler.Get("/{id}", handler.getURL)
 	handler.Get("/ping", handler.ping)
 
 	handler.Get("/api/user/urls", handler.apiUserURLs)
 	handler.Delete("/api/user/urls", handler.apiDeleteUserURLs)
+	handler.Get("/api/user/urls/{id}/stats", handler.apiLinkStats)
+	handler.Get("/api/user/stats", handler.apiUserStats)
 
-	handler.Post("/", handler.shorten)
-	handler.Post("/api/shorten", handler.apiShortener)
-	handler.Post("/api/shorten/batch", handler.apiBatchShortener)
+	handler.Get("/api/user/keys", handler.apiUserAPIKeys)
+	handler.Post("/api/user/keys", handler.apiCreateAPIKey)
+	handler.Delete("/api/user/keys/{id}", handler.apiRevokeAPIKey)
+	handler.Post("/api/user/claim", handler.apiClaimLinks)
+	handler.Post("/api/user/imports", handler.apiStartImport)
+	handler.Get("/api/user/imports/{id}", handler.apiImportStatus)
+
+	shorten := handler.With(handler.idempotent)
+	shorten.Post("/", handler.shorten)
+	shorten.Post("/api/shorten", handler.apiShortener)
+	shorten.Post("/api/shorten/batch", handler.apiBatchShortener)
 
 	handler.Get("/api/internal/stats", handler.apiInternalStats)
 
+	if handler.identityProvider != nil {
+		handler.Get("/api/auth/login", handler.authLogin)
+		handler.Get("/api/auth/callback", handler.authCallback)
+	}
+
+	if handler.metrics != nil {
+		handler.Get("/metrics", handler.exportMetrics)
+	}
+
 	handler.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "", http.StatusBadRequest)
+		handler.writeProblem(w, r, http.StatusBadRequest, CodeMethodNotAllowed, "")
 	})
 
 	return handler, nil
 }
 
 func (s *Server) shorten(w http.ResponseWriter, r *http.Request) {
-	userID, generated, err := s.getUserID(r)
+	user, err := s.getUser(r)
 	if err != nil {
-		s.logger.Error("failed to generate user id", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
 
-	res, err := s.shortener.Shorten(r.Context(), userID, string(b))
+	res, err := s.shortener.Shorten(r.Context(), user.UserID, string(b))
 	if err != nil {
-		s.logger.Error("failed to generate short id", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+		s.requestLogger(r).Info("failed to generate short id", zap.Error(err))
+		s.writeError(w, r, err)
 		return
 	}
 
-	if generated {
-		if err := s.setUserID(w, userID); err != nil {
-			s.logger.Error("failed to set user id", zap.Error(err))
-			http.Error(w, "", http.StatusInternalServerError)
+	if user.needsCookie() {
+		if err := s.setUserID(w, user); err != nil {
+			s.requestLogger(r).Error("failed to set user id", zap.Error(err))
+			s.writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
 			return
 		}
 	}
@@ -105,20 +190,35 @@ func (s *Server) shorten(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if _, err := w.Write([]byte(s.makeResultURL(r, res.Key))); err != nil {
-		s.logger.Error("failed to write response body", zap.Error(err))
+		s.requestLogger(r).Error("failed to write response body", zap.Error(err))
 	}
 }
 
 func (s *Server) getURL(w http.ResponseWriter, r *http.Request) {
 	keyData := chi.URLParam(r, "id")
 
-	u, err := s.shortener.OriginalURL(r.Context(), keyData)
-	if err == storage.ErrDeleted {
-		w.WriteHeader(http.StatusGone)
+	u, err := s.shortener.Redirect(r.Context(), keyData, visitorFromRequest(r))
+	switch {
+	case err == nil:
+	case errors.Is(err, storage.ErrDeleted):
+		s.writeError(w, r, err)
 		return
-	} else if err != nil {
-		s.logger.Error("failed to get original url", zap.Error(err))
-		http.Error(w, "", http.StatusNotFound)
+	case errors.Is(err, storage.ErrBlocked):
+		s.requestLogger(r).Info("blocked short url has been requested", zap.String("id", keyData))
+		// A link can be unblocked, so the page mustn't be cached.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusForbidden)
+		if _, err := io.WriteString(w, blockedPage); err != nil {
+			s.requestLogger(r).Error("failed to write response body", zap.Error(err))
+		}
+		return
+	case errors.Is(err, app.ErrBadShortID), errors.Is(err, storage.ErrNotFound):
+		s.requestLogger(r).Info("failed to get original url", zap.Error(err))
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	default:
+		s.writeError(w, r, err)
 		return
 	}
 
@@ -130,25 +230,21 @@ func (s *Server) apiShortener(w http.ResponseWriter, r *http.Request) {
 	var request map[string]string
 
 	reqData, err := s.apiParseRequest(r, &request)
-	if errors.Is(err, ErrBadRequest) {
-		http.Error(w, "", http.StatusBadRequest)
-		return
-	} else if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+	if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
 
 	urlToShorten, ok := request["url"]
 	if !ok {
-		s.logger.Error("empty url in request body")
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeProblem(w, r, http.StatusBadRequest, CodeMissingField, "url is required")
 		return
 	}
 
 	res, err := s.shortener.Shorten(r.Context(), reqData.UserID, urlToShorten)
 	if err != nil {
-		s.logger.Error("failed to generate short id", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+		s.requestLogger(r).Info("failed to generate short id", zap.Error(err))
+		s.writeError(w, r, err)
 		return
 	}
 
@@ -159,9 +255,11 @@ func (s *Server) apiShortener(w http.ResponseWriter, r *http.Request) {
 	if res.Exists {
 		statusCode = http.StatusConflict
 	}
-	s.apiWriteResponse(w, reqData, statusCode, response)
+	s.apiWriteResponse(w, r, reqData, statusCode, response)
 }
 
+// apiBatchShortener shortens a batch of URLs. Bad URLs are reported in their items and the response is
+// 207 Multi-Status, a batch with no good URLs fails. With atomic=true a bad URL fails the whole batch.
 func (s *Server) apiBatchShortener(w http.ResponseWriter, r *http.Request) {
 	type request struct {
 		CorrelationID string `json:"correlation_id"`
@@ -170,18 +268,29 @@ func (s *Server) apiBatchShortener(w http.ResponseWriter, r *http.Request) {
 
 	type response struct {
 		CorrelationID string `json:"correlation_id"`
-		ShortURL      string `json:"short_url"`
+		ShortURL      string `json:"short_url,omitempty"`
+		Status        string `json:"status"`
+		Code          string `json:"code,omitempty"`
+		Rule          string `json:"rule,omitempty"`
+		Detail        string `json:"detail,omitempty"`
+	}
+
+	mode := app.BatchPartial
+	if v := r.URL.Query().Get("atomic"); len(v) != 0 {
+		atomic, err := strconv.ParseBool(v)
+		if err != nil {
+			s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "atomic must be a boolean")
+			return
+		}
+		if atomic {
+			mode = app.BatchAtomic
+		}
 	}
 
 	requestData := make([]request, 0)
 	reqData, err := s.apiParseRequest(r, &requestData)
-	if errors.Is(err, ErrBadRequest) {
-		s.logger.Error("bad request", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
-		return
-	} else if err != nil {
-		s.logger.Error("failed to parse request", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+	if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
 
@@ -190,41 +299,68 @@ func (s *Server) apiBatchShortener(w http.ResponseWriter, r *http.Request) {
 		urls = append(urls, e.OriginalURL)
 	}
 
-	encodedIds, err := s.shortener.BatchShorten(r.Context(), reqData.UserID, urls)
-	if err != nil {
-		s.logger.Error("failed to generate short ids", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+	results, err := s.shortener.BatchShorten(r.Context(), reqData.UserID, urls, mode)
+	var batchErr *app.BatchError
+	if errors.As(err, &batchErr) {
+		s.sendProblem(w, r, batchProblem(r, batchErr, func(i int) string { return requestData[i].CorrelationID }))
+		return
+	} else if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
 
-	responseData := make([]response, 0, len(encodedIds))
-	for i, dst := range encodedIds {
-		responseData = append(responseData, response{
+	invalid := &app.BatchError{}
+	responseData := make([]response, 0, len(results))
+	for i, res := range results {
+		item := response{
 			CorrelationID: requestData[i].CorrelationID,
-			ShortURL:      s.makeResultURL(r, dst),
-		})
+			Status:        res.Status.String(),
+		}
+		if res.Status == app.BatchInvalid {
+			invalid.Items = append(invalid.Items, app.BatchURLError{Index: i, Err: res.Err})
+			item.Code, item.Rule = urlErrorCode(res.Err)
+			item.Detail = res.Err.Error()
+		} else {
+			item.ShortURL = s.makeResultURL(r, res.Key)
+		}
+		responseData = append(responseData, item)
+	}
+
+	statusCode := http.StatusCreated
+	if len(invalid.Items) != 0 {
+		if len(invalid.Items) == len(results) {
+			s.sendProblem(w, r, batchProblem(r, invalid, func(i int) string { return requestData[i].CorrelationID }))
+			return
+		}
+		statusCode = http.StatusMultiStatus
 	}
 
-	s.apiWriteResponse(w, reqData, http.StatusCreated, responseData)
+	s.apiWriteResponse(w, r, reqData, statusCode, responseData)
 }
 
+// apiUserURLs lists active links of a user as JSON. CSV and NDJSON, asked for with an Accept header,
+// export all links with their creation times and states.
 func (s *Server) apiUserURLs(w http.ResponseWriter, r *http.Request) {
-	userID, generated, err := s.getUserID(r)
+	user, err := s.getUser(r)
 	if err != nil {
-		s.logger.Error("failed to generate user id", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
 
-	if generated {
+	w.Header().Add("Vary", "Accept")
+	if user.IsIDGenerated {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	userUrls, err := s.shortener.UserURLs(r.Context(), userID)
+	if mediaType := negotiateExport(r.Header.Get("Accept")); mediaType != mediaJSON {
+		s.exportUserURLs(w, r, user, mediaType)
+		return
+	}
+
+	userUrls, err := s.shortener.UserURLs(r.Context(), user.UserID)
 	if err != nil {
-		s.logger.Error("failed to get user data", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
 
@@ -241,43 +377,151 @@ func (s *Server) apiUserURLs(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	s.apiWriteResponse(w, &apiRequestData{
-		UserID: userID,
-	}, http.StatusOK, result)
+	s.apiWriteResponse(w, r, user, http.StatusOK, result)
 }
 
 func (s *Server) apiDeleteUserURLs(w http.ResponseWriter, r *http.Request) {
 	requestData := make([]string, 0)
 	reqData, err := s.apiParseRequest(r, &requestData)
-	if errors.Is(err, ErrBadRequest) {
-		s.logger.Error("bad request", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
-		return
-	} else if err != nil {
-		s.logger.Error("failed to parse request", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+	if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
 
 	if reqData.IsIDGenerated {
-		s.logger.Error("unknown user id")
-		http.Error(w, "", http.StatusBadRequest)
+		s.writeProblem(w, r, http.StatusBadRequest, CodeUnknownUser, "user has no urls")
 		return
 	}
 
 	if err := s.shortener.DeleteUserURLs(r.Context(), reqData.UserID, requestData); err != nil {
-		s.logger.Error("failed to delete user urls", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (s *Server) apiLinkStats(w http.ResponseWriter, r *http.Request) {
+	type dailyStats struct {
+		Date           string `json:"date"`
+		Clicks         uint64 `json:"clicks"`
+		BotClicks      uint64 `json:"bot_clicks"`
+		UniqueVisitors uint64 `json:"unique_visitors"`
+	}
+
+	type response struct {
+		ShortURL       string       `json:"short_url"`
+		Clicks         uint64       `json:"clicks"`
+		BotClicks      uint64       `json:"bot_clicks"`
+		UniqueVisitors uint64       `json:"unique_visitors"`
+		Days           []dailyStats `json:"days"`
+	}
+
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if user.IsIDGenerated {
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	}
+
+	keyData := chi.URLParam(r, "id")
+	stats, err := s.shortener.LinkStats(r.Context(), user.UserID, keyData)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, app.ErrBadShortID) {
+		s.writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	} else if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	resp := response{
+		ShortURL:       s.makeResultURL(r, []byte(keyData)),
+		Clicks:         stats.Clicks,
+		BotClicks:      stats.BotClicks,
+		UniqueVisitors: stats.UniqueVisitors,
+		Days:           make([]dailyStats, 0, len(stats.Days)),
+	}
+	for _, d := range stats.Days {
+		resp.Days = append(resp.Days, dailyStats{
+			Date:           d.Day.Format("2006-01-02"),
+			Clicks:         d.Clicks,
+			BotClicks:      d.BotClicks,
+			UniqueVisitors: d.UniqueVisitors,
+		})
+	}
+
+	s.apiWriteResponse(w, r, user, http.StatusOK, resp)
+}
+
+func (s *Server) apiUserStats(w http.ResponseWriter, r *http.Request) {
+	type dailyStats struct {
+		Date    string `json:"date"`
+		Created uint64 `json:"created"`
+	}
+
+	type topLink struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+		Clicks      uint64 `json:"clicks"`
+	}
+
+	type response struct {
+		ActiveURLs  uint64       `json:"active_urls"`
+		DeletedURLs uint64       `json:"deleted_urls"`
+		TotalClicks uint64       `json:"total_clicks"`
+		TopLinks    []topLink    `json:"top_links"`
+		Created     []dailyStats `json:"created"`
+	}
+
+	user, err := s.getUser(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if user.IsIDGenerated {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	stats, err := s.shortener.UserStats(r.Context(), user.UserID)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	resp := response{
+		ActiveURLs:  stats.ActiveURLs,
+		DeletedURLs: stats.DeletedURLs,
+		TotalClicks: stats.TotalClicks,
+		TopLinks:    make([]topLink, 0, len(stats.TopLinks)),
+		Created:     make([]dailyStats, 0, len(stats.Created)),
+	}
+	for _, t := range stats.TopLinks {
+		resp.TopLinks = append(resp.TopLinks, topLink{
+			ShortURL:    s.makeResultURL(r, t.Key),
+			OriginalURL: t.OriginalURL,
+			Clicks:      t.Clicks,
+		})
+	}
+	for _, d := range stats.Created {
+		resp.Created = append(resp.Created, dailyStats{
+			Date:    d.Start.Format("2006-01-02"),
+			Created: d.Count,
+		})
+	}
+
+	s.apiWriteResponse(w, r, user, http.StatusOK, resp)
+}
+
 func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
 	if err := s.shortener.Ping(r.Context()); err != nil {
-		s.logger.Error("failed to ping shortener", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.requestLogger(r).Error("failed to ping shortener", zap.Error(err))
+		s.writeProblem(w, r, http.StatusInternalServerError, CodeUnavailable, "storage isn't available")
 		return
 	}
 
@@ -285,31 +529,77 @@ func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) apiInternalStats(w http.ResponseWriter, r *http.Request) {
+	type point struct {
+		Start time.Time `json:"start"`
+		Count uint64    `json:"count"`
+	}
+
+	type topLink struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+		Clicks      uint64 `json:"clicks"`
+	}
+
 	type response struct {
-		URLs  uint64 `json:"urls"`
-		Users uint64 `json:"users"`
+		URLs          uint64    `json:"urls"`
+		Users         uint64    `json:"users"`
+		From          time.Time `json:"from"`
+		To            time.Time `json:"to"`
+		BucketSeconds int64     `json:"bucket_seconds"`
+		Created       []point   `json:"created"`
+		Deleted       []point   `json:"deleted"`
+		Redirects     []point   `json:"redirects"`
+		TopLinks      []topLink `json:"top_links"`
 	}
 
 	realIP := r.Header.Get("x-real-ip")
 	userIP := net.ParseIP(realIP)
 	if userIP == nil || s.trustedNet == nil || !s.trustedNet.Contains(userIP) {
-		http.Error(w, "", http.StatusForbidden)
+		s.writeProblem(w, r, http.StatusForbidden, CodeForbidden, "")
 		return
 	}
 
-	stat, err := s.shortener.Stat(r.Context())
+	query, err := parseStatsQuery(r)
 	if err != nil {
-		s.logger.Error("failed to get stats", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.writeProblem(w, r, http.StatusBadRequest, CodeInvalidStatsQuery, err.Error())
 		return
 	}
 
+	stat, err := s.shortener.Stat(r.Context(), *query)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	makeSeries := func(buckets []storage.TimeBucket) []point {
+		result := make([]point, 0, len(buckets))
+		for _, b := range buckets {
+			result = append(result, point{Start: b.Start, Count: b.Count})
+		}
+		return result
+	}
+
 	resp := response{
-		URLs:  stat.URLs,
-		Users: stat.Users,
+		URLs:          stat.URLs,
+		Users:         stat.Users,
+		From:          stat.From,
+		To:            stat.To,
+		BucketSeconds: int64(stat.Bucket.Seconds()),
+		Created:       makeSeries(stat.Created),
+		Deleted:       makeSeries(stat.Deleted),
+		Redirects:     makeSeries(stat.Redirects),
+		TopLinks:      make([]topLink, 0, len(stat.TopLinks)),
+	}
+
+	for _, t := range stat.TopLinks {
+		resp.TopLinks = append(resp.TopLinks, topLink{
+			ShortURL:    s.makeResultURL(r, t.Key),
+			OriginalURL: t.OriginalURL,
+			Clicks:      t.Clicks,
+		})
 	}
 
-	s.apiWriteResponse(w, nil /*apiRequestData*/, http.StatusOK, resp)
+	s.apiWriteResponse(w, r, nil /*apiRequestData*/, http.StatusOK, resp)
 }
 
 func (s *Server) makeResultURL(r *http.Request, data []byte) string {
@@ -327,44 +617,40 @@ func (s *Server) makeResultURL(r *http.Request, data []byte) string {
 
 func (s *Server) apiParseRequest(r *http.Request, body interface{}) (*apiRequestData, error) {
 	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
-		return nil, ErrBadRequest
+		s.requestLogger(r).Info("bad content type", zap.String("content_type", contentType))
+		return nil, ErrBadContentType
 	}
 
-	userID, generated, err := s.getUserID(r)
+	user, err := s.getUser(r)
 	if err != nil {
-		s.logger.Error("failed to generate user id", zap.Error(err))
 		return nil, err
 	}
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
 		return nil, err
 	}
 
 	if err = json.Unmarshal(b, &body); err != nil {
-		s.logger.Error("failed to unmarshal request json", zap.Error(err))
-		return nil, ErrBadRequest
+		s.requestLogger(r).Info("failed to unmarshal request json", zap.Error(err))
+		return nil, ErrMalformedJSON
 	}
-	return &apiRequestData{
-		UserID:        userID,
-		IsIDGenerated: generated,
-	}, nil
+	return user, nil
 }
 
-func (s *Server) apiWriteResponse(w http.ResponseWriter, reqData *apiRequestData, statusCode int, response interface{}) {
+func (s *Server) apiWriteResponse(w http.ResponseWriter, r *http.Request, reqData *apiRequestData, statusCode int,
+	response interface{}) {
 	dst, err := json.Marshal(response)
 	if err != nil {
-		s.logger.Error("failed to marshal response", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		s.requestLogger(r).Error("failed to marshal response", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if reqData != nil && reqData.IsIDGenerated {
-		if err := s.setUserID(w, reqData.UserID); err != nil {
-			s.logger.Error("failed to set user id", zap.Error(err))
-			http.Error(w, "", http.StatusInternalServerError)
+	if reqData.needsCookie() {
+		if err := s.setUserID(w, reqData); err != nil {
+			s.requestLogger(r).Error("failed to set user id", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 	}
@@ -373,28 +659,146 @@ func (s *Server) apiWriteResponse(w http.ResponseWriter, reqData *apiRequestData
 	w.WriteHeader(statusCode)
 
 	if _, err := w.Write(dst); err != nil {
-		s.logger.Error("failed to write response body", zap.Error(err))
+		s.requestLogger(r).Error("failed to write response body", zap.Error(err))
 	}
 }
 
-func (s *Server) getUserID(r *http.Request) (uint64, bool, error) {
+// parseStatsQuery reads window, bucket and top query parameters.
+// Durations are accepted in Go format or as a number of days, e.g. "7d".
+func parseStatsQuery(r *http.Request) (*app.StatsQuery, error) {
+	query := &app.StatsQuery{}
+	values := r.URL.Query()
+
+	var err error
+	if v := values.Get("window"); len(v) != 0 {
+		if query.Window, err = parseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := values.Get("bucket"); len(v) != 0 {
+		if query.Bucket, err = parseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := values.Get("top"); len(v) != 0 {
+		if query.Top, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return query, nil
+}
+
+func parseDuration(v string) (time.Duration, error) {
+	if days := strings.TrimSuffix(v, "d"); days != v {
+		count, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(v)
+}
+
+func visitorFromRequest(r *http.Request) *app.Visitor {
+	ip := r.Header.Get("x-real-ip")
+	if len(ip) == 0 {
+		ip = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = host
+		}
+	}
+
+	visitor := &app.Visitor{
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+
+	for _, h := range purposeHeaders {
+		if v := r.Header.Get(h); len(v) != 0 {
+			visitor.Purpose = v
+			break
+		}
+	}
+
+	return visitor
+}
+
+// getUser reads a user from an API key or a cookie. A request with a bad API key fails with ErrUnauthorized.
+// A new user is generated if there is no cookie or its token can't be accepted,
+// e.g. it has expired or has been signed with a retired key.
+func (s *Server) getUser(r *http.Request) (*apiRequestData, error) {
+	user := &apiRequestData{}
+
+	if authorization := r.Header.Get("Authorization"); len(authorization) != 0 {
+		key := strings.TrimPrefix(authorization, bearerPrefix)
+		if len(key) == len(authorization) {
+			return nil, ErrUnauthorized
+		}
+
+		userID, err := s.shortener.AuthenticateAPIKey(r.Context(), key)
+		if errors.Is(err, app.ErrInvalidAPIKey) {
+			return nil, ErrUnauthorized
+		} else if err != nil {
+			return nil, err
+		}
+
+		user.UserID = userID
+		user.APIKey = true
+		logging.SetUserID(r.Context(), user.UserID)
+		return user, nil
+	}
+
 	userIDCookie, err := r.Cookie(UserIDCookieName)
-	if err == http.ErrNoCookie {
-		return s.shortener.GetUserID(nil)
-	} else if err != nil {
-		return 0, false, err
+	if err == nil {
+		token, err := s.shortener.AuthenticateUser(r.Context(), userIDCookie.Value)
+		if err == nil {
+			user.UserID = token.UserID
+			user.RefreshToken = token.NeedsRefresh(time.Now())
+			user.Scopes = token.Scopes
+		} else if errors.Is(err, app.ErrInvalidToken) {
+			s.requestLogger(r).Info("user token isn't accepted", zap.Error(err))
+			user.IsIDGenerated = true
+		} else {
+			return nil, err
+		}
+	} else if err == http.ErrNoCookie {
+		user.IsIDGenerated = true
+	} else {
+		return nil, err
+	}
+
+	if user.IsIDGenerated {
+		if user.UserID, _, err = s.shortener.GetUserID(nil); err != nil {
+			return nil, err
+		}
 	}
 
-	return s.shortener.GetUserID(&userIDCookie.Value)
+	logging.SetUserID(r.Context(), user.UserID)
+	return user, nil
+}
+
+// requestLogger returns a logger annotated with a request id.
+func (s *Server) requestLogger(r *http.Request) *zap.Logger {
+	return logging.FromContext(r.Context(), s.logger)
 }
 
-func (s *Server) setUserID(w http.ResponseWriter, userID uint64) error {
-	cookieValue, err := s.shortener.GenerateUserID(userID)
+func (s *Server) setUserID(w http.ResponseWriter, user *apiRequestData) error {
+	cookieValue, err := s.shortener.GenerateUserID(user.UserID, user.Scopes...)
 	if err != nil {
 		return err
 	}
 
-	w.Header().Set("set-cookie", fmt.Sprintf(`%s=%s; Path=/`, UserIDCookieName, *cookieValue))
+	w.Header().Add("set-cookie", fmt.Sprintf(`%s=%s; Path=/; Max-Age=%d`,
+		UserIDCookieName, *cookieValue, int64(s.shortener.UserTokenTTL().Seconds())))
 
 	return nil
 }
+
+// expireUserID removes the user id cookie from a browser.
+func expireUserID(w http.ResponseWriter) {
+	w.Header().Add("set-cookie", fmt.Sprintf(`%s=; Path=/; Max-Age=-1`, UserIDCookieName))
+}
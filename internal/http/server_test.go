@@ -2,24 +2,34 @@ package http
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/r4start/go-url-shortener/internal/app"
+	"github.com/r4start/go-url-shortener/pkg/metrics"
+	"github.com/r4start/go-url-shortener/pkg/oidc"
+	"github.com/r4start/go-url-shortener/pkg/oidc/oidctest"
 	"github.com/r4start/go-url-shortener/pkg/storage"
+	"github.com/r4start/go-url-shortener/pkg/tracing"
 )
 
 type batchShortenRequest struct {
@@ -30,7 +40,8 @@ type batchShortenRequest struct {
 func testServer(t *testing.T) *Server {
 	logger, _ := zap.NewDevelopment()
 	st := storage.NewInMemoryStorage()
-	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithStat(st))
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithStat(st), app.WithClickStat(st),
+		app.WithAPIKeyStorage(st), app.WithUserMerge(st), app.WithURLExport(st), app.WithIdempotencyStore(st))
 	assert.NoError(t, err)
 
 	h, err := NewHTTPServer(s, logger)
@@ -333,15 +344,15 @@ func TestURLShortener_apiBatchShortener(t *testing.T) {
 			},
 			expected: expected{
 				expectedCode: http.StatusCreated,
-				expectedResponse: `[{"correlation_id":"0","short_url":"http://example.com/ZDIyNDk4MzQzMGZmMDQ1ZQ"},` +
-					`{"correlation_id":"1","short_url":"http://example.com/NWI4NTMwNmZjNWJmMjMzYg"},` +
-					`{"correlation_id":"2","short_url":"http://example.com/NGViNTExNTZlMzI2NmNiMw"},` +
-					`{"correlation_id":"3","short_url":"http://example.com/ZTdjMTdjZDVlMTY3YjQ1YQ"},` +
-					`{"correlation_id":"4","short_url":"http://example.com/YTE3MzY4NmZlZDg4NmE2Mw"},` +
-					`{"correlation_id":"5","short_url":"http://example.com/MWE5MGMyYWI3OTVmNDRjZQ"},` +
-					`{"correlation_id":"6","short_url":"http://example.com/MWZlNTFiNmZhNDQyOWNiOA"},` +
-					`{"correlation_id":"7","short_url":"http://example.com/N2NlNjg3NzEyMzQzZGNlZQ"},` +
-					`{"correlation_id":"8","short_url":"http://example.com/N2YwNTlmY2E2NGNlZWJjZQ"}]`,
+				expectedResponse: `[{"correlation_id":"0","short_url":"http://example.com/ZDIyNDk4MzQzMGZmMDQ1ZQ","status":"created"},` +
+					`{"correlation_id":"1","short_url":"http://example.com/NWI4NTMwNmZjNWJmMjMzYg","status":"created"},` +
+					`{"correlation_id":"2","short_url":"http://example.com/NGViNTExNTZlMzI2NmNiMw","status":"created"},` +
+					`{"correlation_id":"3","short_url":"http://example.com/ZTdjMTdjZDVlMTY3YjQ1YQ","status":"created"},` +
+					`{"correlation_id":"4","short_url":"http://example.com/YTE3MzY4NmZlZDg4NmE2Mw","status":"created"},` +
+					`{"correlation_id":"5","short_url":"http://example.com/MWE5MGMyYWI3OTVmNDRjZQ","status":"created"},` +
+					`{"correlation_id":"6","short_url":"http://example.com/MWZlNTFiNmZhNDQyOWNiOA","status":"created"},` +
+					`{"correlation_id":"7","short_url":"http://example.com/N2NlNjg3NzEyMzQzZGNlZQ","status":"created"},` +
+					`{"correlation_id":"8","short_url":"http://example.com/N2YwNTlmY2E2NGNlZWJjZQ","status":"created"}]`,
 			},
 		},
 	}
@@ -376,6 +387,204 @@ func TestURLShortener_apiBatchShortener(t *testing.T) {
 	}
 }
 
+func TestURLShortener_problemResponses(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte(`{"url":"http://ya.ru"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	// A body cut before its end can't be decompressed, though its header is fine.
+	truncated := compressed.String()[:compressed.Len()-4]
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		encoding    string
+		body        string
+		status      int
+		code        string
+		items       []itemProblem
+	}{
+		{
+			name:   "Invalid url",
+			method: http.MethodPost,
+			target: "/",
+			body:   "vc.ru",
+			status: http.StatusBadRequest,
+			code:   CodeInvalidURL,
+		},
+		{
+			name:        "Wrong content type",
+			method:      http.MethodPost,
+			target:      "/api/shorten",
+			contentType: "text/plain",
+			body:        `{"url":"http://ya.ru"}`,
+			status:      http.StatusBadRequest,
+			code:        CodeBadContentType,
+		},
+		{
+			name:        "Malformed json",
+			method:      http.MethodPost,
+			target:      "/api/shorten",
+			contentType: "application/json",
+			body:        `{"url":`,
+			status:      http.StatusBadRequest,
+			code:        CodeMalformedJSON,
+		},
+		{
+			name:        "Missing url",
+			method:      http.MethodPost,
+			target:      "/api/shorten",
+			contentType: "application/json",
+			body:        `{"link":"http://ya.ru"}`,
+			status:      http.StatusBadRequest,
+			code:        CodeMissingField,
+		},
+		{
+			name:        "Not gzip body",
+			method:      http.MethodPost,
+			target:      "/api/shorten",
+			contentType: "application/json",
+			encoding:    "gzip",
+			body:        `{"url":"http://ya.ru"}`,
+			status:      http.StatusBadRequest,
+			code:        CodeMalformedGzip,
+		},
+		{
+			name:        "Truncated gzip body",
+			method:      http.MethodPost,
+			target:      "/api/shorten",
+			contentType: "application/json",
+			encoding:    "gzip",
+			body:        truncated,
+			status:      http.StatusBadRequest,
+			code:        CodeMalformedGzip,
+		},
+		{
+			name:     "Truncated gzip text body",
+			method:   http.MethodPost,
+			target:   "/",
+			encoding: "gzip",
+			body:     truncated,
+			status:   http.StatusBadRequest,
+			code:     CodeMalformedGzip,
+		},
+		{
+			name:        "Atomic batch items",
+			method:      http.MethodPost,
+			target:      "/api/shorten/batch?atomic=true",
+			contentType: "application/json",
+			body: `[{"correlation_id":"a","original_url":"http://ya.ru"},` +
+				`{"correlation_id":"b","original_url":"ya.ru"},` +
+				`{"correlation_id":"c","original_url":"http://"}]`,
+			status: http.StatusBadRequest,
+			code:   CodeInvalidURL,
+			items: []itemProblem{
+				{Index: 1, CorrelationID: "b", Code: CodeInvalidURL, Detail: app.ErrBadURL.Error()},
+				{Index: 2, CorrelationID: "c", Code: CodeInvalidURL, Detail: app.ErrBadURL.Error()},
+			},
+		},
+		{
+			name:        "No good batch items",
+			method:      http.MethodPost,
+			target:      "/api/shorten/batch",
+			contentType: "application/json",
+			body:        `[{"correlation_id":"a","original_url":"ya.ru"}]`,
+			status:      http.StatusBadRequest,
+			code:        CodeInvalidURL,
+			items: []itemProblem{
+				{Index: 0, CorrelationID: "a", Code: CodeInvalidURL, Detail: app.ErrBadURL.Error()},
+			},
+		},
+		{
+			name:        "Bad atomic parameter",
+			method:      http.MethodPost,
+			target:      "/api/shorten/batch?atomic=maybe",
+			contentType: "application/json",
+			body:        `[]`,
+			status:      http.StatusBadRequest,
+			code:        CodeInvalidParameter,
+		},
+		{
+			name:   "Unknown short url",
+			method: http.MethodGet,
+			target: "/ZDIyNDk4MzQzMGZmMDQ1ZQ",
+			status: http.StatusNotFound,
+			code:   CodeNotFound,
+		},
+		{
+			name:   "Bad api key",
+			method: http.MethodGet,
+			target: "/api/user/urls",
+			status: http.StatusUnauthorized,
+			code:   CodeUnauthorized,
+		},
+		{
+			name:   "Untrusted stats client",
+			method: http.MethodGet,
+			target: "/api/internal/stats",
+			status: http.StatusForbidden,
+			code:   CodeForbidden,
+		},
+	}
+
+	h := testServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if len(tt.contentType) != 0 {
+				r.Header.Set("content-type", tt.contentType)
+			}
+			if len(tt.encoding) != 0 {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if tt.code == CodeUnauthorized {
+				r.Header.Set("Authorization", "Bearer unknown")
+			}
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+
+			var p problem
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.status, p.Status)
+			assert.Equal(t, tt.code, p.Code)
+			assert.Equal(t, http.StatusText(tt.status), p.Title)
+			assert.Equal(t, r.URL.Path, p.Instance)
+			assert.NotEmpty(t, p.RequestID)
+			assert.Equal(t, tt.items, p.Errors)
+		})
+	}
+}
+
+func TestURLShortener_apiBatchShortenerPartial(t *testing.T) {
+	h := testServer(t)
+
+	body := `[{"correlation_id":"a","original_url":"http://ya.ru"}]`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	r.Header.Set("content-type", "application/json")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	body = `[{"correlation_id":"a","original_url":"http://ya.ru"},` +
+		`{"correlation_id":"b","original_url":"ya.ru"},` +
+		`{"correlation_id":"c","original_url":"http://vc.ru"}]`
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	r.Header.Set("content-type", "application/json")
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.Equal(t, `[{"correlation_id":"a","short_url":"http://example.com/ZDIyNDk4MzQzMGZmMDQ1ZQ","status":"existed"},`+
+		`{"correlation_id":"b","status":"invalid","code":"invalid_url","detail":"bad url"},`+
+		`{"correlation_id":"c","short_url":"http://example.com/NWI4NTMwNmZjNWJmMjMzYg","status":"created"}]`, w.Body.String())
+}
+
 func TestURLShortener_apiUserURLs(t *testing.T) {
 	type args struct {
 		URLs []string
@@ -407,15 +616,15 @@ func TestURLShortener_apiUserURLs(t *testing.T) {
 			},
 			expected: expected{
 				expectedCode: http.StatusCreated,
-				expectedResponse: `[{"correlation_id":"0","short_url":"http://example.com/ZDIyNDk4MzQzMGZmMDQ1ZQ"},` +
-					`{"correlation_id":"1","short_url":"http://example.com/NWI4NTMwNmZjNWJmMjMzYg"},` +
-					`{"correlation_id":"2","short_url":"http://example.com/NGViNTExNTZlMzI2NmNiMw"},` +
-					`{"correlation_id":"3","short_url":"http://example.com/ZTdjMTdjZDVlMTY3YjQ1YQ"},` +
-					`{"correlation_id":"4","short_url":"http://example.com/YTE3MzY4NmZlZDg4NmE2Mw"},` +
-					`{"correlation_id":"5","short_url":"http://example.com/MWE5MGMyYWI3OTVmNDRjZQ"},` +
-					`{"correlation_id":"6","short_url":"http://example.com/MWZlNTFiNmZhNDQyOWNiOA"},` +
-					`{"correlation_id":"7","short_url":"http://example.com/N2NlNjg3NzEyMzQzZGNlZQ"},` +
-					`{"correlation_id":"8","short_url":"http://example.com/N2YwNTlmY2E2NGNlZWJjZQ"}]`,
+				expectedResponse: `[{"correlation_id":"0","short_url":"http://example.com/ZDIyNDk4MzQzMGZmMDQ1ZQ","status":"created"},` +
+					`{"correlation_id":"1","short_url":"http://example.com/NWI4NTMwNmZjNWJmMjMzYg","status":"created"},` +
+					`{"correlation_id":"2","short_url":"http://example.com/NGViNTExNTZlMzI2NmNiMw","status":"created"},` +
+					`{"correlation_id":"3","short_url":"http://example.com/ZTdjMTdjZDVlMTY3YjQ1YQ","status":"created"},` +
+					`{"correlation_id":"4","short_url":"http://example.com/YTE3MzY4NmZlZDg4NmE2Mw","status":"created"},` +
+					`{"correlation_id":"5","short_url":"http://example.com/MWE5MGMyYWI3OTVmNDRjZQ","status":"created"},` +
+					`{"correlation_id":"6","short_url":"http://example.com/MWZlNTFiNmZhNDQyOWNiOA","status":"created"},` +
+					`{"correlation_id":"7","short_url":"http://example.com/N2NlNjg3NzEyMzQzZGNlZQ","status":"created"},` +
+					`{"correlation_id":"8","short_url":"http://example.com/N2YwNTlmY2E2NGNlZWJjZQ","status":"created"}]`,
 				expectedMapping: map[string]string{
 					"http://ya.ru":    "http://example.com/ZDIyNDk4MzQzMGZmMDQ1ZQ",
 					"http://vc.ru":    "http://example.com/NWI4NTMwNmZjNWJmMjMzYg",
@@ -503,6 +712,879 @@ func TestURLShortener_apiUserURLs(t *testing.T) {
 	}
 }
 
+func Test_negotiateExport(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: mediaJSON},
+		{accept: "*/*", want: mediaJSON},
+		{accept: "text/html", want: mediaJSON},
+		{accept: "text/csv", want: mediaCSV},
+		{accept: "text/csv; charset=utf-8", want: mediaCSV},
+		{accept: "application/x-ndjson", want: mediaNDJSON},
+		{accept: "application/jsonl", want: mediaNDJSON},
+		{accept: "application/json, text/csv", want: mediaJSON},
+		{accept: "application/json;q=0.5, text/csv", want: mediaCSV},
+		{accept: "text/csv;q=0, */*;q=0.1", want: mediaJSON},
+		{accept: "text/*, application/json;q=0.9", want: mediaCSV},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, negotiateExport(tt.accept))
+		})
+	}
+}
+
+func TestURLShortener_exportUserURLs(t *testing.T) {
+	h := testServer(t)
+
+	body := `[{"correlation_id":"0","original_url":"https://ya.ru"},{"correlation_id":"1","original_url":"https://vc.ru"}]`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["ZjRhMjc3OGQ1N2UyMWQzMw"]`))
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(cookies[0])
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	export := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		r.Header.Set("Accept", accept)
+		r.AddCookie(cookies[0])
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Deletion is asynchronous.
+	assert.Eventually(t, func() bool {
+		return strings.Contains(export(mediaNDJSON).Body.String(), `"state":"deleted"`)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = export(mediaNDJSON)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, mediaNDJSON, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Values("Vary"), "Accept")
+
+	links := make(map[string]exportedLink)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var link exportedLink
+		assert.NoError(t, json.Unmarshal([]byte(line), &link))
+		assert.False(t, link.Created.IsZero())
+		links[link.OriginalURL] = link
+	}
+	assert.Len(t, links, 2)
+	assert.Equal(t, "http://example.com/ZjRhMjc3OGQ1N2UyMWQzMw", links["https://ya.ru"].ShortURL)
+	assert.Equal(t, "deleted", links["https://ya.ru"].State)
+	assert.NotNil(t, links["https://ya.ru"].Deleted)
+	assert.Equal(t, "active", links["https://vc.ru"].State)
+	assert.Nil(t, links["https://vc.ru"].Deleted)
+
+	w = export("text/csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, mediaCSV, w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, exportColumns, records[0])
+
+	// An export can be imported back.
+	rows, err := app.ParseImport(strings.NewReader(export("text/csv").Body.String()), app.ImportCSV)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	for _, row := range rows {
+		assert.NoError(t, row.Err)
+	}
+
+	// JSON stays a default and lists active links only.
+	w = export("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `[{"short_url":"http://example.com/M2U4OWJmNzU4ZWNkZTZlYQ","original_url":"https://vc.ru"}]`, w.Body.String())
+
+	// A user without links gets just a header.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/user/keys", strings.NewReader(`{"name":"export"}`))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, r)
+	if assert.Equal(t, http.StatusCreated, w.Code) {
+		var key struct {
+			Key string `json:"key"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &key))
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		r.Header.Set("Accept", "text/csv")
+		r.Header.Set("Authorization", "Bearer "+key.Key)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, strings.Join(exportColumns, ",")+"\n", w.Body.String())
+	}
+}
+
+func TestURLShortener_apiLinkStats(t *testing.T) {
+	h := testServer(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru"))
+	h.ServeHTTP(w, r)
+	result := w.Result()
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusCreated, result.StatusCode)
+
+	cookies := result.Cookies()
+	assert.NotEmpty(t, cookies)
+
+	visitors := []struct {
+		ip        string
+		userAgent string
+		purpose   string
+	}{
+		{ip: "10.0.0.1", userAgent: "Mozilla/5.0"},
+		{ip: "10.0.0.1", userAgent: "Mozilla/5.0"},
+		{ip: "10.0.0.2", userAgent: "Mozilla/5.0"},
+		{ip: "10.0.0.2", userAgent: "curl/7.68.0"},
+		{ip: "10.0.0.3", userAgent: "Slackbot-LinkExpanding 1.0"},
+		{ip: "10.0.0.4", userAgent: "Mozilla/5.0", purpose: "prefetch"},
+	}
+	for _, v := range visitors {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/ZjRhMjc3OGQ1N2UyMWQzMw", nil)
+		r.Header.Set("X-Real-IP", v.ip)
+		r.Header.Set("User-Agent", v.userAgent)
+		if len(v.purpose) != 0 {
+			r.Header.Set("Sec-Purpose", v.purpose)
+		}
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	}
+
+	type response struct {
+		ShortURL       string `json:"short_url"`
+		Clicks         uint64 `json:"clicks"`
+		BotClicks      uint64 `json:"bot_clicks"`
+		UniqueVisitors uint64 `json:"unique_visitors"`
+		Days           []struct {
+			Date           string `json:"date"`
+			Clicks         uint64 `json:"clicks"`
+			UniqueVisitors uint64 `json:"unique_visitors"`
+		} `json:"days"`
+	}
+
+	getStats := func(id string) (int, *response) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls/"+id+"/stats", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(w, r)
+
+		var resp response
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Code, &resp
+	}
+
+	assert.Eventually(t, func() bool {
+		_, resp := getStats("ZjRhMjc3OGQ1N2UyMWQzMw")
+		return resp.Clicks+resp.BotClicks == uint64(len(visitors))
+	}, time.Second, 10*time.Millisecond)
+
+	code, resp := getStats("ZjRhMjc3OGQ1N2UyMWQzMw")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "http://example.com/ZjRhMjc3OGQ1N2UyMWQzMw", resp.ShortURL)
+	assert.Equal(t, uint64(4), resp.Clicks)
+	assert.Equal(t, uint64(2), resp.BotClicks)
+	assert.Equal(t, uint64(3), resp.UniqueVisitors)
+	assert.Len(t, resp.Days, 1)
+	assert.Equal(t, uint64(3), resp.Days[0].UniqueVisitors)
+
+	code, _ = getStats("M2U4OWJmNzU4ZWNkZTZlYQ")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestURLShortener_apiInternalStats(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger,
+		app.WithStorage(st), app.WithStat(st), app.WithClickStat(st))
+	assert.NoError(t, err)
+
+	_, trustedNet, err := net.ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, err)
+	h, err := NewHTTPServer(s, logger, WithTrustedNetwork(trustedNet))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru"))
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	tests := []struct {
+		name         string
+		query        string
+		realIP       string
+		expectedCode int
+		points       int
+	}{
+		{
+			name:         "Default window",
+			query:        "",
+			realIP:       "10.0.0.1",
+			expectedCode: http.StatusOK,
+			points:       24,
+		},
+		{
+			name:         "Week by days",
+			query:        "?window=7d&bucket=24h&top=5",
+			realIP:       "10.0.0.1",
+			expectedCode: http.StatusOK,
+			points:       7,
+		},
+		{
+			name:         "Bad bucket",
+			query:        "?bucket=1m",
+			realIP:       "10.0.0.1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Bad window",
+			query:        "?window=week",
+			realIP:       "10.0.0.1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Untrusted client",
+			query:        "",
+			realIP:       "192.168.0.1",
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	type response struct {
+		URLs    uint64 `json:"urls"`
+		Created []struct {
+			Count uint64 `json:"count"`
+		} `json:"created"`
+		Redirects []struct {
+			Count uint64 `json:"count"`
+		} `json:"redirects"`
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/internal/stats"+tt.query, nil)
+			r.Header.Set("X-Real-IP", tt.realIP)
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var resp response
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, uint64(1), resp.URLs)
+			assert.Len(t, resp.Created, tt.points)
+			assert.Len(t, resp.Redirects, tt.points)
+			assert.Equal(t, uint64(1), resp.Created[tt.points-1].Count)
+		})
+	}
+}
+
+func TestURLShortener_apiUserStats(t *testing.T) {
+	h := testServer(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/user/stats", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru"))
+	h.ServeHTTP(w, r)
+	result := w.Result()
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusCreated, result.StatusCode)
+
+	cookies := result.Cookies()
+	assert.NotEmpty(t, cookies)
+
+	for _, u := range []string{"https://vc.ru", "https://yandex.ru"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(u))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/ZjRhMjc3OGQ1N2UyMWQzMw", nil)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["M2U4OWJmNzU4ZWNkZTZlYQ"]`))
+	r.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	type response struct {
+		ActiveURLs  uint64 `json:"active_urls"`
+		DeletedURLs uint64 `json:"deleted_urls"`
+		TotalClicks uint64 `json:"total_clicks"`
+		TopLinks    []struct {
+			ShortURL string `json:"short_url"`
+			Clicks   uint64 `json:"clicks"`
+		} `json:"top_links"`
+		Created []struct {
+			Date    string `json:"date"`
+			Created uint64 `json:"created"`
+		} `json:"created"`
+	}
+
+	getStats := func() *response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/user/stats", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp response
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return &resp
+	}
+
+	assert.Eventually(t, func() bool {
+		resp := getStats()
+		return resp.TotalClicks == 2 && resp.DeletedURLs == 1
+	}, time.Second, 10*time.Millisecond)
+
+	resp := getStats()
+	assert.Equal(t, uint64(2), resp.ActiveURLs)
+	assert.Equal(t, uint64(1), resp.DeletedURLs)
+	assert.Len(t, resp.TopLinks, 1)
+	assert.Equal(t, "http://example.com/ZjRhMjc3OGQ1N2UyMWQzMw", resp.TopLinks[0].ShortURL)
+	assert.Equal(t, uint64(2), resp.TopLinks[0].Clicks)
+	assert.Len(t, resp.Created, app.UserHistoryDays)
+	assert.Equal(t, uint64(3), resp.Created[app.UserHistoryDays-1].Created)
+}
+
+func TestURLShortener_metrics(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st))
+	assert.NoError(t, err)
+
+	_, trustedNet, err := net.ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, err)
+	h, err := NewHTTPServer(s, logger, WithTrustedNetwork(trustedNet), WithMetrics(metrics.NewRegistry()))
+	assert.NoError(t, err)
+
+	requests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{method: http.MethodPost, target: "/", body: "https://ya.ru"},
+		{method: http.MethodGet, target: "/ZjRhMjc3OGQ1N2UyMWQzMw"},
+		{method: http.MethodGet, target: "/M2U4OWJmNzU4ZWNkZTZlYQ"},
+		{method: http.MethodGet, target: "/a/b/c"},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(req.method, req.target, strings.NewReader(req.body)))
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("X-Real-IP", "192.168.0.1")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="POST",route="/",code="201"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/{id}",code="307"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/{id}",code="404"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",code="404"} 1`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/{id}"} 2`)
+}
+
+type recordingExporter struct {
+	lock  sync.Mutex
+	spans []*tracing.SpanData
+}
+
+func (e *recordingExporter) Export(span *tracing.SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func TestURLShortener_tracing(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer(exporter)
+
+	logger, _ := zap.NewDevelopment()
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithTracer(tracer))
+	assert.NoError(t, err)
+
+	h, err := NewHTTPServer(s, logger, WithTracer(tracer))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru")))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	exporter.spans = nil
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/ZjRhMjc3OGQ1N2UyMWQzMw", nil)
+	r.Header.Set("Traceparent", traceparent)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	spans := make(map[string]*tracing.SpanData)
+	for _, span := range exporter.spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+		spans[span.Name] = span
+	}
+
+	assert.Len(t, spans, 3)
+	assert.Equal(t, "00f067aa0ba902b7", spans["HTTP GET"].ParentID)
+	assert.Equal(t, "/{id}", spans["HTTP GET"].Attributes["http.route"])
+	assert.Equal(t, "307", spans["HTTP GET"].Attributes["http.status_code"])
+	assert.Equal(t, spans["HTTP GET"].SpanID, spans["chi.route"].ParentID)
+	assert.Equal(t, spans["chi.route"].SpanID, spans["URLShortener.Redirect"].ParentID)
+}
+
+func TestURLShortener_accessLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st))
+	assert.NoError(t, err)
+
+	h, err := NewHTTPServer(s, logger)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://ya.ru"))
+	r.Header.Set("X-Request-ID", "request-1")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "request-1", w.Header().Get("X-Request-ID"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	r.Header.Set("X-Request-ID", "bad request id")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	generatedID := w.Header().Get("X-Request-ID")
+	assert.NotEmpty(t, generatedID)
+	assert.NotEqual(t, "bad request id", generatedID)
+
+	entries := logs.FilterMessage("request").All()
+	assert.Len(t, entries, 2)
+
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "request-1", fields["request_id"])
+	assert.Equal(t, "POST", fields["method"])
+	assert.Equal(t, "/", fields["route"])
+	assert.Equal(t, int64(http.StatusCreated), fields["status"])
+	assert.Equal(t, int64(len("http://example.com/ZjRhMjc3OGQ1N2UyMWQzMw")), fields["bytes"])
+	assert.Contains(t, fields, "latency")
+	assert.Contains(t, fields, "user_id")
+
+	fields = entries[1].ContextMap()
+	assert.Equal(t, generatedID, fields["request_id"])
+	assert.Equal(t, int64(http.StatusNoContent), fields["status"])
+}
+
+func TestURLShortener_userToken(t *testing.T) {
+	logger := zap.NewNop()
+	k, err := app.NewKeyring()
+	assert.NoError(t, err)
+
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithKeyring(k))
+	assert.NoError(t, err)
+	expired, err := app.NewURLShortener(context.Background(), logger, app.WithKeyring(k), app.WithUserTokenTTL(-time.Minute))
+	assert.NoError(t, err)
+
+	h, err := NewHTTPServer(s, logger)
+	assert.NoError(t, err)
+
+	valid, err := s.GenerateUserID(42)
+	assert.NoError(t, err)
+	old, err := expired.GenerateUserID(42)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		cookie    string
+		newCookie bool
+	}{
+		{
+			name:      "Valid token",
+			cookie:    *valid,
+			newCookie: false,
+		},
+		{
+			name:      "Expired token",
+			cookie:    *old,
+			newCookie: true,
+		},
+		{
+			name:      "Garbage",
+			cookie:    "not a token",
+			newCookie: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru/`+tt.name+`"}`))
+			r.Header.Set("Content-Type", "application/json")
+			r.AddCookie(&http.Cookie{Name: UserIDCookieName, Value: tt.cookie})
+			h.ServeHTTP(w, r)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, http.StatusCreated, result.StatusCode)
+
+			cookies := result.Cookies()
+			if !tt.newCookie {
+				assert.Empty(t, cookies)
+				return
+			}
+
+			assert.Len(t, cookies, 1)
+			assert.Equal(t, int(app.DefaultUserTokenTTL.Seconds()), cookies[0].MaxAge)
+
+			token, err := s.ParseUserToken(cookies[0].Value)
+			assert.NoError(t, err)
+			assert.NotEqual(t, uint64(42), token.UserID)
+		})
+	}
+}
+
+func TestURLShortener_apiKeys(t *testing.T) {
+	h := testServer(t)
+
+	do := func(method, target, body string, auth func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(body) != 0 {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		if auth != nil {
+			auth(r)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/", "https://ya.ru", nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	withCookie := func(r *http.Request) { r.AddCookie(cookies[0]) }
+
+	w = do(http.MethodPost, "/api/user/keys", `{"name":"ci"}`, withCookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "ci", created.Name)
+	assert.True(t, strings.HasPrefix(created.Key, app.APIKeyPrefix))
+	withKey := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+created.Key) }
+
+	w = do(http.MethodPost, "/api/user/keys", `{"name":"`+strings.Repeat("a", app.MaxAPIKeyNameLength+1)+`"}`, withCookie)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A key acts on behalf of the user that has created it.
+	w = do(http.MethodGet, "/api/user/urls", "", withKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://ya.ru")
+	assert.Empty(t, w.Result().Cookies())
+
+	w = do(http.MethodGet, "/api/user/keys", "", withKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), created.ID)
+	assert.NotContains(t, w.Body.String(), created.Key)
+
+	w = do(http.MethodGet, "/api/user/keys", "", func(r *http.Request) { r.Header.Set("Authorization", "Basic dXNlcjpwYXNz") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = do(http.MethodDelete, "/api/user/keys/"+created.ID, "", withCookie)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do(http.MethodDelete, "/api/user/keys/"+created.ID, "", withCookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(http.MethodGet, "/api/user/urls", "", withKey)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+}
+
+func TestURLShortener_oidcLogin(t *testing.T) {
+	idp := oidctest.NewServer("shortener")
+	defer idp.Close()
+
+	logger := zap.NewNop()
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st), app.WithIdentityStorage(st),
+		app.WithUserMerge(st))
+	assert.NoError(t, err)
+
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:      idp.Issuer(),
+		ClientID:    "shortener",
+		RedirectURL: "http://localhost/api/auth/callback",
+	})
+	h, err := NewHTTPServer(s, logger, WithIdentityProvider(provider))
+	assert.NoError(t, err)
+
+	cookieOf := func(result *http.Response, name string) *http.Cookie {
+		for _, c := range result.Cookies() {
+			if c.Name == name && c.MaxAge > 0 {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// login goes through the whole flow and returns a result of the callback.
+	login := func(subject, returnTo string, cookies ...*http.Cookie) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/auth/login?return_to="+url.QueryEscape(returnTo), nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusFound, w.Code)
+
+		pending := cookieOf(w.Result(), LoginCookieName)
+		assert.NotNil(t, pending)
+
+		callback, err := idp.Authorize(w.Header().Get("Location"), subject)
+		assert.NoError(t, err)
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, callback, nil)
+		r.AddCookie(pending)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	_, _, err = st.Add(context.Background(), 42, "https://vc.ru")
+	assert.NoError(t, err)
+	anonymous, err := s.GenerateUserID(42)
+	assert.NoError(t, err)
+
+	result := login("alice", "/links", &http.Cookie{Name: UserIDCookieName, Value: *anonymous})
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	assert.Equal(t, "/links", result.Header.Get("Location"))
+
+	user := cookieOf(result, UserIDCookieName)
+	assert.NotNil(t, user)
+	token, err := s.ParseUserToken(user.Value)
+	assert.NoError(t, err)
+	// The first login gets a new account, links of the anonymous user are moved to it.
+	account := token.UserID
+	assert.NotEqual(t, uint64(42), account)
+	assert.True(t, token.HasScope(app.ScopeAccount))
+
+	data, err := st.GetUserData(context.Background(), account)
+	assert.NoError(t, err)
+	assert.Len(t, data, 1)
+	_, err = st.GetUserData(context.Background(), 42)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// A login from another browser gets the same user.
+	result = login("alice", "//evil.com")
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	assert.Equal(t, "/", result.Header.Get("Location"))
+
+	token, err = s.ParseUserToken(cookieOf(result, UserIDCookieName).Value)
+	assert.NoError(t, err)
+	assert.Equal(t, account, token.UserID)
+
+	// Links of another anonymous user join the account when it logs in.
+	_, _, err = st.Add(context.Background(), 7, "https://ya.ru")
+	assert.NoError(t, err)
+	other, err := s.GenerateUserID(7)
+	assert.NoError(t, err)
+
+	result = login("alice", "/", &http.Cookie{Name: UserIDCookieName, Value: *other})
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, result.StatusCode)
+	data, err = st.GetUserData(context.Background(), account)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2)
+
+	result = login("bob", "/")
+	defer result.Body.Close()
+	token, err = s.ParseUserToken(cookieOf(result, UserIDCookieName).Value)
+	assert.NoError(t, err)
+	assert.NotEqual(t, account, token.UserID)
+
+	// A callback without a matching login state is rejected.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/callback?code=abc&state=forged", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestURLShortener_apiClaimLinks(t *testing.T) {
+	h := testServer(t)
+
+	do := func(method, target string, cookie *http.Cookie, auth func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if auth != nil {
+			auth(r)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	shorten := func(url string, cookies ...*http.Cookie) []*http.Cookie {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		return w.Result().Cookies()
+	}
+
+	anonymous := shorten("https://ya.ru")
+	assert.Len(t, anonymous, 1)
+	owner := shorten("https://vc.ru")
+	assert.Len(t, owner, 1)
+	withCookie := func(r *http.Request) { r.AddCookie(owner[0]) }
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/user/keys", strings.NewReader(`{"name":"ci"}`))
+	r.Header.Set("Content-Type", "application/json")
+	withCookie(r)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	withKey := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+created.Key) }
+
+	tests := []struct {
+		name       string
+		cookie     *http.Cookie
+		auth       func(r *http.Request)
+		statusCode int
+		claimed    string
+	}{
+		{
+			name:       "Anonymous user",
+			cookie:     anonymous[0],
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "No cookie",
+			auth:       withKey,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Bad cookie",
+			cookie:     &http.Cookie{Name: UserIDCookieName, Value: "garbage"},
+			auth:       withKey,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Claim",
+			cookie:     anonymous[0],
+			auth:       withKey,
+			statusCode: http.StatusOK,
+			claimed:    `{"claimed":1}`,
+		},
+		{
+			name:       "Claim again",
+			cookie:     anonymous[0],
+			auth:       withKey,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(http.MethodPost, "/api/user/claim", tt.cookie, tt.auth)
+			assert.Equal(t, tt.statusCode, w.Code)
+			if len(tt.claimed) != 0 {
+				assert.JSONEq(t, tt.claimed, w.Body.String())
+
+				cookies := w.Result().Cookies()
+				assert.Len(t, cookies, 1)
+				assert.Equal(t, UserIDCookieName, cookies[0].Name)
+				assert.Negative(t, cookies[0].MaxAge)
+			}
+		})
+	}
+
+	w = do(http.MethodGet, "/api/user/urls", nil, withCookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://ya.ru")
+	assert.Contains(t, w.Body.String(), "https://vc.ru")
+
+	// The token of the claimed user isn't accepted anymore, a request with it is made by a new user.
+	w = do(http.MethodGet, "/api/user/urls", anonymous[0], nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
 func benchServer() *Server {
 	logger, _ := zap.NewDevelopment()
 	s, _ := app.NewURLShortener(context.Background(), logger, app.WithStorage(storage.NewInMemoryStorage()))
@@ -668,3 +1750,216 @@ func BenchmarkURLShortener_apiUserURLs(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+func TestURLShortener_apiImports(t *testing.T) {
+	h := testServer(t)
+
+	data := "long_url,tags,alias\nhttps://ya.ru,news,\nya.ru,,\nhttps://vc.ru,,vc\n"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/user/imports", strings.NewReader(data))
+	r.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(location, "/api/user/imports/"))
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+
+	var job importJobResponse
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, location, nil)
+		r.AddCookie(cookies[0])
+		h.ServeHTTP(w, r)
+		return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &job) == nil && job.Status != "running"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "done", job.Status)
+	assert.Equal(t, 3, job.Total)
+	assert.Equal(t, 3, job.Processed)
+	assert.Equal(t, 2, job.Failed)
+	assert.Equal(t, []importRowResponse{
+		{Line: 2, OriginalURL: "https://ya.ru", ShortURL: "http://example.com/ZjRhMjc3OGQ1N2UyMWQzMw", Status: "created",
+			Ignored: []string{"tags"}},
+		{Line: 3, OriginalURL: "ya.ru", Status: "invalid", Code: CodeInvalidURL, Detail: "bad url"},
+		{Line: 4, OriginalURL: "https://vc.ru", Status: "invalid", Code: CodeUnsupportedField, Detail: "unsupported field: alias"},
+	}, job.Rows)
+
+	// Imports of other users aren't visible.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        string
+		status      int
+		code        string
+	}{
+		{
+			name:        "Unsupported format",
+			contentType: "application/json",
+			data:        `[]`,
+			status:      http.StatusBadRequest,
+			code:        CodeBadContentType,
+		},
+		{
+			name:        "No url column",
+			contentType: "text/csv",
+			data:        "title\nYa\n",
+			status:      http.StatusBadRequest,
+			code:        CodeInvalidImport,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/user/imports", strings.NewReader(tt.data))
+			r.Header.Set("Content-Type", tt.contentType)
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			var p problem
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.code, p.Code)
+		})
+	}
+}
+
+func TestURLShortener_idempotencyKeys(t *testing.T) {
+	h := testServer(t)
+
+	// Keys of users without credentials are ignored, the first request gets a user cookie.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(IdempotencyKeyHeader, "key-0")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+
+	shorten := func(key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(IdempotencyKeyHeader, key)
+		r.AddCookie(cookies[0])
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	first := shorten("key-1", `{"url":"https://vc.ru"}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get(IdempotentReplayedHeader))
+
+	// A retry gets the first response instead of a conflict.
+	retry := shorten("key-1", `{"url":"https://vc.ru"}`)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	// Without a key the same request is a conflict.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://vc.ru"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(cookies[0])
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		status int
+		code   string
+	}{
+		{
+			name:   "Key reused for another request",
+			key:    "key-1",
+			body:   `{"url":"https://habr.com"}`,
+			status: http.StatusUnprocessableEntity,
+			code:   CodeIdempotencyKeyReused,
+		},
+		{
+			name:   "Bad key",
+			key:    "key with spaces",
+			body:   `{"url":"https://habr.com"}`,
+			status: http.StatusBadRequest,
+			code:   CodeInvalidIdempotencyKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := shorten(tt.key, tt.body)
+			assert.Equal(t, tt.status, w.Code)
+			var p problem
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.code, p.Code)
+		})
+	}
+}
+
+func TestURLShortener_forbiddenURLs(t *testing.T) {
+	h := testServer(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://localhost:8080/admin"}`))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var p problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, CodeForbiddenURL, p.Code)
+	assert.Equal(t, app.PolicyRulePrivateIP, p.Rule)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(
+		`[{"correlation_id":"1","original_url":"https://ya.ru"},{"correlation_id":"2","original_url":"file://ya.ru/etc"}]`))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	var items []struct {
+		CorrelationID string `json:"correlation_id"`
+		Status        string `json:"status"`
+		Code          string `json:"code"`
+		Rule          string `json:"rule"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+	assert.Len(t, items, 2)
+	assert.Equal(t, "created", items[0].Status)
+	assert.Equal(t, "invalid", items[1].Status)
+	assert.Equal(t, CodeForbiddenURL, items[1].Code)
+	assert.Equal(t, app.PolicyRuleScheme, items[1].Rule)
+}
+
+func TestURLShortener_blockedURLs(t *testing.T) {
+	logger := zap.NewNop()
+	st := storage.NewInMemoryStorage()
+	s, err := app.NewURLShortener(context.Background(), logger, app.WithStorage(st))
+	assert.NoError(t, err)
+	h, err := NewHTTPServer(s, logger)
+	assert.NoError(t, err)
+
+	id, _, err := st.Add(context.Background(), 1, "https://phish.example/login")
+	assert.NoError(t, err)
+	assert.NoError(t, st.BlockURLs(context.Background(), []uint64{id}))
+
+	// A blocked link gets a warning page rather than a redirect.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+string(app.EncodeID(id)), nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Contains(t, w.Body.String(), "This link has been blocked")
+	assert.NotContains(t, w.Body.String(), "phish.example")
+}
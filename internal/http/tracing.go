@@ -0,0 +1,43 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/r4start/go-url-shortener/pkg/tracing"
+)
+
+// traceRequest starts a request span, its parent is taken from the traceparent header if there is one.
+func (s *Server) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, err := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader)); err == nil {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+
+		ctx, span := s.tracer.Start(ctx, "HTTP "+r.Method)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("http.status_code", strconv.Itoa(recorder.status))
+		if rctx := chi.RouteContext(ctx); rctx != nil {
+			span.SetAttribute("http.route", rctx.RoutePattern())
+		}
+	})
+}
+
+// traceRouting starts a span after all other middlewares, so it covers routing and a handler only.
+func (s *Server) traceRouting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := s.tracer.Start(r.Context(), "chi.route")
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
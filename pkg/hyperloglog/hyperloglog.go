@@ -0,0 +1,162 @@
+// Package hyperloglog provides a HyperLogLog cardinality estimator.
+package hyperloglog
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+const (
+	// Precision - number of hash bits used to select a register.
+	Precision = 12
+
+	registersCount = 1 << Precision
+
+	formatVersion = 1
+	formatDense   = 0
+	formatSparse  = 1
+
+	headerSize      = 3
+	sparseEntrySize = 3
+)
+
+var ErrBadFormat = errors.New("bad sketch format")
+
+// Sketch - HyperLogLog sketch of a set of 64-bit hashes.
+// A zero value is an empty sketch that is ready to use.
+type Sketch struct {
+	registers []uint8
+}
+
+// New creates an empty sketch.
+func New() *Sketch {
+	return &Sketch{}
+}
+
+// Add - add a hashed element to the sketch.
+// The hash has to be uniformly distributed over 64 bits.
+func (s *Sketch) Add(hash uint64) {
+	if s.registers == nil {
+		s.registers = make([]uint8, registersCount)
+	}
+
+	idx := hash >> (64 - Precision)
+	rank := uint8(bits.LeadingZeros64(hash<<Precision|1<<(Precision-1))) + 1
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge - merge other sketch into s. The result estimates cardinality of the union of both sets.
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil || other.registers == nil {
+		return
+	}
+
+	if s.registers == nil {
+		s.registers = make([]uint8, registersCount)
+	}
+
+	for i, v := range other.registers {
+		if v > s.registers[i] {
+			s.registers[i] = v
+		}
+	}
+}
+
+// Clone - make a deep copy of the sketch.
+func (s *Sketch) Clone() *Sketch {
+	result := New()
+	result.Merge(s)
+	return result
+}
+
+// Estimate - get estimated number of distinct elements added to the sketch.
+func (s *Sketch) Estimate() uint64 {
+	if s.registers == nil {
+		return 0
+	}
+
+	m := float64(registersCount)
+	sum := 0.0
+	zeros := 0
+	for _, v := range s.registers {
+		sum += 1.0 / float64(uint64(1)<<v)
+		if v == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Small range correction.
+	if estimate <= 2.5*m && zeros != 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary - encode the sketch. Sparse sketches are encoded as a list of non-zero registers.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	nonZero := 0
+	for _, v := range s.registers {
+		if v != 0 {
+			nonZero++
+		}
+	}
+
+	if nonZero*sparseEntrySize >= registersCount {
+		data := make([]byte, headerSize, headerSize+registersCount)
+		data[0], data[1], data[2] = formatVersion, Precision, formatDense
+		return append(data, s.registers...), nil
+	}
+
+	data := make([]byte, headerSize, headerSize+nonZero*sparseEntrySize)
+	data[0], data[1], data[2] = formatVersion, Precision, formatSparse
+	for i, v := range s.registers {
+		if v == 0 {
+			continue
+		}
+		data = append(data, byte(i>>8), byte(i), v)
+	}
+
+	return data, nil
+}
+
+// UnmarshalBinary - decode a sketch produced by MarshalBinary.
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize || data[0] != formatVersion || data[1] != Precision {
+		return ErrBadFormat
+	}
+
+	registers := make([]uint8, registersCount)
+	payload := data[headerSize:]
+
+	switch data[2] {
+	case formatDense:
+		if len(payload) != registersCount {
+			return ErrBadFormat
+		}
+		copy(registers, payload)
+	case formatSparse:
+		if len(payload)%sparseEntrySize != 0 {
+			return ErrBadFormat
+		}
+		for i := 0; i < len(payload); i += sparseEntrySize {
+			idx := binary.BigEndian.Uint16(payload[i:])
+			if int(idx) >= registersCount {
+				return ErrBadFormat
+			}
+			registers[idx] = payload[i+2]
+		}
+	default:
+		return ErrBadFormat
+	}
+
+	s.registers = registers
+	return nil
+}
@@ -0,0 +1,109 @@
+package hyperloglog
+
+import (
+	"hash/fnv"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hashOf(v int) uint64 {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(strconv.Itoa(v)))
+	// FNV output is poorly mixed in the high bits, finalize it the same way as splitmix64.
+	h := hasher.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func TestSketch_Estimate(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{
+			name:  "Estimate #1",
+			count: 0,
+		},
+		{
+			name:  "Estimate #2",
+			count: 10,
+		},
+		{
+			name:  "Estimate #3",
+			count: 1000,
+		},
+		{
+			name:  "Estimate #4",
+			count: 100000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			for i := 0; i < tt.count; i++ {
+				s.Add(hashOf(i))
+				s.Add(hashOf(i))
+			}
+			assert.InEpsilon(t, float64(tt.count+1), float64(s.Estimate()+1), 0.05)
+		})
+	}
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 3000; i++ {
+		a.Add(hashOf(i))
+	}
+	for i := 2000; i < 5000; i++ {
+		b.Add(hashOf(i))
+	}
+
+	a.Merge(b)
+	a.Merge(nil)
+	assert.InEpsilon(t, 5000, float64(a.Estimate()), 0.05)
+
+	c := New()
+	c.Merge(a)
+	assert.Equal(t, a.Estimate(), c.Estimate())
+}
+
+func TestSketch_MarshalBinary(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{
+			name:  "Sparse sketch",
+			count: 10,
+		},
+		{
+			name:  "Dense sketch",
+			count: 50000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			for i := 0; i < tt.count; i++ {
+				s.Add(hashOf(i))
+			}
+
+			data, err := s.MarshalBinary()
+			assert.NoError(t, err)
+
+			decoded := New()
+			assert.NoError(t, decoded.UnmarshalBinary(data))
+			assert.Equal(t, s.Estimate(), decoded.Estimate())
+		})
+	}
+
+	assert.ErrorIs(t, New().UnmarshalBinary([]byte{0, 1}), ErrBadFormat)
+}
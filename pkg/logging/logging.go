@@ -0,0 +1,96 @@
+// Package logging carries a request id and a request-scoped logger through a context.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// RequestIDHeader - HTTP header with a request id.
+	RequestIDHeader = "X-Request-ID"
+	// RequestIDMetadata - gRPC metadata key with a request id.
+	RequestIDMetadata = "x-request-id"
+
+	maxRequestIDLength = 128
+)
+
+type loggerKey struct{}
+type requestKey struct{}
+
+// Request - request attributes that become known while a request is handled.
+type Request struct {
+	ID string
+
+	lock      sync.Mutex
+	userID    uint64
+	hasUserID bool
+}
+
+// UserID returns a user id if a request has been made by a known or a newly generated user.
+func (r *Request) UserID() (uint64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.userID, r.hasUserID
+}
+
+// NewRequestID generates a random request id.
+func NewRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// AcceptRequestID returns id if it is safe to put into logs and headers, otherwise it generates a new one.
+func AcceptRequestID(id string) string {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return NewRequestID()
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return NewRequestID()
+		}
+	}
+
+	return id
+}
+
+// NewContext attaches a request and a logger annotated with the request id to ctx.
+func NewContext(ctx context.Context, logger *zap.Logger, requestID string) (context.Context, *Request) {
+	request := &Request{ID: requestID}
+	ctx = context.WithValue(ctx, requestKey{}, request)
+	ctx = context.WithValue(ctx, loggerKey{}, logger.With(zap.String("request_id", requestID)))
+	return ctx, request
+}
+
+// FromContext returns a request-scoped logger or fallback if there is none.
+func FromContext(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+// RequestFromContext returns a current request or nil.
+func RequestFromContext(ctx context.Context) *Request {
+	request, _ := ctx.Value(requestKey{}).(*Request)
+	return request
+}
+
+// SetUserID records a user that made a current request, it does nothing outside of a request.
+func SetUserID(ctx context.Context, userID uint64) {
+	request := RequestFromContext(ctx)
+	if request == nil {
+		return
+	}
+
+	request.lock.Lock()
+	defer request.lock.Unlock()
+	request.userID = userID
+	request.hasUserID = true
+}
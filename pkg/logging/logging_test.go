@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAcceptRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		accepted bool
+	}{
+		{
+			name:     "Regular id",
+			id:       "a4a5d9c2-6b7e-4e1f-9c1d-0f2f8d1b3e4a",
+			accepted: true,
+		},
+		{
+			name:     "Empty id",
+			id:       "",
+			accepted: false,
+		},
+		{
+			name:     "Too long id",
+			id:       strings.Repeat("a", maxRequestIDLength+1),
+			accepted: false,
+		},
+		{
+			name:     "Id with spaces",
+			id:       "id with spaces",
+			accepted: false,
+		},
+		{
+			name:     "Id with a line break",
+			id:       "id\nfake log line",
+			accepted: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := AcceptRequestID(tt.id)
+			assert.NotEmpty(t, id)
+			assert.Equal(t, tt.accepted, id == tt.id)
+		})
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	fallback := zap.NewNop()
+
+	assert.Equal(t, fallback, FromContext(context.Background(), fallback))
+	assert.Nil(t, RequestFromContext(context.Background()))
+	SetUserID(context.Background(), 1)
+
+	ctx, request := NewContext(context.Background(), zap.New(core), "request-1")
+	assert.Equal(t, request, RequestFromContext(ctx))
+
+	_, ok := request.UserID()
+	assert.False(t, ok)
+	SetUserID(ctx, 42)
+	userID, ok := request.UserID()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), userID)
+
+	FromContext(ctx, fallback).Info("message")
+	assert.Equal(t, 1, logs.Len())
+	assert.Equal(t, "request-1", logs.All()[0].ContextMap()["request_id"])
+}
@@ -0,0 +1,309 @@
+// Package metrics implements a minimal set of Prometheus metric types
+// and the text exposition format to export them.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType - content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets - histogram buckets in seconds suitable for request latencies.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelSeparator joins label values into a map key, it can't appear in a valid UTF-8 string.
+const labelSeparator = "\xff"
+
+type collector interface {
+	metricName() string
+	write(w *bufio.Writer)
+}
+
+// Registry - a set of metrics exported together.
+type Registry struct {
+	lock       sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]collector),
+	}
+}
+
+// NewCounterVec registers a counter partitioned by labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]*sample),
+	}
+	r.register(c)
+	return c
+}
+
+// NewHistogramVec registers a histogram partitioned by labels.
+// Buckets are upper bounds in ascending order, the +Inf bucket is added implicitly.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramSample),
+	}
+	r.register(h)
+	return h
+}
+
+// NewGaugeFunc registers a gauge which value is taken from f on every export.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{
+		desc:       desc{name: name, help: help},
+		metricType: "gauge",
+		f:          f,
+	})
+}
+
+// NewCounterFunc registers a counter which value is taken from f on every export.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{
+		desc:       desc{name: name, help: help},
+		metricType: "counter",
+		f:          f,
+	})
+}
+
+// Write exports all metrics sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := make([]collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].metricName() < collectors[j].metricName()
+	})
+
+	writer := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(writer)
+	}
+	return writer.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.Write(w)
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.collectors[c.metricName()]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", c.metricName()))
+	}
+	r.collectors[c.metricName()] = c
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) metricName() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, metricType)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// CounterVec - a monotonically increasing value partitioned by labels.
+type CounterVec struct {
+	desc
+	lock   sync.Mutex
+	values map[string]*sample
+}
+
+// Inc increments the counter for label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter for label values by v, v must not be negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), labelValues...)}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeHeader(w, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := c.values[key]
+		writeSample(w, c.name, c.labels, s.labels, "", "", s.value)
+	}
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec - a distribution of observed values partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramSample
+}
+
+// Observe adds a value to the histogram for label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSample{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.writeHeader(w, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.values[key]
+		for i, upper := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(upper), float64(s.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labels, "", "", float64(s.count))
+	}
+}
+
+type funcMetric struct {
+	desc
+	metricType string
+	f          func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w, m.metricType)
+	writeSample(w, m.name, nil, nil, "", "", m.f())
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) != 0 || len(extraLabel) != 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabelValue(values[i]))
+		}
+		if len(extraLabel) != 0 {
+			if len(labels) != 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounterVec("requests_total", "Number of requests.", "method", "code")
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(3, "POST", "201")
+
+	latency := r.NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	latency.Observe(0.05, "/")
+	latency.Observe(0.5, "/")
+	latency.Observe(5, "/")
+
+	r.NewGaugeFunc("queue_depth", "Queue \"depth\".\nLine", func() float64 { return 7 })
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.Write(&buf))
+
+	expected := `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/",le="0.1"} 1
+latency_seconds_bucket{route="/",le="1"} 2
+latency_seconds_bucket{route="/",le="+Inf"} 3
+latency_seconds_sum{route="/"} 5.55
+latency_seconds_count{route="/"} 3
+# HELP queue_depth Queue "depth".\nLine
+# TYPE queue_depth gauge
+queue_depth 7
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 2
+requests_total{method="POST",code="201"} 3
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterRuntimeMetrics()
+	r.NewCounterVec("labels_total", "Escaping.", "value").Inc("a\"b\\c")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	assert.True(t, strings.Contains(w.Body.String(), "# TYPE go_goroutines gauge\n"))
+	assert.True(t, strings.Contains(w.Body.String(), `labels_total{value="a\"b\\c"} 1`))
+}
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("requests_total", "Number of requests.")
+
+	assert.Panics(t, func() {
+		r.NewCounterVec("requests_total", "Number of requests.")
+	})
+	assert.Panics(t, func() {
+		r.NewCounterVec("other_total", "Other.", "label").Inc()
+	})
+}
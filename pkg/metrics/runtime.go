@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bufio"
+	"runtime"
+)
+
+const runtimeCollectorName = "go_"
+
+// RegisterRuntimeMetrics exports Go runtime metrics: goroutines, memory and garbage collector statistics.
+func (r *Registry) RegisterRuntimeMetrics() {
+	r.register(&runtimeCollector{})
+}
+
+type runtimeCollector struct{}
+
+func (c *runtimeCollector) metricName() string {
+	return runtimeCollectorName
+}
+
+func (c *runtimeCollector) write(w *bufio.Writer) {
+	// Memory statistics are read once per export since it stops the world.
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	metrics := []struct {
+		desc
+		metricType string
+		value      float64
+	}{
+		{desc{name: "go_goroutines", help: "Number of goroutines that currently exist."}, "gauge", float64(runtime.NumGoroutine())},
+		{desc{name: "go_memstats_alloc_bytes", help: "Number of bytes allocated and still in use."}, "gauge", float64(stats.Alloc)},
+		{desc{name: "go_memstats_alloc_bytes_total", help: "Total number of bytes allocated, even if freed."}, "counter", float64(stats.TotalAlloc)},
+		{desc{name: "go_memstats_heap_inuse_bytes", help: "Number of heap bytes that are in use."}, "gauge", float64(stats.HeapInuse)},
+		{desc{name: "go_memstats_heap_objects", help: "Number of allocated objects."}, "gauge", float64(stats.HeapObjects)},
+		{desc{name: "go_memstats_sys_bytes", help: "Number of bytes obtained from system."}, "gauge", float64(stats.Sys)},
+		{desc{name: "go_gc_cycles_total", help: "Number of completed GC cycles."}, "counter", float64(stats.NumGC)},
+		{desc{name: "go_gc_pause_seconds_total", help: "Total time spent in GC stop-the-world pauses."}, "counter", float64(stats.PauseTotalNs) / 1e9},
+	}
+
+	for _, m := range metrics {
+		m.writeHeader(w, m.metricType)
+		writeSample(w, m.name, nil, nil, "", "", m.value)
+	}
+}
@@ -0,0 +1,278 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clockSkew - tolerance of time checks for clocks of a provider and this service.
+const clockSkew = time.Minute
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type idTokenPayload struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	Nonce     string   `json:"nonce"`
+	Email     string   `json:"email"`
+	Name      string   `json:"name"`
+}
+
+// audience - the aud claim is either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// VerifyIDToken checks a signature, an issuer, an audience, an expiry time and a nonce of an ID token.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw string, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrBadIDToken)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIDToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIDToken, err)
+	}
+
+	key, err := p.signingKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var payload idTokenPayload
+	if err := decodeSegment(parts[1], &payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadIDToken, err)
+	}
+
+	if payload.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrBadIDToken, payload.Issuer)
+	}
+
+	if !payload.Audience.contains(p.config.ClientID) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrBadIDToken)
+	}
+
+	expiresAt := time.Unix(payload.ExpiresAt, 0)
+	if payload.ExpiresAt == 0 || time.Now().After(expiresAt.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrBadIDToken)
+	}
+
+	if payload.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrBadIDToken)
+	}
+
+	if len(payload.Subject) == 0 {
+		return nil, fmt.Errorf("%w: no subject", ErrBadIDToken)
+	}
+
+	return &Claims{
+		Issuer:    payload.Issuer,
+		Subject:   payload.Subject,
+		Email:     payload.Email,
+		Name:      payload.Name,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, v := range a {
+		if v == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey returns a provider key by its id. Keys are refetched once if the id is unknown,
+// so a provider can rotate its keys.
+func (p *Provider) signingKey(ctx context.Context, keyID string) (interface{}, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	key, ok := p.keys[keyID]
+	p.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	status, err := p.doJSON(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: jwks status %d", ErrDiscovery, status)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped, a provider may publish them for other clients.
+		if publicKey, err := k.publicKey(); err == nil {
+			keys[k.KeyID] = publicKey
+		}
+	}
+
+	p.lock.Lock()
+	p.keys = keys
+	p.lock.Unlock()
+
+	key, ok = keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrBadIDToken, keyID)
+	}
+	return key, nil
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point isn't on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+func verifySignature(algorithm string, key interface{}, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key doesn't match algorithm", ErrBadIDToken)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: bad signature", ErrBadIDToken)
+		}
+		return nil
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key doesn't match algorithm", ErrBadIDToken)
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("%w: bad signature", ErrBadIDToken)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return fmt.Errorf("%w: bad signature", ErrBadIDToken)
+		}
+		return nil
+	}
+
+	// "none" and symmetric algorithms are never accepted.
+	return fmt.Errorf("%w: unsupported algorithm %q", ErrBadIDToken, algorithm)
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,255 @@
+// Package oidc implements the OpenID Connect authorization code flow with PKCE for a relying party.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+
+	// maxResponseSize - limit of a provider response body.
+	maxResponseSize = 1 << 20
+)
+
+var (
+	// ErrDiscovery - provider metadata can't be fetched or is inconsistent.
+	ErrDiscovery = errors.New("oidc discovery failed")
+	// ErrExchange - an authorization code hasn't been exchanged for tokens.
+	ErrExchange = errors.New("oidc code exchange failed")
+	// ErrBadIDToken - an ID token can't be accepted.
+	ErrBadIDToken = errors.New("bad id token")
+)
+
+// Config - relying party settings.
+type Config struct {
+	// Issuer - an identifier of a provider, its metadata is discovered relative to it.
+	Issuer string
+	// ClientID - an identifier of this service registered at the provider.
+	ClientID string
+	// ClientSecret - a secret of a confidential client, public clients leave it empty.
+	ClientSecret string
+	// RedirectURL - where the provider sends users back with an authorization code.
+	RedirectURL string
+	// Scopes - requested scopes, "openid" is always requested.
+	Scopes []string
+	// HTTPClient - a client for provider requests, http.DefaultClient is used if it is nil.
+	HTTPClient *http.Client
+}
+
+// AuthRequest - values that are kept by a client between a redirect to a provider and a callback.
+type AuthRequest struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// NewAuthRequest generates random state, nonce and PKCE code verifier.
+func NewAuthRequest() (*AuthRequest, error) {
+	values := make([]string, 3)
+	for i := range values {
+		data := make([]byte, 32)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	return &AuthRequest{
+		State:    values[0],
+		Nonce:    values[1],
+		Verifier: values[2],
+	}, nil
+}
+
+// CodeChallenge returns an S256 PKCE challenge of a verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Claims - identity claims of a verified ID token.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Email     string
+	Name      string
+	ExpiresAt time.Time
+}
+
+// providerMetadata - the part of the discovery document the flow needs.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider - an OpenID provider as seen by a relying party.
+// Metadata and signing keys are fetched on first use and cached.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	lock     sync.Mutex
+	metadata *providerMetadata
+	keys     map[string]interface{}
+}
+
+// NewProvider creates a provider, no requests are made until it is used.
+func NewProvider(config Config) *Provider {
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Provider{
+		config: config,
+		client: client,
+	}
+}
+
+// Issuer returns an issuer identifier of a provider.
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// AuthURL returns a provider URL a user has to be redirected to.
+func (p *Provider) AuthURL(ctx context.Context, request *AuthRequest) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := []string{"openid"}
+	for _, s := range p.config.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.config.ClientID)
+	values.Set("redirect_uri", p.config.RedirectURL)
+	values.Set("scope", strings.Join(scopes, " "))
+	values.Set("state", request.State)
+	values.Set("nonce", request.Nonce)
+	values.Set("code_challenge", CodeChallenge(request.Verifier))
+	values.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return metadata.AuthorizationEndpoint + separator + values.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens and returns claims of a verified ID token.
+func (p *Provider) Exchange(ctx context.Context, code string, request *AuthRequest) (*Claims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", p.config.RedirectURL)
+	values.Set("client_id", p.config.ClientID)
+	values.Set("code_verifier", request.Verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(p.config.ClientSecret) != 0 {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	status, err := p.doJSON(req, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d %s", ErrExchange, status, tokens.Error)
+	}
+	if len(tokens.IDToken) == 0 {
+		return nil, fmt.Errorf("%w: no id token", ErrExchange)
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, request.Nonce)
+}
+
+// discover fetches provider metadata once.
+func (p *Provider) discover(ctx context.Context) (*providerMetadata, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.config.Issuer, "/")+discoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &providerMetadata{}
+	status, err := p.doJSON(req, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrDiscovery, status)
+	}
+
+	// An issuer in metadata must match the configured one exactly, otherwise tokens of another provider could be accepted.
+	if metadata.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q doesn't match %q", ErrDiscovery, metadata.Issuer, p.config.Issuer)
+	}
+	if len(metadata.AuthorizationEndpoint) == 0 || len(metadata.TokenEndpoint) == 0 || len(metadata.JWKSURI) == 0 {
+		return nil, fmt.Errorf("%w: incomplete metadata", ErrDiscovery)
+	}
+
+	p.metadata = metadata
+	return metadata, nil
+}
+
+func (p *Provider) doJSON(req *http.Request, dst interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(body, dst); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, err
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,162 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/r4start/go-url-shortener/pkg/oidc/oidctest"
+)
+
+func TestProvider_Exchange(t *testing.T) {
+	idp := oidctest.NewServer("shortener")
+	defer idp.Close()
+
+	provider := NewProvider(Config{
+		Issuer:      idp.Issuer(),
+		ClientID:    "shortener",
+		RedirectURL: "http://localhost/api/auth/callback",
+		Scopes:      []string{"openid", "email"},
+	})
+
+	request, err := NewAuthRequest()
+	assert.NoError(t, err)
+
+	authURL, err := provider.AuthURL(context.Background(), request)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(authURL, idp.URL+"/authorize?"))
+
+	u, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "openid email", u.Query().Get("scope"))
+	assert.Equal(t, CodeChallenge(request.Verifier), u.Query().Get("code_challenge"))
+
+	callback, err := idp.Authorize(authURL, "alice")
+	assert.NoError(t, err)
+	c, err := url.Parse(callback)
+	assert.NoError(t, err)
+	assert.Equal(t, request.State, c.Query().Get("state"))
+
+	// A wrong verifier is rejected by the provider.
+	stolen := *request
+	stolen.Verifier = "guess"
+	_, err = provider.Exchange(context.Background(), c.Query().Get("code"), &stolen)
+	assert.ErrorIs(t, err, ErrExchange)
+
+	callback, err = idp.Authorize(authURL, "alice")
+	assert.NoError(t, err)
+	c, err = url.Parse(callback)
+	assert.NoError(t, err)
+
+	claims, err := provider.Exchange(context.Background(), c.Query().Get("code"), request)
+	assert.NoError(t, err)
+	assert.Equal(t, idp.Issuer(), claims.Issuer)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "alice@example.com", claims.Email)
+
+	// A code can be used once.
+	_, err = provider.Exchange(context.Background(), c.Query().Get("code"), request)
+	assert.ErrorIs(t, err, ErrExchange)
+}
+
+func TestProvider_VerifyIDToken(t *testing.T) {
+	idp := oidctest.NewServer("shortener")
+	defer idp.Close()
+
+	provider := NewProvider(Config{Issuer: idp.Issuer(), ClientID: "shortener"})
+
+	sign := func(claims map[string]interface{}) string {
+		token, err := idp.IDToken(claims)
+		assert.NoError(t, err)
+		return token
+	}
+
+	valid := sign(map[string]interface{}{"sub": "alice", "nonce": "n"})
+	parts := strings.Split(valid, ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test-key"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "Valid token",
+			token: valid,
+		},
+		{
+			name:  "Audience array",
+			token: sign(map[string]interface{}{"sub": "alice", "nonce": "n", "aud": []string{"other", "shortener"}}),
+		},
+		{
+			name:    "Wrong nonce",
+			token:   sign(map[string]interface{}{"sub": "alice", "nonce": "other"}),
+			wantErr: true,
+		},
+		{
+			name:    "Wrong audience",
+			token:   sign(map[string]interface{}{"sub": "alice", "nonce": "n", "aud": "other"}),
+			wantErr: true,
+		},
+		{
+			name:    "Wrong issuer",
+			token:   sign(map[string]interface{}{"sub": "alice", "nonce": "n", "iss": "https://evil.example.com"}),
+			wantErr: true,
+		},
+		{
+			name:    "Expired",
+			token:   sign(map[string]interface{}{"sub": "alice", "nonce": "n", "exp": time.Now().Add(-time.Hour).Unix()}),
+			wantErr: true,
+		},
+		{
+			name:    "No subject",
+			token:   sign(map[string]interface{}{"nonce": "n"}),
+			wantErr: true,
+		},
+		{
+			name:    "Unsigned",
+			token:   unsigned,
+			wantErr: true,
+		},
+		{
+			name:    "Tampered payload",
+			token:   parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`)) + "." + parts[2],
+			wantErr: true,
+		},
+		{
+			name:    "Malformed",
+			token:   "abc",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := provider.VerifyIDToken(context.Background(), tt.token, "n")
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadIDToken)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "alice", claims.Subject)
+		})
+	}
+}
+
+func TestProvider_IssuerMismatch(t *testing.T) {
+	idp := oidctest.NewServer("shortener")
+	defer idp.Close()
+
+	provider := NewProvider(Config{Issuer: idp.Issuer() + "/", ClientID: "shortener"})
+	request, err := NewAuthRequest()
+	assert.NoError(t, err)
+
+	_, err = provider.AuthURL(context.Background(), request)
+	assert.ErrorIs(t, err, ErrDiscovery)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// APIKey - a credential that lets a program act on behalf of a user.
+type APIKey struct {
+	// ID - a public key id.
+	ID uint64
+	// UserID - an owner of the key.
+	UserID uint64
+	// Name - a user provided label.
+	Name string
+	// Hash - a hash of the key secret, the secret itself isn't stored.
+	Hash []byte
+	// Created - when the key has been created.
+	Created time.Time
+}
+
+// APIKeyStorage - interface of a storage that keeps user API keys.
+type APIKeyStorage interface {
+	// AddAPIKey - store a new key.
+	AddAPIKey(ctx context.Context, key APIKey) error
+	// FindAPIKey - get an active key by its hash. ErrNotFound is returned for unknown and revoked keys.
+	FindAPIKey(ctx context.Context, hash []byte) (*APIKey, error)
+	// UserAPIKeys - get active keys of a user ordered by creation time.
+	UserAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error)
+	// RevokeAPIKey - revoke a user key. ErrNotFound is returned if the user doesn't have an active key with the id.
+	RevokeAPIKey(ctx context.Context, userID, id uint64) error
+
+	Closer
+}
+
+func (s *syncMapStorage) AddAPIKey(_ context.Context, key APIKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.apiKeys[key.ID] = &key
+	s.apiHashes[string(key.Hash)] = key.ID
+
+	return nil
+}
+
+func (s *syncMapStorage) FindAPIKey(_ context.Context, hash []byte) (*APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	id, ok := s.apiHashes[string(hash)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	key := *s.apiKeys[id]
+	return &key, nil
+}
+
+func (s *syncMapStorage) UserAPIKeys(_ context.Context, userID uint64) ([]APIKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]APIKey, 0)
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, *key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (s *syncMapStorage) RevokeAPIKey(_ context.Context, userID, id uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.UserID != userID {
+		return ErrNotFound
+	}
+
+	delete(s.apiHashes, string(key.Hash))
+	delete(s.apiKeys, id)
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrKeyMismatch - a restored link has an id that its URL doesn't produce.
+var ErrKeyMismatch = errors.New("short url id doesn't match url")
+
+// UserURL - a link with its owner, a unit of backups.
+type UserURL struct {
+	UserID uint64
+	// Canonical - a canonical form of OriginalURL the id is made of, empty if the id is made of OriginalURL.
+	Canonical string
+	// Blocked - a link has been disabled by a blocklist.
+	Blocked bool
+	ExportedURL
+}
+
+// URLBackup - interface of a storage that can list links of all users and load them back
+// keeping their ids, owners, states and times.
+type URLBackup interface {
+	// BackupURLs - call fn for every link of every user, deleted ones included.
+	// It stops at the first error of fn and returns it.
+	BackupURLs(ctx context.Context, fn func(UserURL) error) error
+	// RestoreURLs - add links as they are. Links a storage already has are skipped.
+	// It returns the number of added links.
+	RestoreURLs(ctx context.Context, links []UserURL) (uint64, error)
+
+	Closer
+}
+
+// checkKeys makes sure ids of links are the ones their URLs have in any storage.
+func checkKeys(links []UserURL) error {
+	for _, link := range links {
+		canonical := link.OriginalURL
+		if len(link.Canonical) != 0 {
+			canonical = link.Canonical
+		}
+		key, err := generateKey(canonical)
+		if err != nil {
+			return err
+		}
+		if key != link.ShortURLID {
+			return fmt.Errorf("%w: %d for %q", ErrKeyMismatch, link.ShortURLID, link.OriginalURL)
+		}
+	}
+	return nil
+}
+
+func (s *syncMapStorage) BackupURLs(ctx context.Context, fn func(UserURL) error) error {
+	s.lock.RLock()
+	links := make([]UserURL, 0, len(s.urls))
+	add := func(userID, id uint64) {
+		deletedAt, deleted := s.goneIds[id]
+		links = append(links, UserURL{
+			UserID:    userID,
+			Canonical: s.canonical[id],
+			Blocked:   s.blocked[id],
+			ExportedURL: ExportedURL{
+				ShortURLID:  id,
+				OriginalURL: s.urls[id],
+				Created:     s.added[id],
+				Deleted:     deleted,
+				DeletedAt:   deletedAt,
+			},
+		})
+	}
+	for userID, data := range s.userData {
+		for _, d := range data {
+			add(userID, d.ShortURLID)
+		}
+	}
+	for userID, gone := range s.userGone {
+		for _, id := range gone {
+			add(userID, id)
+		}
+	}
+	s.lock.RUnlock()
+
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Created.Before(links[j].Created)
+	})
+
+	for _, link := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncMapStorage) RestoreURLs(_ context.Context, links []UserURL) (uint64, error) {
+	if err := checkKeys(links); err != nil {
+		return 0, err
+	}
+	return uint64(len(s.restoreURLs(links))), nil
+}
+
+// restoreURLs adds links the storage doesn't have and returns them.
+func (s *syncMapStorage) restoreURLs(links []UserURL) []UserURL {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	restored := make([]UserURL, 0, len(links))
+	for _, link := range links {
+		id := link.ShortURLID
+		if _, ok := s.urls[id]; ok {
+			continue
+		}
+
+		s.urls[id] = link.OriginalURL
+		if len(link.Canonical) != 0 && link.Canonical != link.OriginalURL {
+			s.canonical[id] = link.Canonical
+		}
+		s.added[id] = link.Created
+		if link.Blocked {
+			s.blocked[id] = true
+		}
+		if link.Deleted {
+			s.goneIds[id] = link.DeletedAt
+			s.userGone[link.UserID] = append(s.userGone[link.UserID], id)
+		} else {
+			s.userData[link.UserID] = append(s.userData[link.UserID], UserData{
+				ShortURLID:  id,
+				OriginalURL: link.OriginalURL,
+			})
+		}
+		restored = append(restored, link)
+	}
+	return restored
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"sort"
+)
+
+// URLBlocker - interface of a storage that can disable links with malicious destinations.
+// Get returns ErrBlocked for a blocked link, the link stays in lists of its owner.
+type URLBlocker interface {
+	// ScanURLs - call fn for every link that isn't deleted. It stops at the first error of fn and returns it.
+	ScanURLs(ctx context.Context, fn func(id uint64, url string) error) error
+	// BlockURLs - disable links, unknown ids are skipped.
+	BlockURLs(ctx context.Context, ids []uint64) error
+	// UnblockURLs - enable blocked links again.
+	UnblockURLs(ctx context.Context, ids []uint64) error
+	// BlockedURLs - ids of blocked links that aren't deleted, deleted links aren't scanned and stay blocked.
+	BlockedURLs(ctx context.Context) ([]uint64, error)
+
+	Closer
+}
+
+func (s *syncMapStorage) ScanURLs(ctx context.Context, fn func(id uint64, url string) error) error {
+	type link struct {
+		id  uint64
+		url string
+	}
+
+	s.lock.RLock()
+	links := make([]link, 0, len(s.urls))
+	for id, url := range s.urls {
+		if _, ok := s.goneIds[id]; !ok {
+			links = append(links, link{id: id, url: url})
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, l := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(l.id, l.url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncMapStorage) BlockURLs(_ context.Context, ids []uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.setBlocked(ids, true)
+	return nil
+}
+
+func (s *syncMapStorage) UnblockURLs(_ context.Context, ids []uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.setBlocked(ids, false)
+	return nil
+}
+
+// setBlocked changes states of known links. The lock must be held.
+func (s *syncMapStorage) setBlocked(ids []uint64, blocked bool) {
+	for _, id := range ids {
+		if _, ok := s.urls[id]; !ok {
+			continue
+		}
+		if blocked {
+			s.blocked[id] = true
+		} else {
+			delete(s.blocked, id)
+		}
+	}
+}
+
+func (s *syncMapStorage) BlockedURLs(context.Context) ([]uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ids := make([]uint64, 0, len(s.blocked))
+	for id := range s.blocked {
+		if _, ok := s.goneIds[id]; ok {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
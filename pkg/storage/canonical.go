@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// CanonicalURL - a URL as a user has provided it and its canonical form. An id of a URL is made of the form,
+// so different spellings of a URL share a short URL.
+type CanonicalURL struct {
+	URL       string
+	Canonical string
+}
+
+// CanonicalURLStorage - interface of a storage that identifies URLs by canonical forms and keeps
+// the URLs as they have been provided first.
+type CanonicalURLStorage interface {
+	// AddCanonicalURLs - batch urls add, a URL is skipped if the storage has a URL with the same canonical form.
+	AddCanonicalURLs(ctx context.Context, userID uint64, urls []CanonicalURL) ([]AddResult, error)
+
+	Closer
+}
+
+func (s *syncMapStorage) AddCanonicalURLs(_ context.Context, userID uint64, urls []CanonicalURL) ([]AddResult, error) {
+	keys := make([]uint64, 0, len(urls))
+	for _, url := range urls {
+		key, err := generateKey(url.Canonical)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.addURLs(userID, keys, urls), nil
+}
+
+// addURLs adds urls with their keys unless the storage has them. The lock must be held.
+func (s *syncMapStorage) addURLs(userID uint64, keys []uint64, urls []CanonicalURL) []AddResult {
+	now := time.Now()
+	result := make([]AddResult, 0, len(urls))
+	for i, url := range urls {
+		key := keys[i]
+		delete(s.goneIds, key)
+
+		if _, ok := s.urls[key]; ok {
+			result = append(result, AddResult{ID: key})
+			continue
+		}
+
+		s.urls[key] = url.URL
+		if url.Canonical != url.URL {
+			s.canonical[key] = url.Canonical
+		}
+		s.added[key] = now
+		s.userData[userID] = append(s.userData[userID], UserData{
+			ShortURLID:  key,
+			OriginalURL: url.URL,
+		})
+
+		result = append(result, AddResult{ID: key, Inserted: true})
+	}
+	return result
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/hyperloglog"
+)
+
+const clickDayLayout = "2006-01-02"
+
+// Click - a redirect served for a short URL.
+type Click struct {
+	// ID - short URL id.
+	ID uint64
+	// Visitor - an anonymized visitor fingerprint.
+	Visitor uint64
+	// Time - when the redirect has been served.
+	Time time.Time
+	// Bot - true iff the redirect has been requested by a bot or as a prefetch.
+	Bot bool
+}
+
+// DailyClicks - redirect statistics of a short URL for a single day.
+type DailyClicks struct {
+	// Day - UTC midnight of the day.
+	Day time.Time
+	// Clicks - number of redirects served to people.
+	Clicks uint64
+	// BotClicks - number of redirects served to bots.
+	BotClicks uint64
+	// Visitors - sketch of distinct visitor fingerprints. Bots are not included.
+	Visitors *hyperloglog.Sketch
+}
+
+// ClickStat - interface of a storage that keeps redirect statistics.
+type ClickStat interface {
+	// AddClicks - register served redirects.
+	AddClicks(ctx context.Context, clicks []Click) error
+	// LinkClicks - get daily statistics of a short URL ordered by day.
+	LinkClicks(ctx context.Context, id uint64) ([]DailyClicks, error)
+	// Redirects - number of all served redirects in [from, to) split into buckets aligned to from.
+	// Redirects are accounted with an hour precision, so from and bucket should be aligned to an hour.
+	// Buckets without events may be omitted.
+	Redirects(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error)
+	// TopLinks - short URLs with the largest number of clicks made by people in days [from, to).
+	TopLinks(ctx context.Context, from, to time.Time, limit int) ([]TopLink, error)
+	// LinksClicks - total number of clicks made by people for each of short URLs.
+	// Short URLs without clicks may be omitted.
+	LinksClicks(ctx context.Context, ids []uint64) (map[uint64]uint64, error)
+
+	Closer
+}
+
+// TopLink - a short URL with its clicks count.
+type TopLink struct {
+	ID          uint64
+	OriginalURL string
+	Clicks      uint64
+}
+
+type clickKey struct {
+	ID  uint64
+	Day int64
+}
+
+func clickDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// aggregateClicks groups clicks by short URL id and day.
+func aggregateClicks(clicks []Click) map[clickKey]*DailyClicks {
+	result := make(map[clickKey]*DailyClicks)
+	for _, c := range clicks {
+		day := clickDay(c.Time)
+		key := clickKey{ID: c.ID, Day: day.Unix()}
+		entry, ok := result[key]
+		if !ok {
+			entry = &DailyClicks{
+				Day:      day,
+				Visitors: hyperloglog.New(),
+			}
+			result[key] = entry
+		}
+		if c.Bot {
+			entry.BotClicks++
+			continue
+		}
+		entry.Clicks++
+		entry.Visitors.Add(c.Visitor)
+	}
+	return result
+}
+
+// aggregateRedirects counts clicks per hour.
+func aggregateRedirects(clicks []Click) map[int64]uint64 {
+	result := make(map[int64]uint64)
+	for _, c := range clicks {
+		result[c.Time.UTC().Truncate(time.Hour).Unix()]++
+	}
+	return result
+}
+
+// bucketize groups timestamped counters into buckets of [from, to) aligned to from.
+func bucketize(from, to time.Time, bucket time.Duration, events []TimeBucket) []TimeBucket {
+	counts := make(map[int64]uint64)
+	for _, e := range events {
+		if e.Start.Before(from) || !e.Start.Before(to) {
+			continue
+		}
+		counts[int64(e.Start.Sub(from)/bucket)] += e.Count
+	}
+
+	result := make([]TimeBucket, 0, len(counts))
+	for idx, count := range counts {
+		result = append(result, TimeBucket{
+			Start: from.Add(time.Duration(idx) * bucket),
+			Count: count,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+
+	return result
+}
+
+func sortTopLinks(data []TopLink) {
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].Clicks != data[j].Clicks {
+			return data[i].Clicks > data[j].Clicks
+		}
+		return data[i].ID < data[j].ID
+	})
+}
+
+func sortDailyClicks(data []DailyClicks) {
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].Day.Before(data[j].Day)
+	})
+}
@@ -5,9 +5,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/hyperloglog"
 )
 
 const (
@@ -33,26 +37,185 @@ const (
 	insertFeed = `INSERT INTO feeds (url_hash, url, user_id) VALUES ($1, $2, $3)` +
 		`ON CONFLICT ON CONSTRAINT feeds_url_key DO NOTHING;`
 
-	deleteFeed = `update feeds set flags = 'disabled' where user_id = %d and url_hash in (%s);`
+	// Different spellings of a URL share a hash, so a URL is skipped if its hash is taken.
+	// A canonical form is kept only if it differs from the URL.
+	insertCanonicalFeed = `INSERT INTO feeds (url_hash, url, user_id, canonical) ` +
+		`SELECT $1::bigint, $2::varchar, $3::bigint, nullif($4::varchar, $2::varchar) ` +
+		`WHERE NOT EXISTS (select 1 from feeds where url_hash = $1::bigint) ` +
+		`ON CONFLICT ON CONSTRAINT feeds_url_key DO NOTHING RETURNING url_hash;`
+	// A skipped URL may be stored under a hash of its own, e.g. if it has been added before canonical forms.
+	getCanonicalFeed = `select url_hash from feeds where url_hash = $1 or url = $2 order by url_hash = $1 desc limit 1;`
+
+	deleteFeed = `update feeds set flags = 'disabled', deleted = now() where user_id = %d and url_hash in (%s);`
 
-	getFeed             = `select url, flags from feeds where url_hash = $1;`
+	getFeed             = `select url, flags, blocked is not null from feeds where url_hash = $1;`
 	getActiveFeedsCount = `select count(flags=$1) from feeds;`
 
 	getUserData = `select url_hash, url from feeds where user_id = $1 and flags = 'active';`
 
+	exportUserData = `select url_hash, url, added, flags, deleted from feeds where user_id = $1 order by added, id;`
+
+	backupFeeds = `select user_id, url_hash, url, coalesce(canonical, ''), added, flags, deleted, blocked is not null ` +
+		`from feeds order by id;`
+	// Backups don't keep block times, a restored block starts now.
+	restoreFeed = `INSERT INTO feeds (url_hash, url, user_id, added, flags, deleted, canonical, blocked) ` +
+		`SELECT $1::bigint, $2::varchar, $3::bigint, coalesce($4::timestamptz, now()), $5::state, $6::timestamptz, ` +
+		`nullif($7::varchar, ''), case when $8::boolean then now() end ` +
+		`WHERE NOT EXISTS (select 1 from feeds where url_hash = $1::bigint) ` +
+		`ON CONFLICT ON CONSTRAINT feeds_url_key DO NOTHING;`
+
 	// Plain 'select count(distinct user_id)' is slower than this query.
 	// https://stackoverflow.com/questions/11250253/postgresql-countdistinct-very-slow
 	getActiveUsersCount = `select count(*) from (select distinct user_id from feeds where flags=$1) as temp;`
 
 	checkFeedsTable = `select count(*) from feeds;`
 
+	createClicksTableScheme = `
+       CREATE TABLE IF NOT EXISTS clicks (
+			url_hash bigint not null,
+			day date not null,
+			clicks bigint not null DEFAULT 0,
+			visitors bytea not null,
+			PRIMARY KEY (url_hash, day)
+		);`
+
+	addBotClicksColumn = `ALTER TABLE clicks ADD COLUMN IF NOT EXISTS bot_clicks bigint not null DEFAULT 0;`
+
+	// Sketches can't be merged by SQL, so writers of a link and a day are serialized by an advisory lock
+	// held until a transaction ends. Counters are added up, so they never depend on the lock.
+	lockDailyClicks  = `select pg_advisory_xact_lock($1);`
+	getDailyVisitors = `select visitors from clicks where url_hash = $1 and day = $2;`
+
+	upsertDailyClicks = `INSERT INTO clicks (url_hash, day, clicks, bot_clicks, visitors) VALUES ($1, $2, $3, $4, $5) ` +
+		`ON CONFLICT (url_hash, day) DO UPDATE ` +
+		`SET clicks = clicks.clicks + excluded.clicks, bot_clicks = clicks.bot_clicks + excluded.bot_clicks, ` +
+		`visitors = excluded.visitors;`
+
+	getLinkClicks = `select day, clicks, bot_clicks, visitors from clicks where url_hash = $1 order by day;`
+
+	addFeedsDeletedColumn = `ALTER TABLE feeds ADD COLUMN IF NOT EXISTS deleted timestamptz;`
+
+	addFeedsCanonicalColumn = `ALTER TABLE feeds ADD COLUMN IF NOT EXISTS canonical varchar(8192);`
+
+	addFeedsBlockedColumn = `ALTER TABLE feeds ADD COLUMN IF NOT EXISTS blocked timestamptz;`
+
+	scanActiveFeeds = `select url_hash, url from feeds where flags = 'active' order by id;`
+	blockFeeds      = `update feeds set blocked = now() where blocked is null and url_hash in (%s);`
+	unblockFeeds    = `update feeds set blocked = null where url_hash in (%s);`
+	getBlockedFeeds = `select url_hash from feeds where blocked is not null and flags = 'active' order by url_hash;`
+
+	createRedirectsTableScheme = `
+       CREATE TABLE IF NOT EXISTS redirects (
+			hour timestamptz PRIMARY KEY,
+			count bigint not null DEFAULT 0
+		);`
+
+	upsertRedirects = `INSERT INTO redirects (hour, count) VALUES ($1, $2) ` +
+		`ON CONFLICT (hour) DO UPDATE SET count = redirects.count + excluded.count;`
+
+	// Time series queries take the window start as $1, the window end as $2 and the bucket size in seconds as $3.
+	getCreatedURLsSeries = `select floor(extract(epoch from (added - $1)) / $3)::bigint as bucket, count(*) ` +
+		`from feeds where added >= $1 and added < $2 group by bucket;`
+	getDeletedURLsSeries = `select floor(extract(epoch from (deleted - $1)) / $3)::bigint as bucket, count(*) ` +
+		`from feeds where deleted >= $1 and deleted < $2 group by bucket;`
+	getRedirectsSeries = `select floor(extract(epoch from (hour - $1)) / $3)::bigint as bucket, sum(count)::bigint ` +
+		`from redirects where hour >= $1 and hour < $2 group by bucket;`
+
+	getUserDeletedURLsCount = `select count(*) from feeds where user_id = $1 and flags = 'disabled';`
+
+	// User time series queries take the same parameters as above and the user id as $4.
+	getUserCreatedURLsSeries = `select floor(extract(epoch from (added - $1)) / $3)::bigint as bucket, count(*) ` +
+		`from feeds where added >= $1 and added < $2 and user_id = $4 group by bucket;`
+
+	getLinksClicks = `select url_hash, sum(clicks)::bigint from clicks where url_hash in (%s) group by url_hash;`
+
+	getTopLinks = `select c.url_hash, f.url, sum(c.clicks)::bigint as total from clicks c ` +
+		`join feeds f on f.url_hash = c.url_hash where c.day >= $1 and c.day < $2 ` +
+		`group by c.url_hash, f.url order by total desc, c.url_hash limit $3;`
+
+	createAPIKeysTableScheme = `
+       CREATE TABLE IF NOT EXISTS api_keys (
+			id bigint PRIMARY KEY,
+			user_id bigint not null,
+			name varchar(256) not null DEFAULT '',
+			hash bytea not null UNIQUE,
+			created timestamptz not null DEFAULT now(),
+			revoked timestamptz
+		);`
+
+	createAPIKeysUserIndex = `create index IF NOT EXISTS api_keys_user_id_idx on api_keys(user_id);`
+
+	insertAPIKey     = `INSERT INTO api_keys (id, user_id, name, hash, created) VALUES ($1, $2, $3, $4, $5);`
+	getAPIKeyByHash  = `select id, user_id, name, created from api_keys where hash = $1 and revoked is null;`
+	getUserAPIKeys   = `select id, name, hash, created from api_keys where user_id = $1 and revoked is null order by created, id;`
+	revokeUserAPIKey = `update api_keys set revoked = now() where id = $1 and user_id = $2 and revoked is null;`
+
+	createIdentitiesTableScheme = `
+       CREATE TABLE IF NOT EXISTS identities (
+			issuer varchar(2048) not null,
+			subject varchar(255) not null,
+			user_id bigint not null,
+			created timestamptz not null DEFAULT now(),
+			PRIMARY KEY (issuer, subject)
+		);`
+
+	insertIdentity = `INSERT INTO identities (issuer, subject, user_id) VALUES ($1, $2, $3) ` +
+		`ON CONFLICT (issuer, subject) DO NOTHING;`
+	getIdentityUser = `select user_id from identities where issuer = $1 and subject = $2;`
+
+	createMergedUsersTableScheme = `
+       CREATE TABLE IF NOT EXISTS merged_users (
+			user_id bigint PRIMARY KEY,
+			merged_into bigint not null,
+			merged timestamptz not null DEFAULT now()
+		);`
+
+	// Only active links are counted, deleted ones are moved too, so user statistics stay complete.
+	mergeUsers = `with merged as (INSERT INTO merged_users (user_id, merged_into) VALUES ($1, $2) ` +
+		`ON CONFLICT (user_id) DO NOTHING), ` +
+		`moved as (update feeds set user_id = $2 where user_id = $1 returning flags) ` +
+		`select count(*) from moved where flags = 'active';`
+	getMergedInto = `select merged_into from merged_users where user_id = $1;`
+
+	createIdempotencyTableScheme = `
+       CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id bigint not null,
+			key varchar(255) not null,
+			fingerprint bytea not null,
+			done boolean not null DEFAULT false,
+			status integer not null DEFAULT 0,
+			content_type varchar(255) not null DEFAULT '',
+			body bytea,
+			expires timestamptz not null,
+			PRIMARY KEY (user_id, key)
+		);`
+
+	// Expired records of a user are dropped as the user reserves keys.
+	deleteExpiredIdempotencyKeys = `delete from idempotency_keys where user_id = $1 and expires <= now();`
+	reserveIdempotencyKey        = `INSERT INTO idempotency_keys (user_id, key, fingerprint, expires) VALUES ($1, $2, $3, $4) ` +
+		`ON CONFLICT (user_id, key) DO NOTHING;`
+	getIdempotencyKey  = `select fingerprint, done, status, content_type, body, expires from idempotency_keys where user_id = $1 and key = $2;`
+	saveIdempotencyKey = `update idempotency_keys set done = true, status = $3, content_type = $4, body = $5, expires = $6 ` +
+		`where user_id = $1 and key = $2;`
+	releaseIdempotencyKey = `delete from idempotency_keys where user_id = $1 and key = $2 and not done;`
+
 	databaseFlushTimeout    = 10 * time.Second
 	databaseDeleteQueueSize = 1000
 )
 
 var (
-	_ URLStorage  = (*dbStorage)(nil)
-	_ ServiceStat = (*dbStorage)(nil)
+	_ URLStorage          = (*dbStorage)(nil)
+	_ ServiceStat         = (*dbStorage)(nil)
+	_ ClickStat           = (*dbStorage)(nil)
+	_ DeleteQueue         = (*dbStorage)(nil)
+	_ APIKeyStorage       = (*dbStorage)(nil)
+	_ IdentityStorage     = (*dbStorage)(nil)
+	_ UserMerge           = (*dbStorage)(nil)
+	_ URLExport           = (*dbStorage)(nil)
+	_ URLBackup           = (*dbStorage)(nil)
+	_ IdempotencyStore    = (*dbStorage)(nil)
+	_ CanonicalURLStorage = (*dbStorage)(nil)
+	_ URLBlocker          = (*dbStorage)(nil)
 )
 
 type dbRow struct {
@@ -73,6 +236,8 @@ type dbStorage struct {
 	ctx        context.Context
 	ctxCancel  context.CancelFunc
 	deleteChan chan deleteEntry
+	// deleteQueueDepth - number of ids waiting to be deleted.
+	deleteQueueDepth int64
 }
 
 // NewDatabaseStorage creates URLStorage implementation that defines methods over PostgreSQL database.
@@ -165,6 +330,58 @@ func (s *dbStorage) AddURLs(ctx context.Context, userID uint64, urls []string) (
 	return result, nil
 }
 
+func (s *dbStorage) AddCanonicalURLs(ctx context.Context, userID uint64, urls []CanonicalURL) ([]AddResult, error) {
+	keys := make([]uint64, 0, len(urls))
+	for _, url := range urls {
+		key, err := generateKey(url.Canonical)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insertStmt, err := tx.PrepareContext(ctx, insertCanonicalFeed)
+	if err != nil {
+		return nil, err
+	}
+	defer insertStmt.Close()
+
+	getStmt, err := tx.PrepareContext(ctx, getCanonicalFeed)
+	if err != nil {
+		return nil, err
+	}
+	defer getStmt.Close()
+
+	result := make([]AddResult, 0, len(urls))
+	for i, key := range keys {
+		var id int64
+		err := insertStmt.QueryRowContext(ctx, int64(key), urls[i].URL, int64(userID), urls[i].Canonical).Scan(&id)
+		if err == nil {
+			result = append(result, AddResult{ID: key, Inserted: true})
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		if err := getStmt.QueryRowContext(ctx, int64(key), urls[i].URL).Scan(&id); err != nil {
+			return nil, err
+		}
+		result = append(result, AddResult{ID: uint64(id)})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (s *dbStorage) DeleteURLs(_ context.Context, userID uint64, ids []uint64) error {
 	entry := deleteEntry{
 		UserID: userID,
@@ -176,17 +393,28 @@ func (s *dbStorage) DeleteURLs(_ context.Context, userID uint64, ids []uint64) e
 	return nil
 }
 
+func (s *dbStorage) DeleteQueueDepth() int {
+	return int(atomic.LoadInt64(&s.deleteQueueDepth))
+}
+
 func (s *dbStorage) Get(ctx context.Context, id uint64) (string, error) {
 	var url string
 	var state string
+	var blocked bool
 
-	if err := s.dbConn.QueryRowContext(ctx, getFeed, int64(id)).Scan(&url, &state); err != nil {
+	err := s.dbConn.QueryRowContext(ctx, getFeed, int64(id)).Scan(&url, &state, &blocked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	} else if err != nil {
 		return "", err
 	}
 
 	if state == stateDisabled {
 		return "", ErrDeleted
 	}
+	if blocked {
+		return "", ErrBlocked
+	}
 
 	return url, nil
 }
@@ -244,6 +472,548 @@ func (s *dbStorage) TotalURLs(ctx context.Context) (uint64, error) {
 	return count, err
 }
 
+func (s *dbStorage) AddClicks(ctx context.Context, clicks []Click) error {
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locks and rows are taken in the same order by every writer, so concurrent batches can't deadlock.
+	daily := aggregateClicks(clicks)
+	keys := make([]clickKey, 0, len(daily))
+	for key := range daily {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return clicksLockKey(keys[i]) < clicksLockKey(keys[j])
+	})
+
+	for _, key := range keys {
+		data := daily[key]
+		if _, err := tx.ExecContext(ctx, lockDailyClicks, clicksLockKey(key)); err != nil {
+			return err
+		}
+
+		var rawVisitors []byte
+		err := tx.QueryRowContext(ctx, getDailyVisitors, int64(key.ID), data.Day).Scan(&rawVisitors)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			stored := hyperloglog.New()
+			if err := stored.UnmarshalBinary(rawVisitors); err != nil {
+				return err
+			}
+			data.Visitors.Merge(stored)
+		}
+
+		visitors, err := data.Visitors.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, upsertDailyClicks,
+			int64(key.ID), data.Day, int64(data.Clicks), int64(data.BotClicks), visitors); err != nil {
+			return err
+		}
+	}
+
+	redirects := aggregateRedirects(clicks)
+	hours := make([]int64, 0, len(redirects))
+	for hour := range redirects {
+		hours = append(hours, hour)
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		return hours[i] < hours[j]
+	})
+	for _, hour := range hours {
+		if _, err := tx.ExecContext(ctx, upsertRedirects, time.Unix(hour, 0), int64(redirects[hour])); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// clicksLockKey - an advisory lock key of daily statistics of a link. Keys of different days may collide,
+// that only makes their writers wait for each other.
+func clicksLockKey(key clickKey) int64 {
+	return int64(key.ID) ^ key.Day
+}
+
+func (s *dbStorage) LinkClicks(ctx context.Context, id uint64) ([]DailyClicks, error) {
+	rows, err := s.dbConn.QueryContext(ctx, getLinkClicks, int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]DailyClicks, 0)
+	for rows.Next() {
+		var day time.Time
+		var count, botCount int64
+		var rawVisitors []byte
+		if err := rows.Scan(&day, &count, &botCount, &rawVisitors); err != nil {
+			return nil, err
+		}
+
+		visitors := hyperloglog.New()
+		if err := visitors.UnmarshalBinary(rawVisitors); err != nil {
+			return nil, err
+		}
+
+		result = append(result, DailyClicks{
+			Day:       clickDay(day),
+			Clicks:    uint64(count),
+			BotClicks: uint64(botCount),
+			Visitors:  visitors,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *dbStorage) Redirects(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.timeSeries(ctx, getRedirectsSeries, from, to, bucket)
+}
+
+func (s *dbStorage) TopLinks(ctx context.Context, from, to time.Time, limit int) ([]TopLink, error) {
+	rows, err := s.dbConn.QueryContext(ctx, getTopLinks, clickDay(from), to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]TopLink, 0)
+	for rows.Next() {
+		var r dbRow
+		var clicks int64
+		if err := rows.Scan(&r.URLHash, &r.URL, &clicks); err != nil {
+			return nil, err
+		}
+
+		result = append(result, TopLink{
+			ID:          uint64(r.URLHash),
+			OriginalURL: r.URL,
+			Clicks:      uint64(clicks),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *dbStorage) CreatedURLs(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.timeSeries(ctx, getCreatedURLsSeries, from, to, bucket)
+}
+
+func (s *dbStorage) DeletedURLs(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.timeSeries(ctx, getDeletedURLsSeries, from, to, bucket)
+}
+
+func (s *dbStorage) UserDeletedURLs(ctx context.Context, userID uint64) (uint64, error) {
+	count := uint64(0)
+	err := s.dbConn.QueryRowContext(ctx, getUserDeletedURLsCount, int64(userID)).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return count, nil
+	}
+	return count, err
+}
+
+func (s *dbStorage) UserCreatedURLs(ctx context.Context, userID uint64, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.timeSeries(ctx, getUserCreatedURLsSeries, from, to, bucket, int64(userID))
+}
+
+func (s *dbStorage) LinksClicks(ctx context.Context, ids []uint64) (map[uint64]uint64, error) {
+	result := make(map[uint64]uint64)
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	queryIDs := make([]string, len(ids))
+	for i, e := range ids {
+		queryIDs[i] = strconv.FormatInt(int64(e), 10)
+	}
+
+	rows, err := s.dbConn.QueryContext(ctx, fmt.Sprintf(getLinksClicks, strings.Join(queryIDs, ",")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, clicks int64
+		if err := rows.Scan(&id, &clicks); err != nil {
+			return nil, err
+		}
+		result[uint64(id)] = uint64(clicks)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *dbStorage) AddAPIKey(ctx context.Context, key APIKey) error {
+	_, err := s.dbConn.ExecContext(ctx, insertAPIKey, int64(key.ID), int64(key.UserID), key.Name, key.Hash, key.Created)
+	return err
+}
+
+func (s *dbStorage) FindAPIKey(ctx context.Context, hash []byte) (*APIKey, error) {
+	var id, userID int64
+	key := &APIKey{Hash: hash}
+	err := s.dbConn.QueryRowContext(ctx, getAPIKeyByHash, hash).Scan(&id, &userID, &key.Name, &key.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	key.ID = uint64(id)
+	key.UserID = uint64(userID)
+	return key, nil
+}
+
+func (s *dbStorage) UserAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error) {
+	rows, err := s.dbConn.QueryContext(ctx, getUserAPIKeys, int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		var id int64
+		key := APIKey{UserID: userID}
+		if err := rows.Scan(&id, &key.Name, &key.Hash, &key.Created); err != nil {
+			return nil, err
+		}
+		key.ID = uint64(id)
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *dbStorage) RevokeAPIKey(ctx context.Context, userID, id uint64) error {
+	res, err := s.dbConn.ExecContext(ctx, revokeUserAPIKey, int64(id), int64(userID))
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *dbStorage) BindIdentity(ctx context.Context, identity Identity, userID uint64) (uint64, error) {
+	// A concurrent login of the same identity may win the insert, so the bound id is always read back.
+	if _, err := s.dbConn.ExecContext(ctx, insertIdentity, identity.Issuer, identity.Subject, int64(userID)); err != nil {
+		return 0, err
+	}
+
+	var boundID int64
+	if err := s.dbConn.QueryRowContext(ctx, getIdentityUser, identity.Issuer, identity.Subject).Scan(&boundID); err != nil {
+		return 0, err
+	}
+
+	return uint64(boundID), nil
+}
+
+func (s *dbStorage) MergeUsers(ctx context.Context, fromUserID, toUserID uint64) (uint64, error) {
+	if fromUserID == toUserID {
+		return 0, nil
+	}
+
+	var moved int64
+	if err := s.dbConn.QueryRowContext(ctx, mergeUsers, int64(fromUserID), int64(toUserID)).Scan(&moved); err != nil {
+		return 0, err
+	}
+
+	return uint64(moved), nil
+}
+
+func (s *dbStorage) MergedInto(ctx context.Context, userID uint64) (uint64, error) {
+	var mergedInto int64
+	err := s.dbConn.QueryRowContext(ctx, getMergedInto, int64(userID)).Scan(&mergedInto)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	return uint64(mergedInto), nil
+}
+
+func (s *dbStorage) ExportUserURLs(ctx context.Context, userID uint64, fn func(ExportedURL) error) error {
+	rows, err := s.dbConn.QueryContext(ctx, exportUserData, int64(userID))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r dbRow
+		var state string
+		var deleted sql.NullTime
+		if err := rows.Scan(&r.URLHash, &r.URL, &r.Added, &state, &deleted); err != nil {
+			return err
+		}
+
+		link := ExportedURL{
+			ShortURLID:  uint64(r.URLHash),
+			OriginalURL: r.URL,
+			Created:     r.Added,
+			Deleted:     state == stateDisabled,
+		}
+		if deleted.Valid {
+			link.DeletedAt = deleted.Time
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *dbStorage) BackupURLs(ctx context.Context, fn func(UserURL) error) error {
+	rows, err := s.dbConn.QueryContext(ctx, backupFeeds)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r dbRow
+		var state string
+		var deleted sql.NullTime
+		var canonical string
+		var blocked bool
+		if err := rows.Scan(&r.UserID, &r.URLHash, &r.URL, &canonical, &r.Added, &state, &deleted, &blocked); err != nil {
+			return err
+		}
+
+		link := UserURL{
+			UserID:    uint64(r.UserID),
+			Canonical: canonical,
+			Blocked:   blocked,
+			ExportedURL: ExportedURL{
+				ShortURLID:  uint64(r.URLHash),
+				OriginalURL: r.URL,
+				Created:     r.Added,
+				Deleted:     state == stateDisabled,
+			},
+		}
+		if deleted.Valid {
+			link.DeletedAt = deleted.Time
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *dbStorage) RestoreURLs(ctx context.Context, links []UserURL) (uint64, error) {
+	if err := checkKeys(links); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, restoreFeed)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	restored := uint64(0)
+	for _, link := range links {
+		added := sql.NullTime{Time: link.Created, Valid: !link.Created.IsZero()}
+		deleted := sql.NullTime{Time: link.DeletedAt, Valid: link.Deleted && !link.DeletedAt.IsZero()}
+		state := stateActive
+		if link.Deleted {
+			state = stateDisabled
+		}
+
+		res, err := stmt.ExecContext(ctx, int64(link.ShortURLID), link.OriginalURL, int64(link.UserID), added, state, deleted,
+			link.Canonical, link.Blocked)
+		if err != nil {
+			return 0, err
+		}
+		count, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		restored += uint64(count)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return restored, nil
+}
+
+func (s *dbStorage) ScanURLs(ctx context.Context, fn func(id uint64, url string) error) error {
+	rows, err := s.dbConn.QueryContext(ctx, scanActiveFeeds)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r dbRow
+		if err := rows.Scan(&r.URLHash, &r.URL); err != nil {
+			return err
+		}
+		if err := fn(uint64(r.URLHash), r.URL); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *dbStorage) BlockURLs(ctx context.Context, ids []uint64) error {
+	return s.setBlocked(ctx, blockFeeds, ids)
+}
+
+func (s *dbStorage) UnblockURLs(ctx context.Context, ids []uint64) error {
+	return s.setBlocked(ctx, unblockFeeds, ids)
+}
+
+func (s *dbStorage) setBlocked(ctx context.Context, query string, ids []uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	queryIDs := make([]string, len(ids))
+	for i, e := range ids {
+		queryIDs[i] = strconv.FormatInt(int64(e), 10)
+	}
+
+	_, err := s.dbConn.ExecContext(ctx, fmt.Sprintf(query, strings.Join(queryIDs, ",")))
+	return err
+}
+
+func (s *dbStorage) BlockedURLs(ctx context.Context) ([]uint64, error) {
+	rows, err := s.dbConn.QueryContext(ctx, getBlockedFeeds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uint64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint64(id))
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *dbStorage) ReserveIdempotencyKey(ctx context.Context, userID uint64, key string, fingerprint []byte,
+	expires time.Time) (*IdempotencyRecord, error) {
+	if _, err := s.dbConn.ExecContext(ctx, deleteExpiredIdempotencyKeys, int64(userID)); err != nil {
+		return nil, err
+	}
+
+	res, err := s.dbConn.ExecContext(ctx, reserveIdempotencyKey, int64(userID), key, fingerprint, expires)
+	if err != nil {
+		return nil, err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if count != 0 {
+		return nil, nil
+	}
+
+	var record IdempotencyRecord
+	err = s.dbConn.QueryRowContext(ctx, getIdempotencyKey, int64(userID), key).Scan(&record.Fingerprint, &record.Done,
+		&record.Status, &record.ContentType, &record.Body, &record.Expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The record has been released in between, the key can be reserved again.
+		return s.ReserveIdempotencyKey(ctx, userID, key, fingerprint, expires)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (s *dbStorage) SaveIdempotentResponse(ctx context.Context, userID uint64, key string, record IdempotencyRecord) error {
+	res, err := s.dbConn.ExecContext(ctx, saveIdempotencyKey, int64(userID), key, record.Status, record.ContentType,
+		record.Body, record.Expires)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *dbStorage) ReleaseIdempotencyKey(ctx context.Context, userID uint64, key string) error {
+	_, err := s.dbConn.ExecContext(ctx, releaseIdempotencyKey, int64(userID), key)
+	return err
+}
+
+func (s *dbStorage) timeSeries(ctx context.Context, query string, from, to time.Time, bucket time.Duration, args ...interface{}) ([]TimeBucket, error) {
+	args = append([]interface{}{from, to, bucket.Seconds()}, args...)
+	rows, err := s.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]TimeBucket, 0)
+	for rows.Next() {
+		var idx, count int64
+		if err := rows.Scan(&idx, &count); err != nil {
+			return nil, err
+		}
+
+		result = append(result, TimeBucket{
+			Start: from.Add(time.Duration(idx) * bucket),
+			Count: uint64(count),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (s *dbStorage) deleteURLs() {
 	deleteQueue := make(map[uint64][]uint64)
 	ticker := time.NewTicker(databaseFlushTimeout)
@@ -257,12 +1027,14 @@ func (s *dbStorage) deleteURLs() {
 		}
 		deleteQueue = make(map[uint64][]uint64)
 		queueSize = 0
+		atomic.StoreInt64(&s.deleteQueueDepth, 0)
 	}
 
 	for {
 		select {
 		case v := <-s.deleteChan:
 			queueSize += len(v.IDs)
+			atomic.StoreInt64(&s.deleteQueueDepth, int64(queueSize))
 			if _, ok := deleteQueue[v.UserID]; !ok {
 				deleteQueue[v.UserID] = make([]uint64, 0)
 			}
@@ -305,6 +1077,34 @@ func (s *dbStorage) deleteUserURLs(ctx context.Context, userID uint64, ids []uin
 }
 
 func prepareDatabase(conn *sql.DB) error {
+	if err := prepareFeedsTable(conn); err != nil {
+		return err
+	}
+
+	// Tables below have been added after the initial scheme, so they are created on demand.
+	schemes := []string{
+		createClicksTableScheme,
+		addBotClicksColumn,
+		addFeedsDeletedColumn,
+		createRedirectsTableScheme,
+		createAPIKeysTableScheme,
+		createAPIKeysUserIndex,
+		createIdentitiesTableScheme,
+		createIdempotencyTableScheme,
+		addFeedsCanonicalColumn,
+		addFeedsBlockedColumn,
+		createMergedUsersTableScheme,
+	}
+	for _, scheme := range schemes {
+		if _, err := conn.Exec(scheme); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func prepareFeedsTable(conn *sql.DB) error {
 	r, exists := conn.Query(checkFeedsTable)
 	if exists == nil {
 		return r.Err()
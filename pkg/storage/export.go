@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// ExportedURL - a link of a user with its state.
+type ExportedURL struct {
+	ShortURLID  uint64
+	OriginalURL string
+	Created     time.Time
+	Deleted     bool
+	// DeletedAt - zero for active links and for links deleted before deletion times were recorded.
+	DeletedAt time.Time
+}
+
+// URLExport - interface of a storage that can list all links of a user without loading them at once.
+type URLExport interface {
+	// ExportUserURLs - call fn for every link of userID, deleted ones included, in order of creation.
+	// It stops at the first error of fn and returns it.
+	ExportUserURLs(ctx context.Context, userID uint64, fn func(ExportedURL) error) error
+
+	Closer
+}
+
+func (s *syncMapStorage) ExportUserURLs(ctx context.Context, userID uint64, fn func(ExportedURL) error) error {
+	// Links are already in memory, a copy lets fn run without the lock.
+	s.lock.RLock()
+	data := s.userData[userID]
+	gone := s.userGone[userID]
+	links := make([]ExportedURL, 0, len(data)+len(gone))
+	add := func(id uint64) {
+		deletedAt, deleted := s.goneIds[id]
+		links = append(links, ExportedURL{
+			ShortURLID:  id,
+			OriginalURL: s.urls[id],
+			Created:     s.added[id],
+			Deleted:     deleted,
+			DeletedAt:   deletedAt,
+		})
+	}
+	// Deleted links are moved from user data to the list of gone ones.
+	for _, d := range data {
+		add(d.ShortURLID)
+	}
+	for _, id := range gone {
+		add(id)
+	}
+	s.lock.RUnlock()
+
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Created.Before(links[j].Created)
+	})
+
+	for _, link := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,19 +4,106 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/hyperloglog"
+)
+
+const (
+	clickRecordKey     = "click"
+	redirectsRecordKey = "redirects"
+	addedRecordKey     = "added"
+	apiKeyRecordKey    = "api_key"
+	revokedRecordKey   = "api_key_revoked"
+	identityRecordKey  = "identity"
+	mergeRecordKey     = "merge"
+	restoredRecordKey  = "restored"
+	canonicalRecordKey = "canonical"
+	blockedRecordKey   = "blocked"
+)
+
+var (
+	_ ClickStat           = (*fileStorage)(nil)
+	_ ServiceStat         = (*fileStorage)(nil)
+	_ APIKeyStorage       = (*fileStorage)(nil)
+	_ IdentityStorage     = (*fileStorage)(nil)
+	_ UserMerge           = (*fileStorage)(nil)
+	_ URLExport           = (*fileStorage)(nil)
+	_ URLBackup           = (*fileStorage)(nil)
+	_ IdempotencyStore    = (*fileStorage)(nil)
+	_ CanonicalURLStorage = (*fileStorage)(nil)
+	_ URLBlocker          = (*fileStorage)(nil)
 )
 
 type fileStorage struct {
 	file          *os.File
 	writer        *bufio.Writer
 	fileLock      sync.Mutex
-	memoryStorage URLStorage
+	memoryStorage *syncMapStorage
+}
+
+type redirectsRecord struct {
+	Hour  int64  `json:"hour"`
+	Count uint64 `json:"count"`
+}
+
+type apiKeyRecord struct {
+	ID      uint64 `json:"id"`
+	UserID  uint64 `json:"user_id"`
+	Name    string `json:"name,omitempty"`
+	Hash    []byte `json:"hash,omitempty"`
+	Created int64  `json:"created,omitempty"`
+}
+
+type identityRecord struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	UserID  uint64 `json:"user_id"`
+}
+
+type mergeRecord struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// restoredRecord - a link added by RestoreURLs, unlike regular url records it keeps a deletion.
+// Times are unix seconds, zero if they are unknown.
+type restoredRecord struct {
+	ID        uint64 `json:"id"`
+	UserID    uint64 `json:"user_id"`
+	URL       string `json:"url"`
+	Canonical string `json:"canonical,omitempty"`
+	Created   int64  `json:"created,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	DeletedAt int64  `json:"deleted_at,omitempty"`
+	Blocked   bool   `json:"blocked,omitempty"`
+}
+
+// canonicalRecord - a URL added by AddCanonicalURLs, its id is made of the canonical form.
+type canonicalRecord struct {
+	UserID    uint64 `json:"user_id"`
+	URL       string `json:"url"`
+	Canonical string `json:"canonical"`
+	Created   int64  `json:"created"`
+}
+
+// blockedRecord - links blocked or unblocked by a blocklist.
+type blockedRecord struct {
+	IDs     []uint64 `json:"ids"`
+	Blocked bool     `json:"blocked"`
+}
+
+type clickRecord struct {
+	ID        uint64 `json:"id"`
+	Day       string `json:"day"`
+	Clicks    uint64 `json:"clicks"`
+	BotClicks uint64 `json:"bot_clicks,omitempty"`
+	Visitors  []byte `json:"visitors"`
 }
 
 // NewFileStorage creates URLStorage implementation that defines methods over a regular file.
@@ -45,20 +132,14 @@ func NewFileStorage(filePath string) (URLStorage, error) {
 	ctx := context.Background()
 	decoder := json.NewDecoder(file)
 	for {
-		data := make(map[string]string)
+		data := make(map[string]json.RawMessage)
 		if err := decoder.Decode(&data); err == io.EOF {
 			break
 		} else if err != nil {
 			return nil, err
 		}
-		for k, v := range data {
-			userID, err := strconv.ParseUint(k, 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			if _, _, err := storage.memoryStorage.Add(ctx, userID, v); err != nil {
-				return nil, err
-			}
+		if err := storage.loadRecord(ctx, data); err != nil {
+			return nil, err
 		}
 	}
 
@@ -75,17 +156,33 @@ func (s *fileStorage) Add(ctx context.Context, userID uint64, url string) (uint6
 		return key, exists, err
 	}
 
-	data := fmt.Sprintf("{\"%d\":\"%s\"}\n", userID, url)
+	data, err := urlRecord(userID, url, time.Now().Unix())
+	if err != nil {
+		return key, exists, err
+	}
+
 	s.fileLock.Lock()
 	defer s.fileLock.Unlock()
 
-	if _, err := s.writer.WriteString(data); err != nil {
+	if _, err := s.writer.Write(data); err != nil {
 		return key, exists, err
 	}
 
 	return key, exists, s.writer.Flush()
 }
 
+// urlRecord - a line of a URL a user has added, the URL is keyed by the user id.
+func urlRecord(userID uint64, url string, added int64) ([]byte, error) {
+	line, err := json.Marshal(map[string]interface{}{
+		strconv.FormatUint(userID, 10): url,
+		addedRecordKey:                 added,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
 func (s *fileStorage) Get(ctx context.Context, id uint64) (string, error) {
 	return s.memoryStorage.Get(ctx, id)
 }
@@ -94,37 +191,295 @@ func (s *fileStorage) GetUserData(ctx context.Context, userID uint64) ([]UserDat
 	return s.memoryStorage.GetUserData(ctx, userID)
 }
 
+func (s *fileStorage) ExportUserURLs(ctx context.Context, userID uint64, fn func(ExportedURL) error) error {
+	return s.memoryStorage.ExportUserURLs(ctx, userID, fn)
+}
+
 func (s *fileStorage) AddURLs(ctx context.Context, userID uint64, urls []string) ([]AddResult, error) {
 	result, err := s.memoryStorage.AddURLs(ctx, userID, urls)
 	if err != nil {
 		return nil, err
 	}
 
-	dataToAdd := make([]string, 0)
+	now := time.Now().Unix()
+	dataToAdd := make([]byte, 0)
 	for i, key := range result {
 		if !key.Inserted {
 			continue
 		}
 
-		dataToAdd = append(dataToAdd, fmt.Sprintf("{\"%d\":\"%s\"}\n", userID, urls[i]))
+		data, err := urlRecord(userID, urls[i], now)
+		if err != nil {
+			return nil, err
+		}
+		dataToAdd = append(dataToAdd, data...)
 	}
 
-	insertText := strings.Join(dataToAdd, "")
-
 	s.fileLock.Lock()
 	defer s.fileLock.Unlock()
 
-	if _, err := s.writer.WriteString(insertText); err != nil {
+	if _, err := s.writer.Write(dataToAdd); err != nil {
 		return nil, err
 	}
 
 	return result, s.writer.Flush()
 }
 
+func (s *fileStorage) AddCanonicalURLs(ctx context.Context, userID uint64, urls []CanonicalURL) ([]AddResult, error) {
+	result, err := s.memoryStorage.AddCanonicalURLs(ctx, userID, urls)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	records := make([]interface{}, 0, len(urls))
+	for i, r := range result {
+		if !r.Inserted {
+			continue
+		}
+		records = append(records, canonicalRecord{UserID: userID, URL: urls[i].URL, Canonical: urls[i].Canonical, Created: now})
+	}
+
+	return result, s.writeRecords(canonicalRecordKey, records)
+}
+
 func (s *fileStorage) DeleteURLs(ctx context.Context, userID uint64, ids []uint64) error {
 	return nil
 }
 
+func (s *fileStorage) AddClicks(ctx context.Context, clicks []Click) error {
+	if err := s.memoryStorage.AddClicks(ctx, clicks); err != nil {
+		return err
+	}
+
+	var records strings.Builder
+	for key, data := range aggregateClicks(clicks) {
+		visitors, err := data.Visitors.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		line, err := json.Marshal(map[string]clickRecord{
+			clickRecordKey: {
+				ID:        key.ID,
+				Day:       data.Day.Format(clickDayLayout),
+				Clicks:    data.Clicks,
+				BotClicks: data.BotClicks,
+				Visitors:  visitors,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		records.Write(line)
+		records.WriteByte('\n')
+	}
+
+	for hour, count := range aggregateRedirects(clicks) {
+		line, err := json.Marshal(map[string]redirectsRecord{
+			redirectsRecordKey: {
+				Hour:  hour,
+				Count: count,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		records.Write(line)
+		records.WriteByte('\n')
+	}
+
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	if _, err := s.writer.WriteString(records.String()); err != nil {
+		return err
+	}
+
+	return s.writer.Flush()
+}
+
+func (s *fileStorage) LinkClicks(ctx context.Context, id uint64) ([]DailyClicks, error) {
+	return s.memoryStorage.LinkClicks(ctx, id)
+}
+
+func (s *fileStorage) Redirects(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.memoryStorage.Redirects(ctx, from, to, bucket)
+}
+
+func (s *fileStorage) TopLinks(ctx context.Context, from, to time.Time, limit int) ([]TopLink, error) {
+	return s.memoryStorage.TopLinks(ctx, from, to, limit)
+}
+
+func (s *fileStorage) LinksClicks(ctx context.Context, ids []uint64) (map[uint64]uint64, error) {
+	return s.memoryStorage.LinksClicks(ctx, ids)
+}
+
+func (s *fileStorage) AddAPIKey(ctx context.Context, key APIKey) error {
+	if err := s.memoryStorage.AddAPIKey(ctx, key); err != nil {
+		return err
+	}
+
+	return s.writeRecord(apiKeyRecordKey, apiKeyRecord{
+		ID:      key.ID,
+		UserID:  key.UserID,
+		Name:    key.Name,
+		Hash:    key.Hash,
+		Created: key.Created.Unix(),
+	})
+}
+
+func (s *fileStorage) FindAPIKey(ctx context.Context, hash []byte) (*APIKey, error) {
+	return s.memoryStorage.FindAPIKey(ctx, hash)
+}
+
+func (s *fileStorage) UserAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error) {
+	return s.memoryStorage.UserAPIKeys(ctx, userID)
+}
+
+func (s *fileStorage) RevokeAPIKey(ctx context.Context, userID, id uint64) error {
+	if err := s.memoryStorage.RevokeAPIKey(ctx, userID, id); err != nil {
+		return err
+	}
+
+	return s.writeRecord(revokedRecordKey, apiKeyRecord{ID: id, UserID: userID})
+}
+
+func (s *fileStorage) BindIdentity(ctx context.Context, identity Identity, userID uint64) (uint64, error) {
+	boundID, err := s.memoryStorage.BindIdentity(ctx, identity, userID)
+	if err != nil || boundID != userID {
+		return boundID, err
+	}
+
+	return boundID, s.writeRecord(identityRecordKey, identityRecord{
+		Issuer:  identity.Issuer,
+		Subject: identity.Subject,
+		UserID:  userID,
+	})
+}
+
+func (s *fileStorage) MergeUsers(ctx context.Context, fromUserID, toUserID uint64) (uint64, error) {
+	moved, err := s.memoryStorage.MergeUsers(ctx, fromUserID, toUserID)
+	if err != nil || fromUserID == toUserID {
+		return moved, err
+	}
+
+	return moved, s.writeRecord(mergeRecordKey, mergeRecord{From: fromUserID, To: toUserID})
+}
+
+func (s *fileStorage) MergedInto(ctx context.Context, userID uint64) (uint64, error) {
+	return s.memoryStorage.MergedInto(ctx, userID)
+}
+
+func (s *fileStorage) BackupURLs(ctx context.Context, fn func(UserURL) error) error {
+	return s.memoryStorage.BackupURLs(ctx, fn)
+}
+
+func (s *fileStorage) RestoreURLs(_ context.Context, links []UserURL) (uint64, error) {
+	if err := checkKeys(links); err != nil {
+		return 0, err
+	}
+
+	restored := s.memoryStorage.restoreURLs(links)
+	records := make([]interface{}, 0, len(restored))
+	for _, link := range restored {
+		records = append(records, restoredRecord{
+			ID:        link.ShortURLID,
+			UserID:    link.UserID,
+			URL:       link.OriginalURL,
+			Canonical: link.Canonical,
+			Created:   unixSeconds(link.Created),
+			Deleted:   link.Deleted,
+			DeletedAt: unixSeconds(link.DeletedAt),
+			Blocked:   link.Blocked,
+		})
+	}
+
+	return uint64(len(restored)), s.writeRecords(restoredRecordKey, records)
+}
+
+func (s *fileStorage) ScanURLs(ctx context.Context, fn func(id uint64, url string) error) error {
+	return s.memoryStorage.ScanURLs(ctx, fn)
+}
+
+func (s *fileStorage) BlockURLs(ctx context.Context, ids []uint64) error {
+	if err := s.memoryStorage.BlockURLs(ctx, ids); err != nil {
+		return err
+	}
+	return s.writeRecord(blockedRecordKey, blockedRecord{IDs: ids, Blocked: true})
+}
+
+func (s *fileStorage) UnblockURLs(ctx context.Context, ids []uint64) error {
+	if err := s.memoryStorage.UnblockURLs(ctx, ids); err != nil {
+		return err
+	}
+	return s.writeRecord(blockedRecordKey, blockedRecord{IDs: ids})
+}
+
+func (s *fileStorage) BlockedURLs(ctx context.Context) ([]uint64, error) {
+	return s.memoryStorage.BlockedURLs(ctx)
+}
+
+// Idempotency records live for a short window, so they are kept in memory only.
+func (s *fileStorage) ReserveIdempotencyKey(ctx context.Context, userID uint64, key string, fingerprint []byte,
+	expires time.Time) (*IdempotencyRecord, error) {
+	return s.memoryStorage.ReserveIdempotencyKey(ctx, userID, key, fingerprint, expires)
+}
+
+func (s *fileStorage) SaveIdempotentResponse(ctx context.Context, userID uint64, key string, record IdempotencyRecord) error {
+	return s.memoryStorage.SaveIdempotentResponse(ctx, userID, key, record)
+}
+
+func (s *fileStorage) ReleaseIdempotencyKey(ctx context.Context, userID uint64, key string) error {
+	return s.memoryStorage.ReleaseIdempotencyKey(ctx, userID, key)
+}
+
+func (s *fileStorage) writeRecord(key string, record interface{}) error {
+	return s.writeRecords(key, []interface{}{record})
+}
+
+// writeRecords appends records and flushes them once.
+func (s *fileStorage) writeRecords(key string, records []interface{}) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	for _, record := range records {
+		line, err := json.Marshal(map[string]interface{}{key: record})
+		if err != nil {
+			return err
+		}
+		if _, err := s.writer.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return s.writer.Flush()
+}
+
+func (s *fileStorage) TotalUsers(ctx context.Context) (uint64, error) {
+	return s.memoryStorage.TotalUsers(ctx)
+}
+
+func (s *fileStorage) TotalURLs(ctx context.Context) (uint64, error) {
+	return s.memoryStorage.TotalURLs(ctx)
+}
+
+func (s *fileStorage) CreatedURLs(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.memoryStorage.CreatedURLs(ctx, from, to, bucket)
+}
+
+func (s *fileStorage) DeletedURLs(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.memoryStorage.DeletedURLs(ctx, from, to, bucket)
+}
+
+func (s *fileStorage) UserDeletedURLs(ctx context.Context, userID uint64) (uint64, error) {
+	return s.memoryStorage.UserDeletedURLs(ctx, userID)
+}
+
+func (s *fileStorage) UserCreatedURLs(ctx context.Context, userID uint64, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	return s.memoryStorage.UserCreatedURLs(ctx, userID, from, to, bucket)
+}
+
 func (s *fileStorage) Close() error {
 	s.memoryStorage.Close()
 
@@ -140,3 +495,199 @@ func (s *fileStorage) Close() error {
 	}
 	return nil
 }
+
+func (s *fileStorage) loadRecord(ctx context.Context, data map[string]json.RawMessage) error {
+	if v, ok := data[clickRecordKey]; ok {
+		return s.loadClickRecord(v)
+	}
+
+	if v, ok := data[redirectsRecordKey]; ok {
+		return s.loadRedirectsRecord(v)
+	}
+
+	if v, ok := data[apiKeyRecordKey]; ok {
+		return s.loadAPIKeyRecord(ctx, v, false)
+	}
+
+	if v, ok := data[revokedRecordKey]; ok {
+		return s.loadAPIKeyRecord(ctx, v, true)
+	}
+
+	if v, ok := data[identityRecordKey]; ok {
+		var record identityRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		_, err := s.memoryStorage.BindIdentity(ctx, Identity{Issuer: record.Issuer, Subject: record.Subject}, record.UserID)
+		return err
+	}
+
+	if v, ok := data[restoredRecordKey]; ok {
+		var record restoredRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		s.memoryStorage.restoreURLs([]UserURL{{
+			UserID:    record.UserID,
+			Canonical: record.Canonical,
+			Blocked:   record.Blocked,
+			ExportedURL: ExportedURL{
+				ShortURLID:  record.ID,
+				OriginalURL: record.URL,
+				Created:     fromUnixSeconds(record.Created),
+				Deleted:     record.Deleted,
+				DeletedAt:   fromUnixSeconds(record.DeletedAt),
+			},
+		}})
+		return nil
+	}
+
+	if v, ok := data[canonicalRecordKey]; ok {
+		var record canonicalRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		result, err := s.memoryStorage.AddCanonicalURLs(ctx, record.UserID,
+			[]CanonicalURL{{URL: record.URL, Canonical: record.Canonical}})
+		if err != nil {
+			return err
+		}
+		if result[0].Inserted {
+			s.memoryStorage.setAdded(result[0].ID, time.Unix(record.Created, 0))
+		}
+		return nil
+	}
+
+	if v, ok := data[blockedRecordKey]; ok {
+		var record blockedRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		if record.Blocked {
+			return s.memoryStorage.BlockURLs(ctx, record.IDs)
+		}
+		return s.memoryStorage.UnblockURLs(ctx, record.IDs)
+	}
+
+	if v, ok := data[mergeRecordKey]; ok {
+		var record mergeRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		_, err := s.memoryStorage.MergeUsers(ctx, record.From, record.To)
+		return err
+	}
+
+	// Records written by older versions don't have a creation time.
+	var added int64
+	if v, ok := data[addedRecordKey]; ok {
+		if err := json.Unmarshal(v, &added); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range data {
+		if k == addedRecordKey {
+			continue
+		}
+
+		userID, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return err
+		}
+		var url string
+		if err := json.Unmarshal(v, &url); err != nil {
+			return err
+		}
+
+		key, exists, err := s.memoryStorage.Add(ctx, userID, url)
+		if err != nil {
+			return err
+		}
+		if !exists && added != 0 {
+			s.memoryStorage.setAdded(key, time.Unix(added, 0))
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStorage) loadAPIKeyRecord(ctx context.Context, data json.RawMessage, revoked bool) error {
+	var record apiKeyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	if revoked {
+		err := s.memoryStorage.RevokeAPIKey(ctx, record.UserID, record.ID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		return nil
+	}
+
+	return s.memoryStorage.AddAPIKey(ctx, APIKey{
+		ID:      record.ID,
+		UserID:  record.UserID,
+		Name:    record.Name,
+		Hash:    record.Hash,
+		Created: time.Unix(record.Created, 0),
+	})
+}
+
+func (s *fileStorage) loadRedirectsRecord(data json.RawMessage) error {
+	var record redirectsRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	s.memoryStorage.lock.Lock()
+	defer s.memoryStorage.lock.Unlock()
+
+	s.memoryStorage.redirects[record.Hour] += record.Count
+
+	return nil
+}
+
+func (s *fileStorage) loadClickRecord(data json.RawMessage) error {
+	var record clickRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	day, err := time.Parse(clickDayLayout, record.Day)
+	if err != nil {
+		return err
+	}
+
+	visitors := hyperloglog.New()
+	if err := visitors.UnmarshalBinary(record.Visitors); err != nil {
+		return err
+	}
+
+	s.memoryStorage.lock.Lock()
+	defer s.memoryStorage.lock.Unlock()
+
+	s.memoryStorage.mergeClicks(record.ID, &DailyClicks{
+		Day:       day,
+		Clicks:    record.Clicks,
+		BotClicks: record.BotClicks,
+		Visitors:  visitors,
+	})
+
+	return nil
+}
+
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixSeconds(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
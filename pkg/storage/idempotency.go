@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyRecord - a request made with an idempotency key and its response once it is done.
+type IdempotencyRecord struct {
+	// Fingerprint - a hash of a request, a key can't be reused for another request.
+	Fingerprint []byte
+	// Done - false while a request is in progress.
+	Done bool
+	// Status - an HTTP status or a gRPC code of a response.
+	Status      int
+	ContentType string
+	Body        []byte
+	Expires     time.Time
+}
+
+// IdempotencyStore - interface of a storage that keeps responses of requests by idempotency keys of users.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey - hold a key of userID for a request until expires. If there is an unexpired
+	// record of the key, it is returned and nothing is reserved, otherwise the result is nil.
+	ReserveIdempotencyKey(ctx context.Context, userID uint64, key string, fingerprint []byte, expires time.Time) (*IdempotencyRecord, error)
+	// SaveIdempotentResponse - save a response of a request that holds a key, the record is kept
+	// until its Expires. A fingerprint of the request isn't changed.
+	SaveIdempotentResponse(ctx context.Context, userID uint64, key string, record IdempotencyRecord) error
+	// ReleaseIdempotencyKey - free a key of a request that hasn't been done, so it can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, userID uint64, key string) error
+
+	Closer
+}
+
+// idempotencySweepInterval - how often the memory storage drops expired idempotency records.
+const idempotencySweepInterval = time.Minute
+
+type idempotencyKey struct {
+	UserID uint64
+	Key    string
+}
+
+func (s *syncMapStorage) ReserveIdempotencyKey(_ context.Context, userID uint64, key string, fingerprint []byte,
+	expires time.Time) (*IdempotencyRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	// Expired records are dropped as new keys are reserved, at most once per idempotencySweepInterval.
+	if now.Sub(s.idempotencySweep) > idempotencySweepInterval {
+		s.idempotencySweep = now
+		for k, record := range s.idempotency {
+			if !record.Expires.After(now) {
+				delete(s.idempotency, k)
+			}
+		}
+	}
+
+	id := idempotencyKey{UserID: userID, Key: key}
+	if record, ok := s.idempotency[id]; ok && record.Expires.After(now) {
+		result := *record
+		return &result, nil
+	}
+
+	s.idempotency[id] = &IdempotencyRecord{Fingerprint: append([]byte(nil), fingerprint...), Expires: expires}
+	return nil, nil
+}
+
+func (s *syncMapStorage) SaveIdempotentResponse(_ context.Context, userID uint64, key string, record IdempotencyRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := idempotencyKey{UserID: userID, Key: key}
+	saved, ok := s.idempotency[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	saved.Done = true
+	saved.Status = record.Status
+	saved.ContentType = record.ContentType
+	saved.Body = append([]byte(nil), record.Body...)
+	saved.Expires = record.Expires
+	return nil
+}
+
+func (s *syncMapStorage) ReleaseIdempotencyKey(_ context.Context, userID uint64, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := idempotencyKey{UserID: userID, Key: key}
+	if record, ok := s.idempotency[id]; ok && !record.Done {
+		delete(s.idempotency, id)
+	}
+	return nil
+}
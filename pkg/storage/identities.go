@@ -0,0 +1,31 @@
+package storage
+
+import "context"
+
+// Identity - a user account at an external identity provider.
+type Identity struct {
+	// Issuer - an identifier of a provider.
+	Issuer string
+	// Subject - an identifier of an account that is unique within a provider.
+	Subject string
+}
+
+// IdentityStorage - interface of a storage that maps external identities to persistent user ids.
+type IdentityStorage interface {
+	// BindIdentity - get a user id an identity is bound to. An unknown identity is bound to userID.
+	BindIdentity(ctx context.Context, identity Identity, userID uint64) (uint64, error)
+
+	Closer
+}
+
+func (s *syncMapStorage) BindIdentity(_ context.Context, identity Identity, userID uint64) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if id, ok := s.identities[identity]; ok {
+		return id, nil
+	}
+
+	s.identities[identity] = userID
+	return userID, nil
+}
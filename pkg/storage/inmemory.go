@@ -3,107 +3,80 @@ package storage
 import (
 	"context"
 	"sync"
+	"time"
+
+	"github.com/r4start/go-url-shortener/pkg/hyperloglog"
 )
 
 var (
-	_ URLStorage  = (*syncMapStorage)(nil)
-	_ ServiceStat = (*syncMapStorage)(nil)
+	_ URLStorage          = (*syncMapStorage)(nil)
+	_ ServiceStat         = (*syncMapStorage)(nil)
+	_ ClickStat           = (*syncMapStorage)(nil)
+	_ APIKeyStorage       = (*syncMapStorage)(nil)
+	_ IdentityStorage     = (*syncMapStorage)(nil)
+	_ UserMerge           = (*syncMapStorage)(nil)
+	_ URLExport           = (*syncMapStorage)(nil)
+	_ URLBackup           = (*syncMapStorage)(nil)
+	_ IdempotencyStore    = (*syncMapStorage)(nil)
+	_ CanonicalURLStorage = (*syncMapStorage)(nil)
+	_ URLBlocker          = (*syncMapStorage)(nil)
 )
 
 type syncMapStorage struct {
-	urls     map[uint64]string
-	userData map[uint64][]UserData
-	goneIds  map[uint64]bool
-	lock     sync.RWMutex
+	urls       map[uint64]string
+	canonical  map[uint64]string // canonical forms of URLs that differ from the URLs
+	userData   map[uint64][]UserData
+	userGone   map[uint64][]uint64 // ids of URLs deleted by a user
+	added      map[uint64]time.Time
+	goneIds    map[uint64]time.Time
+	blocked    map[uint64]bool // ids of links disabled by a blocklist
+	clicks     map[uint64]map[int64]*DailyClicks
+	redirects  map[int64]uint64
+	apiKeys    map[uint64]*APIKey
+	apiHashes  map[string]uint64 // ids of API keys by their hashes
+	identities map[Identity]uint64
+	merged     map[uint64]uint64 // users merged into other users
+	// idempotency - responses by idempotency keys, idempotencySweep - when expired ones have been dropped.
+	idempotency      map[idempotencyKey]*IdempotencyRecord
+	idempotencySweep time.Time
+	lock             sync.RWMutex
 }
 
 // NewInMemoryStorage creates URLStorage implementation that doesn't have any persistent storage.
 func NewInMemoryStorage() *syncMapStorage {
 	return &syncMapStorage{
-		urls:     make(map[uint64]string),
-		userData: make(map[uint64][]UserData),
-		goneIds:  make(map[uint64]bool),
-		lock:     sync.RWMutex{},
+		urls:        make(map[uint64]string),
+		canonical:   make(map[uint64]string),
+		userData:    make(map[uint64][]UserData),
+		userGone:    make(map[uint64][]uint64),
+		added:       make(map[uint64]time.Time),
+		goneIds:     make(map[uint64]time.Time),
+		blocked:     make(map[uint64]bool),
+		clicks:      make(map[uint64]map[int64]*DailyClicks),
+		redirects:   make(map[int64]uint64),
+		apiKeys:     make(map[uint64]*APIKey),
+		apiHashes:   make(map[string]uint64),
+		identities:  make(map[Identity]uint64),
+		merged:      make(map[uint64]uint64),
+		idempotency: make(map[idempotencyKey]*IdempotencyRecord),
+		lock:        sync.RWMutex{},
 	}
 }
 
 func (s *syncMapStorage) Add(ctx context.Context, userID uint64, url string) (uint64, bool, error) {
-	key, err := generateKey(url)
+	result, err := s.AddURLs(ctx, userID, []string{url})
 	if err != nil {
 		return 0, false, err
 	}
-
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	delete(s.goneIds, key)
-
-	if _, ok := s.urls[key]; ok {
-		return key, ok, nil
-	}
-
-	s.urls[key] = url
-	data := s.userData[userID]
-	if len(data) == 0 {
-		data = make([]UserData, 0)
-	}
-
-	data = append(data, UserData{
-		ShortURLID:  key,
-		OriginalURL: url,
-	})
-
-	s.userData[userID] = data
-
-	return key, false, nil
+	return result[0].ID, !result[0].Inserted, nil
 }
 
 func (s *syncMapStorage) AddURLs(ctx context.Context, userID uint64, urls []string) ([]AddResult, error) {
-	keys := make([]uint64, 0)
+	links := make([]CanonicalURL, 0, len(urls))
 	for _, url := range urls {
-		key, err := generateKey(url)
-		if err != nil {
-			return nil, err
-		}
-		keys = append(keys, key)
-	}
-
-	result := make([]AddResult, 0)
-
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	for i, url := range urls {
-		delete(s.goneIds, keys[i])
-
-		if _, ok := s.urls[keys[i]]; ok {
-			result = append(result, AddResult{
-				ID:       keys[i],
-				Inserted: false,
-			})
-			continue
-		}
-
-		s.urls[keys[i]] = url
-		data := s.userData[userID]
-		if len(data) == 0 {
-			data = make([]UserData, 0)
-		}
-
-		data = append(data, UserData{
-			ShortURLID:  keys[i],
-			OriginalURL: url,
-		})
-
-		s.userData[userID] = data
-
-		result = append(result, AddResult{
-			ID:       keys[i],
-			Inserted: true,
-		})
+		links = append(links, CanonicalURL{URL: url, Canonical: url})
 	}
-
-	return result, nil
+	return s.AddCanonicalURLs(ctx, userID, links)
 }
 
 func (s *syncMapStorage) DeleteURLs(ctx context.Context, userID uint64, ids []uint64) error {
@@ -138,8 +111,10 @@ func (s *syncMapStorage) DeleteURLs(ctx context.Context, userID uint64, ids []ui
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	now := time.Now()
 	for id := range idsToDelete {
-		s.goneIds[id] = true
+		s.goneIds[id] = now
+		s.userGone[userID] = append(s.userGone[userID], id)
 	}
 
 	userData = s.userData[userID]
@@ -161,6 +136,9 @@ func (s *syncMapStorage) Get(ctx context.Context, id uint64) (string, error) {
 	if _, ok := s.goneIds[id]; ok {
 		return "", ErrDeleted
 	}
+	if s.blocked[id] {
+		return "", ErrBlocked
+	}
 
 	if v, ok := s.urls[id]; ok {
 		return v, nil
@@ -203,3 +181,178 @@ func (s *syncMapStorage) TotalURLs(context.Context) (uint64, error) {
 	defer s.lock.RUnlock()
 	return uint64(len(s.urls) - len(s.goneIds)), nil
 }
+
+func (s *syncMapStorage) CreatedURLs(_ context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	events := make([]TimeBucket, 0, len(s.added))
+	for _, t := range s.added {
+		events = append(events, TimeBucket{Start: t, Count: 1})
+	}
+
+	return bucketize(from, to, bucket, events), nil
+}
+
+func (s *syncMapStorage) DeletedURLs(_ context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	events := make([]TimeBucket, 0, len(s.goneIds))
+	for _, t := range s.goneIds {
+		events = append(events, TimeBucket{Start: t, Count: 1})
+	}
+
+	return bucketize(from, to, bucket, events), nil
+}
+
+func (s *syncMapStorage) UserDeletedURLs(_ context.Context, userID uint64) (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	count := uint64(0)
+	for _, id := range s.userGone[userID] {
+		if _, ok := s.goneIds[id]; ok {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *syncMapStorage) UserCreatedURLs(_ context.Context, userID uint64, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	events := make([]TimeBucket, 0, len(s.userData[userID])+len(s.userGone[userID]))
+	for _, d := range s.userData[userID] {
+		events = append(events, TimeBucket{Start: s.added[d.ShortURLID], Count: 1})
+	}
+	for _, id := range s.userGone[userID] {
+		events = append(events, TimeBucket{Start: s.added[id], Count: 1})
+	}
+
+	return bucketize(from, to, bucket, events), nil
+}
+
+func (s *syncMapStorage) AddClicks(_ context.Context, clicks []Click) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, data := range aggregateClicks(clicks) {
+		s.mergeClicks(key.ID, data)
+	}
+
+	for hour, count := range aggregateRedirects(clicks) {
+		s.redirects[hour] += count
+	}
+
+	return nil
+}
+
+func (s *syncMapStorage) Redirects(_ context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	events := make([]TimeBucket, 0, len(s.redirects))
+	for hour, count := range s.redirects {
+		events = append(events, TimeBucket{Start: time.Unix(hour, 0), Count: count})
+	}
+
+	return bucketize(from, to, bucket, events), nil
+}
+
+func (s *syncMapStorage) TopLinks(_ context.Context, from, to time.Time, limit int) ([]TopLink, error) {
+	from = clickDay(from)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make([]TopLink, 0)
+	for id, days := range s.clicks {
+		link := TopLink{
+			ID:          id,
+			OriginalURL: s.urls[id],
+		}
+		for _, d := range days {
+			if d.Day.Before(from) || !d.Day.Before(to) {
+				continue
+			}
+			link.Clicks += d.Clicks
+		}
+
+		if link.Clicks != 0 {
+			result = append(result, link)
+		}
+	}
+
+	sortTopLinks(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result, nil
+}
+
+func (s *syncMapStorage) LinksClicks(_ context.Context, ids []uint64) (map[uint64]uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make(map[uint64]uint64)
+	for _, id := range ids {
+		for _, d := range s.clicks[id] {
+			result[id] += d.Clicks
+		}
+	}
+
+	return result, nil
+}
+
+func (s *syncMapStorage) LinkClicks(_ context.Context, id uint64) ([]DailyClicks, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	days := s.clicks[id]
+	result := make([]DailyClicks, 0, len(days))
+	for _, d := range days {
+		result = append(result, DailyClicks{
+			Day:       d.Day,
+			Clicks:    d.Clicks,
+			BotClicks: d.BotClicks,
+			Visitors:  d.Visitors.Clone(),
+		})
+	}
+	sortDailyClicks(result)
+
+	return result, nil
+}
+
+// mergeClicks adds daily statistics of a short URL. Must be called under the write lock.
+func (s *syncMapStorage) mergeClicks(id uint64, data *DailyClicks) {
+	days, ok := s.clicks[id]
+	if !ok {
+		days = make(map[int64]*DailyClicks)
+		s.clicks[id] = days
+	}
+
+	entry, ok := days[data.Day.Unix()]
+	if !ok {
+		entry = &DailyClicks{
+			Day:      data.Day,
+			Visitors: hyperloglog.New(),
+		}
+		days[data.Day.Unix()] = entry
+	}
+
+	entry.Clicks += data.Clicks
+	entry.BotClicks += data.BotClicks
+	entry.Visitors.Merge(data.Visitors)
+}
+
+// setAdded overrides creation time of a URL, it is used to restore persisted data.
+func (s *syncMapStorage) setAdded(id uint64, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.added[id] = t
+}
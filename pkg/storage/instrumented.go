@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// OperationObserver - a callback that receives a context, name, start time and result of every storage operation.
+type OperationObserver func(ctx context.Context, operation string, start time.Time, err error)
+
+type instrumentedStorage struct {
+	storage  URLStorage
+	observer OperationObserver
+}
+
+// instrumentedCanonicalStorage - an instrumented storage that adds URLs by canonical forms.
+type instrumentedCanonicalStorage struct {
+	*instrumentedStorage
+	canonical CanonicalURLStorage
+}
+
+// NewInstrumentedStorage wraps a storage to report its operations to observer.
+// Only URLStorage and CanonicalURLStorage methods are reported, the returned storage doesn't implement
+// other storage interfaces. It implements CanonicalURLStorage if st does.
+func NewInstrumentedStorage(st URLStorage, observer OperationObserver) URLStorage {
+	instrumented := &instrumentedStorage{
+		storage:  st,
+		observer: observer,
+	}
+	if canonical, ok := st.(CanonicalURLStorage); ok {
+		return &instrumentedCanonicalStorage{instrumentedStorage: instrumented, canonical: canonical}
+	}
+	return instrumented
+}
+
+func (s *instrumentedStorage) Add(ctx context.Context, userID uint64, url string) (uint64, bool, error) {
+	start := time.Now()
+	id, exists, err := s.storage.Add(ctx, userID, url)
+	s.observer(ctx, "add", start, err)
+	return id, exists, err
+}
+
+func (s *instrumentedStorage) AddURLs(ctx context.Context, userID uint64, urls []string) ([]AddResult, error) {
+	start := time.Now()
+	result, err := s.storage.AddURLs(ctx, userID, urls)
+	s.observer(ctx, "add_urls", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) DeleteURLs(ctx context.Context, userID uint64, ids []uint64) error {
+	start := time.Now()
+	err := s.storage.DeleteURLs(ctx, userID, ids)
+	s.observer(ctx, "delete_urls", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) Get(ctx context.Context, id uint64) (string, error) {
+	start := time.Now()
+	url, err := s.storage.Get(ctx, id)
+	s.observer(ctx, "get", start, err)
+	return url, err
+}
+
+func (s *instrumentedStorage) GetUserData(ctx context.Context, userID uint64) ([]UserData, error) {
+	start := time.Now()
+	data, err := s.storage.GetUserData(ctx, userID)
+	s.observer(ctx, "get_user_data", start, err)
+	return data, err
+}
+
+func (s *instrumentedStorage) Close() error {
+	return s.storage.Close()
+}
+
+func (s *instrumentedCanonicalStorage) AddCanonicalURLs(ctx context.Context, userID uint64, urls []CanonicalURL) ([]AddResult, error) {
+	start := time.Now()
+	result, err := s.canonical.AddCanonicalURLs(ctx, userID, urls)
+	s.observer(ctx, "add_canonical_urls", start, err)
+	return result, err
+}
@@ -0,0 +1,59 @@
+package storage
+
+import "context"
+
+// UserMerge - interface of a storage that can move links between users.
+type UserMerge interface {
+	// MergeUsers - reassign all links of fromUserID, deleted ones included, to toUserID and remember
+	// that fromUserID has been merged. It returns the number of moved links that aren't deleted.
+	MergeUsers(ctx context.Context, fromUserID, toUserID uint64) (uint64, error)
+	// MergedInto - get a user id a user has been merged into, ErrNotFound if the user hasn't been merged.
+	MergedInto(ctx context.Context, userID uint64) (uint64, error)
+
+	Closer
+}
+
+func (s *syncMapStorage) MergeUsers(_ context.Context, fromUserID, toUserID uint64) (uint64, error) {
+	if fromUserID == toUserID {
+		return 0, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.merged[fromUserID]; !ok {
+		s.merged[fromUserID] = toUserID
+	}
+
+	data, ok := s.userData[fromUserID]
+	if !ok {
+		return 0, nil
+	}
+
+	moved := uint64(0)
+	for _, d := range data {
+		if _, gone := s.goneIds[d.ShortURLID]; !gone {
+			moved++
+		}
+	}
+
+	s.userData[toUserID] = append(s.userData[toUserID], data...)
+	delete(s.userData, fromUserID)
+
+	if gone, ok := s.userGone[fromUserID]; ok {
+		s.userGone[toUserID] = append(s.userGone[toUserID], gone...)
+		delete(s.userGone, fromUserID)
+	}
+
+	return moved, nil
+}
+
+func (s *syncMapStorage) MergedInto(_ context.Context, userID uint64) (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if id, ok := s.merged[userID]; ok {
+		return id, nil
+	}
+	return 0, ErrNotFound
+}
@@ -4,6 +4,7 @@ package storage
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 var (
@@ -11,6 +12,8 @@ var (
 	ErrDeleted = errors.New("deleted")
 	// ErrNotFound - an entry hasn't been found.
 	ErrNotFound = errors.New("not found")
+	// ErrBlocked - a link has been disabled because its destination is malicious, see URLBlocker.
+	ErrBlocked = errors.New("blocked")
 )
 
 // UserData information about users shortened URLs.
@@ -51,9 +54,32 @@ type URLStorage interface {
 	Closer
 }
 
+// DeleteQueue - a storage that deletes URLs asynchronously in batches.
+type DeleteQueue interface {
+	// DeleteQueueDepth - number of URLs waiting to be deleted.
+	DeleteQueueDepth() int
+}
+
+// TimeBucket - number of events that happened in [Start, Start + bucket size).
+type TimeBucket struct {
+	Start time.Time
+	Count uint64
+}
+
 type ServiceStat interface {
 	TotalUsers(ctx context.Context) (uint64, error)
 	TotalURLs(ctx context.Context) (uint64, error)
+	// CreatedURLs - number of URLs created in [from, to) split into buckets aligned to from.
+	// Buckets without events may be omitted.
+	CreatedURLs(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error)
+	// DeletedURLs - number of URLs deleted in [from, to) split into buckets aligned to from.
+	// Buckets without events may be omitted.
+	DeletedURLs(ctx context.Context, from, to time.Time, bucket time.Duration) ([]TimeBucket, error)
+	// UserDeletedURLs - number of URLs a user has deleted.
+	UserDeletedURLs(ctx context.Context, userID uint64) (uint64, error)
+	// UserCreatedURLs - number of URLs created by a user in [from, to) split into buckets aligned to from.
+	// Deleted URLs are accounted too. Buckets without events may be omitted.
+	UserCreatedURLs(ctx context.Context, userID uint64, from, to time.Time, bucket time.Duration) ([]TimeBucket, error)
 
 	Closer
 }
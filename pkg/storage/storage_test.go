@@ -3,13 +3,30 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/r4start/go-url-shortener/pkg/storage/storagetest"
 )
 
+// testDatabase creates a storage in a database of storagetest.Database.
+func testDatabase(t *testing.T) *dbStorage {
+	s, err := NewDatabaseStorage(context.Background(), storagetest.Database(t))
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	t.Cleanup(func() {
+		assert.NoError(t, s.Close())
+	})
+	return s
+}
+
 func Test_generateKey(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -403,6 +420,570 @@ func Test_syncMapStorage_GetUserData(t *testing.T) {
 	}
 }
 
+func Test_syncMapStorage_AddClicks(t *testing.T) {
+	day := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	clicks := []Click{
+		{ID: 1, Visitor: 0x1111111111111111, Time: day},
+		{ID: 1, Visitor: 0x1111111111111111, Time: day.Add(time.Hour)},
+		{ID: 1, Visitor: 0x2222222222222222, Time: day.Add(time.Hour)},
+		{ID: 1, Visitor: 0x1111111111111111, Time: day.Add(24 * time.Hour)},
+		{ID: 2, Visitor: 0x3333333333333333, Time: day},
+		{ID: 1, Visitor: 0x4444444444444444, Time: day, Bot: true},
+	}
+
+	check := func(t *testing.T, s ClickStat) {
+		data, err := s.LinkClicks(context.Background(), 1)
+		assert.NoError(t, err)
+		assert.Len(t, data, 2)
+		assert.Equal(t, clickDay(day), data[0].Day)
+		assert.Equal(t, uint64(3), data[0].Clicks)
+		assert.Equal(t, uint64(1), data[0].BotClicks)
+		assert.Equal(t, uint64(2), data[0].Visitors.Estimate())
+		assert.Equal(t, uint64(1), data[1].Clicks)
+		assert.Equal(t, uint64(1), data[1].Visitors.Estimate())
+
+		data, err = s.LinkClicks(context.Background(), 3)
+		assert.NoError(t, err)
+		assert.Empty(t, data)
+
+		redirects, err := s.Redirects(context.Background(), clickDay(day), clickDay(day).Add(48*time.Hour), 24*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, []TimeBucket{
+			{Start: clickDay(day), Count: 5},
+			{Start: clickDay(day).Add(24 * time.Hour), Count: 1},
+		}, redirects)
+	}
+
+	s := NewInMemoryStorage()
+	assert.NoError(t, s.AddClicks(context.Background(), clicks[:2]))
+	assert.NoError(t, s.AddClicks(context.Background(), clicks[2:]))
+	check(t, s)
+
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.(ClickStat).AddClicks(context.Background(), clicks[:2]))
+	assert.NoError(t, fs.(ClickStat).AddClicks(context.Background(), clicks[2:]))
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	check(t, fs.(ClickStat))
+}
+
+func Test_fileStorage_AddEscapedURLs(t *testing.T) {
+	ctx := context.Background()
+	urls := []string{`https://ya.ru/"quoted"`, `https://ya.ru/back\slash`}
+
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	id, _, err := fs.Add(ctx, 1, urls[0])
+	assert.NoError(t, err)
+	result, err := fs.AddURLs(ctx, 1, urls[1:])
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	for i, id := range []uint64{id, result[0].ID} {
+		url, err := fs.Get(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, urls[i], url)
+	}
+}
+
+func Test_syncMapStorage_APIKeys(t *testing.T) {
+	created := time.Date(2022, 9, 1, 10, 0, 0, 0, time.UTC)
+	keys := []APIKey{
+		{ID: 1, UserID: 10, Name: "ci", Hash: []byte("hash-1"), Created: created},
+		{ID: 2, UserID: 10, Name: "backup", Hash: []byte("hash-2"), Created: created.Add(time.Hour)},
+		{ID: 3, UserID: 20, Name: "other", Hash: []byte("hash-3"), Created: created},
+	}
+
+	fill := func(t *testing.T, s APIKeyStorage) {
+		for _, k := range keys {
+			assert.NoError(t, s.AddAPIKey(context.Background(), k))
+		}
+		assert.ErrorIs(t, s.RevokeAPIKey(context.Background(), 20, 1), ErrNotFound)
+		assert.NoError(t, s.RevokeAPIKey(context.Background(), 10, 1))
+		assert.ErrorIs(t, s.RevokeAPIKey(context.Background(), 10, 1), ErrNotFound)
+	}
+
+	check := func(t *testing.T, s APIKeyStorage) {
+		_, err := s.FindAPIKey(context.Background(), []byte("hash-1"))
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		key, err := s.FindAPIKey(context.Background(), []byte("hash-2"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), key.ID)
+		assert.Equal(t, uint64(10), key.UserID)
+		assert.Equal(t, "backup", key.Name)
+
+		userKeys, err := s.UserAPIKeys(context.Background(), 10)
+		assert.NoError(t, err)
+		assert.Len(t, userKeys, 1)
+		assert.Equal(t, uint64(2), userKeys[0].ID)
+		assert.True(t, keys[1].Created.Equal(userKeys[0].Created))
+
+		userKeys, err = s.UserAPIKeys(context.Background(), 30)
+		assert.NoError(t, err)
+		assert.Empty(t, userKeys)
+	}
+
+	s := NewInMemoryStorage()
+	fill(t, s)
+	check(t, s)
+
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	fill(t, fs.(APIKeyStorage))
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	check(t, fs.(APIKeyStorage))
+}
+
+func Test_syncMapStorage_BindIdentity(t *testing.T) {
+	alice := Identity{Issuer: "https://idp.example.com", Subject: "alice"}
+	bob := Identity{Issuer: "https://idp.example.com", Subject: "bob"}
+
+	check := func(t *testing.T, s IdentityStorage) {
+		id, err := s.BindIdentity(context.Background(), alice, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), id)
+
+		id, err = s.BindIdentity(context.Background(), bob, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), id)
+	}
+
+	bind := func(t *testing.T, s IdentityStorage) {
+		id, err := s.BindIdentity(context.Background(), alice, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), id)
+
+		id, err = s.BindIdentity(context.Background(), bob, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), id)
+	}
+
+	s := NewInMemoryStorage()
+	bind(t, s)
+	check(t, s)
+
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	bind(t, fs.(IdentityStorage))
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	check(t, fs.(IdentityStorage))
+}
+
+func Test_syncMapStorage_MergeUsers(t *testing.T) {
+	ctx := context.Background()
+
+	merge := func(t *testing.T, s URLStorage) uint64 {
+		ids, err := s.AddURLs(ctx, 1, []string{"vc.ru", "ya.ru"})
+		assert.NoError(t, err)
+		_, _, err = s.Add(ctx, 2, "yandex.ru")
+		assert.NoError(t, err)
+		assert.NoError(t, s.DeleteURLs(ctx, 1, []uint64{ids[0].ID}))
+
+		moved, err := s.(UserMerge).MergeUsers(ctx, 1, 2)
+		assert.NoError(t, err)
+
+		again, err := s.(UserMerge).MergeUsers(ctx, 1, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), again)
+
+		return moved
+	}
+
+	check := func(t *testing.T, s URLStorage, urls []string) {
+		_, err := s.GetUserData(ctx, 1)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		data, err := s.GetUserData(ctx, 2)
+		assert.NoError(t, err)
+		actual := make([]string, 0, len(data))
+		for _, d := range data {
+			actual = append(actual, d.OriginalURL)
+		}
+		assert.ElementsMatch(t, urls, actual)
+
+		into, err := s.(UserMerge).MergedInto(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), into)
+		_, err = s.(UserMerge).MergedInto(ctx, 2)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+
+	s := NewInMemoryStorage()
+	assert.Equal(t, uint64(1), merge(t, s))
+	check(t, s, []string{"ya.ru", "yandex.ru"})
+
+	deleted, err := s.UserDeletedURLs(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), deleted)
+
+	// The file storage doesn't persist deletes, so all links are moved.
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), merge(t, fs))
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	check(t, fs, []string{"vc.ru", "ya.ru", "yandex.ru"})
+}
+
+func Test_syncMapStorage_ExportUserURLs(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorage()
+
+	ids, err := s.AddURLs(ctx, 1, []string{"vc.ru", "ya.ru"})
+	assert.NoError(t, err)
+	_, _, err = s.Add(ctx, 2, "yandex.ru")
+	assert.NoError(t, err)
+	assert.NoError(t, s.DeleteURLs(ctx, 1, []uint64{ids[0].ID}))
+
+	links := make([]ExportedURL, 0)
+	assert.NoError(t, s.ExportUserURLs(ctx, 1, func(link ExportedURL) error {
+		links = append(links, link)
+		return nil
+	}))
+
+	assert.Len(t, links, 2)
+	byURL := make(map[string]ExportedURL)
+	for _, l := range links {
+		assert.False(t, l.Created.IsZero())
+		byURL[l.OriginalURL] = l
+	}
+	assert.Equal(t, ids[0].ID, byURL["vc.ru"].ShortURLID)
+	assert.True(t, byURL["vc.ru"].Deleted)
+	assert.False(t, byURL["vc.ru"].DeletedAt.IsZero())
+	assert.Equal(t, ids[1].ID, byURL["ya.ru"].ShortURLID)
+	assert.False(t, byURL["ya.ru"].Deleted)
+
+	// An export stops at the first error of a callback.
+	errStop := errors.New("stop")
+	calls := 0
+	err = s.ExportUserURLs(ctx, 1, func(ExportedURL) error {
+		calls++
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, calls)
+
+	assert.NoError(t, s.ExportUserURLs(ctx, 3, func(ExportedURL) error {
+		t.Error("unknown user has no links")
+		return nil
+	}))
+}
+
+// testAddCanonicalStoredURL checks a URL that is stored under an id of its own spelling keeps a short URL.
+func testAddCanonicalStoredURL(t *testing.T, s interface {
+	URLStorage
+	CanonicalURLStorage
+}) {
+	ctx := context.Background()
+
+	_, _, err := s.Add(ctx, 1, "HTTP://Example.com:80/stored")
+	assert.NoError(t, err)
+	result, err := s.AddCanonicalURLs(ctx, 2, []CanonicalURL{
+		{URL: "HTTP://Example.com:80/stored", Canonical: "http://example.com/stored"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+
+	url, err := s.Get(ctx, result[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP://Example.com:80/stored", url)
+}
+
+func Test_syncMapStorage_AddCanonicalStoredURL(t *testing.T) {
+	testAddCanonicalStoredURL(t, NewInMemoryStorage())
+}
+
+func Test_dbStorage_AddCanonicalStoredURL(t *testing.T) {
+	testAddCanonicalStoredURL(t, testDatabase(t))
+}
+
+func Test_syncMapStorage_AddCanonicalURLs(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorage()
+
+	result, err := s.AddCanonicalURLs(ctx, 1, []CanonicalURL{
+		{URL: "HTTP://Example.com:80/a?b=1&a=2", Canonical: "http://example.com/a?a=2&b=1"},
+		{URL: "http://example.com/a?a=2&b=1", Canonical: "http://example.com/a?a=2&b=1"},
+		{URL: "http://ya.ru", Canonical: "http://ya.ru"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.True(t, result[0].Inserted)
+	assert.Equal(t, AddResult{ID: result[0].ID}, result[1])
+	assert.True(t, result[2].Inserted)
+
+	// The first spelling is kept, ids of canonical URLs are the regular ones.
+	url, err := s.Get(ctx, result[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP://Example.com:80/a?b=1&a=2", url)
+	id, exists, err := s.Add(ctx, 2, "http://ya.ru")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, result[2].ID, id)
+
+	// Backups keep canonical forms, so links can be restored with their ids.
+	links := make([]UserURL, 0)
+	assert.NoError(t, s.BackupURLs(ctx, func(link UserURL) error {
+		links = append(links, link)
+		return nil
+	}))
+	assert.Len(t, links, 2)
+	restored := NewInMemoryStorage()
+	count, err := restored.RestoreURLs(ctx, links)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), count)
+	result, err = restored.AddCanonicalURLs(ctx, 3, []CanonicalURL{
+		{URL: "http://EXAMPLE.com/a?a=2&b=1", Canonical: "http://example.com/a?a=2&b=1"},
+	})
+	assert.NoError(t, err)
+	assert.False(t, result[0].Inserted)
+
+	links[0].Canonical = ""
+	_, err = NewInMemoryStorage().RestoreURLs(ctx, links)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	// A file storage keeps canonical forms after a restart.
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	result, err = fs.(CanonicalURLStorage).AddCanonicalURLs(ctx, 1, []CanonicalURL{
+		{URL: "HTTP://Example.com:80/a", Canonical: "http://example.com/a"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	reloaded, err := fs.(CanonicalURLStorage).AddCanonicalURLs(ctx, 2, []CanonicalURL{
+		{URL: "http://example.com/a", Canonical: "http://example.com/a"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []AddResult{{ID: result[0].ID}}, reloaded)
+	url, err = fs.Get(ctx, result[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP://Example.com:80/a", url)
+}
+
+func Test_syncMapStorage_BlockURLs(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorage()
+
+	added, err := s.AddURLs(ctx, 1, []string{"http://phish.example/login", "http://ya.ru", "http://vc.ru"})
+	assert.NoError(t, err)
+	assert.NoError(t, s.DeleteURLs(ctx, 1, []uint64{added[2].ID}))
+
+	scanned := make(map[uint64]string)
+	assert.NoError(t, s.ScanURLs(ctx, func(id uint64, url string) error {
+		scanned[id] = url
+		return nil
+	}))
+	assert.Equal(t, map[uint64]string{added[0].ID: "http://phish.example/login", added[1].ID: "http://ya.ru"}, scanned)
+
+	// Unknown ids are skipped.
+	assert.NoError(t, s.BlockURLs(ctx, []uint64{added[0].ID, 12345}))
+	_, err = s.Get(ctx, added[0].ID)
+	assert.ErrorIs(t, err, ErrBlocked)
+	blocked, err := s.BlockedURLs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{added[0].ID}, blocked)
+
+	// Blocked links stay with their owners.
+	data, err := s.GetUserData(ctx, 1)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2)
+
+	assert.NoError(t, s.UnblockURLs(ctx, []uint64{added[0].ID}))
+	url, err := s.Get(ctx, added[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://phish.example/login", url)
+
+	// Deleted links aren't scanned, so they aren't listed as blocked either.
+	assert.NoError(t, s.BlockURLs(ctx, []uint64{added[1].ID}))
+	assert.NoError(t, s.DeleteURLs(ctx, 1, []uint64{added[1].ID}))
+	blocked, err = s.BlockedURLs(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, blocked)
+
+	// A file storage keeps blocks after a restart.
+	filePath := filepath.Join(t.TempDir(), "storage")
+	fs, err := NewFileStorage(filePath)
+	assert.NoError(t, err)
+	added, err = fs.AddURLs(ctx, 1, []string{"http://phish.example/login", "http://malware.example"})
+	assert.NoError(t, err)
+	assert.NoError(t, fs.(URLBlocker).BlockURLs(ctx, []uint64{added[0].ID, added[1].ID}))
+	assert.NoError(t, fs.(URLBlocker).UnblockURLs(ctx, []uint64{added[0].ID}))
+	assert.NoError(t, fs.Close())
+
+	fs, err = NewFileStorage(filePath)
+	assert.NoError(t, err)
+	defer fs.Close()
+	_, err = fs.Get(ctx, added[0].ID)
+	assert.NoError(t, err)
+	_, err = fs.Get(ctx, added[1].ID)
+	assert.ErrorIs(t, err, ErrBlocked)
+}
+
+func Test_syncMapStorage_IdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorage()
+	expires := time.Now().Add(time.Minute)
+
+	record, err := s.ReserveIdempotencyKey(ctx, 1, "key", []byte("a"), expires)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	// A held key is returned, keys of other users are independent.
+	record, err = s.ReserveIdempotencyKey(ctx, 1, "key", []byte("b"), expires)
+	assert.NoError(t, err)
+	assert.Equal(t, &IdempotencyRecord{Fingerprint: []byte("a"), Expires: expires}, record)
+	record, err = s.ReserveIdempotencyKey(ctx, 2, "key", []byte("b"), expires)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	// A released key can be reserved again.
+	assert.NoError(t, s.ReleaseIdempotencyKey(ctx, 2, "key"))
+	record, err = s.ReserveIdempotencyKey(ctx, 2, "key", []byte("c"), expires)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	assert.NoError(t, s.SaveIdempotentResponse(ctx, 1, "key", IdempotencyRecord{
+		Fingerprint: []byte("ignored"), Status: 201, ContentType: "application/json", Body: []byte("{}"), Expires: expires,
+	}))
+	assert.ErrorIs(t, s.SaveIdempotentResponse(ctx, 3, "key", IdempotencyRecord{}), ErrNotFound)
+
+	// A response survives a release.
+	assert.NoError(t, s.ReleaseIdempotencyKey(ctx, 1, "key"))
+	record, err = s.ReserveIdempotencyKey(ctx, 1, "key", []byte("a"), expires)
+	assert.NoError(t, err)
+	assert.Equal(t, &IdempotencyRecord{
+		Fingerprint: []byte("a"), Done: true, Status: 201, ContentType: "application/json", Body: []byte("{}"), Expires: expires,
+	}, record)
+
+	// An expired record is replaced.
+	assert.NoError(t, s.SaveIdempotentResponse(ctx, 1, "key", IdempotencyRecord{Expires: time.Now().Add(-time.Second)}))
+	record, err = s.ReserveIdempotencyKey(ctx, 1, "key", []byte("d"), expires)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func Test_syncMapStorage_TimeSeries(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorage()
+
+	ids, err := s.AddURLs(ctx, 1, []string{"vc.ru", "ya.ru", "yandex.ru"})
+	assert.NoError(t, err)
+	assert.NoError(t, s.DeleteURLs(ctx, 1, []uint64{ids[0].ID}))
+
+	now := time.Now().UTC()
+	hour := now.Truncate(time.Hour)
+	assert.NoError(t, s.AddClicks(ctx, []Click{
+		{ID: ids[1].ID, Time: now},
+		{ID: ids[1].ID, Time: now},
+		{ID: ids[2].ID, Time: now},
+		{ID: ids[2].ID, Time: now, Bot: true},
+		{ID: ids[2].ID, Time: now.Add(-48 * time.Hour)},
+	}))
+
+	from, to := hour.Add(-2*time.Hour), hour.Add(time.Hour)
+
+	created, err := s.CreatedURLs(ctx, from, to, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []TimeBucket{{Start: hour, Count: 3}}, created)
+
+	deleted, err := s.DeletedURLs(ctx, from, to, 3*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []TimeBucket{{Start: from, Count: 1}}, deleted)
+
+	redirects, err := s.Redirects(ctx, from, to, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []TimeBucket{{Start: hour, Count: 4}}, redirects)
+
+	top, err := s.TopLinks(ctx, from, to, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []TopLink{{ID: ids[1].ID, OriginalURL: "ya.ru", Clicks: 2}}, top)
+
+	userDeleted, err := s.UserDeletedURLs(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), userDeleted)
+
+	userCreated, err := s.UserCreatedURLs(ctx, 1, from, to, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []TimeBucket{{Start: hour, Count: 3}}, userCreated)
+
+	userCreated, err = s.UserCreatedURLs(ctx, 2, from, to, time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, userCreated)
+
+	linksClicks, err := s.LinksClicks(ctx, []uint64{ids[0].ID, ids[1].ID, ids[2].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]uint64{ids[1].ID: 2, ids[2].ID: 2}, linksClicks)
+}
+
+func TestNewInstrumentedStorage(t *testing.T) {
+	ctx := context.Background()
+	observed := make(map[string]int)
+	failed := make(map[string]int)
+
+	s := NewInstrumentedStorage(NewInMemoryStorage(), func(_ context.Context, operation string, _ time.Time, err error) {
+		observed[operation]++
+		if err != nil {
+			failed[operation]++
+		}
+	})
+	defer s.Close()
+
+	id, _, err := s.Add(ctx, 1, "ya.ru")
+	assert.NoError(t, err)
+	_, err = s.AddURLs(ctx, 1, []string{"vc.ru"})
+	assert.NoError(t, err)
+	canonical, ok := s.(CanonicalURLStorage)
+	assert.True(t, ok)
+	_, err = canonical.AddCanonicalURLs(ctx, 1, []CanonicalURL{{URL: "HTTP://Habr.com", Canonical: "http://habr.com"}})
+	assert.NoError(t, err)
+	_, err = s.Get(ctx, id)
+	assert.NoError(t, err)
+	_, err = s.Get(ctx, id+1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetUserData(ctx, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, s.DeleteURLs(ctx, 1, []uint64{id}))
+
+	assert.Equal(t, map[string]int{
+		"add":                1,
+		"add_urls":           1,
+		"add_canonical_urls": 1,
+		"get":                2,
+		"get_user_data":      1,
+		"delete_urls":        1,
+	}, observed)
+	assert.Equal(t, map[string]int{"get": 1}, failed)
+}
+
 func ExampleNewInMemoryStorage() {
 	ctx := context.Background()
 
@@ -555,3 +1136,17 @@ func ExampleNewFileStorage() {
 		// Some error handling
 	}
 }
+
+func Test_dbStorage_Get(t *testing.T) {
+	ctx := context.Background()
+	s := testDatabase(t)
+
+	id, _, err := s.Add(ctx, 1, "https://ya.ru")
+	assert.NoError(t, err)
+	url, err := s.Get(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ya.ru", url)
+
+	_, err = s.Get(ctx, id+1)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,47 @@
+// Package storagetest provides PostgreSQL databases for tests of the database storage.
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// DSNVariable - an environment variable with a connection string of a database tests may use.
+const DSNVariable = "TEST_DATABASE_DSN"
+
+// Database connects to the database of DSNVariable. Tables are created in a schema of their own
+// that is dropped after a test. Without the variable a test is skipped.
+func Database(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(DSNVariable)
+	if len(dsn) == 0 {
+		t.Skipf("%s isn't set", DSNVariable)
+	}
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", DSNVariable, err)
+	}
+	admin := stdlib.OpenDB(*config)
+	schema := fmt.Sprintf("shortener_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("create schema " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("drop schema " + schema + " cascade"); err != nil {
+			t.Errorf("failed to drop schema: %v", err)
+		}
+		admin.Close()
+	})
+
+	config.RuntimeParams["search_path"] = schema
+	return stdlib.OpenDB(*config)
+}
@@ -0,0 +1,270 @@
+// Package tracing implements spans with W3C trace context propagation.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader - name of the W3C trace context header and gRPC metadata key.
+const TraceparentHeader = "traceparent"
+
+const (
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+)
+
+// ErrBadTraceparent - a traceparent value doesn't follow the W3C format.
+var ErrBadTraceparent = errors.New("bad traceparent")
+
+// TraceID - a globally unique identifier of a trace.
+type TraceID [16]byte
+
+// SpanID - an identifier of a span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext - the part of a span that is propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true iff both ids are non-zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats a span context as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return traceparentVersion + "-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value.
+// Future versions are accepted as long as they start with the fields of version 00.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == traceparentVersion && len(parts) != 4) {
+		return sc, ErrBadTraceparent
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, ErrBadTraceparent
+	}
+
+	if len(parts[1]) != 2*len(sc.TraceID) || len(parts[2]) != 2*len(sc.SpanID) || len(parts[3]) != 2 {
+		return sc, ErrBadTraceparent
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, ErrBadTraceparent
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, ErrBadTraceparent
+	}
+	sc.Sampled = flags[0]&flagSampled != 0
+
+	if !sc.IsValid() {
+		return sc, ErrBadTraceparent
+	}
+
+	return sc, nil
+}
+
+// SpanData - a finished span as it is passed to an exporter.
+type SpanData struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   time.Duration     `json:"duration_ns"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Exporter receives finished sampled spans.
+type Exporter interface {
+	Export(span *SpanData)
+}
+
+// Tracer creates spans and passes finished ones to an exporter.
+// A nil tracer is valid and creates nil spans, so tracing can be disabled without checks at call sites.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer creates a tracer that exports spans to exporter.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start creates a span that is a child of a span in ctx, a remote parent in ctx or a new trace root.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parentID = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		span.context.TraceID = remote.TraceID
+		span.context.Sampled = remote.Sampled
+		span.parentID = remote.SpanID
+	} else {
+		_, _ = rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	_, _ = rand.Read(span.context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Record creates an already finished span that started at start and ended now.
+// It is meant for leaf operations that are measured elsewhere.
+func (t *Tracer) Record(ctx context.Context, name string, start time.Time, err error, attributes map[string]string) {
+	_, span := t.Start(ctx, name)
+	if span == nil {
+		return
+	}
+	span.start = start
+	for k, v := range attributes {
+		span.SetAttribute(k, v)
+	}
+	span.SetError(err)
+	span.End()
+}
+
+// ContextWithRemoteParent returns a context which spans are children of a span from another process.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanFromContext returns a current span or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Span - a timed operation within a trace. All methods are safe to call on a nil span.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	context  SpanContext
+	parentID SpanID
+	start    time.Time
+
+	lock       sync.Mutex
+	attributes map[string]string
+	err        error
+	ended      bool
+}
+
+// Context returns a span context to propagate.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute attaches a key-value pair to a span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks a span as failed, nil errors are ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
+
+// End finishes a span and exports it if it is sampled. Subsequent calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	end := time.Now()
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := &SpanData{
+		Name:       s.name,
+		TraceID:    s.context.TraceID.String(),
+		SpanID:     s.context.SpanID.String(),
+		Start:      s.start,
+		End:        end,
+		Duration:   end.Sub(s.start),
+		Attributes: s.attributes,
+	}
+	if s.parentID != (SpanID{}) {
+		data.ParentID = s.parentID.String()
+	}
+	if s.err != nil {
+		data.Error = s.err.Error()
+	}
+	s.lock.Unlock()
+
+	if s.context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(data)
+	}
+}
@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingExporter struct {
+	spans []*SpanData
+}
+
+func (e *recordingExporter) Export(span *SpanData) {
+	e.spans = append(e.spans, span)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		sampled bool
+		wantErr bool
+	}{
+		{
+			name:    "Sampled",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			sampled: true,
+		},
+		{
+			name:  "Not sampled",
+			value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		},
+		{
+			name:    "Future version",
+			value:   "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			sampled: true,
+		},
+		{
+			name:    "Extra fields in version 00",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid version",
+			value:   "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Zero trace id",
+			value:   "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Short span id",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba9-01",
+			wantErr: true,
+		},
+		{
+			name:    "Not hex",
+			value:   "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "Empty",
+			value:   "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.value)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadTraceparent)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+			assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+			assert.Equal(t, tt.sampled, sc.Sampled)
+			if strings.HasPrefix(tt.value, traceparentVersion) {
+				assert.Equal(t, tt.value, sc.Traceparent())
+			}
+		})
+	}
+}
+
+func TestTracer_Start(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter)
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+
+	ctx, root := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "root")
+	root.SetAttribute("route", "/{id}")
+
+	_, child := tracer.Start(ctx, "child")
+	child.SetError(errors.New("failure"))
+	child.End()
+
+	tracer.Record(ctx, "leaf", time.Now().Add(-time.Second), nil, map[string]string{"backend": "memory"})
+	root.End()
+	root.End()
+
+	assert.Len(t, exporter.spans, 3)
+	for _, s := range exporter.spans {
+		assert.Equal(t, remote.TraceID.String(), s.TraceID)
+	}
+
+	assert.Equal(t, "child", exporter.spans[0].Name)
+	assert.Equal(t, root.Context().SpanID.String(), exporter.spans[0].ParentID)
+	assert.Equal(t, "failure", exporter.spans[0].Error)
+
+	assert.Equal(t, "leaf", exporter.spans[1].Name)
+	assert.GreaterOrEqual(t, exporter.spans[1].Duration, time.Second)
+	assert.Equal(t, map[string]string{"backend": "memory"}, exporter.spans[1].Attributes)
+
+	assert.Equal(t, "root", exporter.spans[2].Name)
+	assert.Equal(t, remote.SpanID.String(), exporter.spans[2].ParentID)
+	assert.Equal(t, map[string]string{"route": "/{id}"}, exporter.spans[2].Attributes)
+
+	remote.Sampled = false
+	_, span := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "not sampled")
+	span.End()
+	assert.Len(t, exporter.spans, 3)
+
+	_, span = tracer.Start(context.Background(), "new trace")
+	span.End()
+	assert.Len(t, exporter.spans, 4)
+	assert.Empty(t, exporter.spans[3].ParentID)
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop")
+	assert.Nil(t, span)
+	assert.Nil(t, SpanFromContext(ctx))
+
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failure"))
+	span.End()
+	assert.False(t, span.Context().IsValid())
+	tracer.Record(ctx, "noop", time.Now(), nil, nil)
+}
+
+func TestNewWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(NewWriterExporter(&buf))
+
+	_, span := tracer.Start(context.Background(), "span")
+	span.End()
+
+	var data SpanData
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &data))
+	assert.Equal(t, "span", data.Name)
+	assert.Equal(t, span.Context().TraceID.String(), data.TraceID)
+}